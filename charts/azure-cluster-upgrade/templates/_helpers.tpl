@@ -0,0 +1,16 @@
+{{- define "azure-cluster-upgrade.fullname" -}}
+{{- if contains .Chart.Name .Release.Name -}}
+{{- .Release.Name | trunc 63 | trimSuffix "-" -}}
+{{- else -}}
+{{- printf "%s-%s" .Release.Name .Chart.Name | trunc 63 | trimSuffix "-" -}}
+{{- end -}}
+{{- end -}}
+
+{{- define "azure-cluster-upgrade.labels" -}}
+app.kubernetes.io/name: {{ .Chart.Name }}
+app.kubernetes.io/instance: {{ .Release.Name }}
+{{- end -}}
+
+{{- define "azure-cluster-upgrade.serviceAccountName" -}}
+{{- default (include "azure-cluster-upgrade.fullname" .) .Values.serviceAccount.name -}}
+{{- end -}}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var certificatesCmd = &cobra.Command{
+	Use:   "certificates",
+	Short: "Rotate a Scale Set's Key Vault certificates onto new versions",
+	Long: `Points the Key Vault certificate references in the Virtual Machine Scale Set
+model at new versions of the same secrets, then performs the full blue/green
+upgrade. New instances are checked via Run Command for the new certificates
+before the instances holding the old ones are removed.`,
+	Run: deploy.RunCertificates,
+}
+
+func init() {
+	rootCmd.AddCommand(certificatesCmd)
+
+	addUpgradeFlags(certificatesCmd)
+	certificatesCmd.Flags().StringArray("certificate-url", nil, "Versioned Key Vault secret URL of a certificate to rotate onto, replacing the model's reference to the same secret (repeatable)")
+
+	certificatesCmd.MarkFlagRequired("certificate-url")
+}
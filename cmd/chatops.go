@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var chatopsCmd = &cobra.Command{
+	Use:   "chatops",
+	Short: "Drive upgrades from Slack",
+	Long: `Serves a Slack app's slash command, so upgrades of the clusters listed in the
+config file can be driven from Slack:
+
+  /upgrade <cluster> plan|run|pause|resume|abort
+  /upgrade stop-all|resume-all
+
+Point the slash command at /slack/commands and the app's interactivity at
+/slack/actions. Pausing and aborting take effect between phases, and stop-all
+pauses every running upgrade at once, e.g. during an incident. Clusters which
+require approval hold once their new instances are verified, until someone
+approves promoting them with the buttons posted to the channel, for up to
+--approval-timeout. Commands and approvals are only taken from the users and
+channels listed, by ID or name, where lists are given.
+
+  chatops:
+    signingSecret: env:SLACK_SIGNING_SECRET
+    clusters:
+      prod-workers:
+        subscriptionID: <subscription>
+        resourceGroup: prod
+        scaleSet: workers
+        requireApproval: true
+    allowedUsers: [U0123ABCD, alice]
+    allowedChannels: [deploys]
+
+The upgrade flags given to this command apply to every upgrade it runs. The
+/healthz and /readyz probes are served alongside the Slack endpoints. On SIGTERM,
+running upgrades are held ahead of their next phase before exiting; run with
+--on-rerun resume to pick them up once restarted.`,
+	Run: deploy.RunChatops,
+}
+
+func init() {
+	rootCmd.AddCommand(chatopsCmd)
+
+	addUpgradeBehaviourFlags(chatopsCmd)
+	chatopsCmd.Flags().String("listen", ":3000", "Address to serve Slack requests on")
+	chatopsCmd.Flags().Duration("approval-timeout", 4*time.Hour, "Time a promotion may wait for approval before it's rejected, on top of the upgrade's own --timeout")
+	chatopsCmd.Flags().String("health-listen", "", "Address to serve the /healthz and /readyz probes on, e.g. :8080")
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check whether every instance runs the latest Scale Set model",
+	Long: `Lists the instances of the Virtual Machine Scale Set which are not running the
+latest scale set model, printing the details as JSON. Exits 0 when every
+instance is up to date, 2 when some need upgrading, and 1 if the check itself
+fails. Nothing is modified, so this is safe to run from scheduled jobs.`,
+	Run: deploy.RunCheck,
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	addSessionFlags(checkCmd)
+}
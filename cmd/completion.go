@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Bash functions completing resource group and scale set names, by asking
+// the CLI to list them from ARM for the subscription (and resource group)
+// typed so far
+const bashCompletionFunction = `
+__azure-cluster-upgrade_flag_value()
+{
+    local i
+    for ((i = 1; i < ${#words[@]}; i++)); do
+        case "${words[i]}" in
+            "$1"|"$2")
+                echo "${words[i+1]}"
+                return
+                ;;
+            "$1"=*)
+                echo "${words[i]#*=}"
+                return
+                ;;
+        esac
+    done
+}
+
+__azure-cluster-upgrade_list_names()
+{
+    local subscription group
+    subscription=$(__azure-cluster-upgrade_flag_value --subscription-id -s)
+    group=$(__azure-cluster-upgrade_flag_value --resource-group -r)
+    if [[ -z "${subscription}" ]]; then
+        return
+    fi
+
+    local names
+    if names=$(${words[0]} __list-names "$1" --subscription-id "${subscription}" --resource-group "${group}" 2>/dev/null); then
+        COMPREPLY=( $(compgen -W "${names}" -- "${cur}") )
+    fi
+}
+
+__azure-cluster-upgrade_resource_groups()
+{
+    __azure-cluster-upgrade_list_names resource-groups
+}
+
+__azure-cluster-upgrade_scale_sets()
+{
+    __azure-cluster-upgrade_list_names scale-sets
+}
+`
+
+var completionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|powershell]",
+	Short: "Generate a shell completion script",
+	Long: `Writes a completion script for the given shell to stdout. In bash, resource group
+and scale set names are completed from the scale sets in the subscription given
+with --subscription-id, which requires an Azure CLI login.
+
+  source <(azure-cluster-upgrade completion bash)`,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{"bash", "zsh", "powershell"},
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+
+		switch args[0] {
+		case "bash":
+			err = rootCmd.GenBashCompletion(os.Stdout)
+		case "zsh":
+			err = rootCmd.GenZshCompletion(os.Stdout)
+		case "powershell":
+			err = rootCmd.GenPowerShellCompletion(os.Stdout)
+		default:
+			err = fmt.Errorf("unsupported shell '%s'", args[0])
+		}
+
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	},
+}
+
+// listNamesCmd backs the dynamic parts of the completion scripts
+var listNamesCmd = &cobra.Command{
+	Use:       "__list-names [resource-groups|scale-sets]",
+	Hidden:    true,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{"resource-groups", "scale-sets"},
+	Run:       deploy.RunListNames,
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+	rootCmd.AddCommand(listNamesCmd)
+
+	rootCmd.BashCompletionFunction = bashCompletionFunction
+
+	listNamesCmd.Flags().StringP("subscription-id", "s", "", "Subscription ID")
+	listNamesCmd.Flags().StringP("resource-group", "r", "", "Only list scale sets in this Resource Group")
+	listNamesCmd.MarkFlagRequired("subscription-id")
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show what an upgrade would change on each instance",
+	Long: `Compares each instance of the Virtual Machine Scale Set against the scale set
+model, and prints the fields an upgrade would change: VM size, image, OS profile
+and extensions. Nothing is modified.`,
+	Run: deploy.RunDiff,
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	addSessionFlags(diffCmd)
+}
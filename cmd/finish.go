@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var finishCmd = &cobra.Command{
+	Use:   "finish",
+	Short: "Remove the old instances of an upgrade whose surge was held",
+	Long: `Completes an upgrade run with --strategy=scale-out-only, which surged and
+protected the new instances but left the old ones in place for another system
+to retire. Removes whichever old instances remain by scaling back in to the
+original capacity recorded on the scale set, then unprotects the instances and
+clears the upgrade state, as the upgrade would have once its gates passed.
+
+The options removing old instances apply as they do to an upgrade, such as
+--drain-script, --max-unavailable and --warm-up-steps.`,
+	Run: deploy.RunFinish,
+}
+
+func init() {
+	rootCmd.AddCommand(finishCmd)
+
+	addUpgradeFlags(finishCmd)
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var fleetCmd = &cobra.Command{
+	Use:   "fleet",
+	Short: "Operate on many Scale Sets at once",
+}
+
+var fleetUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade every Scale Set listed in a fleet manifest",
+	Long: `Performs the blue/green upgrade of every Virtual Machine Scale Set listed in a
+fleet manifest, which may span regions and subscriptions. Scale sets are
+upgraded region by region, one at a time, or concurrently across regions by a
+pool of workers, optionally starting with a canary region, and further upgrades
+are paused once one fails. At most maxParallel scale sets are upgraded at once
+(per region, unless concurrently), and at most maxPerSubscription of each
+subscription. ARM rate limits apply to each subscription separately. The
+fleet's blast radius can be limited with maxDisruption, a count or share of the
+fleet's total capacity: a scale set being upgraded counts as disrupting all its
+instances, or as many as --max-unavailable allows, and waits to start until the
+budget has room for it.
+
+Scale sets may be given a priority class: canary, standard (the default) or
+critical. Classes are upgraded in that order, each once the one before it has
+succeeded and soaked for its soak time. A class requiring approval stops the
+fleet ahead of it, to be rerun with --approve naming the class once the earlier
+ones are judged healthy; scale sets already upgraded have nothing left to do. Scale sets may be placed
+in groups, ordered against each other within each region, so that e.g. a
+cluster's servers are upgraded before its clients. Progress is logged as
+each scale set finishes, followed by a consolidated report with totals by
+subscription and region.
+
+Example manifest:
+
+  order: region-by-region
+  canaryRegion: westus2
+  pauseOnFailure: true
+  maxParallel: 2
+  maxPerSubscription: 1
+  maxDisruption: 5%
+  priorities:
+    canary:
+      soak: 1h
+    critical:
+      requireApproval: true
+  groups:
+    - name: servers
+    - name: clients
+      after: [servers]
+      notConcurrentWith: [servers]
+  scaleSets:
+    - subscriptionID: 00000000-0000-0000-0000-000000000000
+      resourceGroup: cluster-westus2
+      name: servers
+      region: westus2
+      group: servers
+      priority: canary`,
+	Run: deploy.RunFleetUpgrade,
+}
+
+func init() {
+	rootCmd.AddCommand(fleetCmd)
+	fleetCmd.AddCommand(fleetUpgradeCmd)
+
+	addUpgradeBehaviourFlags(fleetUpgradeCmd)
+	fleetUpgradeCmd.Flags().Duration("batch-pause", 0, "Time to wait between waves and groups, letting caches warm and autoscalers settle (SIGUSR1 skips a pause)")
+	fleetUpgradeCmd.Flags().Duration("batch-jitter", 0, "Random extra time of up to this much added to each batch pause")
+	fleetUpgradeCmd.Flags().String("manifest", "", "Fleet manifest (YAML or JSON) listing the scale sets to upgrade")
+	fleetUpgradeCmd.Flags().StringSlice("approve", nil, "Priority classes approved for upgrade, of those whose policy requires approval, e.g. 'critical'")
+
+	fleetUpgradeCmd.MarkFlagRequired("manifest")
+}
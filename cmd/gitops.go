@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var gitopsCmd = &cobra.Command{
+	Use:   "gitops",
+	Short: "Upgrade Scale Sets onto the images declared in a Git repository",
+	Long: `Follows a desired-state file in a Git repository, listing the gallery image
+version each Virtual Machine Scale Set should run. Whenever a commit changes the
+file, every scale set whose model references another image is moved onto its
+desired image and upgraded, one at a time, so image rollouts are reviewed and
+merged like any other change. A failed upgrade isn't retried until the file
+changes again.
+
+Outcomes are reported as GitHub commit statuses on the commit applied, and
+committed back to the branch as a status file, where configured:
+
+  gitops:
+    repository: git@github.com:example/infrastructure.git
+    branch: main
+    path: clusters/images.yaml
+    statusFile: clusters/status.json
+    github:
+      repository: example/infrastructure
+      token: env:GITHUB_TOKEN
+
+The desired-state file lists the scale sets:
+
+  scaleSets:
+    - subscriptionID: <subscription>
+      resourceGroup: prod
+      name: workers
+      galleryImage: /subscriptions/<subscription>/resourceGroups/images/providers/Microsoft.Compute/galleries/g/images/workers/versions/1.4.2
+
+Git is run with the credentials of the environment. The upgrade flags given to
+this command apply to every upgrade it runs. On SIGTERM, a running upgrade is held
+ahead of its next phase before exiting; run with --on-rerun resume to pick it up
+once restarted.`,
+	Run: deploy.RunGitOps,
+}
+
+func init() {
+	rootCmd.AddCommand(gitopsCmd)
+
+	addUpgradeBehaviourFlags(gitopsCmd)
+	gitopsCmd.Flags().Duration("poll-interval", time.Minute, "How often to fetch the repository for changes to the desired state")
+	gitopsCmd.Flags().String("work-dir", "", "Directory to keep the working copy of the repository in (default is a directory under the system temp dir)")
+	gitopsCmd.Flags().String("health-listen", "", "Address to serve the /healthz and /readyz probes on, e.g. :8080")
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Roll a Scale Set onto a new gallery image version",
+	Long: `Points the Virtual Machine Scale Set model at the given Shared Image Gallery
+image version, then performs the full blue/green upgrade: preflight checks,
+surge, health gates, drain, scale-in and verification.`,
+	Run: deploy.RunImage,
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+
+	addUpgradeFlags(imageCmd)
+	imageCmd.Flags().String("gallery-image", "", "Resource ID of the gallery image version to roll out, or of an image definition to roll out its latest version")
+	imageCmd.Flags().String("min-image-version", "", "Refuse to roll out an image version older than this major.minor.patch version")
+	imageCmd.Flags().Bool("include-excluded-from-latest", false, "Consider versions marked exclude-from-latest when resolving an image definition")
+	imageCmd.Flags().Bool("show-release-notes", false, "Fetch and print the image version's release notes before rolling out")
+
+	imageCmd.MarkFlagRequired("gallery-image")
+}
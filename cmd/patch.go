@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var patchCmd = &cobra.Command{
+	Use:   "patch",
+	Short: "Roll a Scale Set onto the latest patch level of its marketplace image",
+	Long: `Checks whether a newer version of the Virtual Machine Scale Set's marketplace
+image has been published to its region and, if so, points the model at it and
+performs the full blue/green upgrade, so instances are patched by replacing them
+with a fresh image rather than in place. Where the model follows the 'latest'
+version, only the instances created from an older version are replaced. Does
+nothing when every instance is already at the latest patch level, so it is safe
+to run from scheduled jobs.`,
+	Run: deploy.RunPatch,
+}
+
+func init() {
+	rootCmd.AddCommand(patchCmd)
+
+	addUpgradeFlags(patchCmd)
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what an upgrade would do, without doing it",
+	Long: `Validates every phase of an upgrade of the Virtual Machine Scale Set onto its
+current model, then shows how many instances it would replace and keep, how
+far it would surge, and the phases it would run. Nothing is modified.
+
+With --what-if, the ARM template making a model change, given by --template, is
+run through ARM What-If, and the plan shows the property-level changes it would
+make alongside what the upgrade does to which instances, step by step: one
+artifact for a change advisory board to review. A change to the scale set is
+planned as replacing every instance.`,
+	Run: deploy.RunPlan,
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Run an upgrade's preflight checks, without upgrading",
+	Long: `Validates every phase of an upgrade of the Virtual Machine Scale Set onto its
+current model, including specs, subnet capacity and placement constraints, and
+exits non-zero if any would fail. Nothing is modified.`,
+	Run: deploy.RunValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(validateCmd)
+
+	addUpgradeFlags(planCmd)
+	addUpgradeFlags(validateCmd)
+
+	planCmd.Flags().Bool("what-if", false, "Preview the model change made by --template with ARM What-If, and show the instance-level choreography")
+	planCmd.Flags().String("template", "", "Path to the ARM template making the model change, for --what-if")
+	planCmd.Flags().String("template-parameters", "", "Path to a parameters file for --template")
+}
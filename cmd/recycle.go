@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var recycleCmd = &cobra.Command{
+	Use:   "recycle",
+	Short: "Replace a Scale Set's instances older than a maximum age",
+	Long: `Replaces every instance of a Virtual Machine Scale Set created longer ago than
+--older-than, whether or not its model has changed, through the same blue/green
+surge and scale-in as an upgrade. An instance's age is taken from the creation
+time of its OS disk. Instances not running the latest model are replaced too.
+
+Run on a schedule with --max-recycled to keep a scale set continuously fresh
+without manual invocations, under the same gates and disruption budgets as an
+upgrade. For example, a nightly job replacing the oldest tenth of the
+instances, with every instance replaced at least monthly:
+
+  azure-cluster-upgrade recycle -s <subscription> -r <group> -v <scale set> \
+    --older-than 720h --max-recycled 10%`,
+	Run: deploy.RunRecycle,
+}
+
+func init() {
+	rootCmd.AddCommand(recycleCmd)
+
+	addUpgradeFlags(recycleCmd)
+	recycleCmd.Flags().Duration("older-than", 30*24*time.Hour, "Replace instances created longer ago than this")
+	recycleCmd.Flags().String("max-recycled", "", "Replace at most this many (or this percentage) of the instances past --older-than per run, oldest first")
+}
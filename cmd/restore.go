@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Roll a Scale Set back onto a snapshot of its model",
+	Long: `Re-applies the Virtual Machine Scale Set model captured by 'snapshot', then
+performs the full blue/green upgrade so every instance is replaced with one
+running the restored model. Capacity is left as it is now.`,
+	Run: deploy.RunRestore,
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	addUpgradeFlags(restoreCmd)
+	restoreCmd.Flags().String("snapshot", "", "File path or https:// blob URL of the snapshot to restore")
+
+	restoreCmd.MarkFlagRequired("snapshot")
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var rollbackImageCmd = &cobra.Command{
+	Use:     "rollback-image",
+	Aliases: []string{"rollback"},
+	Short:   "Roll a Scale Set back onto the image it ran before",
+	Long: `Points the Virtual Machine Scale Set model back at the image recorded before
+the last 'image' upgrade, then performs the full blue/green upgrade so every
+instance is replaced with one running the previous image.`,
+	Run: deploy.RunRollbackImage,
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackImageCmd)
+
+	addUpgradeFlags(rollbackImageCmd)
+}
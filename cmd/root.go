@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"github.com/krarey/azure-cluster-upgrade/deploy"
+	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var cfgFile string
@@ -17,10 +20,27 @@ var rootCmd = &cobra.Command{
 	Long: `Interacts with the Azure API to perform a blue/green deployment.
 
 Expects a Virtual Machine Scale Set whose configuration has recently been updated.
-Expands the chosen scale set by a factor of two, and once all VMs have entered the
-'Running' state, protects the replacement instances and reduces Scale Set capacity
-to its original value.`,
-	Run: deploy.Run,
+Expands the chosen scale set by one instance for each not running the latest model,
+and once all VMs have entered the 'Running' state, protects the replacement
+instances and reduces Scale Set capacity to its original value.
+
+Run without a subcommand, performs the upgrade as 'upgrade' does. Use 'plan' or
+'validate' to check an upgrade beforehand, and 'status', 'check', 'scan' or
+'history' to inspect scale sets without changing them.
+
+Authenticates with the Azure CLI's credentials, or with workload identity when run
+in a Kubernetes pod federated with an Azure AD application, as detected from the
+AZURE_FEDERATED_TOKEN_FILE, AZURE_CLIENT_ID and AZURE_TENANT_ID variables.
+
+Logs go to stderr, and reports to stdout. Exit codes:
+  0  succeeded
+  1  failed before changing anything, or for any other reason
+  2  failed part way through, or some scale sets of a fleet failed
+  3  failed, and every phase was rolled back
+  4  nothing to upgrade (with --detailed-exit-codes)
+  5  a plan or validation found an upgrade to do (with --detailed-exit-codes)`,
+	PersistentPreRunE: deploy.ValidateFlags,
+	Run:               deploy.Run,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -33,11 +53,184 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.Flags().StringP("subscription-id", "s", "", "Subscription ID")
-	rootCmd.Flags().StringP("resource-group", "r", "", "Resource Group name")
-	rootCmd.Flags().StringP("vm-scale-set", "v", "", "Virtual Machine Scale Set name")
+	cobra.OnInitialize(initConfig)
+
+	// Logs are kept off stdout, so reports can be piped
+	log.SetOutput(os.Stderr)
+
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.azure-cluster-upgrade.yaml)")
+	addRootFlags(rootCmd)
+	addClientFlags(rootCmd)
+
+	addUpgradeFlags(rootCmd)
+}
+
+// addRootFlags registers the persistent flags every command shares, other
+// than --config: profiles, reporting and run identity.
+func addRootFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
+
+	flags.String("profile", "", "Profile from the config file to apply, e.g. 'prod'; its flags apply unless given on the command line")
+	flags.StringArray("var", nil, "Variable substituted for ${name} in the config file, as name=value (repeatable); the environment is consulted for others")
+	flags.StringP("output", "o", "text", "Format of reports printed to stdout: 'text' or 'json'")
+	flags.Bool("detailed-exit-codes", false, "Exit with 4 when there is nothing to upgrade, and 5 when a plan or validation finds an upgrade to do")
+	flags.String("run-id", "", "UUID identifying this run in logs, ARM correlation IDs, scale set tags, events, change records and reports (random by default)")
+	flags.String("ci", "", "Emit annotations, step outputs and a job summary for this CI system: 'azdo' or 'github'")
+}
+
+// addSessionFlags registers the flags shared by every command which
+// talks to a scale set, naming which one, or selecting it by its tags.
+// Names complete in bash.
+func addSessionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("subscription-id", "s", "", "Subscription ID")
+	cmd.Flags().StringP("resource-group", "r", "", "Resource Group name (optional with --selector, to narrow it)")
+	cmd.Flags().StringP("vm-scale-set", "v", "", "Virtual Machine Scale Set name")
+	cmd.Flags().String("selector", "", "Select the scale set by its tags instead of by name, e.g. 'env=prod,role=worker'")
+
+	cmd.MarkFlagRequired("subscription-id")
+
+	cmd.MarkFlagCustom("resource-group", "__azure-cluster-upgrade_resource_groups")
+	cmd.MarkFlagCustom("vm-scale-set", "__azure-cluster-upgrade_scale_sets")
+}
+
+// addClientFlags registers the flags controlling how scale sets are
+// reached: rate limits, recording, simulation and fault injection. They're
+// registered as persistent flags, so every subcommand shares them.
+func addClientFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
 
-	rootCmd.MarkFlagRequired("subscription-id")
-	rootCmd.MarkFlagRequired("resource-group")
-	rootCmd.MarkFlagRequired("vm-scale-set")
+	flags.Int("arm-reads-per-minute", 0, "Limit on ARM read requests per minute, shared by all clients (0 for unlimited)")
+	flags.Int("arm-writes-per-minute", 0, "Limit on ARM write requests per minute, shared by all clients (0 for unlimited)")
+	flags.String("record", "", "Record every ARM request and response to this file")
+	flags.String("replay", "", "Replay ARM responses from a file written by --record, instead of calling Azure")
+	flags.Bool("simulate", false, "Rehearse against an in-memory scale set instead of Azure")
+	flags.Int64("simulate-instances", 3, "Number of instances in the simulated scale set")
+	flags.Int64("simulate-compliant-instances", 0, "Number of simulated instances already running the latest model")
+	flags.String("simulate-tags", "", "Tags of the simulated scale set, e.g. 'env=prod,role=worker'")
+	flags.Int("simulate-allocation-failures", 0, "Number of simulated scale-outs which fail to allocate instances")
+	flags.Duration("simulate-provisioning-delay", 0, "Time each simulated scale-out takes to complete")
+
+	// Fault injection, for testing how the upgrade copes with failures
+	flags.String("inject-protect-failure", "", "Fail the scale-in protection update of this instance ID")
+	flags.Bool("inject-scale-in-timeout", false, "Time out waiting for the scale-in to complete")
+	flags.Float64("inject-throttle-rate", 0, "Fraction of ARM requests to answer with 429 Too Many Requests")
+	flags.String("inject-unhealthy-instance", "", "Report this instance ID unhealthy after it's first listed")
+	flags.MarkHidden("inject-protect-failure")
+	flags.MarkHidden("inject-scale-in-timeout")
+	flags.MarkHidden("inject-throttle-rate")
+	flags.MarkHidden("inject-unhealthy-instance")
+}
+
+// addUpgradeFlags registers the flags shared by every command which
+// performs a blue/green upgrade of a scale set.
+func addUpgradeFlags(cmd *cobra.Command) {
+	addSessionFlags(cmd)
+	addUpgradeBehaviourFlags(cmd)
+}
+
+// addUpgradeBehaviourFlags registers the flags controlling how an upgrade
+// runs, independent of which scale set it targets.
+func addUpgradeBehaviourFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("timeout", 0, "Time an upgrade of a single scale set may take before it's abandoned (0 for 20 minutes on top of the longest its phases may wait, such as --backup-timeout or the warm-up)")
+	cmd.Flags().String("strategy", "blue-green", "How instances are moved onto the model: 'blue-green', 'scale-out-only' to surge and protect new instances but leave old ones for finish, or a strategy compiled in with deploy.RegisterStrategy")
+	cmd.Flags().String("smoke-test-script", "", "Script executed via Run Command on new instances before scale-in")
+	cmd.Flags().String("drain-script", "", "Script executed via Run Command on old instances before scale-in")
+	cmd.Flags().String("shutdown-script", "", "Script executed via Run Command on each old instance to stop its workload cleanly before it's removed, leaving the instances in place if any fails")
+	cmd.Flags().Duration("shutdown-timeout", 5*time.Minute, "Time each attempt of --shutdown-script is allowed")
+	cmd.Flags().Int("shutdown-retries", 2, "Times --shutdown-script is retried on an instance where it fails")
+	cmd.Flags().String("shutdown-success-marker", "", "Line --shutdown-script must print for an instance to count as shut down")
+	cmd.Flags().String("sessions-from", "", "Hold off removing each old instance until its active sessions end: 'metrics' to count its inbound flows from Azure Monitor, or an endpoint answering with the count as a JSON number, where {ip} and {instance} are replaced by the instance's private IP and ID")
+	cmd.Flags().String("sessions-token", "", "Bearer token for the --sessions-from endpoint, or a reference to it such as env:NAME, file:PATH or keyvault:URI")
+	cmd.Flags().Int64("max-sessions", 0, "Most sessions an old instance may hold and still be removed, with --sessions-from")
+	cmd.Flags().Duration("sessions-max-wait", 30*time.Minute, "Longest to wait for old instances' sessions to end before removing them regardless")
+	cmd.Flags().String("carry-disks", "", "Old instances whose data disks are snapshotted and attached to a new instance each at the same LUNs once drained, as a list of instance IDs or 'all'")
+	cmd.Flags().Bool("record-deployment", false, "Make model changes as ARM deployments, so they appear in the resource group's deployment history")
+	cmd.Flags().String("cost-center", "", "Tag surge instances with this cost center while they're surplus to the scale set's capacity")
+	cmd.Flags().String("cost-center-tag", "cost-center", "Name of the tag --cost-center is given in")
+	cmd.Flags().Float64("hourly-price", 0, "Price of an instance-hour the surge's cost is reported at, in place of the retail price")
+	cmd.Flags().String("currency", "USD", "Currency surge costs are reported in")
+	cmd.Flags().Bool("spot-surge", false, "Allow surging with spot instances when they're cheaper and evicted no more than --max-eviction-rate, by setting the priority of the scale set model")
+	cmd.Flags().String("surge-priority", "model", "Priority of surged instances, set on the scale set model and kept by the instances that replace the old ones: 'model' to leave it as is, 'regular' or 'spot'")
+	cmd.Flags().Int("max-eviction-rate", 10, "Highest eviction rate, in percent, of the VM size at which the surge may use spot instances")
+	cmd.Flags().String("orphaned-resources", "off", "Look for disks, network interfaces and public IPs removed instances left behind: 'off', 'report' or 'delete'")
+	cmd.Flags().Bool("snapshot-data-disks", false, "Snapshot the data disks of old instances before they're removed, as a way to recover their data")
+	cmd.Flags().Duration("snapshot-retention", 7*24*time.Hour, "How long snapshots taken by --snapshot-data-disks are kept before a later run deletes them (0 to keep them)")
+	cmd.Flags().String("backup-vault", "", "Resource ID of the Recovery Services vault protecting the instances, each of which it protects must have a recent recovery point before the upgrade")
+	cmd.Flags().Duration("backup-max-age", 24*time.Hour, "How recent the recovery points required by --backup-vault must be")
+	cmd.Flags().Bool("backup-trigger", false, "Back up protected instances without a recent recovery point and wait for it, rather than refusing the upgrade")
+	cmd.Flags().Duration("backup-retention", 30*24*time.Hour, "How long recovery points taken by --backup-trigger are kept")
+	cmd.Flags().Duration("backup-timeout", 2*time.Hour, "Time to wait for the recovery points of backups taken by --backup-trigger")
+	cmd.Flags().String("termination-script", "", "Script old instances run via an agent on their Scheduled Events termination notice, acknowledging it once done so they're deleted without waiting out the notice (Linux, needs --terminate-notification or a terminate notification profile)")
+	cmd.Flags().Duration("terminate-notification", 0, "Enable the scale set's terminate notification with this much notice (5m to 15m) as part of the model update, and check it's in effect before old instances are removed (0 to leave the model's setting)")
+	cmd.Flags().String("health-extension", "", "Add the Application Health extension to the model, probing with this protocol (http, https or tcp), if the scale set has no health extension or load balancer probe")
+	cmd.Flags().Int("health-extension-port", 80, "Port the Application Health extension added by --health-extension probes")
+	cmd.Flags().String("health-extension-path", "/", "Request path the Application Health extension added by --health-extension probes over HTTP(S)")
+	cmd.Flags().Bool("suspend-repairs", false, "Turn off the scale set's automatic instance repairs for the upgrade, turning them back on once old instances are removed")
+	cmd.Flags().Duration("run-command-timeout", 5*time.Minute, "Timeout for each Run Command invocation")
+	cmd.Flags().Bool("verify-extensions", false, "Check every extension in the scale set model provisioned successfully on each new instance before scale-in")
+	cmd.Flags().Int("expected-gpus", 0, "Check via Run Command that each new instance's NVIDIA driver is ready and nvidia-smi reports this many GPUs before scale-in (0 to disable)")
+	cmd.Flags().Bool("verify-dual-stack", false, "Check via Run Command that new instances of a dual-stack scale set have an address and default route for both IPv4 and IPv6 before scale-in")
+	cmd.Flags().String("dual-stack-probe-target", "", "Host or address new instances must reach by ping over both IPv4 and IPv6 for --verify-dual-stack; without it, only their addresses and default routes are checked")
+	cmd.Flags().String("rotate-identity-to", "", "Resource ID of a user-assigned identity to swap in for --rotate-identity-from, once new instances obtain tokens for it")
+	cmd.Flags().String("rotate-identity-from", "", "Resource ID of the user-assigned identity --rotate-identity-to replaces, removed once the old instances are gone")
+	cmd.Flags().Bool("remove-retired-roles", false, "Remove the role assignments of the identity retired by --rotate-identity-from, unless it's still assigned to other resources")
+	cmd.Flags().Bool("patch-report", false, "Collect the OS patch level of replaced and new instances via Run Command, and report them side by side")
+	cmd.Flags().Bool("verify-identities", false, "Check via Run Command that new instances obtain tokens for the scale set's managed identities before scale-in")
+	cmd.Flags().Duration("lb-health-timeout", 10*time.Minute, "Time to wait for new instances to pass load balancer health probes (0 to disable)")
+	cmd.Flags().String("removal-order", "listed", "Order old instances are removed in by warm-up steps and budgeted batches: 'listed', or least busy first by 'cpu', 'network' or 'connections' from Azure Monitor")
+	cmd.Flags().Duration("load-window", 30*time.Minute, "Window the load of instances is averaged over, for --removal-order and shrink's --victims=least-loaded")
+	cmd.Flags().Int("warm-up-steps", 0, "Shift traffic onto new instances gradually, removing old instances over this many steps before scale-in (0 or 1 to disable)")
+	cmd.Flags().Duration("warm-up-interval", 5*time.Minute, "Time to watch new instances after each warm-up step")
+	cmd.Flags().Duration("warm-up-max-latency", 0, "Abort the warm-up if application gateway backend latency exceeds this (0 for no limit)")
+	cmd.Flags().Int("warm-up-max-failed-requests", 0, "Abort the warm-up if an application gateway fails more requests than this in a step (0 for no limit)")
+	cmd.Flags().Bool("reserve-surge-capacity", false, "Expand the scale set's capacity reservation to cover the surge, restoring it afterwards or once the upgrade fails")
+	cmd.Flags().Bool("add-dedicated-hosts", false, "Add hosts to the scale set's dedicated host group for the surge, removing as many empty hosts from the group after the scale-in, or once the upgrade fails")
+	cmd.Flags().String("vulnerability-gate", "", "Endpoint asked for the known vulnerabilities of the image being rolled out, refusing it if any are of the blocking severity")
+	cmd.Flags().String("vulnerability-gate-token", "", "Bearer token for the vulnerability gate, or a reference to it such as env:NAME, file:PATH or keyvault:URI")
+	cmd.Flags().String("vulnerability-block-severity", "critical", "Least severe finding which blocks a rollout: 'low', 'medium', 'high' or 'critical'")
+	cmd.Flags().String("image-signing-key", "", "PEM public key which must have signed any image the model is moved onto, with the signature in the image's 'signature' tag")
+	cmd.Flags().Bool("lift-delete-locks", false, "Lift CanNotDelete locks on the scale set for the upgrade, restoring them afterwards")
+	cmd.Flags().String("diagnostics-dir", "diagnostics", "Directory to store boot diagnostics of failed instances (empty to disable)")
+	cmd.Flags().String("on-rerun", "refuse", "Behaviour when an earlier upgrade was left in progress: 'refuse' or 'resume'")
+	cmd.Flags().String("max-unavailable", "", "Remove old instances in batches, keeping at most this many (or this percentage) of the original capacity unavailable at once")
+	cmd.Flags().Int64("min-healthy", 0, "Remove old instances in batches, never leaving fewer than this many instances available")
+	cmd.Flags().String("on-external-change", "abort", "Behaviour when the scale set's capacity is changed by something else mid-upgrade: 'abort' or 'reconcile'")
+	cmd.Flags().Bool("rollback-on-failure", false, "Undo completed phases, including removing surged instances, when a phase fails")
+	cmd.Flags().Duration("health-watch-interval", 0, "Poll the health of every instance this often while the upgrade runs, holding it between phases while instances it hasn't touched are failing (0 to disable)")
+	cmd.Flags().Int("health-watch-max-failing", 1, "Number of failing instances the upgrade hasn't touched which holds it")
+	cmd.Flags().Duration("health-watch-timeout", 30*time.Minute, "Time to hold for failing instances to recover before failing the upgrade")
+	cmd.Flags().String("service-health", "off", "Behaviour when Azure Service Health reports an incident or planned maintenance affecting compute in the region, or instances have maintenance scheduled: 'off', 'warn' or 'pause'")
+	cmd.Flags().Duration("service-health-timeout", time.Hour, "Time to pause between phases for Service Health trouble to clear before failing the upgrade")
+	cmd.Flags().Int("max-recent-upgrades", 0, "Refuse to start once this many of the subscription's scale sets (those matching --selector, if given) were upgraded within --recent-upgrade-window (0 to disable)")
+	cmd.Flags().Duration("recent-upgrade-window", 24*time.Hour, "Window --max-recent-upgrades counts upgrades within")
+	cmd.Flags().Bool("override", false, "Start the upgrade even though --max-recent-upgrades is reached")
+}
+
+// initConfig reads in config file and ENV variables if set.
+func initConfig() {
+	if cfgFile != "" {
+		// Use config file from the flag.
+		viper.SetConfigFile(cfgFile)
+	} else {
+		// Find home directory.
+		home, err := homedir.Dir()
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+
+		// Search config in home directory with name ".azure-cluster-upgrade" (without extension).
+		viper.AddConfigPath(home)
+		viper.SetConfigName(".azure-cluster-upgrade")
+	}
+
+	viper.AutomaticEnv() // read in environment variables that match
+
+	// If a config file is found, read it in.
+	if err := viper.ReadInConfig(); err == nil {
+		log.Infof("Using config file: %s", viper.ConfigFileUsed())
+	} else if cfgFile != "" {
+		log.Fatal(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Report model drift across every Scale Set in a subscription",
+	Long: `Lists every Virtual Machine Scale Set in a subscription, optionally only those
+whose tags match a selector, and reports how many instances of each are not
+running the scale set model, the images the model and its instances use, and
+any upgrade in progress or last completed. Scale sets needing an upgrade are
+listed first, in priority order. Nothing is modified.`,
+	Run: deploy.RunScan,
+}
+
+func init() {
+	rootCmd.AddCommand(scanCmd)
+
+	scanCmd.Flags().StringP("subscription-id", "s", "", "Subscription ID")
+	scanCmd.Flags().String("selector", "", "Only scan scale sets with these tags, e.g. 'env=prod,role=worker'")
+	scanCmd.MarkFlagRequired("subscription-id")
+
+}
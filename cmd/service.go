@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Install the long-running commands as services",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install -- gitops|chatops [flags]",
+	Short: "Install a long-running command as a systemd service",
+	Long: `Installs the command given after '--', gitops or chatops, as a systemd service
+running this executable with the config file in use, then enables and starts it.
+The service restarts according to --restart, so it can be left running on a
+management VM:
+
+  azure-cluster-upgrade service install --config /etc/azure-cluster-upgrade.yaml \
+    --env AZURE_CONFIG_DIR=/var/lib/azure-cluster-upgrade/.azure \
+    -- gitops --poll-interval 5m
+
+Windows services aren't supported.`,
+	Run: deploy.RunServiceInstall,
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall [-- gitops|chatops]",
+	Short: "Stop and remove a service installed with 'service install'",
+	Run:   deploy.RunServiceUninstall,
+}
+
+func init() {
+	rootCmd.AddCommand(serviceCmd)
+	serviceCmd.AddCommand(serviceInstallCmd)
+	serviceCmd.AddCommand(serviceUninstallCmd)
+
+	for _, cmd := range []*cobra.Command{serviceInstallCmd, serviceUninstallCmd} {
+		cmd.Flags().String("name", "", "Name of the service (default is azure-cluster-upgrade-<command>)")
+		cmd.Flags().String("unit-dir", "/etc/systemd/system", "Directory holding systemd unit files")
+	}
+
+	serviceInstallCmd.Flags().StringArray("env", nil, "Environment variable of the service, as NAME=value (repeatable)")
+	serviceInstallCmd.Flags().String("user", "", "User to run the service as (default is root)")
+	serviceInstallCmd.Flags().String("restart", "on-failure", "When systemd restarts the service: 'always' or 'on-failure'")
+	serviceInstallCmd.Flags().Duration("restart-delay", 30*time.Second, "Time to wait before restarting the service")
+	serviceInstallCmd.Flags().Bool("no-start", false, "Only write the unit file, without enabling or starting the service")
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var shrinkCmd = &cobra.Command{
+	Use:   "shrink",
+	Short: "Safely reduce a Scale Set's capacity",
+	Long: `Removes instances of a Virtual Machine Scale Set until it has --to-capacity,
+as the second half of a blue/green upgrade without the first: the instances
+chosen are drained with --drain-script, snapshotted or given the termination
+agent as configured, then removed by ID rather than left to the scale set's own
+scale-in policy. With --max-unavailable or --min-healthy, they're removed in
+batches which keep the remaining instances available.
+
+Instances are chosen by --victims: 'oldest' by the creation time of their OS
+disks, 'stale-model' those not running the latest model before the rest, or
+'least-loaded' those with the lowest average CPU over --load-window, as
+reported by Azure Monitor, or the load --removal-order ranks by.
+
+  azure-cluster-upgrade shrink -s <subscription> -r <group> -v <scale set> \
+    --to-capacity 6 --victims least-loaded --max-unavailable 1`,
+	Run: deploy.RunShrink,
+}
+
+func init() {
+	rootCmd.AddCommand(shrinkCmd)
+
+	addUpgradeFlags(shrinkCmd)
+	shrinkCmd.Flags().Int64("to-capacity", 0, "Number of instances the scale set is shrunk to")
+	shrinkCmd.Flags().String("victims", "stale-model", "Which instances are removed first: 'oldest', 'stale-model' or 'least-loaded'")
+
+	shrinkCmd.MarkFlagRequired("to-capacity")
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Export the Scale Set model and instance inventory",
+	Long: `Exports the Virtual Machine Scale Set model, along with an inventory of its
+instances and the image and size each one runs, to a local file or an https://
+blob URL. The snapshot can later be re-applied with 'restore'.`,
+	Run: deploy.RunSnapshot,
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+
+	addSessionFlags(snapshotCmd)
+	snapshotCmd.Flags().StringP("file", "f", "", "File path or https:// blob URL to write the snapshot to")
+
+	snapshotCmd.MarkFlagRequired("file")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show a Scale Set's drift and any upgrade in progress",
+	Long: `Shows the capacity of the Virtual Machine Scale Set, how many of its instances are
+not running the scale set model, and any upgrade left in progress, along with
+when the last upgrade completed. Nothing is modified.`,
+	Run: deploy.RunStatus,
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List recent operations on a Scale Set",
+	Long: `Lists the completed operations on the Virtual Machine Scale Set recorded in the
+Azure activity log, such as model updates, scaling and instance deletions,
+along with when the last upgrade completed and the image it replaced.
+Nothing is modified.`,
+	Run: deploy.RunHistory,
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(historyCmd)
+
+	addSessionFlags(statusCmd)
+
+	addSessionFlags(historyCmd)
+	historyCmd.Flags().Duration("since", 7*24*time.Hour, "How far back to list operations, up to the activity log's 90 day retention")
+}
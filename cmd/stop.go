@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var stopAllCmd = &cobra.Command{
+	Use:   "stop-all",
+	Short: "Stop every upgrade in progress in some subscriptions, for incidents",
+	Long: `Emergency stop: tags each subscription so that every upgrade of its scale sets,
+whichever process runs it (a pipeline, the gitops or chatops controller, a
+fleet upgrade), holds ahead of its next phase. A phase in progress completes
+first, so no upgrade is left part way through one. Held upgrades log where they
+stopped, note it on their change record and publish an upgrade.stopped event,
+and wait until the stop is released with --release, without the wait counting
+against their timeout. Upgrades started while the stop is in place hold ahead
+of their first phase, and those unable to read the subscription's tags refuse
+to start, as they couldn't be stopped.
+
+The upgrades recorded as in progress in each subscription are reported. Those
+still in their preflight checks aren't listed, though they're held all the
+same. Needs permission to write the subscription's tags, e.g. Tag Contributor.
+Simulated upgrades aren't stopped.`,
+	Run: deploy.RunStopAll,
+}
+
+func init() {
+	rootCmd.AddCommand(stopAllCmd)
+
+	stopAllCmd.Flags().StringSliceP("subscriptions", "s", nil, "Subscription IDs whose upgrades are stopped")
+	stopAllCmd.Flags().String("reason", "emergency stop", "Reason for the stop, logged by every held upgrade")
+	stopAllCmd.Flags().Bool("release", false, "Release the stop, letting held upgrades carry on")
+	stopAllCmd.MarkFlagRequired("subscriptions")
+}
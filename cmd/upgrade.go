@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"github.com/krarey/azure-cluster-upgrade/deploy"
+	"github.com/spf13/cobra"
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade a Scale Set's instances onto its current model",
+	Long: `Performs the blue/green upgrade of a Virtual Machine Scale Set whose model has
+been updated: surges a replacement for every instance not running the model,
+protects the replacements once they're running and healthy, then scales back in
+to the original capacity. Equivalent to running the command without a
+subcommand.
+
+A program embedding the upgrade can register strategies of its own with
+deploy.RegisterStrategy, such as a roll of a stateful database, which --strategy
+selects in place of the surge. They run behind the same preflight checks, and
+can hold new instances to the same gates.`,
+	Run: deploy.Run,
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+
+	addUpgradeFlags(upgradeCmd)
+}
+
+// NewUpgradeCommand returns a command carrying every flag controlling how
+// an upgrade runs, but not which scale set it targets, for programs
+// embedding the upgrade to configure a deploy.Upgrader with. Set its flags
+// with Flags().Set, or parse arguments onto it with ParseFlags.
+func NewUpgradeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: upgradeCmd.Short,
+	}
+
+	addRootFlags(cmd)
+	addClientFlags(cmd)
+	addUpgradeBehaviourFlags(cmd)
+
+	// Persistent flags are only merged into Flags on parsing, which an
+	// embedding program may not do
+	cmd.LocalFlags()
+
+	return cmd
+}
@@ -0,0 +1,175 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const (
+	userAgent = "azure-cluster-upgrade"
+)
+
+// Returns the session's bare ARM client. Used for resource providers we
+// don't vendor a dedicated SDK package for.
+func (s *azureSession) getARMClient() autorest.Client {
+	return s.cachedClient("arm", func() interface{} {
+		client := autorest.NewClientWithUserAgent(userAgent)
+		s.configureClient(&client)
+		return client
+	}).(autorest.Client)
+}
+
+// Returns the ARM path of the session's resource group
+func (s *azureSession) resourceGroupPath() string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", s.SubscriptionID, s.ResourceGroupName)
+}
+
+// Returns the ARM path of the session's scale set
+func (s *azureSession) scaleSetPath() string {
+	return fmt.Sprintf("%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s", s.resourceGroupPath(), s.ScaleSetName)
+}
+
+// Prepares and sends a request against an arbitrary ARM path. The query
+// parameters must include the 'api-version'. A non-nil 'body' is sent as JSON.
+func (s *azureSession) armSend(ctx context.Context, client autorest.Client, method string, path string, query map[string]interface{}, body interface{}) (*http.Response, error) {
+	decorators := []autorest.PrepareDecorator{
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(azure.PublicCloud.ResourceManagerEndpoint),
+		autorest.WithPath(path),
+		autorest.WithQueryParameters(query),
+		client.WithAuthorization(),
+	}
+	if body != nil {
+		decorators = append(decorators, autorest.AsContentType("application/json; charset=utf-8"), autorest.WithJSON(body))
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return nil, err
+	}
+
+	return autorest.SendWithSender(client, req, autorest.DoRetryForStatusCodes(client.RetryAttempts, client.RetryDuration, autorest.StatusCodesForRetry...))
+}
+
+// Decodes an ARM response into 'result' (which may be nil), surfacing any
+// status code outside of 'expected' as an error.
+func armRespond(client autorest.Client, resp *http.Response, result interface{}, expected ...int) error {
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+
+	responders := []autorest.RespondDecorator{
+		client.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(expected...),
+	}
+	if result != nil {
+		responders = append(responders, autorest.ByUnmarshallingJSON(result))
+	}
+	responders = append(responders, autorest.ByClosing())
+
+	return autorest.Respond(resp, responders...)
+}
+
+// Issues a request against an arbitrary ARM path and decodes the JSON
+// response into 'result'. Any status code outside of 'expected' (default
+// 200 OK) is surfaced as an error.
+func (s *azureSession) armDo(ctx context.Context, method string, path string, apiVersion string, body interface{}, result interface{}, expected ...int) error {
+	client := s.getARMClient()
+
+	resp, err := s.armSend(ctx, client, method, path, map[string]interface{}{"api-version": apiVersion}, body)
+	if err != nil {
+		return err
+	}
+
+	return armRespond(client, resp, result, expected...)
+}
+
+// Issues a long-running request against an arbitrary ARM path, blocks until
+// the operation completes and decodes its final result into 'result'.
+func (s *azureSession) armDoAsync(ctx context.Context, method string, path string, apiVersion string, body interface{}, result interface{}) error {
+	client := s.getARMClient()
+
+	resp, err := s.armSend(ctx, client, method, path, map[string]interface{}{"api-version": apiVersion}, body)
+	if err != nil {
+		return err
+	}
+
+	future, err := azure.NewFutureFromResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if err = future.WaitForCompletionRef(ctx, client); err != nil {
+		return err
+	}
+
+	resp, err = future.GetResult(client)
+	if err != nil {
+		return err
+	}
+
+	return armRespond(client, resp, result)
+}
+
+// Convenience wrapper around armDo for GET requests
+func (s *azureSession) armGet(ctx context.Context, path string, apiVersion string, result interface{}) error {
+	return s.armDo(ctx, http.MethodGet, path, apiVersion, nil, result)
+}
+
+// Issues a GET with additional query parameters, such as OData filters
+func (s *azureSession) armGetWithQuery(ctx context.Context, path string, query map[string]interface{}, result interface{}) error {
+	client := s.getARMClient()
+
+	resp, err := s.armSend(ctx, client, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+
+	return armRespond(client, resp, result)
+}
+
+// Lists a collection at an ARM path, following nextLink until every page
+// is read, and decodes the value of every page into 'items', a pointer to
+// a slice. The query parameters must include the 'api-version'.
+func (s *azureSession) armList(ctx context.Context, path string, query map[string]interface{}, items interface{}) error {
+	var raw []json.RawMessage
+
+	for {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"nextLink"`
+		}
+		if err := s.armGetWithQuery(ctx, path, query, &page); err != nil {
+			return err
+		}
+		raw = append(raw, page.Value...)
+
+		if page.NextLink == "" {
+			break
+		}
+
+		next, err := url.Parse(page.NextLink)
+		if err != nil {
+			return err
+		}
+		path, query = next.Path, map[string]interface{}{}
+		for key, values := range next.Query() {
+			query[key] = values[0]
+		}
+	}
+
+	if raw == nil {
+		raw = []json.RawMessage{}
+	}
+	all, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(all, items)
+}
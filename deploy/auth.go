@@ -0,0 +1,207 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/azure/cli"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tokens are fetched afresh from the Azure CLI this long before they
+// expire, so no request goes out with a token that lapses in flight
+const tokenRefreshMargin = 5 * time.Minute
+
+// cliTokenProvider supplies Azure CLI access tokens to a bearer
+// authorizer. The SDK's own CLI authorizer fetches a single token, which
+// expires after an hour or so and would fail a long upgrade partway
+// through; this one fetches a new token from the CLI whenever the current
+// one is about to expire.
+type cliTokenProvider struct {
+	mu       sync.Mutex
+	resource string
+	token    adal.Token
+}
+
+// Environment variables the AKS workload identity webhook injects into
+// pods whose service account is federated with an Azure AD application
+const (
+	federatedTokenFileEnv = "AZURE_FEDERATED_TOKEN_FILE"
+	clientIDEnv           = "AZURE_CLIENT_ID"
+	tenantIDEnv           = "AZURE_TENANT_ID"
+	authorityHostEnv      = "AZURE_AUTHORITY_HOST"
+)
+
+// federatedTokenSecret authenticates to Azure AD with the Kubernetes
+// service account token projected into the pod. The token is rotated by
+// the kubelet, so it is read afresh for every refresh.
+type federatedTokenSecret struct {
+	path string
+}
+
+// SetAuthenticationValues adds the service account token as a client
+// assertion
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	token, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("unable to read federated token: %v", err)
+	}
+
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	return nil
+}
+
+// Reports whether the process runs in a pod with workload identity, in
+// which case its federated credentials are used in place of the Azure CLI
+func workloadIdentityAvailable() bool {
+	return os.Getenv(federatedTokenFileEnv) != "" && os.Getenv(clientIDEnv) != "" && os.Getenv(tenantIDEnv) != ""
+}
+
+// Returns an authorizer for a resource exchanging the pod's service
+// account token for Azure AD tokens, refreshed ahead of their expiry
+func newWorkloadIdentityAuthorizer(resource string) (autorest.Authorizer, error) {
+	authority := os.Getenv(authorityHostEnv)
+	if authority == "" {
+		settings, err := auth.GetSettingsFromEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		authority = settings.Environment.ActiveDirectoryEndpoint
+	}
+
+	config, err := adal.NewOAuthConfig(authority, os.Getenv(tenantIDEnv))
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &federatedTokenSecret{path: os.Getenv(federatedTokenFileEnv)}
+	token, err := adal.NewServicePrincipalTokenWithSecret(*config, os.Getenv(clientIDEnv), resource, secret)
+	if err != nil {
+		return nil, err
+	}
+	token.SetRefreshWithin(tokenRefreshMargin)
+
+	if err = token.Refresh(); err != nil {
+		return nil, fmt.Errorf("unable to authenticate with workload identity: %v", err)
+	}
+	log.Debugf("Authenticated as client %s with workload identity", os.Getenv(clientIDEnv))
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// Returns an authorizer for ARM, which keeps its token fresh for as long
+// as the upgrade runs. Workload identity is used when running in a pod
+// set up for it, the Azure CLI's credentials otherwise.
+func newAuthorizer() (autorest.Authorizer, error) {
+	settings, err := auth.GetSettingsFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	resource := settings.Values[auth.Resource]
+	if resource == "" {
+		resource = settings.Environment.ResourceManagerEndpoint
+	}
+
+	return newAuthorizerForResource(resource)
+}
+
+// Returns an authorizer for another resource, such as Key Vault, using
+// workload identity or the Azure CLI's credentials
+func newAuthorizerForResource(resource string) (autorest.Authorizer, error) {
+	if workloadIdentityAvailable() {
+		return newWorkloadIdentityAuthorizer(resource)
+	}
+
+	provider := &cliTokenProvider{resource: resource}
+	if err := provider.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return autorest.NewBearerAuthorizer(provider), nil
+}
+
+// OAuthToken returns the current access token
+func (p *cliTokenProvider) OAuthToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.token.OAuthToken()
+}
+
+// Refresh fetches a new access token from the Azure CLI
+func (p *cliTokenProvider) Refresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refreshLocked()
+}
+
+func (p *cliTokenProvider) refreshLocked() error {
+	token, err := cli.GetTokenFromCLI(p.resource)
+	if err != nil {
+		return err
+	}
+
+	converted, err := token.ToADALToken()
+	if err != nil {
+		return err
+	}
+
+	p.token = converted
+	log.Debugf("Fetched an Azure CLI access token valid until %s", p.token.Expires().Format(time.RFC3339))
+
+	return nil
+}
+
+// RefreshExchange fetches a new access token for another resource
+func (p *cliTokenProvider) RefreshExchange(resource string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resource = resource
+	return p.refreshLocked()
+}
+
+// EnsureFresh fetches a new access token if the current one is about to
+// expire. Should the CLI fail while the current token is still valid,
+// e.g. on a transient error, the current token is kept and the refresh
+// retried on the next request.
+func (p *cliTokenProvider) EnsureFresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.token.WillExpireIn(tokenRefreshMargin) {
+		return nil
+	}
+
+	err := p.refreshLocked()
+	if err != nil && !p.token.IsExpired() {
+		log.Warnf("Unable to refresh Azure CLI access token, using the current one until it expires at %s: %v", p.token.Expires().Format(time.RFC3339), err)
+		return nil
+	}
+
+	return err
+}
+
+// RefreshWithContext is Refresh; the Azure CLI can't be cancelled
+func (p *cliTokenProvider) RefreshWithContext(ctx context.Context) error {
+	return p.Refresh()
+}
+
+// RefreshExchangeWithContext is RefreshExchange; the Azure CLI can't be cancelled
+func (p *cliTokenProvider) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	return p.RefreshExchange(resource)
+}
+
+// EnsureFreshWithContext is EnsureFresh; the Azure CLI can't be cancelled
+func (p *cliTokenProvider) EnsureFreshWithContext(ctx context.Context) error {
+	return p.EnsureFresh()
+}
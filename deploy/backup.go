@@ -0,0 +1,242 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recoveryServicesAPIVersion = "2023-02-01"
+
+	// How often a triggered backup is checked for its recovery point
+	backupPollInterval = time.Minute
+)
+
+// protectedItem is an instance protected by Azure Backup, along with the
+// recovery point found or taken for it
+type protectedItem struct {
+	ID            string
+	InstanceID    string
+	RecoveryPoint string
+	Time          time.Time
+}
+
+// Checks a --backup-vault value is a Recovery Services vault's resource ID
+func validateBackupVault(value string) error {
+	id, err := azure.ParseResourceID(value)
+	if err != nil || !strings.EqualFold(id.Provider, "Microsoft.RecoveryServices") || !strings.EqualFold(id.ResourceType, "vaults") {
+		return fmt.Errorf("%s is not the resource ID of a Recovery Services vault", value)
+	}
+	return nil
+}
+
+// Returns the items the vault protects, keyed by the lower-cased resource
+// ID of the virtual machine each protects
+func (s *azureSession) backupProtectedItems(ctx context.Context, vault string) (map[string]string, error) {
+	items := map[string]string{}
+
+	var protected []struct {
+		ID         string `json:"id"`
+		Properties struct {
+			SourceResourceID string `json:"sourceResourceId"`
+		} `json:"properties"`
+	}
+
+	path := vault + "/backupProtectedItems"
+	query := map[string]interface{}{
+		"api-version": recoveryServicesAPIVersion,
+		"$filter":     "backupManagementType eq 'AzureIaasVM' and itemType eq 'VM'",
+	}
+
+	if err := s.armList(ctx, path, query, &protected); err != nil {
+		return items, err
+	}
+
+	for _, item := range protected {
+		items[strings.ToLower(item.Properties.SourceResourceID)] = item.ID
+	}
+
+	return items, nil
+}
+
+// Returns the ID and time of an item's latest recovery point, or an empty
+// ID if it has none
+func (s *azureSession) latestRecoveryPoint(ctx context.Context, itemID string) (string, time.Time, error) {
+	var points []struct {
+		ID         string `json:"id"`
+		Properties struct {
+			RecoveryPointTime time.Time `json:"recoveryPointTime"`
+		} `json:"properties"`
+	}
+	query := map[string]interface{}{"api-version": recoveryServicesAPIVersion}
+	if err := s.armList(ctx, itemID+"/recoveryPoints", query, &points); err != nil {
+		return "", time.Time{}, err
+	}
+
+	var latest string
+	var at time.Time
+	for _, point := range points {
+		if point.Properties.RecoveryPointTime.After(at) {
+			latest, at = point.ID, point.Properties.RecoveryPointTime
+		}
+	}
+
+	return latest, at, nil
+}
+
+// Starts an on-demand backup of an item, keeping its recovery point for
+// the given time
+func (s *azureSession) triggerBackup(ctx context.Context, itemID string, keep time.Duration) error {
+	body := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"objectType":                   "IaasVMBackupRequest",
+			"recoveryPointExpiryTimeInUTC": time.Now().Add(keep).UTC().Format(time.RFC3339),
+		},
+	}
+	return s.armDo(ctx, http.MethodPost, itemID+"/backup", recoveryServicesAPIVersion, body, nil, http.StatusAccepted)
+}
+
+// Returns the instances which are replaced by the upgrade: all of them
+// when the model is changing, or those not running the latest model
+func (r *upgradeRun) replacedInstances(ctx context.Context) ([]string, error) {
+	if r.modelChanging {
+		return r.sess.getInstanceIDs(ctx, "")
+	}
+	return r.oldInstanceIDs(ctx)
+}
+
+// Makes sure every instance the upgrade replaces which --backup-vault
+// protects has a recovery point newer than --backup-max-age, for change
+// control to record how the instances could be restored. With
+// --backup-trigger, a backup is taken of instances without one and waited
+// for; otherwise they refuse the upgrade. Instances the vault doesn't
+// protect are only noted, since instances of scale sets in uniform
+// orchestration can't be.
+func (r *upgradeRun) checkBackups(ctx context.Context) error {
+	vault := r.cmd.Flags().Lookup("backup-vault").Value.String()
+	if vault == "" {
+		return nil
+	}
+
+	maxAge, _ := r.cmd.Flags().GetDuration("backup-max-age")
+	trigger, _ := r.cmd.Flags().GetBool("backup-trigger")
+	timeout, _ := r.cmd.Flags().GetDuration("backup-timeout")
+
+	protected, err := r.sess.backupProtectedItems(ctx, vault)
+	if err != nil {
+		return fmt.Errorf("unable to list the items protected by %s: %v", vault, err)
+	}
+
+	instanceIDs, err := r.replacedInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	var items []*protectedItem
+	var unprotected []string
+	for _, instanceID := range instanceIDs {
+		vm, err := r.sess.getVMSSVMClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, instanceID)
+		if err != nil {
+			return err
+		}
+
+		itemID, ok := protected[strings.ToLower(to.String(vm.ID))]
+		if !ok {
+			unprotected = append(unprotected, instanceID)
+			continue
+		}
+		items = append(items, &protectedItem{ID: itemID, InstanceID: instanceID})
+	}
+
+	if len(unprotected) > 0 {
+		log.Warnf("Instances %s aren't protected by %s, so have no recovery point", strings.Join(unprotected, ", "), vault)
+	}
+
+	var stale []*protectedItem
+	for _, item := range items {
+		if item.RecoveryPoint, item.Time, err = r.sess.latestRecoveryPoint(ctx, item.ID); err != nil {
+			return err
+		}
+		if item.RecoveryPoint == "" || time.Since(item.Time) > maxAge {
+			stale = append(stale, item)
+		}
+	}
+
+	if len(stale) > 0 && !trigger {
+		var names []string
+		for _, item := range stale {
+			names = append(names, item.InstanceID)
+		}
+		return fmt.Errorf("instances %s have no recovery point from the past %s; back them up first, or pass --backup-trigger",
+			strings.Join(names, ", "), maxAge)
+	}
+
+	if err = r.awaitBackups(ctx, stale, timeout); err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].InstanceID < items[j].InstanceID })
+	for _, item := range items {
+		log.Infof("Instance %s can be restored from recovery point %s, taken %s", item.InstanceID, item.RecoveryPoint, item.Time.Format(time.RFC3339))
+		r.recoveryPoints = append(r.recoveryPoints, item.RecoveryPoint)
+	}
+
+	return nil
+}
+
+// Triggers a backup of each item and waits for their recovery points
+func (r *upgradeRun) awaitBackups(ctx context.Context, items []*protectedItem, timeout time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	started := time.Now()
+	keep, _ := r.cmd.Flags().GetDuration("backup-retention")
+
+	for _, item := range items {
+		log.Infof("Backing up instance %s...", item.InstanceID)
+		if err := r.sess.triggerBackup(ctx, item.ID, keep); err != nil {
+			return fmt.Errorf("unable to back up instance %s: %v", item.InstanceID, err)
+		}
+	}
+
+	deadline := time.After(timeout)
+	pending := items
+	for len(pending) > 0 {
+		select {
+		case <-time.After(backupPollInterval):
+		case <-deadline:
+			var names []string
+			for _, item := range pending {
+				names = append(names, item.InstanceID)
+			}
+			return fmt.Errorf("backups of instances %s took no recovery point within %s", strings.Join(names, ", "), timeout)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		var still []*protectedItem
+		for _, item := range pending {
+			id, at, err := r.sess.latestRecoveryPoint(ctx, item.ID)
+			if err != nil {
+				log.Warnf("Unable to check the backup of instance %s: %v", item.InstanceID, err)
+			}
+			if err != nil || id == "" || at.Before(started) {
+				still = append(still, item)
+				continue
+			}
+			item.RecoveryPoint, item.Time = id, at
+		}
+		pending = still
+	}
+
+	return nil
+}
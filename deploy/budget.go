@@ -0,0 +1,227 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const budgetPollInterval = 15 * time.Second
+
+// Resolves a --max-unavailable value, either a count ('2') or a share of
+// the original capacity ('25%', rounded up), to a number of instances.
+func parseMaxUnavailable(value string, capacity int64) (int64, error) {
+	return parseInstanceShare("--max-unavailable", value, capacity)
+}
+
+// Resolves the value of an instance count flag, either a count ('2') or a
+// share of the capacity ('25%', rounded up), to at least one instance.
+func parseInstanceShare(flag string, value string, capacity int64) (int64, error) {
+	var max int64
+
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("%s %s is not a percentage between 0%% and 100%%", flag, value)
+		}
+		max = int64(math.Ceil(float64(capacity) * percent / 100))
+	} else {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("%s %s is not a count or percentage", flag, value)
+		}
+		max = count
+	}
+
+	if max < 1 {
+		return 0, fmt.Errorf("%s %s allows no instance of %d to be removed", flag, value, capacity)
+	}
+
+	return max, nil
+}
+
+// Returns the IDs of instances which are serving: provisioned, running
+// and, where the Application Health extension reports on them, healthy.
+func (s *azureSession) getAvailableInstances(ctx context.Context) (map[string]bool, error) {
+	available := map[string]bool{}
+
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "instanceView")
+	if err != nil {
+		return available, err
+	}
+
+	for _, vm := range vms {
+		if isAvailable(vm) {
+			available[to.String(vm.InstanceID)] = true
+		}
+	}
+
+	return available, nil
+}
+
+// Reports whether an instance listed with its instance view is serving
+func isAvailable(vm compute.VirtualMachineScaleSetVM) bool {
+	if vm.VirtualMachineScaleSetVMProperties == nil || vm.InstanceView == nil || vm.InstanceView.Statuses == nil {
+		return false
+	}
+
+	running, provisioned := false, false
+	for _, status := range *vm.InstanceView.Statuses {
+		switch to.String(status.Code) {
+		case "PowerState/running":
+			running = true
+		case "ProvisioningState/succeeded":
+			provisioned = true
+		}
+	}
+
+	healthy := true
+	if health := vm.InstanceView.VMHealth; health != nil && health.Status != nil {
+		healthy = to.String(health.Status.Code) == "HealthState/healthy"
+	}
+
+	return running && provisioned && healthy
+}
+
+// Returns the fewest available instances the scale-in may leave: the
+// original capacity less the --max-unavailable budget, or the
+// --min-healthy floor, whichever is higher.
+func (r *upgradeRun) availabilityFloor() (int64, error) {
+	floor := r.minHealthy
+
+	if r.maxUnavailable != "" {
+		maxUnavailable, err := parseMaxUnavailable(r.maxUnavailable, r.originalCapacity)
+		if err != nil {
+			return 0, err
+		}
+		if r.originalCapacity-maxUnavailable > floor {
+			floor = r.originalCapacity - maxUnavailable
+		}
+	}
+
+	return floor, nil
+}
+
+// Refuses an upgrade whose --min-healthy floor the scale set can't keep:
+// once the old instances are gone it runs at its original capacity, so a
+// higher floor could never be met.
+func (r *upgradeRun) validateAvailabilityFloor(ctx context.Context) error {
+	if r.minHealthy < 0 {
+		return fmt.Errorf("--min-healthy must not be negative, got %d", r.minHealthy)
+	}
+
+	capacity := r.originalCapacity
+	if !r.resuming {
+		scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+		if err != nil {
+			return err
+		}
+		capacity = *scaleSet.Sku.Capacity
+	}
+
+	if r.minHealthy > capacity {
+		return fmt.Errorf("--min-healthy %d can't be kept, %s has a capacity of %d once the upgrade completes", r.minHealthy, r.sess.ScaleSetName, capacity)
+	}
+
+	if r.maxUnavailable != "" {
+		_, err := parseMaxUnavailable(r.maxUnavailable, capacity)
+		return err
+	}
+
+	return nil
+}
+
+// Drains and removes the old instances in batches, each as large as the
+// availability floor allows. Old instances which are already unavailable
+// are removed straight away. When no more can be removed, e.g. because
+// new instances' health checks are flapping, the run waits for instances
+// to recover.
+func (r *upgradeRun) budgetedScaleIn(ctx context.Context) error {
+	minAvailable, err := r.availabilityFloor()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Removing old instances while keeping at least %d of %d available", minAvailable, r.originalCapacity)
+
+	// A shrink records no upgrade state, having no surge to resume
+	if r.strategyName != strategyScaleInOnly {
+		if err = r.recordState(ctx, upgradeStateScalingIn); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err = r.checkExternalChanges(ctx); err != nil {
+			return err
+		}
+
+		// The floor follows the capacity, should an external change have
+		// been reconciled
+		if minAvailable, err = r.availabilityFloor(); err != nil {
+			return err
+		}
+
+		old, err := r.oldInstanceIDs(ctx)
+		if err != nil {
+			return err
+		}
+		if len(old) == 0 {
+			return nil
+		}
+		old = r.leaderLast(ctx, r.rankByLoad(ctx, old))
+
+		available, err := r.sess.getAvailableInstances(ctx)
+		if err != nil {
+			return err
+		}
+
+		allowed := int64(len(available)) - minAvailable
+
+		var batch []string
+		for _, id := range old {
+			switch {
+			case !available[id]:
+				batch = append(batch, id)
+			case allowed > 0:
+				batch = append(batch, id)
+				allowed--
+			}
+		}
+
+		if len(batch) == 0 {
+			log.Infof("Waiting for instances to recover, %d available and at least %d must remain", len(available), minAvailable)
+
+			select {
+			case <-time.After(budgetPollInterval):
+				continue
+			case <-ctx.Done():
+				return fmt.Errorf("disruption budget allowed no further removals: %v", ctx.Err())
+			}
+		}
+
+		if err = r.handOffLeadership(ctx, batch); err != nil {
+			return err
+		}
+
+		err = r.drainInstances(ctx, batch, func(ctx context.Context, ids []string) error {
+			log.Infof("Removing %d old instances: %s", len(ids), strings.Join(ids, ", "))
+			if err := r.sess.deleteInstances(ctx, ids); err != nil {
+				return err
+			}
+			r.expectedCapacity -= int64(len(ids))
+			r.surgeMeter.set(r.expectedCapacity - r.originalCapacity)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
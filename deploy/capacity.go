@@ -0,0 +1,284 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Capacity reservations and host groups postdate the vendored compute
+	// SDK, so these are queried directly against a newer API version.
+	newerComputeAPIVersion = "2021-07-01"
+)
+
+type capacityReservation struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Zones []string `json:"zones"`
+	Sku   struct {
+		Name     string `json:"name"`
+		Capacity int64  `json:"capacity"`
+	} `json:"sku"`
+	Properties struct {
+		VirtualMachinesAssociated []subResource `json:"virtualMachinesAssociated"`
+	} `json:"properties"`
+}
+
+// reservationExpansion records a capacity reservation we grew for the
+// surge window, so it can be shrunk back afterwards.
+type reservationExpansion struct {
+	ID               string
+	OriginalCapacity int64
+}
+
+// Returns the session's Proximity Placement Group client for a subscription
+func (s *azureSession) getProximityPlacementGroupsClient(subscription string) compute.ProximityPlacementGroupsClient {
+	return s.cachedClient("proximityPlacementGroups/"+subscription, func() interface{} {
+		client := compute.NewProximityPlacementGroupsClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.ProximityPlacementGroupsClient)
+}
+
+// Returns the ID of the capacity reservation group referenced by the scale
+// set model, or an empty string if it doesn't use one.
+func (s *azureSession) getCapacityReservationGroupID(ctx context.Context) (string, error) {
+	var scaleSet struct {
+		Properties struct {
+			VirtualMachineProfile struct {
+				CapacityReservation *struct {
+					CapacityReservationGroup *subResource `json:"capacityReservationGroup"`
+				} `json:"capacityReservation"`
+			} `json:"virtualMachineProfile"`
+		} `json:"properties"`
+	}
+
+	if err := s.armGet(ctx, s.scaleSetPath(), newerComputeAPIVersion, &scaleSet); err != nil {
+		return "", err
+	}
+
+	reservation := scaleSet.Properties.VirtualMachineProfile.CapacityReservation
+	if reservation == nil || reservation.CapacityReservationGroup == nil {
+		return "", nil
+	}
+
+	return reservation.CapacityReservationGroup.ID, nil
+}
+
+// Lists the reservations in a capacity reservation group
+func (s *azureSession) getCapacityReservations(ctx context.Context, groupID string) ([]capacityReservation, error) {
+	var reservations []capacityReservation
+
+	query := map[string]interface{}{"api-version": newerComputeAPIVersion}
+	if err := s.armList(ctx, groupID+"/capacityReservations", query, &reservations); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// Returns whether a reservation can satisfy allocations in the given zone.
+// An empty zone denotes a regional (non-zonal) scale set.
+func (r capacityReservation) servesZone(zone string) bool {
+	if zone == "" {
+		return len(r.Zones) == 0
+	}
+	for _, z := range r.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits the surge evenly across the scale set's zones, as the platform
+// balances new instances between them.
+func surgePerZone(scaleSet compute.VirtualMachineScaleSet, surge int64) map[string]int64 {
+	if scaleSet.Zones == nil || len(*scaleSet.Zones) == 0 {
+		return map[string]int64{"": surge}
+	}
+
+	zones := *scaleSet.Zones
+	perZone := int64(math.Ceil(float64(surge) / float64(len(zones))))
+
+	demand := map[string]int64{}
+	for _, zone := range zones {
+		demand[zone] = perZone
+	}
+	return demand
+}
+
+// Checks that the capacity reservation group attached to the scale set has
+// enough unused reservations of the scale set's VM size to absorb a surge
+// of 'surge' instances. When 'expand' is set, any shortfall is added to the
+// reservations and returned so they can be restored once the upgrade
+// finishes; otherwise a shortfall is only logged, as allocations above the
+// reserved quantity still succeed, just without the capacity guarantee.
+// Reservations expanded before failing are restored again.
+func (s *azureSession) preflightCapacityReservation(ctx context.Context, expand bool, surge int64) ([]reservationExpansion, error) {
+	expansions, err := s.expandCapacityReservations(ctx, expand, surge)
+	if err != nil && len(expansions) > 0 {
+		// The run's context may be why expanding failed
+		restoreCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+
+		failed, restoreErr := s.restoreCapacityReservations(restoreCtx, expansions)
+		if restoreErr != nil {
+			log.Errorf("Unable to restore the capacity reservations expanded before failing: %v", restoreErr)
+		}
+		return failed, err
+	}
+
+	return expansions, err
+}
+
+// Expands the reservations of the scale set's capacity reservation group,
+// if any, by the surge's shortfall, returning those expanded even on
+// failure
+func (s *azureSession) expandCapacityReservations(ctx context.Context, expand bool, surge int64) ([]reservationExpansion, error) {
+	var expansions []reservationExpansion
+
+	groupID, err := s.getCapacityReservationGroupID(ctx)
+	if err != nil || groupID == "" {
+		return expansions, err
+	}
+
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return expansions, err
+	}
+
+	reservations, err := s.getCapacityReservations(ctx, groupID)
+	if err != nil {
+		return expansions, err
+	}
+
+	vmSize := to.String(scaleSet.Sku.Name)
+
+	for zone, demand := range surgePerZone(scaleSet, surge) {
+		var candidate *capacityReservation
+		var free int64
+
+		for i, reservation := range reservations {
+			if !strings.EqualFold(reservation.Sku.Name, vmSize) || !reservation.servesZone(zone) {
+				continue
+			}
+			if candidate == nil {
+				candidate = &reservations[i]
+			}
+			if unused := reservation.Sku.Capacity - int64(len(reservation.Properties.VirtualMachinesAssociated)); unused > 0 {
+				free += unused
+			}
+		}
+
+		shortfall := demand - free
+		if shortfall <= 0 {
+			log.Infof("Capacity reservation group has room for %d %s instances in zone %q", demand, vmSize, zone)
+			continue
+		}
+
+		if !expand || candidate == nil {
+			log.Warnf("Capacity reservation group %s is %d %s instances short of the surge in zone %q, surge instances may not be guaranteed capacity", groupID, shortfall, vmSize, zone)
+			continue
+		}
+
+		// Tracked before it's expanded, as a failed update may still apply
+		log.Infof("Expanding capacity reservation %s by %d instances for the surge...", candidate.Name, shortfall)
+		expansions = append(expansions, reservationExpansion{ID: candidate.ID, OriginalCapacity: candidate.Sku.Capacity})
+		if err = s.setReservationCapacity(ctx, candidate.ID, candidate.Sku.Capacity+shortfall); err != nil {
+			return expansions, err
+		}
+	}
+
+	return expansions, nil
+}
+
+// Updates the reserved quantity of a capacity reservation
+func (s *azureSession) setReservationCapacity(ctx context.Context, reservationID string, capacity int64) error {
+	body := map[string]interface{}{
+		"sku": map[string]interface{}{"capacity": capacity},
+	}
+
+	return s.armDoAsync(ctx, http.MethodPatch, reservationID, newerComputeAPIVersion, body, nil)
+}
+
+// Shrinks any reservations expanded for the surge back to their original
+// size. Every reservation is attempted even if an earlier one fails, and
+// those which couldn't be restored are returned along with the errors.
+func (s *azureSession) restoreCapacityReservations(ctx context.Context, expansions []reservationExpansion) ([]reservationExpansion, error) {
+	var failed []reservationExpansion
+	var errs []string
+
+	for _, expansion := range expansions {
+		log.Infof("Restoring capacity reservation %s to %d instances...", expansion.ID, expansion.OriginalCapacity)
+		if err := s.setReservationCapacity(ctx, expansion.ID, expansion.OriginalCapacity); err != nil {
+			failed = append(failed, expansion)
+			errs = append(errs, fmt.Sprintf("%s: %v", expansion.ID, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return failed, fmt.Errorf("unable to restore capacity reservations, shrink them manually: %s", strings.Join(errs, "; "))
+	}
+
+	return nil, nil
+}
+
+// Inspects the proximity placement group the scale set is pinned to, if
+// any. A surge into a PPG must be co-located with every existing member,
+// which makes allocation failures far more likely, so surface its current
+// co-location status and membership ahead of time.
+func (s *azureSession) preflightProximityPlacementGroup(ctx context.Context) error {
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	if scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.ProximityPlacementGroup == nil {
+		return nil
+	}
+
+	resource, err := azure.ParseResourceID(to.String(scaleSet.ProximityPlacementGroup.ID))
+	if err != nil {
+		return err
+	}
+
+	ppgClient := s.getProximityPlacementGroupsClient(resource.SubscriptionID)
+	ppg, err := ppgClient.Get(ctx, resource.ResourceGroup, resource.ResourceName, "true")
+	if err != nil {
+		return err
+	}
+
+	members := 0
+	if ppg.ProximityPlacementGroupProperties != nil {
+		if ppg.VirtualMachines != nil {
+			members += len(*ppg.VirtualMachines)
+		}
+		if ppg.VirtualMachineScaleSets != nil {
+			members += len(*ppg.VirtualMachineScaleSets)
+		}
+		if ppg.AvailabilitySets != nil {
+			members += len(*ppg.AvailabilitySets)
+		}
+
+		if ppg.ColocationStatus != nil && !strings.HasSuffix(to.String(ppg.ColocationStatus.Code), "/Aligned") {
+			return fmt.Errorf("proximity placement group %s is not aligned (%s), resolve this before surging: %s",
+				resource.ResourceName, to.String(ppg.ColocationStatus.DisplayStatus), to.String(ppg.ColocationStatus.Message))
+		}
+	}
+
+	log.Warnf("Scale set is pinned to proximity placement group %s with %d members, surge instances must be allocated alongside them", resource.ResourceName, members)
+	return nil
+}
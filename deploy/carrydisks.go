@@ -0,0 +1,316 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Tags recording where a snapshot or carried disk came from
+	sourceInstanceTag = "azure-cluster-upgrade-source-instance"
+	sourceLunTag      = "azure-cluster-upgrade-source-lun"
+
+	// Managed disks and snapshots are versioned apart from the rest of
+	// the compute RP
+	disksAPIVersion = "2021-08-01"
+)
+
+// Checks a --carry-disks value: 'all', or a list of instance IDs
+func validateCarryDisks(value string) error {
+	if value == "all" {
+		return nil
+	}
+	for _, id := range strings.Split(value, ",") {
+		if _, err := strconv.ParseUint(strings.TrimSpace(id), 10, 64); err != nil {
+			return fmt.Errorf("%s is not 'all' or a list of instance IDs", value)
+		}
+	}
+	return nil
+}
+
+// Returns the old instances whose data disks are carried to their
+// replacements, per --carry-disks
+func (r *upgradeRun) carriedInstances(ctx context.Context) ([]string, error) {
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value := r.cmd.Flags().Lookup("carry-disks").Value.String()
+	if value == "all" {
+		return old, nil
+	}
+
+	isOld := map[string]bool{}
+	for _, id := range old {
+		isOld[id] = true
+	}
+
+	var carried []string
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if !isOld[id] {
+			return nil, fmt.Errorf("instance %s given to --carry-disks isn't an old instance of %s", id, r.sess.ScaleSetName)
+		}
+		carried = append(carried, id)
+	}
+
+	return carried, nil
+}
+
+// Returns the instances created by the surge, oldest first
+func (r *upgradeRun) surgedInstances(ctx context.Context) ([]string, error) {
+	original := map[string]bool{}
+	for _, id := range r.originalInstances {
+		original[id] = true
+	}
+
+	current, err := r.sess.getInstanceIDs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var surged []string
+	for _, id := range current {
+		if !original[id] {
+			surged = append(surged, id)
+		}
+	}
+	sort.Slice(surged, func(i, j int) bool {
+		a, _ := strconv.Atoi(surged[i])
+		b, _ := strconv.Atoi(surged[j])
+		return a < b
+	})
+
+	return surged, nil
+}
+
+// Returns the managed data disks of an instance, by LUN
+func instanceDataDisks(vm compute.VirtualMachineScaleSetVM) map[int32]compute.DataDisk {
+	disks := map[int32]compute.DataDisk{}
+	if vm.VirtualMachineScaleSetVMProperties == nil || vm.StorageProfile == nil || vm.StorageProfile.DataDisks == nil {
+		return disks
+	}
+
+	for _, disk := range *vm.StorageProfile.DataDisks {
+		if disk.Lun != nil && disk.ManagedDisk != nil && disk.ManagedDisk.ID != nil {
+			disks[*disk.Lun] = disk
+		}
+	}
+	return disks
+}
+
+// Snapshots a managed disk, returning the snapshot's ID. The snapshot is
+// tagged with the run and the instance and LUN the disk was attached at.
+func (s *azureSession) snapshotDisk(ctx context.Context, diskID string, location string, name string, tags map[string]string) (string, error) {
+	id := fmt.Sprintf("%s/providers/Microsoft.Compute/snapshots/%s", s.resourceGroupPath(), name)
+	body := map[string]interface{}{
+		"location": location,
+		"tags":     tags,
+		"properties": map[string]interface{}{
+			"incremental":  true,
+			"creationData": map[string]interface{}{"createOption": "Copy", "sourceResourceId": diskID},
+		},
+	}
+
+	if err := s.armDoAsync(ctx, http.MethodPut, id, disksAPIVersion, body, nil); err != nil {
+		return "", fmt.Errorf("unable to snapshot disk %s: %v", diskID, err)
+	}
+	return id, nil
+}
+
+// Creates a managed disk from a snapshot in the given zone, if any,
+// returning the disk's ID
+func (s *azureSession) diskFromSnapshot(ctx context.Context, snapshotID string, location string, zones *[]string, sku string, name string, tags map[string]string) (string, error) {
+	id := fmt.Sprintf("%s/providers/Microsoft.Compute/disks/%s", s.resourceGroupPath(), name)
+	body := map[string]interface{}{
+		"location": location,
+		"tags":     tags,
+		"properties": map[string]interface{}{
+			"creationData": map[string]interface{}{"createOption": "Copy", "sourceResourceId": snapshotID},
+		},
+	}
+	if zones != nil && len(*zones) > 0 {
+		body["zones"] = *zones
+	}
+	if sku != "" {
+		body["sku"] = map[string]string{"name": sku}
+	}
+
+	if err := s.armDoAsync(ctx, http.MethodPut, id, disksAPIVersion, body, nil); err != nil {
+		return "", fmt.Errorf("unable to create disk from snapshot %s: %v", snapshotID, err)
+	}
+	return id, nil
+}
+
+// Copies each data disk of an old instance onto its replacement, at the
+// same LUN, in place of the empty disk the replacement got from the model.
+// The replaced disks are deleted, being new and empty.
+func (r *upgradeRun) carryDisks(ctx context.Context, location string, oldID string, newID string) error {
+	client := r.sess.getVMSSVMClient()
+
+	old, err := client.Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, oldID)
+	if err != nil {
+		return err
+	}
+	replacement, err := client.Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, newID)
+	if err != nil {
+		return err
+	}
+
+	oldDisks := instanceDataDisks(old)
+	if len(oldDisks) == 0 {
+		log.Infof("Instance %s has no data disks to carry", oldID)
+		return nil
+	}
+	if replacement.StorageProfile == nil {
+		replacement.StorageProfile = &compute.StorageProfile{}
+	}
+
+	var disks []compute.DataDisk
+	if replacement.StorageProfile.DataDisks != nil {
+		disks = *replacement.StorageProfile.DataDisks
+	}
+
+	var emptied []string
+	for lun, disk := range oldDisks {
+		tags := map[string]string{upgradeRunIDTag: r.runID, sourceInstanceTag: to.String(old.Name), sourceLunTag: strconv.Itoa(int(lun))}
+		name := fmt.Sprintf("%s-%s-lun%d-%s", r.sess.ScaleSetName, oldID, lun, r.runID[:8])
+
+		log.Infof("Carrying data disk at LUN %d of instance %s to instance %s...", lun, oldID, newID)
+		snapshotID, err := r.sess.snapshotDisk(ctx, to.String(disk.ManagedDisk.ID), location, name, tags)
+		if err != nil {
+			return err
+		}
+
+		sku := string(disk.ManagedDisk.StorageAccountType)
+		diskID, err := r.sess.diskFromSnapshot(ctx, snapshotID, location, replacement.Zones, sku, name, tags)
+		if err != nil {
+			return err
+		}
+
+		carried := compute.DataDisk{
+			Lun:          to.Int32Ptr(lun),
+			Caching:      disk.Caching,
+			CreateOption: compute.DiskCreateOptionTypesAttach,
+			ManagedDisk:  &compute.ManagedDiskParameters{ID: to.StringPtr(diskID)},
+		}
+
+		replaced := false
+		for i := range disks {
+			if disks[i].Lun != nil && *disks[i].Lun == lun {
+				if disks[i].ManagedDisk != nil && disks[i].ManagedDisk.ID != nil {
+					emptied = append(emptied, *disks[i].ManagedDisk.ID)
+				}
+				disks[i], replaced = carried, true
+			}
+		}
+		if !replaced {
+			disks = append(disks, carried)
+		}
+	}
+
+	replacement.StorageProfile.DataDisks = &disks
+	future, err := client.Update(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, newID, replacement)
+	if err != nil {
+		return err
+	}
+	if err = future.Wait(ctx); err != nil {
+		return fmt.Errorf("unable to attach carried disks to instance %s: %v", newID, err)
+	}
+
+	for _, diskID := range emptied {
+		if err = r.sess.armDoAsync(ctx, http.MethodDelete, diskID, disksAPIVersion, nil, nil); err != nil {
+			log.Warnf("Unable to delete disk %s replaced by a carried disk, delete it manually: %v", diskID, err)
+		}
+	}
+
+	return nil
+}
+
+// Checks the data disks of the instances given by --carry-disks can be
+// carried: the instances must exist, still be told apart from the new
+// ones, and be removed together rather than a batch at a time
+func (r *upgradeRun) checkCarryDisks(ctx context.Context) error {
+	value := r.cmd.Flags().Lookup("carry-disks").Value.String()
+	if value == "" {
+		return nil
+	}
+
+	steps, _ := r.cmd.Flags().GetInt("warm-up-steps")
+	switch {
+	case r.resuming:
+		return fmt.Errorf("--carry-disks can't be used when resuming an upgrade, since its new instances can't be told apart from the old ones")
+	case r.maxUnavailable != "" || r.minHealthy != 0 || r.retiring != nil || steps > 1:
+		return fmt.Errorf("--carry-disks removes old instances together, so can't be used with a disruption budget, availability floor, warm-up or recycle")
+	}
+
+	if value == "all" {
+		return nil
+	}
+
+	current, err := r.sess.getInstanceIDs(ctx, "")
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, id := range current {
+		exists[id] = true
+	}
+
+	for _, id := range strings.Split(value, ",") {
+		if id = strings.TrimSpace(id); !exists[id] {
+			return fmt.Errorf("instance %s given to --carry-disks isn't an instance of %s", id, r.sess.ScaleSetName)
+		}
+	}
+
+	return nil
+}
+
+// Carries the data disks of the instances given by --carry-disks to the
+// new instances, one each, once they're drained, so data of a
+// semi-stateful role follows it onto the new model. Each disk is
+// snapshotted, and a disk created from the snapshot attached to the
+// replacement at the same LUN. Instances' NICs and IPs can't be moved
+// within a scale set, so only their data follows them.
+func (r *upgradeRun) carryDataDisks(ctx context.Context) error {
+	if r.cmd.Flags().Lookup("carry-disks").Value.String() == "" {
+		return nil
+	}
+
+	carried, err := r.carriedInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	surged, err := r.surgedInstances(ctx)
+	if err != nil {
+		return err
+	}
+	if len(surged) < len(carried) {
+		return fmt.Errorf("%d instances have disks to carry but only %d new instances were created", len(carried), len(surged))
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	location := to.String(scaleSet.Location)
+
+	for i, oldID := range carried {
+		if err = r.carryDisks(ctx, location, oldID, surged[i]); err != nil {
+			return err
+		}
+		log.Infof("Instance %s now has the data disks of instance %s", surged[i], oldID)
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package deploy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Linux agents place certificates here, named by upper-case thumbprint
+const linuxCertificateDir = "/var/lib/waagent"
+
+// keyVaultObject identifies a version of a Key Vault secret or certificate
+type keyVaultObject struct {
+	Vault   string
+	Name    string
+	Version string
+}
+
+// Parses a versioned Key Vault secret URL, as referenced by the scale set
+// model, of the form https://<vault>.vault.azure.net/secrets/<name>/<version>
+func parseSecretURL(secretURL string) (keyVaultObject, error) {
+	parsed, err := url.Parse(secretURL)
+	if err != nil || parsed.Scheme != "https" {
+		return keyVaultObject{}, fmt.Errorf("%s is not a Key Vault secret URL", secretURL)
+	}
+
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "secrets" {
+		return keyVaultObject{}, fmt.Errorf("%s is not a versioned Key Vault secret URL of the form https://<vault>.vault.azure.net/secrets/<name>/<version>", secretURL)
+	}
+
+	return keyVaultObject{Vault: strings.ToLower(parsed.Host), Name: parts[1], Version: parts[2]}, nil
+}
+
+// Returns a copy of the model's certificate references with each one
+// naming the same vault and secret as a new URL pointed at the new URL's
+// version. Every new URL must replace a certificate already in the model.
+func rotateCertificates(groups []compute.VaultSecretGroup, newURLs []string) ([]compute.VaultSecretGroup, error) {
+	rotated := make([]compute.VaultSecretGroup, len(groups))
+
+	for i, group := range groups {
+		rotated[i] = group
+		if group.VaultCertificates == nil {
+			continue
+		}
+		certs := append([]compute.VaultCertificate(nil), *group.VaultCertificates...)
+		rotated[i].VaultCertificates = &certs
+	}
+
+	for _, newURL := range newURLs {
+		target, err := parseSecretURL(newURL)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for _, group := range rotated {
+			if group.VaultCertificates == nil {
+				continue
+			}
+			for j, cert := range *group.VaultCertificates {
+				current, err := parseSecretURL(to.String(cert.CertificateURL))
+				if err != nil || current.Vault != target.Vault || !strings.EqualFold(current.Name, target.Name) {
+					continue
+				}
+				(*group.VaultCertificates)[j].CertificateURL = to.StringPtr(newURL)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("the scale set model has no certificate from secret %s in %s to rotate; add it to the model first", target.Name, target.Vault)
+		}
+	}
+
+	return rotated, nil
+}
+
+// Returns the certificate references in the scale set model
+func modelCertificates(scaleSet compute.VirtualMachineScaleSet) []compute.VaultSecretGroup {
+	if scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.VirtualMachineProfile == nil ||
+		scaleSet.VirtualMachineProfile.OsProfile == nil || scaleSet.VirtualMachineProfile.OsProfile.Secrets == nil {
+		return nil
+	}
+	return *scaleSet.VirtualMachineProfile.OsProfile.Secrets
+}
+
+// Points the scale set model's certificate references at new versions
+func (s *azureSession) setModelCertificates(ctx context.Context, groups []compute.VaultSecretGroup) error {
+	return s.updateModel(ctx, compute.VirtualMachineScaleSetUpdate{
+		VirtualMachineScaleSetUpdateProperties: &compute.VirtualMachineScaleSetUpdateProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetUpdateVMProfile{
+				OsProfile: &compute.VirtualMachineScaleSetUpdateOSProfile{
+					Secrets: &groups,
+				},
+			},
+		},
+	})
+}
+
+// Looks up the upper-case hex thumbprint of a certificate version, as the
+// agent names it on instances. Only the certificate's public part is read.
+func getCertificateThumbprint(ctx context.Context, secretURL string) (string, error) {
+	object, err := parseSecretURL(secretURL)
+	if err != nil {
+		return "", err
+	}
+
+	var certificate struct {
+		X5t string `json:"x5t"`
+	}
+	certificateURL := fmt.Sprintf("https://%s/certificates/%s/%s", object.Vault, object.Name, object.Version)
+	if err = keyVaultGet(ctx, certificateURL, "/certificates/", &certificate); err != nil {
+		return "", err
+	}
+
+	thumbprint, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(certificate.X5t, "="))
+	if err != nil {
+		return "", fmt.Errorf("unable to decode thumbprint of certificate %s: %v", object.Name, err)
+	}
+
+	return strings.ToUpper(hex.EncodeToString(thumbprint)), nil
+}
+
+// Returns a phase which points the scale set model's certificate
+// references at new versions, checking beforehand that each one replaces
+// a certificate in the model and is readable. Rolling back restores the
+// previous versions.
+func (s *azureSession) certificateStep(newURLs []string) phase.Step {
+	var previous []compute.VaultSecretGroup
+
+	return &phase.Func{
+		StepName: "certificates",
+		ValidateFunc: func(ctx context.Context) error {
+			scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			if _, err = rotateCertificates(modelCertificates(scaleSet), newURLs); err != nil {
+				return err
+			}
+
+			for _, newURL := range newURLs {
+				if _, err = getCertificateThumbprint(ctx, newURL); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+		ExecuteFunc: func(ctx context.Context) error {
+			scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			current := modelCertificates(scaleSet)
+			rotated, err := rotateCertificates(current, newURLs)
+			if err != nil {
+				return err
+			}
+
+			log.Infof("Updating scale set model to certificates %s...", strings.Join(newURLs, ", "))
+			if err = s.setModelCertificates(ctx, rotated); err != nil {
+				return err
+			}
+			previous = current
+
+			return nil
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			if previous == nil {
+				return nil
+			}
+
+			log.Info("Restoring previous certificate versions")
+			return s.setModelCertificates(ctx, previous)
+		},
+	}
+}
+
+// Builds a script printing 'MISSING <thumbprint>' for each certificate
+// absent from an instance. Windows certificates are looked for in the
+// LocalMachine store the model names, Linux ones where the agent puts them.
+func certificateCheckScript(commandID string, stores map[string]string) []string {
+	thumbprints := make([]string, 0, len(stores))
+	for thumbprint := range stores {
+		thumbprints = append(thumbprints, thumbprint)
+	}
+	sort.Strings(thumbprints)
+
+	var script []string
+	for _, thumbprint := range thumbprints {
+		if commandID == windowsRunCommandID {
+			script = append(script, fmt.Sprintf(`if (-not (Test-Path 'Cert:\LocalMachine\%s\%s')) { Write-Output 'MISSING %s' }`, stores[thumbprint], thumbprint, thumbprint))
+		} else {
+			script = append(script, fmt.Sprintf("[ -f %s/%s.crt ] || echo 'MISSING %s'", linuxCertificateDir, thumbprint, thumbprint))
+		}
+	}
+
+	return script
+}
+
+// Confirms every new instance received the certificates the run rotated
+// onto, before the instances holding the old ones are removed
+func (r *upgradeRun) verifyCertificates(ctx context.Context) error {
+	newURLs, err := r.cmd.Flags().GetStringArray("certificate-url")
+	if err != nil || len(newURLs) == 0 {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	storesByURL := map[string]string{}
+	for _, group := range modelCertificates(scaleSet) {
+		if group.VaultCertificates == nil {
+			continue
+		}
+		for _, cert := range *group.VaultCertificates {
+			storesByURL[strings.ToLower(to.String(cert.CertificateURL))] = to.String(cert.CertificateStore)
+		}
+	}
+
+	stores := map[string]string{}
+	for _, newURL := range newURLs {
+		thumbprint, err := getCertificateThumbprint(ctx, newURL)
+		if err != nil {
+			return err
+		}
+		store := storesByURL[strings.ToLower(newURL)]
+		if store == "" {
+			store = "My"
+		}
+		stores[thumbprint] = store
+	}
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	log.Infof("Checking new instances received %d rotated certificates...", len(stores))
+	results, err := r.sess.runCommandOnInstances(ctx, "properties/latestModelApplied eq true", certificateCheckScript(commandID, stores), timeout)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+		return err
+	}
+
+	var missing []string
+	for _, result := range results {
+		for _, line := range strings.Split(result.Stdout, "\n") {
+			if thumbprint := strings.TrimPrefix(strings.TrimSpace(line), "MISSING "); thumbprint != strings.TrimSpace(line) {
+				missing = append(missing, fmt.Sprintf("%s lacks %s", result.InstanceID, thumbprint))
+			}
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) > 0 {
+		return fmt.Errorf("new instances did not receive the rotated certificates: %s", strings.Join(missing, ", "))
+	}
+
+	log.Info("Every new instance holds the rotated certificates")
+	return nil
+}
+
+// RunCertificates points the scale set model's Key Vault certificate
+// references at new versions and executes the upgrade operation, so the
+// new instances receive the new certificates and the instances holding
+// the old ones are retired
+func RunCertificates(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Certificate Rotation")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	newURLs, err := cmd.Flags().GetStringArray("certificate-url")
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	scaleSet, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Once the model references the new versions, this is a plain upgrade
+	// (or a re-run of one which may already be complete)
+	current := map[string]bool{}
+	for _, group := range modelCertificates(scaleSet) {
+		if group.VaultCertificates == nil {
+			continue
+		}
+		for _, cert := range *group.VaultCertificates {
+			current[strings.ToLower(to.String(cert.CertificateURL))] = true
+		}
+	}
+
+	applied := true
+	for _, newURL := range newURLs {
+		applied = applied && current[strings.ToLower(newURL)]
+	}
+	if applied {
+		log.Info("Scale set model already references the certificates")
+		sess.upgrade(ctx, cmd)
+		return
+	}
+
+	sess.upgrade(ctx, cmd, sess.certificateStep(newURLs))
+}
@@ -0,0 +1,302 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ServiceNow change request states and close codes
+const (
+	serviceNowStateImplement = "-1"
+	serviceNowStateClosed    = "3"
+	serviceNowSuccessful     = "successful"
+	serviceNowUnsuccessful   = "unsuccessful"
+)
+
+// changeSpec describes the change management system each upgrade is
+// recorded in. It is read from the 'changeManagement' key of the config
+// file.
+type changeSpec struct {
+	// One of 'serviceNow' or 'webhook'
+	Type string `mapstructure:"type"`
+
+	ServiceNow struct {
+		// Instance URL, e.g. https://example.service-now.com
+		Instance string `mapstructure:"instance"`
+		Username string `mapstructure:"username"`
+		// Password reference, see resolveSecret
+		Password string `mapstructure:"password"`
+		// Further fields set on the change request, e.g. assignment_group
+		Fields map[string]string `mapstructure:"fields"`
+	} `mapstructure:"serviceNow"`
+
+	Webhook struct {
+		// Endpoint receiving {"action": "open"|"update"|"close", ...} and
+		// answering an open with {"id": "<change ID>"}
+		URL string `mapstructure:"url"`
+		// Bearer token reference, see resolveSecret
+		Token string `mapstructure:"token"`
+	} `mapstructure:"webhook"`
+}
+
+// changePlan is what a change record is opened with
+type changePlan struct {
+	ResourceGroup string   `json:"resourceGroup"`
+	ScaleSet      string   `json:"scaleSet"`
+	Capacity      int64    `json:"capacity"`
+	SurgeSize     int64    `json:"surgeSize"`
+	Phases        []string `json:"phases"`
+	RunID         string   `json:"runID"`
+}
+
+func (p changePlan) String() string {
+	return fmt.Sprintf("Blue/green upgrade of scale set %s/%s: capacity %d, surging by %d\nPhases: %s\nRun ID: %s",
+		p.ResourceGroup, p.ScaleSet, p.Capacity, p.SurgeSize, strings.Join(p.Phases, ", "), p.RunID)
+}
+
+// changeRecorder keeps a change record up to date as an upgrade runs
+type changeRecorder interface {
+	// Opens a change record for the plan, returning its ID
+	open(ctx context.Context, plan changePlan) (string, error)
+	update(ctx context.Context, id string, note string) error
+	close(ctx context.Context, id string, succeeded bool, report string) error
+}
+
+type serviceNowRecorder struct {
+	instance string
+	username string
+	password secret
+	fields   map[string]string
+}
+
+type webhookChangeRecorder struct {
+	url   string
+	token secret
+}
+
+// Reads the change management spec from the config file. Returns nil when
+// upgrades aren't recorded.
+func loadChangeSpec() (*changeSpec, error) {
+	if !viper.IsSet("changeManagement") {
+		return nil, nil
+	}
+
+	spec := &changeSpec{}
+	if err := viper.UnmarshalKey("changeManagement", spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Builds the recorder described by the spec, resolving its credentials
+func newChangeRecorder(ctx context.Context, spec *changeSpec) (changeRecorder, error) {
+	switch spec.Type {
+	case "serviceNow":
+		password, err := resolveSecret(ctx, spec.ServiceNow.Password)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve ServiceNow password: %v", err)
+		}
+		return &serviceNowRecorder{
+			instance: strings.TrimRight(spec.ServiceNow.Instance, "/"),
+			username: spec.ServiceNow.Username,
+			password: password,
+			fields:   spec.ServiceNow.Fields,
+		}, nil
+	case "webhook":
+		token, err := resolveSecret(ctx, spec.Webhook.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve change webhook token: %v", err)
+		}
+		return &webhookChangeRecorder{url: spec.Webhook.URL, token: token}, nil
+	default:
+		return nil, fmt.Errorf("unknown change management type %q", spec.Type)
+	}
+}
+
+// Sends a request with a JSON body, if any, decoding any JSON response
+// into result
+func sendJSONRequest(ctx context.Context, method string, url string, body interface{}, result interface{}, decorators ...autorest.PrepareDecorator) error {
+	prepare := []autorest.PrepareDecorator{
+		autorest.WithMethod(method),
+		autorest.WithBaseURL(url),
+		autorest.WithHeader("Accept", "application/json"),
+	}
+	if body != nil {
+		prepare = append(prepare, autorest.WithJSON(body))
+	}
+	decorators = append(prepare, decorators...)
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return err
+	}
+
+	resp, err := autorest.SendWithSender(autorest.NewClientWithUserAgent(userAgent), req)
+	if err != nil {
+		return err
+	}
+
+	responders := []autorest.RespondDecorator{autorest.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent)}
+	if result != nil {
+		responders = append(responders, autorest.ByUnmarshallingJSON(result))
+	}
+
+	return autorest.Respond(resp, append(responders, autorest.ByClosing())...)
+}
+
+func (r *serviceNowRecorder) auth() autorest.PrepareDecorator {
+	return autorest.NewBasicAuthorizer(r.username, r.password.reveal()).WithAuthorization()
+}
+
+// Opens a change request through the Table API, in the Implement state
+// since the upgrade is starting
+func (r *serviceNowRecorder) open(ctx context.Context, plan changePlan) (string, error) {
+	var result struct {
+		Result struct {
+			SysID  string `json:"sys_id"`
+			Number string `json:"number"`
+		} `json:"result"`
+	}
+
+	fields := map[string]string{
+		"short_description": fmt.Sprintf("Blue/green upgrade of %s/%s", plan.ResourceGroup, plan.ScaleSet),
+		"description":       plan.String(),
+		"state":             serviceNowStateImplement,
+		"correlation_id":    plan.RunID,
+	}
+	for name, value := range r.fields {
+		fields[name] = value
+	}
+
+	if err := sendJSONRequest(ctx, http.MethodPost, r.instance+"/api/now/table/change_request", fields, &result, r.auth()); err != nil {
+		return "", err
+	}
+
+	log.Infof("Opened ServiceNow change request %s", result.Result.Number)
+	return result.Result.SysID, nil
+}
+
+func (r *serviceNowRecorder) update(ctx context.Context, id string, note string) error {
+	return sendJSONRequest(ctx, http.MethodPatch, r.instance+"/api/now/table/change_request/"+id,
+		map[string]string{"work_notes": note}, nil, r.auth())
+}
+
+func (r *serviceNowRecorder) close(ctx context.Context, id string, succeeded bool, report string) error {
+	code := serviceNowSuccessful
+	if !succeeded {
+		code = serviceNowUnsuccessful
+	}
+
+	return sendJSONRequest(ctx, http.MethodPatch, r.instance+"/api/now/table/change_request/"+id,
+		map[string]string{"state": serviceNowStateClosed, "close_code": code, "close_notes": report}, nil, r.auth())
+}
+
+func (r *webhookChangeRecorder) send(ctx context.Context, body map[string]interface{}, result interface{}) error {
+	var decorators []autorest.PrepareDecorator
+	if r.token != "" {
+		decorators = append(decorators, autorest.WithBearerAuthorization(r.token.reveal()))
+	}
+	return sendJSONRequest(ctx, http.MethodPost, r.url, body, result, decorators...)
+}
+
+func (r *webhookChangeRecorder) open(ctx context.Context, plan changePlan) (string, error) {
+	var result struct {
+		ID string `json:"id"`
+	}
+
+	if err := r.send(ctx, map[string]interface{}{"action": "open", "plan": plan}, &result); err != nil {
+		return "", err
+	}
+	if result.ID == "" {
+		return "", fmt.Errorf("change webhook %s returned no change ID", r.url)
+	}
+
+	log.Infof("Opened change %s", result.ID)
+	return result.ID, nil
+}
+
+func (r *webhookChangeRecorder) update(ctx context.Context, id string, note string) error {
+	return r.send(ctx, map[string]interface{}{"action": "update", "id": id, "note": note}, nil)
+}
+
+func (r *webhookChangeRecorder) close(ctx context.Context, id string, succeeded bool, report string) error {
+	return r.send(ctx, map[string]interface{}{"action": "close", "id": id, "succeeded": succeeded, "report": report}, nil)
+}
+
+// Opens the run's change record, if upgrades are recorded. Unlike updates
+// to it, failing to open one fails the upgrade before anything changes,
+// since the change would otherwise go unrecorded.
+func (r *upgradeRun) openChange(ctx context.Context) error {
+	if r.changes == nil {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	plan := changePlan{
+		ResourceGroup: r.sess.ResourceGroupName,
+		ScaleSet:      r.sess.ScaleSetName,
+		Capacity:      *scaleSet.Sku.Capacity,
+		SurgeSize:     r.surgeSize,
+		Phases:        r.phaseNames,
+		RunID:         r.runID,
+	}
+	if r.resuming {
+		plan.Capacity = r.originalCapacity
+	}
+
+	if r.changeID, err = r.changes.open(ctx, plan); err != nil {
+		return fmt.Errorf("unable to open change record: %v", err)
+	}
+
+	return nil
+}
+
+// Notes a phase transition on the run's change record
+func (r *upgradeRun) updateChange(ctx context.Context, note string) {
+	if r.changeID == "" {
+		return
+	}
+
+	if err := r.changes.update(ctx, r.changeID, note); err != nil {
+		log.Warnf("Unable to update change record %s: %v", r.changeID, err)
+	}
+}
+
+// Closes the run's change record with its outcome
+func (r *upgradeRun) closeChange(ctx context.Context, runErr error) {
+	if r.changeID == "" {
+		return
+	}
+
+	report := fmt.Sprintf("Upgrade of %s completed, surged by %d from a capacity of %d", r.sess.ScaleSetName, r.surgeSize, r.originalCapacity)
+	if runErr != nil {
+		report = fmt.Sprintf("Upgrade of %s failed: %v", r.sess.ScaleSetName, runErr)
+	}
+	if len(r.recoveryPoints) > 0 {
+		report += fmt.Sprintf("\nRecovery points of replaced instances: %s", strings.Join(r.recoveryPoints, ", "))
+	}
+	for _, row := range r.patchReport() {
+		report += fmt.Sprintf("\nPatch level %s: %s -> %s", row[0], row[1], row[2])
+	}
+	if r.cost != nil {
+		report += "\n" + r.cost.String()
+	}
+	if len(r.orphans) > 0 {
+		report += fmt.Sprintf("\n%s %s", r.orphansSummary(), strings.Join(r.orphans, ", "))
+	}
+
+	if err := r.changes.close(ctx, r.changeID, runErr == nil, report); err != nil {
+		log.Warnf("Unable to close change record %s: %v", r.changeID, err)
+	}
+}
@@ -0,0 +1,81 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns the names of the scale sets which completed an upgrade since
+// 'since', by their last upgrade tag, or have one in progress. Only the
+// last upgrade of each scale set is recorded, so a scale set upgraded
+// twice within the window counts once.
+func recentUpgrades(scaleSets []compute.VirtualMachineScaleSet, selector map[string]string, since time.Time) []string {
+	var names []string
+
+	for _, scaleSet := range scaleSets {
+		if !matchesSelector(scaleSet.Tags, selector) {
+			continue
+		}
+
+		if to.String(scaleSet.Tags[upgradeStateTag]) != "" {
+			names = append(names, to.String(scaleSet.Name))
+			continue
+		}
+
+		last, err := time.Parse(time.RFC3339, to.String(scaleSet.Tags[lastUpgradeTag]))
+		if err == nil && last.After(since) {
+			names = append(names, to.String(scaleSet.Name))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Refuses to start an upgrade once --max-recent-upgrades scale sets of the
+// fleet were upgraded within --recent-upgrade-window, so runaway automation
+// can't churn every cluster at once. The fleet is the subscription's scale
+// sets matching --selector, or all of them. --override starts it anyway.
+func (r *upgradeRun) checkChangeRate(ctx context.Context) error {
+	limit, _ := r.cmd.Flags().GetInt("max-recent-upgrades")
+	if limit <= 0 {
+		return nil
+	}
+	window, _ := r.cmd.Flags().GetDuration("recent-upgrade-window")
+
+	selector := map[string]string{}
+	if flag := r.cmd.Flags().Lookup("selector"); flag != nil {
+		var err error
+		if selector, err = parseSelector(flag.Value.String()); err != nil {
+			return err
+		}
+	}
+
+	scaleSets, err := r.sess.listScaleSets(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to list the fleet's scale sets for their upgrade history: %v", err)
+	}
+
+	recent := recentUpgrades(scaleSets, selector, time.Now().Add(-window))
+	if len(recent) < limit {
+		log.Debugf("%d scale sets upgraded within the past %s, under the limit of %d", len(recent), window, limit)
+		return nil
+	}
+
+	err = fmt.Errorf("%d scale sets were upgraded within the past %s, reaching the limit of %d: %s",
+		len(recent), window, limit, strings.Join(recent, ", "))
+
+	if override, _ := r.cmd.Flags().GetBool("override"); override {
+		log.Warnf("%v; upgrading anyway as --override is given", err)
+		return nil
+	}
+
+	return fmt.Errorf("%v; pass --override to upgrade anyway", err)
+}
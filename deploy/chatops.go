@@ -0,0 +1,661 @@
+package deploy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Slack rejects requests signed longer ago than this, to stop replays
+	slackRequestMaxAge = 5 * time.Minute
+	// Largest request body Slack sends
+	maxSlackRequestBytes = 1 << 20
+
+	slackApprove = "approve"
+	slackReject  = "reject"
+)
+
+// Phases which start removing old instances, leaving new ones to take
+// traffic on their own. Approval is asked for ahead of the first of them.
+var promotionPhases = map[string]bool{"warm-up": true, "budgeted-scale-in": true, "drain": true}
+
+// chatopsSpec describes the Slack app driving upgrades and the clusters it
+// may drive. It is read from the 'chatops' key of the config file.
+type chatopsSpec struct {
+	// Signing secret reference of the Slack app, see resolveSecret
+	SigningSecret string `mapstructure:"signingSecret"`
+
+	// Clusters by the name used in commands, e.g. prod-workers
+	Clusters map[string]chatopsCluster `mapstructure:"clusters"`
+
+	// Slack users and channels, by ID or name, commands and approvals are
+	// taken from. Anyone, or any channel, if empty.
+	AllowedUsers    []string `mapstructure:"allowedUsers"`
+	AllowedChannels []string `mapstructure:"allowedChannels"`
+}
+
+// Reports whether a Slack user may drive upgrades from a channel
+func (s *chatopsSpec) allows(userID string, userName string, channelID string, channelName string) bool {
+	return slackListed(s.AllowedUsers, userID, userName) && slackListed(s.AllowedChannels, channelID, channelName)
+}
+
+// Reports whether a list is empty or holds the ID or name
+func slackListed(list []string, id string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, entry := range list {
+		if entry != "" && (entry == id || entry == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatopsCluster is a scale set which may be driven from Slack
+type chatopsCluster struct {
+	SubscriptionID string `mapstructure:"subscriptionID"`
+	ResourceGroup  string `mapstructure:"resourceGroup"`
+	ScaleSet       string `mapstructure:"scaleSet"`
+	// Hold the upgrade once new instances are verified, until someone
+	// approves promoting them from Slack
+	RequireApproval bool `mapstructure:"requireApproval"`
+}
+
+// runControl lets an upgrade be paused, resumed, aborted and approved from
+// outside while it runs. Each takes effect between phases, so a phase is
+// never interrupted part way through and rolls back cleanly.
+type runControl struct {
+	mu       sync.Mutex
+	paused   bool
+	held     bool
+	aborted  bool
+	promoted bool
+	resumed  chan struct{}
+	// Takes the answer to the request for approval pending, if any
+	pending chan bool
+
+	// Asks for approval ahead of promoting new instances, if needed
+	requestApproval func(phaseName string)
+	// Time a request for approval waits for an answer before it's rejected
+	approvalTimeout time.Duration
+}
+
+func newRunControl() *runControl {
+	return &runControl{resumed: make(chan struct{})}
+}
+
+func (c *runControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+}
+
+func (c *runControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Aborts the run ahead of its next phase, releasing any pause or wait for
+// approval
+func (c *runControl) abort() {
+	c.mu.Lock()
+	c.aborted = true
+	c.mu.Unlock()
+
+	c.resume()
+	c.approve(false)
+}
+
+// Answers a pending request for approval, reporting whether one was
+// pending. Only the first answer to a request counts, and answers given
+// while none is pending are ignored rather than kept for the next one.
+func (c *runControl) approve(approved bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == nil {
+		return false
+	}
+	c.pending <- approved
+	c.pending = nil
+	return true
+}
+
+// Opens a request for approval, unless the run was aborted
+func (c *runControl) openApproval() (chan bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.aborted {
+		return nil, false
+	}
+	c.pending = make(chan bool, 1)
+	return c.pending, true
+}
+
+// Closes a request for approval left unanswered
+func (c *runControl) closeApproval(answer chan bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == answer {
+		c.pending = nil
+	}
+}
+
+// Reports whether the run is paused and held ahead of a phase
+func (c *runControl) isHeld() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.held
+}
+
+func (c *runControl) setHeld(held bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = held
+}
+
+func (c *runControl) isAborted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.aborted
+}
+
+// Holds the run ahead of a phase while it's paused or awaiting approval,
+// failing the phase once the run is aborted
+func (c *runControl) wait(ctx context.Context, phaseName string) error {
+	c.mu.Lock()
+	paused, resumed := c.paused, c.resumed
+	c.mu.Unlock()
+
+	if paused {
+		log.Infof("Upgrade paused ahead of phase %s", phaseName)
+		c.setHeld(true)
+		select {
+		case <-resumed:
+			c.setHeld(false)
+			log.Infof("Upgrade resumed")
+		case <-ctx.Done():
+			c.setHeld(false)
+			return ctx.Err()
+		}
+	}
+
+	if c.isAborted() {
+		return fmt.Errorf("upgrade aborted ahead of phase %s", phaseName)
+	}
+
+	if !promotionPhases[phaseName] || c.requestApproval == nil || c.promoted {
+		return nil
+	}
+
+	answer, ok := c.openApproval()
+	if !ok {
+		return fmt.Errorf("upgrade aborted ahead of phase %s", phaseName)
+	}
+	defer c.closeApproval(answer)
+
+	log.Infof("Waiting up to %s for approval to promote new instances", c.approvalTimeout)
+	c.requestApproval(phaseName)
+
+	select {
+	case ok := <-answer:
+		if !ok || c.isAborted() {
+			return fmt.Errorf("promotion of new instances was rejected")
+		}
+		log.Info("Promotion of new instances approved")
+		c.promoted = true
+		return nil
+	case <-time.After(c.approvalTimeout):
+		return fmt.Errorf("promotion of new instances wasn't approved within %s", c.approvalTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chatopsServer serves Slack slash commands and interactive messages,
+// running at most one upgrade per cluster at a time
+type chatopsServer struct {
+	cmd    *cobra.Command
+	spec   *chatopsSpec
+	secret secret
+	opts   sessionOptions
+	health *healthServer
+
+	mu   sync.Mutex
+	runs map[string]*runControl
+}
+
+// Reads the chatops spec from the config file
+func loadChatopsSpec() (*chatopsSpec, error) {
+	if !viper.IsSet("chatops") {
+		return nil, fmt.Errorf("the config file has no 'chatops' section")
+	}
+
+	spec := &chatopsSpec{}
+	if err := viper.UnmarshalKey("chatops", spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Clusters) == 0 {
+		return nil, fmt.Errorf("the chatops config lists no clusters")
+	}
+
+	return spec, nil
+}
+
+// Checks a request was signed by Slack with the app's signing secret,
+// returning its body
+func verifySlackRequest(signingSecret secret, req *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxSlackRequestBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("request has no valid timestamp")
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > slackRequestMaxAge || age < -slackRequestMaxAge {
+		return nil, fmt.Errorf("request timestamp is %s off", age.Round(time.Second))
+	}
+
+	mac := hmac.New(sha256.New, []byte(signingSecret.reveal()))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(req.Header.Get("X-Slack-Signature"))) {
+		return nil, fmt.Errorf("request signature doesn't match")
+	}
+
+	return body, nil
+}
+
+// Replies to a Slack command or action through its response URL
+func postSlackMessage(responseURL string, message map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	message["response_type"] = "in_channel"
+	if err := sendJSONRequest(ctx, http.MethodPost, responseURL, message, nil); err != nil {
+		log.Warnf("Unable to reply in Slack: %v", err)
+	}
+}
+
+func slackText(text string) map[string]interface{} {
+	return map[string]interface{}{"text": text}
+}
+
+// Asks for approval to promote a cluster's new instances, with buttons
+// answering back to the actions endpoint
+func slackApprovalRequest(cluster string) map[string]interface{} {
+	text := fmt.Sprintf("New instances of *%s* are verified. Promote them and remove the old instances?", cluster)
+	button := func(label string, style string, action string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": label},
+			"style":     style,
+			"action_id": action,
+			"value":     cluster,
+		}
+	}
+
+	return map[string]interface{}{
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			map[string]interface{}{"type": "actions", "elements": []interface{}{
+				button("Approve", "primary", slackApprove),
+				button("Reject", "danger", slackReject),
+			}},
+		},
+	}
+}
+
+func (s *chatopsServer) session(name string) (*azureSession, error) {
+	cluster, ok := s.spec.Clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %s", name)
+	}
+	return newSessionWithOptions(s.cmd, cluster.SubscriptionID, cluster.ResourceGroup, cluster.ScaleSet, s.opts)
+}
+
+// Handles '/upgrade <cluster> plan|run|pause|resume|abort', and
+// '/upgrade stop-all|resume-all' for every running upgrade, answering at
+// once and replying with the outcome of plans and runs once known
+func (s *chatopsServer) handleCommand(w http.ResponseWriter, req *http.Request) {
+	body, err := verifySlackRequest(s.secret, req)
+	if err != nil {
+		log.Warnf("Rejected Slack command: %v", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !s.spec.allows(form.Get("user_id"), form.Get("user_name"), form.Get("channel_id"), form.Get("channel_name")) {
+		log.Warnf("Refused a Slack command from %s in #%s, who isn't allowed", form.Get("user_name"), form.Get("channel_name"))
+		writeJSON(w, slackText("You're not allowed to drive upgrades from here"))
+		return
+	}
+
+	args := strings.Fields(form.Get("text"))
+	if len(args) == 1 && (args[0] == "stop-all" || args[0] == "resume-all") {
+		log.Warnf("%s asked to %s from Slack", form.Get("user_name"), args[0])
+		writeJSON(w, slackText(s.stopAll(args[0] == "stop-all")))
+		return
+	}
+	if len(args) != 2 {
+		writeJSON(w, slackText("Usage: /upgrade <cluster> plan|run|pause|resume|abort, or /upgrade stop-all|resume-all"))
+		return
+	}
+	name, action := args[0], args[1]
+
+	log.Infof("%s asked to %s %s from Slack", form.Get("user_name"), action, name)
+	writeJSON(w, slackText(s.dispatch(name, action, form.Get("response_url"))))
+}
+
+// Carries out a command, returning the immediate reply
+func (s *chatopsServer) dispatch(name string, action string, responseURL string) string {
+	if _, ok := s.spec.Clusters[name]; !ok {
+		return fmt.Sprintf("Unknown cluster %s", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	control := s.runs[name]
+
+	switch action {
+	case "plan":
+		go s.plan(name, responseURL)
+		return fmt.Sprintf("Planning an upgrade of %s...", name)
+	case "run":
+		if control != nil {
+			return fmt.Sprintf("An upgrade of %s is already running", name)
+		}
+		if !s.health.isReady() {
+			return "Shutting down, not starting any more upgrades"
+		}
+		control = newRunControl()
+		if s.spec.Clusters[name].RequireApproval {
+			control.requestApproval = func(string) { postSlackMessage(responseURL, slackApprovalRequest(name)) }
+			control.approvalTimeout, _ = s.cmd.Flags().GetDuration("approval-timeout")
+		}
+		s.runs[name] = control
+		go s.run(name, control, responseURL)
+		return fmt.Sprintf("Upgrading %s...", name)
+	case "pause", "resume", "abort":
+		if control == nil {
+			return fmt.Sprintf("No upgrade of %s is running", name)
+		}
+		switch action {
+		case "pause":
+			control.pause()
+			return fmt.Sprintf("Upgrade of %s will pause ahead of its next phase", name)
+		case "resume":
+			control.resume()
+			return fmt.Sprintf("Upgrade of %s resumed", name)
+		default:
+			control.abort()
+			return fmt.Sprintf("Upgrade of %s will abort ahead of its next phase", name)
+		}
+	default:
+		return fmt.Sprintf("Unknown action %s, expected plan, run, pause, resume or abort", action)
+	}
+}
+
+// Pauses every running upgrade ahead of its next phase, or resumes them,
+// returning the reply reporting where each is
+func (s *chatopsServer) stopAll(stop bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.runs) == 0 {
+		return "No upgrades are running"
+	}
+
+	var names []string
+	for name, control := range s.runs {
+		if stop {
+			control.pause()
+		} else {
+			control.resume()
+		}
+
+		state := "running"
+		if control.isHeld() {
+			state = "held"
+		}
+		names = append(names, fmt.Sprintf("%s (%s)", name, state))
+	}
+	sort.Strings(names)
+
+	if stop {
+		return fmt.Sprintf("Stopping every upgrade ahead of its next phase: %s", strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("Resumed every upgrade: %s", strings.Join(names, ", "))
+}
+
+// Returns the controls of the upgrades running
+func (s *chatopsServer) running() []*runControl {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	controls := make([]*runControl, 0, len(s.runs))
+	for _, control := range s.runs {
+		controls = append(controls, control)
+	}
+	return controls
+}
+
+func (s *chatopsServer) plan(name string, responseURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := s.session(name)
+	if err != nil {
+		postSlackMessage(responseURL, slackText(fmt.Sprintf("Unable to plan an upgrade of %s: %v", name, err)))
+		return
+	}
+
+	plan, err := sess.planUpgrade(ctx, s.cmd, nil)
+	if err != nil {
+		postSlackMessage(responseURL, slackText(fmt.Sprintf("Upgrade of %s can't go ahead: %v", name, err)))
+		return
+	}
+
+	postSlackMessage(responseURL, slackText("```"+formatPlan(plan)+"```"))
+}
+
+func (s *chatopsServer) run(name string, control *runControl, responseURL string) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.runs, name)
+		s.mu.Unlock()
+	}()
+
+	// Waiting for approval doesn't count against the upgrade's own time
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout(s.cmd)+control.approvalTimeout)
+	defer cancel()
+
+	runID := newRunID()
+	log.Infof("Upgrade of %s started as run %s", name, runID)
+
+	sess, err := s.session(name)
+	if err == nil {
+		run := newUpgradeRun(sess, s.cmd)
+		run.setRunID(runID)
+		run.control = control
+		err = run.execute(ctx)
+	}
+
+	if err != nil {
+		log.Errorf("Upgrade of %s, run %s, failed: %v", name, runID, err)
+		postSlackMessage(responseURL, slackText(fmt.Sprintf("Upgrade of %s failed: %v (run %s)", name, err, runID)))
+		return
+	}
+	log.Infof("Upgrade of %s, run %s, complete", name, runID)
+	postSlackMessage(responseURL, slackText(fmt.Sprintf("Upgrade of %s complete (run %s)", name, runID)))
+}
+
+// Handles the approval buttons of interactive messages
+func (s *chatopsServer) handleAction(w http.ResponseWriter, req *http.Request) {
+	body, err := verifySlackRequest(s.secret, req)
+	if err != nil {
+		log.Warnf("Rejected Slack action: %v", err)
+		http.Error(w, "invalid request", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Channel struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"channel"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+		ResponseURL string `json:"response_url"`
+	}
+	if err = json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if !s.spec.allows(payload.User.ID, payload.User.Username, payload.Channel.ID, payload.Channel.Name) {
+		log.Warnf("Refused a Slack action from %s in #%s, who isn't allowed", payload.User.Username, payload.Channel.Name)
+		go postSlackMessage(payload.ResponseURL, slackText(fmt.Sprintf("%s isn't allowed to approve upgrades from here", payload.User.Username)))
+		return
+	}
+
+	for _, action := range payload.Actions {
+		s.mu.Lock()
+		control := s.runs[action.Value]
+		s.mu.Unlock()
+
+		approved := action.ActionID == slackApprove
+		if control == nil || !control.approve(approved) {
+			go postSlackMessage(payload.ResponseURL, slackText(fmt.Sprintf("No upgrade of %s is waiting for approval", action.Value)))
+			continue
+		}
+		log.Infof("%s answered the promotion of %s: %s", payload.User.Username, action.Value, action.ActionID)
+
+		verb := "approved"
+		if !approved {
+			verb = "rejected"
+		}
+		go postSlackMessage(payload.ResponseURL, map[string]interface{}{
+			"replace_original": true,
+			"text":             fmt.Sprintf("%s %s promoting the new instances of %s", payload.User.Username, verb, action.Value),
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// RunChatops serves a Slack app's slash command and interactive messages,
+// so upgrades of the clusters in the config file can be planned, run,
+// paused, resumed and aborted from Slack, with the promotion of new
+// instances approved there where a cluster requires it. On SIGTERM, running
+// upgrades are held ahead of their next phase before the process exits.
+func RunChatops(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green ChatOps")
+
+	spec, err := loadChatopsSpec()
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	signingSecret, err := resolveSecret(context.Background(), spec.SigningSecret)
+	if err != nil {
+		log.Fatal(fmt.Errorf("unable to resolve Slack signing secret: %v", err))
+		os.Exit(1)
+	}
+	if signingSecret == "" {
+		log.Fatal(fmt.Errorf("the chatops config has no signing secret"))
+		os.Exit(1)
+	}
+
+	// Every session shares one set of options, so rate limits apply
+	// across clusters
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	server := &chatopsServer{cmd: cmd, spec: spec, secret: signingSecret, opts: opts, health: &healthServer{}, runs: map[string]*runControl{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/commands", server.handleCommand)
+	mux.HandleFunc("/slack/actions", server.handleAction)
+	server.health.register(mux)
+	server.health.serve(cmd.Flags().Lookup("health-listen").Value.String())
+
+	listen := cmd.Flags().Lookup("listen").Value.String()
+	log.Infof("Serving Slack commands for %d clusters on %s", len(spec.Clusters), listen)
+
+	httpServer := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}()
+	server.health.setReady(true)
+
+	sig := <-shutdownSignals()
+	log.Infof("Received %s, holding running upgrades ahead of their next phase", sig)
+	server.health.setReady(false)
+	holdRuns(server.running)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpServer.Shutdown(ctx)
+	log.Info("Shut down")
+}
@@ -0,0 +1,120 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Exit status of 'check' when instances need upgrading, distinct from the
+// status of 1 a failure to check exits with
+const checkStaleExitCode = 2
+
+// checkResult reports how far a scale set is from running its model
+type checkResult struct {
+	SubscriptionID    string          `json:"subscriptionId"`
+	ResourceGroupName string          `json:"resourceGroup"`
+	ScaleSetName      string          `json:"scaleSet"`
+	Instances         int             `json:"instances"`
+	Stale             int             `json:"stale"`
+	UpgradeState      string          `json:"upgradeState,omitempty"`
+	StaleInstances    []checkInstance `json:"staleInstances"`
+}
+
+// checkInstance is a single instance not running the latest model
+type checkInstance struct {
+	InstanceID string `json:"instanceId"`
+	Name       string `json:"name"`
+	VMSize     string `json:"vmSize,omitempty"`
+	Image      string `json:"image,omitempty"`
+}
+
+// Lists the instances which don't run the latest scale set model, along
+// with any upgrade recorded as in progress
+func (s *azureSession) checkInstances(ctx context.Context) (*checkResult, error) {
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := s.getUpgradeState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &checkResult{
+		SubscriptionID:    s.SubscriptionID,
+		ResourceGroupName: s.ResourceGroupName,
+		ScaleSetName:      s.ScaleSetName,
+		Instances:         len(vms),
+		UpgradeState:      state.State,
+		StaleInstances:    []checkInstance{},
+	}
+
+	for _, vm := range vms {
+		if vm.VirtualMachineScaleSetVMProperties != nil && to.Bool(vm.LatestModelApplied) {
+			continue
+		}
+
+		instance := checkInstance{InstanceID: to.String(vm.InstanceID), Name: to.String(vm.Name)}
+		if vm.Sku != nil {
+			instance.VMSize = to.String(vm.Sku.Name)
+		}
+		if props := vm.VirtualMachineScaleSetVMProperties; props != nil && props.StorageProfile != nil && props.StorageProfile.ImageReference != nil {
+			instance.Image = imageReferenceString(props.StorageProfile.ImageReference)
+		}
+		result.StaleInstances = append(result.StaleInstances, instance)
+	}
+	result.Stale = len(result.StaleInstances)
+
+	return result, nil
+}
+
+// RunCheck reports whether every instance runs the latest model, listing
+// those which don't, and exits non-zero when any don't. Nothing is modified.
+func RunCheck(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	result, err := sess.checkInstances(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		err = printJSON(result)
+	} else {
+		for _, instance := range result.StaleInstances {
+			fmt.Printf("instance %s (%s): %s %s\n", instance.InstanceID, instance.Name, orNone(instance.VMSize), orNone(instance.Image))
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if result.Stale > 0 {
+		log.Warnf("%d of %d instances of %s are not running the latest model", result.Stale, result.Instances, sess.ScaleSetName)
+		os.Exit(checkStaleExitCode)
+	}
+
+	log.Infof("All %d instances of %s are running the latest model", result.Instances, sess.ScaleSetName)
+}
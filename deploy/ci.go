@@ -0,0 +1,226 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// CI systems whose logging commands --ci emits
+const (
+	ciAzureDevOps = "azdo"
+	ciGitHub      = "github"
+)
+
+// phaseResult is how one phase of an upgrade went, for the job summary
+type phaseResult struct {
+	Name     string
+	Status   string
+	Duration time.Duration
+}
+
+// ciHook turns warnings and errors into annotations on the pipeline run
+type ciHook struct {
+	system string
+}
+
+func (h ciHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (h ciHook) Fire(entry *log.Entry) error {
+	severity := "error"
+	if entry.Level == log.WarnLevel {
+		severity = "warning"
+	}
+
+	switch h.system {
+	case ciGitHub:
+		fmt.Printf("::%s::%s\n", severity, escapeGitHubCommand(entry.Message))
+	case ciAzureDevOps:
+		fmt.Printf("##vso[task.logissue type=%s]%s\n", severity, escapeAzureDevOpsCommand(entry.Message))
+	}
+	return nil
+}
+
+// Escapes a GitHub Actions workflow command's message
+func escapeGitHubCommand(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// Escapes an Azure Pipelines logging command's message
+func escapeAzureDevOpsCommand(s string) string {
+	return strings.NewReplacer("%", "%AZP25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// Returns the CI system named by --ci, or "" outside a pipeline
+func ciSystem(cmd *cobra.Command) string {
+	if flag := cmd.Flags().Lookup("ci"); flag != nil {
+		return flag.Value.String()
+	}
+	return ""
+}
+
+// Annotates the pipeline run with warnings and errors, if --ci is given.
+// Logs still go to stderr; the logging commands go to stdout, where the
+// CI systems look for them.
+func configureCI(cmd *cobra.Command) {
+	if system := ciSystem(cmd); system != "" {
+		log.AddHook(ciHook{system: system})
+	}
+}
+
+// Sets a step output of the pipeline
+func setCIOutput(system string, name string, value string) error {
+	switch system {
+	case ciGitHub:
+		path := os.Getenv("GITHUB_OUTPUT")
+		if path == "" {
+			fmt.Printf("::set-output name=%s::%s\n", name, escapeGitHubCommand(value))
+			return nil
+		}
+		return appendFile(path, fmt.Sprintf("%s=%s\n", name, value))
+	case ciAzureDevOps:
+		fmt.Printf("##vso[task.setvariable variable=%s;isOutput=true]%s\n", name, escapeAzureDevOpsCommand(value))
+	}
+	return nil
+}
+
+// Adds a markdown report to the pipeline run's summary
+func addCISummary(system string, markdown string) error {
+	switch system {
+	case ciGitHub:
+		if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+			return appendFile(path, markdown)
+		}
+	case ciAzureDevOps:
+		dir := os.Getenv("AGENT_TEMPDIRECTORY")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		path := filepath.Join(dir, fmt.Sprintf("azure-cluster-upgrade-%d.md", time.Now().UnixNano()))
+		if err := ioutil.WriteFile(path, []byte(markdown), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("##vso[task.uploadsummary]%s\n", path)
+	}
+	return nil
+}
+
+func appendFile(path string, contents string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(contents)
+	return err
+}
+
+// Formats the outcome of an upgrade as a markdown job summary
+func (r *upgradeRun) ciSummary(result string, runErr error) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "## Blue/green upgrade of %s/%s: %s\n\n", r.sess.ResourceGroupName, r.sess.ScaleSetName, result)
+	fmt.Fprintf(&b, "Run ID `%s`.\n\n", r.runID)
+	if r.surgeSize > 0 {
+		fmt.Fprintf(&b, "Capacity %d, surged by %d instances.\n\n", r.originalCapacity, r.surgeSize)
+	}
+	if r.cost != nil {
+		fmt.Fprintf(&b, "%s.\n\n", r.cost)
+	}
+	if runErr != nil {
+		fmt.Fprintf(&b, "**Error:** %s\n\n", strings.Replace(runErr.Error(), "\n", " ", -1))
+	}
+
+	if len(r.phaseResults) > 0 {
+		fmt.Fprintln(&b, "| Phase | Result | Duration |")
+		fmt.Fprintln(&b, "|---|---|---|")
+		for _, phase := range r.phaseResults {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", phase.Name, phase.Status, phase.Duration.Round(time.Second))
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if rows := r.patchReport(); len(rows) > 0 {
+		fmt.Fprintln(&b, "| Patch level | Replaced instances | New instances |")
+		fmt.Fprintln(&b, "|---|---|---|")
+		for _, row := range rows {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", row[0], row[1], row[2])
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if len(r.recoveryPoints) > 0 {
+		fmt.Fprintln(&b, "Replaced instances can be restored from recovery points:")
+		fmt.Fprintln(&b)
+		for _, id := range r.recoveryPoints {
+			fmt.Fprintf(&b, "- `%s`\n", id)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if len(r.orphans) > 0 {
+		fmt.Fprintln(&b, r.orphansSummary())
+		fmt.Fprintln(&b)
+		for _, id := range r.orphans {
+			fmt.Fprintf(&b, "- `%s`\n", id)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	if len(r.diskSnapshots) > 0 {
+		fmt.Fprintln(&b, "Data disks of removed instances were snapshotted to:")
+		fmt.Fprintln(&b)
+		for _, id := range r.diskSnapshots {
+			fmt.Fprintf(&b, "- `%s`\n", id)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	return b.String()
+}
+
+// Reports the outcome of an upgrade to the pipeline as step outputs and a
+// job summary, if --ci is given. Failing to is only worth a warning.
+func (r *upgradeRun) reportCI(runErr error) {
+	system := ciSystem(r.cmd)
+	if system == "" {
+		return
+	}
+
+	result, failedPhase := "succeeded", ""
+	if runErr != nil {
+		result = "failed"
+		for _, phase := range r.phaseResults {
+			if phase.Status == "failed" {
+				failedPhase = phase.Name
+			}
+		}
+	}
+
+	outputs := [][2]string{
+		{"result", result},
+		{"runID", r.runID},
+		{"scaleSet", r.sess.ScaleSetName},
+		{"originalCapacity", fmt.Sprint(r.originalCapacity)},
+		{"surgeSize", fmt.Sprint(r.surgeSize)},
+		{"failedPhase", failedPhase},
+	}
+	for _, output := range outputs {
+		if err := setCIOutput(system, output[0], output[1]); err != nil {
+			log.Warnf("Unable to set output %s: %v", output[0], err)
+		}
+	}
+
+	if err := addCISummary(system, r.ciSummary(result, runErr)); err != nil {
+		log.Warnf("Unable to add job summary: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Names 'list-names' can print for shell completion
+	namesResourceGroups = "resource-groups"
+	namesScaleSets      = "scale-sets"
+
+	// Completion has to feel interactive, so give up on a slow listing
+	completionTimeout = 10 * time.Second
+)
+
+// Lists the names of the resource groups holding scale sets in the
+// session's subscription, or of the scale sets in the session's resource
+// group, for shell completion
+func (s *azureSession) listNames(ctx context.Context, kind string) ([]string, error) {
+	scaleSets, err := s.listScaleSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	unique := map[string]bool{}
+	for _, scaleSet := range scaleSets {
+		if scaleSet.ID == nil {
+			continue
+		}
+		id, err := azure.ParseResourceID(*scaleSet.ID)
+		if err != nil {
+			continue
+		}
+
+		switch kind {
+		case namesResourceGroups:
+			unique[id.ResourceGroup] = true
+		case namesScaleSets:
+			if s.ResourceGroupName == "" || strings.EqualFold(id.ResourceGroup, s.ResourceGroupName) {
+				unique[id.ResourceName] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown kind of name '%s', expected %s or %s", kind, namesResourceGroups, namesScaleSets)
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// RunListNames prints resource group or scale set names, one per line,
+// for the shell completion scripts
+func RunListNames(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	sess, err := newSessionWithOptions(cmd,
+		cmd.Flags().Lookup("subscription-id").Value.String(),
+		cmd.Flags().Lookup("resource-group").Value.String(),
+		"", opts)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	names, err := sess.listNames(ctx, args[0])
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
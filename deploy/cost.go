@@ -0,0 +1,230 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Azure Retail Prices API, which needs no credentials
+const retailPricesURL = "https://prices.azure.com/api/retail/prices"
+
+// Matches ISO 4217 currency codes such as USD
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// surgeMeter measures the instance-hours of the capacity the surge adds,
+// from the surge's scale-out until the old instances are all removed
+type surgeMeter struct {
+	vmSize  string
+	region  string
+	windows bool
+
+	extra         int64
+	since         time.Time
+	instanceHours float64
+}
+
+// Returns the VM size, region and OS a scale set's instances are billed by
+func billingOf(scaleSet compute.VirtualMachineScaleSet) (vmSize string, region string, windows bool) {
+	profile := scaleSet.VirtualMachineProfile
+	windows = profile != nil && profile.OsProfile != nil && profile.OsProfile.WindowsConfiguration != nil
+	return to.String(scaleSet.Sku.Name), to.String(scaleSet.Location), windows
+}
+
+// Records that the scale set now runs the given number of instances over
+// its original capacity. Stopping a meter which never started leaves it
+// unstarted, as when finishing a surge another run held.
+func (m *surgeMeter) set(extra int64) {
+	if extra == 0 && m.since.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	m.instanceHours += float64(m.extra) * now.Sub(m.since).Hours()
+	m.extra, m.since = extra, now
+}
+
+// Returns the instance-hours the surge has consumed so far
+func (m *surgeMeter) hours() float64 {
+	return m.instanceHours + float64(m.extra)*time.Since(m.since).Hours()
+}
+
+// surgeCost is what the capacity added by the surge cost
+type surgeCost struct {
+	InstanceHours float64
+	VMSize        string
+	HourlyPrice   float64
+	Currency      string
+	Retail        bool
+}
+
+func (c surgeCost) String() string {
+	cost := fmt.Sprintf("The surge consumed %.2f instance-hours of %s", c.InstanceHours, c.VMSize)
+	if c.HourlyPrice == 0 {
+		return cost
+	}
+
+	basis := "the given price"
+	if c.Retail {
+		basis = "retail price"
+	}
+	return fmt.Sprintf("%s, costing %.2f %s at %s of %.4f %s an hour", cost, c.InstanceHours*c.HourlyPrice, c.Currency, basis, c.HourlyPrice, c.Currency)
+}
+
+// Checks a --hourly-price value is a price of zero or more
+func validateHourlyPrice(value string) error {
+	if price, err := strconv.ParseFloat(value, 64); err != nil || price < 0 {
+		return fmt.Errorf("%s is not a price of zero or more", value)
+	}
+	return nil
+}
+
+// Checks a --currency value is an ISO 4217 currency code
+func validateCurrency(value string) error {
+	if !currencyPattern.MatchString(value) {
+		return fmt.Errorf("%s is not a currency code such as USD", value)
+	}
+	return nil
+}
+
+// Looks up the pay-as-you-go hourly price of a VM size in a region, in the
+// given currency
+func retailHourlyPrice(ctx context.Context, region string, vmSize string, windows bool, currency string) (float64, error) {
+	query := url.Values{
+		"currencyCode": {fmt.Sprintf("'%s'", currency)},
+		"$filter": {fmt.Sprintf("serviceName eq 'Virtual Machines' and priceType eq 'Consumption' and armRegionName eq '%s' and armSkuName eq '%s'",
+			region, vmSize)},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, retailPricesURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var prices struct {
+		Items []struct {
+			UnitPrice     float64 `json:"unitPrice"`
+			UnitOfMeasure string  `json:"unitOfMeasure"`
+			SkuName       string  `json:"skuName"`
+			ProductName   string  `json:"productName"`
+		} `json:"Items"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return 0, err
+	}
+
+	for _, item := range prices.Items {
+		if item.UnitOfMeasure != "1 Hour" || strings.Contains(item.SkuName, "Spot") || strings.Contains(item.SkuName, "Low Priority") {
+			continue
+		}
+		if strings.Contains(item.ProductName, "Windows") == windows {
+			return item.UnitPrice, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no retail price is listed for %s in %s", vmSize, region)
+}
+
+// Returns the ARM path of the tags of one of the scale set's instances
+func (s *azureSession) instanceTagsPath(instanceID string) string {
+	return fmt.Sprintf("%s/virtualMachines/%s/providers/Microsoft.Resources/tags/default", s.scaleSetPath(), instanceID)
+}
+
+// Tags the instances created by the surge with --cost-center for as long
+// as they're surplus to the scale set's capacity, so finance can attribute
+// their cost to the upgrade. Instances which can't be tagged individually,
+// such as those of some scale sets in uniform orchestration, are only
+// warned about.
+func (r *upgradeRun) tagSurgeInstances(ctx context.Context) error {
+	center := r.cmd.Flags().Lookup("cost-center").Value.String()
+	if center == "" || r.sess.Simulated {
+		return nil
+	}
+	tag := r.cmd.Flags().Lookup("cost-center-tag").Value.String()
+
+	surged, err := r.surgedInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Tagging %d surge instances with %s=%s...", len(surged), tag, center)
+	for _, id := range surged {
+		body := map[string]interface{}{
+			"operation":  "Merge",
+			"properties": map[string]interface{}{"tags": map[string]string{tag: center}},
+		}
+		if err = r.sess.armDo(ctx, http.MethodPatch, r.sess.instanceTagsPath(id), tagsAPIVersion, body, nil); err != nil {
+			log.Warnf("Unable to tag surge instance %s with its cost center: %v", id, err)
+			continue
+		}
+		r.costCenterTagged = append(r.costCenterTagged, id)
+	}
+
+	return nil
+}
+
+// Removes the cost center tag from the surge instances once the old
+// instances are gone, since they then make up the scale set's capacity
+func (r *upgradeRun) untagSurgeInstances(ctx context.Context) {
+	tag := r.cmd.Flags().Lookup("cost-center-tag").Value.String()
+	center := r.cmd.Flags().Lookup("cost-center").Value.String()
+
+	for _, id := range r.costCenterTagged {
+		body := map[string]interface{}{
+			"operation":  "Delete",
+			"properties": map[string]interface{}{"tags": map[string]string{tag: center}},
+		}
+		if err := r.sess.armDo(ctx, http.MethodPatch, r.sess.instanceTagsPath(id), tagsAPIVersion, body, nil); err != nil {
+			log.Warnf("Unable to remove the cost center tag from instance %s, remove it manually: %v", id, err)
+		}
+	}
+	r.costCenterTagged = nil
+}
+
+// Works out what the capacity added by the surge cost, pricing its
+// instance-hours by --hourly-price, or the retail price of the VM size
+// when no price is given. Failing to find a price only leaves the cost
+// out of the report.
+func (r *upgradeRun) costSurge(ctx context.Context) {
+	if r.surgeMeter.since.IsZero() || r.strategyName == strategyScaleInOnly {
+		return
+	}
+
+	cost := &surgeCost{
+		InstanceHours: r.surgeMeter.hours(),
+		VMSize:        r.surgeMeter.vmSize,
+		Currency:      r.cmd.Flags().Lookup("currency").Value.String(),
+	}
+	cost.HourlyPrice, _ = r.cmd.Flags().GetFloat64("hourly-price")
+
+	if cost.HourlyPrice == 0 && !r.sess.Simulated {
+		price, err := retailHourlyPrice(ctx, r.surgeMeter.region, cost.VMSize, r.surgeMeter.windows, cost.Currency)
+		if err != nil {
+			log.Warnf("Unable to look up the retail price of %s, give one with --hourly-price: %v", cost.VMSize, err)
+		}
+		cost.HourlyPrice, cost.Retail = price, err == nil
+	}
+
+	r.cost = cost
+	log.Info(cost.String())
+}
@@ -0,0 +1,336 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Upper bound on hosts we'll add to a group for a single surge
+	maxSurgeHosts = 10
+)
+
+// surgeHost is a dedicated host added to a host group for the surge
+// window, by its resource ID
+type surgeHost struct {
+	ID string
+}
+
+// Returns the session's Dedicated Host client for a subscription
+func (s *azureSession) getDedicatedHostsClient(subscription string) compute.DedicatedHostsClient {
+	return s.cachedClient("dedicatedHosts/"+subscription, func() interface{} {
+		client := compute.NewDedicatedHostsClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.DedicatedHostsClient)
+}
+
+// Returns the session's Dedicated Host Group client for a subscription
+func (s *azureSession) getDedicatedHostGroupsClient(subscription string) compute.DedicatedHostGroupsClient {
+	return s.cachedClient("dedicatedHostGroups/"+subscription, func() interface{} {
+		client := compute.NewDedicatedHostGroupsClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.DedicatedHostGroupsClient)
+}
+
+// Returns the ID of the dedicated host group the scale set is pinned to, or
+// an empty string if it isn't.
+func (s *azureSession) getHostGroupID(ctx context.Context) (string, error) {
+	var scaleSet struct {
+		Properties struct {
+			HostGroup *subResource `json:"hostGroup"`
+		} `json:"properties"`
+	}
+
+	if err := s.armGet(ctx, s.scaleSetPath(), newerComputeAPIVersion, &scaleSet); err != nil {
+		return "", err
+	}
+
+	if scaleSet.Properties.HostGroup == nil {
+		return "", nil
+	}
+
+	return scaleSet.Properties.HostGroup.ID, nil
+}
+
+// Returns how many more VMs of the given size fit on a host
+func allocatableVMs(host compute.DedicatedHost, vmSize string) int64 {
+	if host.DedicatedHostProperties == nil || host.InstanceView == nil || host.InstanceView.AvailableCapacity == nil ||
+		host.InstanceView.AvailableCapacity.AllocatableVMs == nil {
+		return 0
+	}
+
+	for _, allocatable := range *host.InstanceView.AvailableCapacity.AllocatableVMs {
+		if strings.EqualFold(to.String(allocatable.VMSize), vmSize) && allocatable.Count != nil {
+			return int64(*allocatable.Count)
+		}
+	}
+
+	return 0
+}
+
+// Fetches every host in the group along with its instance view
+func (s *azureSession) getDedicatedHosts(ctx context.Context, group azure.Resource) ([]compute.DedicatedHost, error) {
+	var hosts []compute.DedicatedHost
+
+	client := s.getDedicatedHostsClient(group.SubscriptionID)
+
+	list, err := client.ListByHostGroupComplete(ctx, group.ResourceGroup, group.ResourceName)
+	if err != nil {
+		return hosts, err
+	}
+
+	for ; list.NotDone(); err = list.Next() {
+		if err != nil {
+			return hosts, err
+		}
+
+		host, err := client.Get(ctx, group.ResourceGroup, group.ResourceName, to.String(list.Value().Name), compute.InstanceView)
+		if err != nil {
+			return hosts, err
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// Picks the fault domain with the fewest hosts, so added hosts keep the
+// group's fault isolation balanced.
+func leastPopulatedFaultDomain(hosts []compute.DedicatedHost, faultDomains int32) int32 {
+	counts := make([]int, faultDomains)
+	for _, host := range hosts {
+		if host.DedicatedHostProperties != nil && host.PlatformFaultDomain != nil && *host.PlatformFaultDomain < faultDomains {
+			counts[*host.PlatformFaultDomain]++
+		}
+	}
+
+	least := int32(0)
+	for fd := int32(1); fd < faultDomains; fd++ {
+		if counts[fd] < counts[least] {
+			least = fd
+		}
+	}
+	return least
+}
+
+// Creates a new host in the group, modelled on an existing host's SKU
+func (s *azureSession) addSurgeHost(ctx context.Context, group azure.Resource, template compute.DedicatedHost, name string, faultDomain int32) (compute.DedicatedHost, error) {
+	client := s.getDedicatedHostsClient(group.SubscriptionID)
+
+	log.Infof("Adding dedicated host %s to host group %s in fault domain %d...", name, group.ResourceName, faultDomain)
+
+	future, err := client.CreateOrUpdate(ctx, group.ResourceGroup, group.ResourceName, name, compute.DedicatedHost{
+		Location: template.Location,
+		Sku:      &compute.Sku{Name: template.Sku.Name},
+		DedicatedHostProperties: &compute.DedicatedHostProperties{
+			PlatformFaultDomain: &faultDomain,
+		},
+		Tags: map[string]*string{"azure-cluster-upgrade": to.StringPtr("surge")},
+	})
+	if err != nil {
+		return compute.DedicatedHost{}, err
+	}
+
+	if err = future.WaitForCompletionRef(ctx, client.Client); err != nil {
+		return compute.DedicatedHost{}, err
+	}
+
+	return client.Get(ctx, group.ResourceGroup, group.ResourceName, name, compute.InstanceView)
+}
+
+// Checks that the dedicated host group the scale set is pinned to has room
+// for 'demand' surge instances. Fails when it doesn't, unless 'addHosts' is
+// set, in which case hosts are added (spread across fault domains) until
+// the surge fits. Added hosts are returned so they can be removed once the
+// upgrade is done. Hosts are only ever added under names the group doesn't
+// already hold, and any added before failing are removed again.
+func (s *azureSession) preflightDedicatedHosts(ctx context.Context, addHosts bool, demand int64) ([]surgeHost, error) {
+	added, err := s.addDedicatedHosts(ctx, addHosts, demand)
+	if err != nil && len(added) > 0 {
+		// The run's context may be why adding failed
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+
+		if removeErr := s.removeSurgeHosts(cleanupCtx, added); removeErr != nil {
+			log.Errorf("Unable to remove the dedicated hosts added before failing: %v", removeErr)
+			return added, err
+		}
+		return nil, err
+	}
+
+	return added, err
+}
+
+// Adds hosts to the scale set's dedicated host group, if any, until it has
+// room for the surge, returning those added even on failure
+func (s *azureSession) addDedicatedHosts(ctx context.Context, addHosts bool, demand int64) ([]surgeHost, error) {
+	var added []surgeHost
+
+	groupID, err := s.getHostGroupID(ctx)
+	if err != nil || groupID == "" {
+		return added, err
+	}
+
+	group, err := azure.ParseResourceID(groupID)
+	if err != nil {
+		return added, err
+	}
+
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return added, err
+	}
+
+	vmSize := to.String(scaleSet.Sku.Name)
+
+	hosts, err := s.getDedicatedHosts(ctx, group)
+	if err != nil {
+		return added, err
+	}
+
+	var free int64
+	for _, host := range hosts {
+		free += allocatableVMs(host, vmSize)
+	}
+
+	if free >= demand {
+		log.Infof("Dedicated host group %s has room for %d more %s instances", group.ResourceName, free, vmSize)
+		return added, nil
+	}
+
+	if !addHosts || len(hosts) == 0 {
+		return added, fmt.Errorf("dedicated host group %s only has room for %d of %d surge instances", group.ResourceName, free, demand)
+	}
+
+	hostGroup, err := s.getDedicatedHostGroupsClient(group.SubscriptionID).Get(ctx, group.ResourceGroup, group.ResourceName)
+	if err != nil {
+		return added, err
+	}
+
+	faultDomains := int32(1)
+	if hostGroup.DedicatedHostGroupProperties != nil && hostGroup.PlatformFaultDomainCount != nil {
+		faultDomains = *hostGroup.PlatformFaultDomainCount
+	}
+
+	existing := map[string]bool{}
+	for _, host := range hosts {
+		existing[strings.ToLower(to.String(host.Name))] = true
+	}
+
+	for i := 1; free < demand; i++ {
+		if len(added) >= maxSurgeHosts {
+			return added, fmt.Errorf("dedicated host group %s still lacks room for %d surge instances after adding %d hosts", group.ResourceName, demand-free, maxSurgeHosts)
+		}
+
+		// Hosts left in place by an earlier run keep their names
+		name := fmt.Sprintf("%s-surge-%d", s.ScaleSetName, i)
+		if existing[strings.ToLower(name)] {
+			continue
+		}
+
+		// Tracked before it's created, as a failed creation may still leave
+		// the host behind
+		added = append(added, surgeHost{ID: groupID + "/hosts/" + name})
+
+		host, err := s.addSurgeHost(ctx, group, hosts[0], name, leastPopulatedFaultDomain(hosts, faultDomains))
+		if err != nil {
+			return added, err
+		}
+
+		hosts = append(hosts, host)
+		free += allocatableVMs(host, vmSize)
+	}
+
+	return added, nil
+}
+
+// Shrinks each host group back by as many hosts as were added to it for
+// the surge. The surge's instances replace the old ones, so the hosts
+// added for them usually end up running new instances while the hosts of
+// the old ones are left empty; any empty host in the group counts, the
+// added ones first. Added hosts which were never created are skipped, and
+// if too few hosts are empty, the rest are left in place with a warning.
+func (s *azureSession) removeSurgeHosts(ctx context.Context, hosts []surgeHost) error {
+	added := map[string][]string{}
+	var groups []string
+	for _, host := range hosts {
+		// Host IDs are their group's ID followed by /hosts/<name>
+		groupID := path.Dir(path.Dir(host.ID))
+		if _, ok := added[groupID]; !ok {
+			groups = append(groups, groupID)
+		}
+		added[groupID] = append(added[groupID], path.Base(host.ID))
+	}
+
+	for _, groupID := range groups {
+		group, err := azure.ParseResourceID(groupID)
+		if err != nil {
+			return err
+		}
+
+		current, err := s.getDedicatedHosts(ctx, group)
+		if err != nil {
+			return err
+		}
+
+		surge := map[string]bool{}
+		for _, name := range added[groupID] {
+			surge[strings.ToLower(name)] = true
+		}
+
+		// Empty hosts, those added for the surge first
+		count := 0
+		var empty, emptySurge []string
+		for _, host := range current {
+			name := to.String(host.Name)
+			if surge[strings.ToLower(name)] {
+				count++
+			}
+			if host.DedicatedHostProperties != nil && host.VirtualMachines != nil && len(*host.VirtualMachines) > 0 {
+				continue
+			}
+			if surge[strings.ToLower(name)] {
+				emptySurge = append(emptySurge, name)
+			} else {
+				empty = append(empty, name)
+			}
+		}
+		empty = append(emptySurge, empty...)
+
+		if len(empty) < count {
+			log.Warnf("Only %d hosts in dedicated host group %s are empty, leaving %d of the %d added for the surge in place", len(empty), group.ResourceName, count-len(empty), count)
+			count = len(empty)
+		}
+
+		client := s.getDedicatedHostsClient(group.SubscriptionID)
+
+		for _, name := range empty[:count] {
+			log.Infof("Removing empty dedicated host %s from %s...", name, group.ResourceName)
+
+			future, err := client.Delete(ctx, group.ResourceGroup, group.ResourceName, name)
+			if errorStatus(err) == http.StatusNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err = future.WaitForCompletionRef(ctx, client.Client); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
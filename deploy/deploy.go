@@ -2,21 +2,32 @@ package deploy
 
 import (
 	"context"
-	"math"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
 	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	"github.com/krarey/azure-cluster-upgrade/recorder"
+	"github.com/krarey/azure-cluster-upgrade/vmss"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 const (
+	// Time a command may take, unless it has --timeout
 	timeoutMinutes = 20
+
+	// Time rolling back a failed upgrade may take, apart from the run's
+	rollbackTimeout = 30 * time.Minute
+
+	// Number of instance protection updates issued at once
+	protectionConcurrency = 20
 )
 
 type azureSession struct {
@@ -24,31 +35,121 @@ type azureSession struct {
 	ScaleSetName      string
 	SubscriptionID    string
 	Authorizer        *autorest.Authorizer
+
+	// Scale set clients, replaceable with the fakes in vmss/fake
+	ScaleSets vmss.ScaleSetsClient
+	VMs       vmss.VMsClient
+
+	// Records or replays every ARM request, when set
+	Recorder *recorder.Recorder
+
+	// Faults deliberately injected to exercise failure handling
+	Faults *faultInjection
+
+	// Shared budget for ARM requests, when set
+	Limiter *armRateLimiter
+
+	// Set when the session targets a simulated scale set
+	Simulated bool
+
+	// Set when model changes are made as ARM deployments
+	RecordDeployments bool
+
+	// ID of the run, sent as the correlation ID of every ARM request
+	RunID string
+
+	// Transport shared by every client, built on first use
+	senderOnce sync.Once
+	sender     autorest.Sender
+
+	// Clients for other resource types, keyed by type and subscription
+	clientsMu sync.Mutex
+	clients   map[string]interface{}
 }
 
-// Attaches the session's authorizer to a new instance of the VM Scale Set client
-func (s *azureSession) getVMSSClient() compute.VirtualMachineScaleSetsClient {
-	client := compute.NewVirtualMachineScaleSetsClient(s.SubscriptionID)
-	client.Authorizer = *s.Authorizer
-	return client
+// Returns the sender shared by every client in the session, so they pool
+// connections and pass through the same recorder, injected faults, rate
+// limiter, conditional update headers and correlation ID.
+func (s *azureSession) getSender() autorest.Sender {
+	s.senderOnce.Do(func() {
+		if s.Recorder != nil {
+			s.sender = s.Recorder
+		} else {
+			s.sender = autorest.CreateSender()
+		}
+
+		if s.Faults != nil && s.Faults.ThrottleRate > 0 {
+			s.sender = s.Faults.throttle(s.sender)
+		}
+
+		if s.Limiter != nil {
+			s.sender = s.Limiter.limit(s.sender)
+		}
+
+		s.sender = s.correlate(conditional(s.sender))
+	})
+
+	return s.sender
 }
 
-// Attaches the session's authorizer to a new instance of the VMSS VM client
-func (s *azureSession) getVMSSVMClient() compute.VirtualMachineScaleSetVMsClient {
-	client := compute.NewVirtualMachineScaleSetVMsClient(s.SubscriptionID)
+// Attaches the session's authorizer and shared sender to an autorest
+// client. Replayed runs skip the polling and retry delays of the original.
+func (s *azureSession) configureClient(client *autorest.Client) {
 	client.Authorizer = *s.Authorizer
+	client.Sender = s.getSender()
+
+	if s.Recorder != nil && s.Recorder.Replaying() {
+		client.PollingDelay = 0
+		client.RetryDuration = 0
+	}
+}
+
+// Returns the client cached under 'key', creating it on first use.
+// Clients are configured once and shared for the life of the session.
+func (s *azureSession) cachedClient(key string, create func() interface{}) interface{} {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.clients == nil {
+		s.clients = map[string]interface{}{}
+	}
+
+	client, ok := s.clients[key]
+	if !ok {
+		client = create()
+		s.clients[key] = client
+	}
+
 	return client
 }
 
+// Returns the session's VM Scale Set client
+func (s *azureSession) getVMSSClient() vmss.ScaleSetsClient {
+	return s.ScaleSets
+}
+
+// Returns the session's VMSS VM client
+func (s *azureSession) getVMSSVMClient() vmss.VMsClient {
+	return s.VMs
+}
+
 // Iterates through the instances within a Scale Set. If 'protect' is true,
 // we apply scale-in protection to any instances which are the latest model
 // (created using the most recent VMSS configuration). When false, we remove
 // protection from all instances.
 //
+// Scale sets have no batch API for protection, so the per-instance updates
+// are issued concurrently for the instances in a single listing which
+// aren't already in the desired state. Each update carries only the
+// protection policy, leaving the rest of the instance alone. It is
+// conditional on the instance's ETag, so a concurrent change by other
+// tooling is retried against fresh state, and an instance busy with
+// another operation is retried once that completes.
+//
 // Returns a slice of futures, which we can optionally await to block further
 // operations until we know the operations have completed.
-func (s *azureSession) setVMProtection(ctx context.Context, protect bool) ([]compute.VirtualMachineScaleSetVMsUpdateFuture, error) {
-	var futures []compute.VirtualMachineScaleSetVMsUpdateFuture
+func (s *azureSession) setVMProtection(ctx context.Context, protect bool) ([]vmss.VMFuture, error) {
+	var futures []vmss.VMFuture
 	var filter string
 
 	client := s.getVMSSVMClient()
@@ -63,104 +164,209 @@ func (s *azureSession) setVMProtection(ctx context.Context, protect bool) ([]com
 		log.Info("Removing scale-in protection from Scale Set instances...")
 	}
 
-	for vms, err := client.ListComplete(ctx, s.ResourceGroupName, s.ScaleSetName, filter, "", ""); vms.NotDone(); err = vms.Next() {
-		if err != nil {
-			return futures, err
-		}
+	vms, err := client.List(ctx, s.ResourceGroupName, s.ScaleSetName, filter, "")
+	if err != nil {
+		return futures, err
+	}
 
-		vm := vms.Value()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, protectionConcurrency)
 
-		vm.ProtectionPolicy = &compute.VirtualMachineScaleSetVMProtectionPolicy{
-			ProtectFromScaleIn:         &protect,
-			ProtectFromScaleSetActions: to.BoolPtr(false),
+	for _, vm := range vms {
+		if protectedFromScaleIn(vm) == protect {
+			continue
 		}
 
-		future, err := client.Update(
-			ctx,
-			s.ResourceGroupName,
-			s.ScaleSetName,
-			*vm.InstanceID,
-			vm,
-		)
-		if err != nil {
-			return futures, err
-		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(instanceID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var future vmss.VMFuture
+			err := retryWhileBusy(ctx, "instance "+instanceID, func() error {
+				return retryOnConflict("instance "+instanceID, func() error {
+					vm, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName, instanceID)
+					if err != nil {
+						return err
+					}
+					if protectedFromScaleIn(vm) == protect {
+						return nil
+					}
+
+					patch := compute.VirtualMachineScaleSetVM{
+						VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+							ProtectionPolicy: &compute.VirtualMachineScaleSetVMProtectionPolicy{
+								ProtectFromScaleIn:         &protect,
+								ProtectFromScaleSetActions: to.BoolPtr(false),
+							},
+						},
+					}
+
+					future, err = client.Update(withIfMatch(ctx, etagOf(vm.Response)), s.ResourceGroupName, s.ScaleSetName, instanceID, patch)
+					return err
+				})
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if future != nil {
+				futures = append(futures, future)
+			}
+		}(*vm.InstanceID)
+	}
+
+	wg.Wait()
+	return futures, firstErr
+}
+
+// Reports whether an instance is protected from scale-in
+func protectedFromScaleIn(vm compute.VirtualMachineScaleSetVM) bool {
+	return vm.VirtualMachineScaleSetVMProperties != nil && vm.ProtectionPolicy != nil &&
+		to.Bool(vm.ProtectionPolicy.ProtectFromScaleIn)
+}
+
+// Returns the instance IDs of all scale set members matching the given
+// OData filter.
+func (s *azureSession) getInstanceIDs(ctx context.Context, filter string) ([]string, error) {
+	var ids []string
+
+	client := s.getVMSSVMClient()
 
-		futures = append(futures, future)
+	vms, err := client.List(ctx, s.ResourceGroupName, s.ScaleSetName, filter, "")
+	if err != nil {
+		return ids, err
+	}
+
+	for _, vm := range vms {
+		ids = append(ids, *vm.InstanceID)
 	}
 
-	return futures, nil
+	return ids, nil
 }
 
-// Helper function, accepts a slice of VMSS VM Update futures and
-// spawns a goroutine to poll for success on each. Upon completion
-// of each, logs the modified VM's resource name. Upon completion
-// of all futures, returns.
-func (s *azureSession) awaitVMFutures(ctx context.Context, futures []compute.VirtualMachineScaleSetVMsUpdateFuture) error {
-	var wg sync.WaitGroup
-	var err error
-	e := make(chan error, 1)
+// Deletes the given instances from the scale set, which also reduces its
+// capacity by the same number.
+func (s *azureSession) deleteInstances(ctx context.Context, instanceIDs []string) error {
+	client := s.getVMSSClient()
 
-	// 'Fork' the upstream timed context.
-	// If the upstream context is canceled, these will die, too.
-	// Otherwise, an error in the 'inner' context will cancel the
-	// other API calls and pass the error out via channel.
-	subCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	future, err := client.DeleteInstances(ctx, s.ResourceGroupName, s.ScaleSetName, instanceIDs)
+	if err != nil {
+		return err
+	}
 
-	for _, future := range futures {
-		client := s.getVMSSVMClient()
+	return future.Wait(ctx)
+}
+
+// vmResult is the outcome of a single instance update
+type vmResult struct {
+	VM  compute.VirtualMachineScaleSetVM
+	Err error
+}
 
+// Polls each VMSS VM Update future in its own goroutine, sending each
+// outcome on the returned channel as soon as it's known, so callers can
+// act on instances as they finish rather than once all have. The channel
+// is closed once every future has reported.
+func (s *azureSession) streamVMFutures(ctx context.Context, futures []vmss.VMFuture) <-chan vmResult {
+	var wg sync.WaitGroup
+	results := make(chan vmResult, len(futures))
+
+	for _, future := range futures {
 		wg.Add(1)
-		go func(client compute.VirtualMachineScaleSetVMsClient, future compute.VirtualMachineScaleSetVMsUpdateFuture) {
+		go func(future vmss.VMFuture) {
 			defer wg.Done()
 
-			innerErr := future.WaitForCompletionRef(subCtx, client.Client)
-			if innerErr != nil {
-				e <- innerErr
-				cancel()
+			if err := future.Wait(ctx); err != nil {
+				results <- vmResult{Err: err}
 				return
 			}
 
-			res, innerErr := future.Result(client)
-			if innerErr != nil {
-				e <- innerErr
+			vm, err := future.Result()
+			results <- vmResult{VM: vm, Err: err}
+		}(future)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// Helper function, accepts a slice of VMSS VM Update futures and
+// streams their results, logging each modified VM's resource name
+// and progress as it completes. Returns upon completion of all
+// futures, or the first failure, which cancels the rest.
+func (s *azureSession) awaitVMFutures(ctx context.Context, futures []vmss.VMFuture) error {
+	// 'Fork' the upstream timed context.
+	// If the upstream context is canceled, these will die, too.
+	// Otherwise, an error in one update will cancel the others.
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var err error
+	done := 0
+
+	for res := range s.streamVMFutures(subCtx, futures) {
+		if res.Err != nil {
+			if err == nil {
+				err = res.Err
 				cancel()
-				return
 			}
+			continue
+		}
 
-			log.Infof("Modified VM: %s", *res.Name)
-		}(client, future)
+		done++
+		log.Infof("Modified VM: %s (%d/%d)", to.String(res.VM.Name), done, len(futures))
 	}
 
-	wg.Wait()
-	if subCtx.Err() != nil {
-		err = <-e
-	}
-	close(e)
-	return err // Default nil if the channel was empty
+	return err
 }
 
-// Adjusts the desired capacity of the chosen scale set by a given factor.
-// Blocks execution until all VMSS instances have reported success.
+// Adjusts the desired capacity of the chosen scale set. Blocks execution
+// until all VMSS instances have reported success, and does nothing if the
+// scale set is already at that capacity.
 //
 // Instances will not report success until VM Extensions scripts have returned
 // with an exit code of 0.
-func (s *azureSession) scaleVMSSByFactor(ctx context.Context, factor float64) error {
+func (s *azureSession) scaleVMSS(ctx context.Context, capacity int64) error {
 	client := s.getVMSSClient()
 
-	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
-	if err != nil {
-		return err
-	}
+	return retryOnConflict("scale set "+s.ScaleSetName, func() error {
+		scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+		if err != nil {
+			return err
+		}
 
-	// Ick
-	newCapacity := int64(math.Floor(float64(*scaleSet.Sku.Capacity) * factor))
+		if *scaleSet.Sku.Capacity == capacity {
+			log.Infof("VMSS %s already has %d instances", *scaleSet.Name, capacity)
+			return nil
+		}
+
+		return s.setVMSSCapacity(ctx, scaleSet, capacity)
+	})
+}
+
+// Sets the desired capacity of the given scale set, blocking until the
+// update (and any resulting instance provisioning) has completed. The
+// update is conditional on the scale set being unchanged since it was read.
+func (s *azureSession) setVMSSCapacity(ctx context.Context, scaleSet compute.VirtualMachineScaleSet, newCapacity int64) error {
+	client := s.getVMSSClient()
 
 	log.Infof("Scaling VMSS %s to %d instances...", *scaleSet.Name, newCapacity)
 
 	future, err := client.Update(
-		ctx,
+		withIfMatch(ctx, etagOf(scaleSet.Response)),
 		s.ResourceGroupName,
 		s.ScaleSetName,
 		compute.VirtualMachineScaleSetUpdate{
@@ -175,83 +381,318 @@ func (s *azureSession) scaleVMSSByFactor(ctx context.Context, factor float64) er
 		return err
 	}
 
-	err = future.WaitForCompletionRef(ctx, client.Client)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return future.Wait(ctx)
 }
 
 // Initializes a new azureSession struct. Mostly used to get
 // rid of unnecessary variable passing and allow the chosen
-// authorizer to be easily replaced.
-func newSession(subscription string, rg string, scaleSet string) (*azureSession, error) {
-	authorizer, err := auth.NewAuthorizerFromCLI()
-	if err != nil {
-		return &azureSession{}, err
+// authorizer to be easily replaced. Replayed sessions don't
+// need credentials, so skip fetching them.
+func newSession(subscription string, rg string, scaleSet string, opts sessionOptions) (*azureSession, error) {
+	var authorizer autorest.Authorizer = autorest.NullAuthorizer{}
+
+	if opts.Recorder == nil || !opts.Recorder.Replaying() {
+		var err error
+		if authorizer, err = newAuthorizer(); err != nil {
+			return &azureSession{}, err
+		}
 	}
 
-	return &azureSession{
+	sess := &azureSession{
 		SubscriptionID:    subscription,
 		ResourceGroupName: rg,
 		ScaleSetName:      scaleSet,
 		Authorizer:        &authorizer,
-	}, nil
+		Recorder:          opts.Recorder,
+		Faults:            opts.Faults,
+		Limiter:           opts.Limiter,
+		RecordDeployments: opts.RecordDeployments,
+	}
+
+	scaleSets := compute.NewVirtualMachineScaleSetsClient(subscription)
+	sess.configureClient(&scaleSets.Client)
+	sess.ScaleSets = vmss.NewScaleSetsClient(scaleSets)
+
+	vms := compute.NewVirtualMachineScaleSetVMsClient(subscription)
+	sess.configureClient(&vms.Client)
+	sess.VMs = vmss.NewVMsClient(vms)
+
+	sess.injectFaults()
+
+	return sess, nil
+}
+
+// sessionOptions are the optional behaviours of a session
+type sessionOptions struct {
+	Recorder          *recorder.Recorder
+	Faults            *faultInjection
+	Limiter           *armRateLimiter
+	RecordDeployments bool
+}
+
+// Creates a session from the command's flags, recording or replaying its
+// ARM traffic if asked to. A --selector must match exactly one scale set.
+func newSessionFromFlags(ctx context.Context, cmd *cobra.Command) (*azureSession, error) {
+	sessions, err := newSessionsFromFlags(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) > 1 {
+		return nil, fmt.Errorf("--selector matched %d scale sets, but %s operates on one; narrow the selector, or name the scale set", len(sessions), cmd.Name())
+	}
+
+	return sessions[0], nil
+}
+
+// Creates a session for the given scale set, simulating it if the
+// command's flags ask to.
+func newSessionWithOptions(cmd *cobra.Command, subscription string, rg string, scaleSet string, opts sessionOptions) (*azureSession, error) {
+	var sess *azureSession
+	var err error
+
+	if simulate, _ := cmd.Flags().GetBool("simulate"); simulate {
+		sess, err = newSimulatedSession(cmd, subscription, rg, scaleSet, opts.Faults)
+	} else {
+		sess, err = newSession(subscription, rg, scaleSet, opts)
+	}
+	if err != nil {
+		return sess, err
+	}
+
+	sess.RunID = defaultRunID(cmd)
+	return sess, nil
+}
+
+// Reads the session options from the command's flags. Every session
+// created with the same options shares their recorder and rate limits.
+func sessionOptionsFromFlags(cmd *cobra.Command) (sessionOptions, error) {
+	var opts sessionOptions
+	var err error
+
+	if opts.Faults, err = faultsFromFlags(cmd); err != nil {
+		return opts, err
+	}
+
+	if simulate, _ := cmd.Flags().GetBool("simulate"); simulate {
+		return opts, nil
+	}
+
+	if path := cmd.Flags().Lookup("record").Value.String(); path != "" {
+		log.Infof("Recording ARM interactions to %s", path)
+		opts.Recorder, err = recorder.New(path, recorder.Record)
+	} else if path := cmd.Flags().Lookup("replay").Value.String(); path != "" {
+		log.Infof("Replaying ARM interactions from %s", path)
+		opts.Recorder, err = recorder.New(path, recorder.Replay)
+	}
+	if err != nil {
+		return opts, err
+	}
+
+	reads, _ := cmd.Flags().GetInt("arm-reads-per-minute")
+	writes, _ := cmd.Flags().GetInt("arm-writes-per-minute")
+	opts.Limiter = newARMRateLimiter(reads, writes)
+
+	if flag := cmd.Flags().Lookup("record-deployment"); flag != nil {
+		opts.RecordDeployments = flag.Value.String() == "true"
+	}
+
+	return opts, nil
 }
 
-// Run initializes a session and executes the upgrade operation
+// Run initializes a session and executes the upgrade operation. When a
+// selector matches several scale sets, they're upgraded one at a time,
+// stopping at the first failure.
 func Run(cmd *cobra.Command, args []string) {
 	log.Info("Initializing Cluster Blue/Green Upgrade")
 
-	// Maybe we should let users override the timeout with a CLI flag?
-	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	ctx, cancel := upgradeContext(cmd)
 	defer cancel() // In the event we return/exit early, stop all children of this context
 
-	sess, err := newSession(
-		cmd.Flags().Lookup("subscription-id").Value.String(),
-		cmd.Flags().Lookup("resource-group").Value.String(),
-		cmd.Flags().Lookup("vm-scale-set").Value.String(),
-	)
+	sessions, err := newSessionsFromFlags(ctx, cmd)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 
-	if err = sess.scaleVMSSByFactor(ctx, 2); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	if len(sessions) == 1 {
+		sessions[0].upgrade(ctx, cmd)
+		return
+	}
+
+	for i, sess := range sessions {
+		log.Infof("Upgrading scale set %d of %d: %s/%s", i+1, len(sessions), sess.ResourceGroupName, sess.ScaleSetName)
+
+		// Each scale set gets the timeout of a single upgrade
+		upgradeCtx, cancel := upgradeContext(cmd)
+		err := sess.runUpgrade(upgradeCtx, cmd)
+		cancel()
+
+		if err != nil {
+			fail(fmt.Errorf("upgrade of %s failed, leaving %d selected scale sets unattempted: %w", sess.ScaleSetName, len(sessions)-i-1, err))
+		}
+	}
+}
+
+// Returns how long a single upgrade may run before it's abandoned: the
+// --timeout given, or otherwise 20 minutes on top of the longest the
+// enabled phases may wait
+func upgradeTimeout(cmd *cobra.Command) time.Duration {
+	if timeout, _ := cmd.Flags().GetDuration("timeout"); timeout > 0 {
+		return timeout
+	}
+
+	timeout := timeoutMinutes * time.Minute
+	for _, wait := range phaseWaits(cmd) {
+		timeout += wait
 	}
+	return timeout
+}
+
+// Returns the longest the phases enabled by the command's flags may wait
+// for something outside the upgrade, by the flag setting each
+func phaseWaits(cmd *cobra.Command) map[string]time.Duration {
+	waits := map[string]time.Duration{}
+	duration := func(name string) time.Duration {
+		value, _ := cmd.Flags().GetDuration(name)
+		return value
+	}
+	text := func(name string) string {
+		value, _ := cmd.Flags().GetString(name)
+		return value
+	}
+
+	if trigger, _ := cmd.Flags().GetBool("backup-trigger"); trigger && text("backup-vault") != "" {
+		waits["backup-timeout"] = duration("backup-timeout")
+	}
+	if text("service-health") == serviceHealthPause {
+		waits["service-health-timeout"] = duration("service-health-timeout")
+	}
+	if duration("health-watch-interval") > 0 {
+		waits["health-watch-timeout"] = duration("health-watch-timeout")
+	}
+	if text("sessions-from") != "" {
+		waits["sessions-max-wait"] = duration("sessions-max-wait")
+	}
+	if steps, _ := cmd.Flags().GetInt("warm-up-steps"); steps > 1 {
+		waits["warm-up-interval"] = time.Duration(steps-1) * duration("warm-up-interval")
+	}
+	waits["lb-health-timeout"] = duration("lb-health-timeout")
+
+	return waits
+}
+
+// Returns the phase waits which a --timeout given can't accommodate, each
+// of which would have the upgrade abandoned part way through
+func timeoutProblems(cmd *cobra.Command) []string {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	if timeout <= 0 {
+		return nil
+	}
+
+	var problems []string
+	for name, wait := range phaseWaits(cmd) {
+		if wait >= timeout {
+			problems = append(problems, fmt.Sprintf("--%s allows waiting %s, which --timeout %s can't accommodate", name, wait, timeout))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Performs the blue/green swap of every instance onto the scale set's
+// current model, running any extra phases ahead of the surge. Exits the
+// process on failure, with the code for how far the upgrade got.
+func (s *azureSession) upgrade(ctx context.Context, cmd *cobra.Command, extra ...phase.Step) {
+	run := newUpgradeRun(s, cmd)
+	run.modelChanging = len(extra) > 0 || run.rotation != nil
+
+	run.finish(run.execute(ctx, extra...))
+}
+
+// Performs the blue/green swap of every instance onto the scale set's
+// current model, as for upgrade, returning any failure.
+func (s *azureSession) runUpgrade(ctx context.Context, cmd *cobra.Command, extra ...phase.Step) error {
+	run := newUpgradeRun(s, cmd)
+	run.modelChanging = len(extra) > 0 || run.rotation != nil
+
+	return run.execute(ctx, extra...)
+}
+
+// Runs the phases of an upgrade, unless it turns out to have already
+// completed, or finishes one whose surge was held
+func (r *upgradeRun) execute(ctx context.Context, extra ...phase.Step) error {
+	var proceed bool
+	var err error
+	if r.finishing {
+		proceed, err = r.detectHeldSurge(ctx)
+	} else {
+		onRerun := r.cmd.Flags().Lookup("on-rerun").Value.String()
+		proceed, err = r.detectRerun(ctx, onRerun, r.modelChanging || r.retiring != nil)
+	}
+	if err != nil || !proceed {
+		r.upToDate = err == nil
+		return err
+	}
+
+	engine := phase.NewEngine(r.steps(extra...)...)
+	engine.RollbackOnFailure, _ = r.cmd.Flags().GetBool("rollback-on-failure")
+	engine.RollbackTimeout = rollbackTimeout
 
-	log.Info("Waiting for new instances to reach Running state...")
+	stopHealthWatch := r.startHealthWatch(ctx)
+	err = engine.Run(ctx)
+	stopHealthWatch()
 
-	// Protect newly-created instances
-	scaleOutFutures, err := sess.setVMProtection(ctx, true)
+	// Capacity reserved or hosts added for the surge are paid for while
+	// they're held, so are released on failure even without a rollback
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		r.releaseCapacityOnFailure()
 	}
 
-	if err = sess.awaitVMFutures(ctx, scaleOutFutures); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	// Assertions are made once every phase succeeded, outside the engine,
+	// so failing them leaves the completed upgrade in place. A held surge
+	// is only verified once finished.
+	if err == nil && r.announced && r.strategyName != strategyScaleOutOnly {
+		err = r.verifyAssertions(ctx)
 	}
 
-	// Halve VMSS Capacity
-	if err = sess.scaleVMSSByFactor(ctx, 0.5); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	// Runs which failed validation never started, so aren't announced
+	if r.announced {
+		r.costSurge(ctx)
+		if err != nil {
+			r.publishEvent(ctx, eventUpgradeFailed, "", err)
+		} else {
+			r.publishEvent(ctx, eventUpgradeCompleted, "", nil)
+		}
+		r.closeChange(ctx, err)
 	}
 
-	// Un-protect instances
-	scaleInFutures, err := sess.setVMProtection(ctx, false)
+	r.reportCI(err)
+
+	return upgradeFailure(err, r.announced)
+}
+
+// Confirms that every remaining instance runs the latest scale set model
+// and logs a short report of the scale set's final state.
+func (s *azureSession) verifyUpgrade(ctx context.Context) error {
+	stale, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
 	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		return err
 	}
 
-	if err = sess.awaitVMFutures(ctx, scaleInFutures); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+	if len(stale) > 0 {
+		return fmt.Errorf("%d instances are not running the latest model: %s", len(stale), strings.Join(stale, ", "))
 	}
+
+	current, err := s.getInstanceIDs(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"scaleSet":  s.ScaleSetName,
+		"instances": len(current),
+	}).Info("Upgrade complete, all instances are running the latest model")
+
+	return nil
 }
@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schema of the templates model changes are deployed with
+const deploymentTemplateSchema = "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#"
+
+// Merges a JSON merge patch (RFC 7386) into a decoded JSON object: objects
+// are merged key by key, nulls remove keys and anything else replaces them
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+
+		child, isObject := value.(map[string]interface{})
+		existing, wasObject := target[key].(map[string]interface{})
+		if isObject && wasObject {
+			mergePatch(existing, child)
+			continue
+		}
+		target[key] = value
+	}
+}
+
+// Builds the template resource of a scale set as ARM returns it, leaving
+// out what ARM sets itself
+func scaleSetTemplateResource(name string, scaleSet map[string]interface{}) map[string]interface{} {
+	resource := map[string]interface{}{
+		"type":       "Microsoft.Compute/virtualMachineScaleSets",
+		"apiVersion": newerComputeAPIVersion,
+		"name":       name,
+	}
+	for _, key := range []string{"location", "tags", "sku", "plan", "zones", "identity", "extendedLocation", "properties"} {
+		if value, ok := scaleSet[key]; ok {
+			resource[key] = value
+		}
+	}
+
+	if properties, ok := resource["properties"].(map[string]interface{}); ok {
+		for _, key := range []string{"provisioningState", "uniqueId", "timeCreated"} {
+			delete(properties, key)
+		}
+	}
+
+	if identity, ok := resource["identity"].(map[string]interface{}); ok {
+		delete(identity, "principalId")
+		delete(identity, "tenantId")
+		if assigned, ok := identity["userAssignedIdentities"].(map[string]interface{}); ok {
+			for id := range assigned {
+				assigned[id] = map[string]interface{}{}
+			}
+		}
+	}
+
+	return resource
+}
+
+// Applies a model update as an ARM deployment of the whole scale set, so
+// the change appears in the resource group's deployment history, as those
+// made by other tooling do, rather than as a bare update. The update is
+// merged into the current model as the update itself would be. Unlike a
+// direct update, a deployment can't be made conditional on the model's
+// ETag, so a change made between reading the model and deploying it is
+// overwritten rather than retried.
+func (s *azureSession) deployModel(ctx context.Context, parameters compute.VirtualMachineScaleSetUpdate) error {
+	encoded, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+	var update map[string]interface{}
+	if err = json.Unmarshal(encoded, &update); err != nil {
+		return err
+	}
+
+	return s.deployModelPatch(ctx, update)
+}
+
+// Deploys the scale set with a JSON merge patch applied to its model, as
+// for deployModel
+func (s *azureSession) deployModelPatch(ctx context.Context, update map[string]interface{}) error {
+	var scaleSet map[string]interface{}
+	if err := s.armGet(ctx, s.scaleSetPath(), newerComputeAPIVersion, &scaleSet); err != nil {
+		return err
+	}
+	mergePatch(scaleSet, update)
+
+	name := "azure-cluster-upgrade-" + time.Now().UTC().Format("20060102-150405.000")
+	body := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"mode": "Incremental",
+			"template": map[string]interface{}{
+				"$schema":        deploymentTemplateSchema,
+				"contentVersion": "1.0.0.0",
+				"resources":      []interface{}{scaleSetTemplateResource(s.ScaleSetName, scaleSet)},
+			},
+		},
+	}
+	if s.RunID != "" {
+		body["tags"] = map[string]string{upgradeRunIDTag: s.RunID}
+	}
+
+	var deployment struct {
+		Properties struct {
+			ProvisioningState string `json:"provisioningState"`
+		} `json:"properties"`
+	}
+
+	log.Infof("Deploying the model change to %s as deployment %s...", s.ScaleSetName, name)
+	path := fmt.Sprintf("%s/providers/Microsoft.Resources/deployments/%s", s.resourceGroupPath(), name)
+	if err := s.armDoAsync(ctx, http.MethodPut, path, deploymentsAPIVersion, body, &deployment); err != nil {
+		return fmt.Errorf("deployment %s of the model change failed: %v", name, err)
+	}
+	if deployment.Properties.ProvisioningState != "Succeeded" {
+		return fmt.Errorf("deployment %s of the model change ended %s", name, deployment.Properties.ProvisioningState)
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	storageResource = "https://storage.azure.com/"
+	storageVersion  = "2019-02-02"
+
+	diagnosticsTimeoutMinutes = 5
+)
+
+// diagnosticsCapture records where the debugging artifacts for a single
+// failed instance ended up, so they can be referenced in the failure report.
+type diagnosticsCapture struct {
+	InstanceID string
+	Files      []string
+	BlobURIs   []string
+}
+
+// Returns the IDs of new (latest model) instances whose instance view
+// reports a failed provisioning state or that never reached 'Running'.
+func (s *azureSession) getFailedNewInstances(ctx context.Context) ([]string, error) {
+	var failed []string
+
+	client := s.getVMSSVMClient()
+
+	vms, err := client.List(ctx, s.ResourceGroupName, s.ScaleSetName, "properties/latestModelApplied eq true", "instanceView")
+	if err != nil {
+		return failed, err
+	}
+
+	for _, vm := range vms {
+		if vm.InstanceView == nil || vm.InstanceView.Statuses == nil {
+			continue
+		}
+
+		running, provisioningFailed := false, false
+		for _, status := range *vm.InstanceView.Statuses {
+			code := to.String(status.Code)
+			switch {
+			case code == "PowerState/running":
+				running = true
+			case strings.HasPrefix(code, "ProvisioningState/failed"):
+				provisioningFailed = true
+			}
+		}
+
+		if provisioningFailed || !running {
+			failed = append(failed, *vm.InstanceID)
+		}
+	}
+
+	return failed, nil
+}
+
+// Fetches the instance view for each of the given instances, writes its
+// statuses to the output directory and attempts to download the boot
+// diagnostics screenshot and serial log. Blob downloads that fail (e.g.
+// missing data-plane permissions) are logged, and their URIs retained so
+// they can be retrieved by hand.
+func (s *azureSession) captureBootDiagnostics(ctx context.Context, instanceIDs []string, dir string) ([]diagnosticsCapture, error) {
+	var captures []diagnosticsCapture
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return captures, err
+	}
+
+	client := s.getVMSSVMClient()
+
+	// Boot diagnostics blobs live behind the storage data plane, which
+	// needs a token scoped to storage rather than ARM.
+	blobAuthorizer, authErr := newAuthorizerForResource(storageResource)
+	if authErr != nil {
+		log.Warnf("Unable to authorize against storage, boot diagnostics blobs will not be downloaded: %v", authErr)
+	}
+
+	for _, instanceID := range instanceIDs {
+		capture := diagnosticsCapture{InstanceID: instanceID}
+
+		view, err := client.GetInstanceView(ctx, s.ResourceGroupName, s.ScaleSetName, instanceID)
+		if err != nil {
+			log.Warnf("Unable to fetch instance view for instance %s: %v", instanceID, err)
+			captures = append(captures, capture)
+			continue
+		}
+
+		statusFile := filepath.Join(dir, fmt.Sprintf("%s-%s-instance-view.json", s.ScaleSetName, instanceID))
+		contents, err := json.MarshalIndent(view, "", "  ")
+		if err != nil {
+			return captures, err
+		}
+		if err = ioutil.WriteFile(statusFile, contents, 0644); err != nil {
+			return captures, err
+		}
+		capture.Files = append(capture.Files, statusFile)
+
+		if view.BootDiagnostics != nil {
+			for _, uri := range []*string{view.BootDiagnostics.ConsoleScreenshotBlobURI, view.BootDiagnostics.SerialConsoleLogBlobURI} {
+				if uri == nil {
+					continue
+				}
+				capture.BlobURIs = append(capture.BlobURIs, *uri)
+
+				if authErr != nil {
+					continue
+				}
+
+				dest := filepath.Join(dir, fmt.Sprintf("%s-%s-%s", s.ScaleSetName, instanceID, path.Base(*uri)))
+				if err = downloadBlob(ctx, blobAuthorizer, *uri, dest); err != nil {
+					log.Warnf("Unable to download %s: %v", *uri, err)
+					continue
+				}
+				capture.Files = append(capture.Files, dest)
+			}
+		}
+
+		captures = append(captures, capture)
+	}
+
+	return captures, nil
+}
+
+// Downloads a single blob to the given local path
+func downloadBlob(ctx context.Context, authorizer autorest.Authorizer, uri string, dest string) error {
+	contents, err := readBlob(ctx, authorizer, uri)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dest, contents, 0644)
+}
+
+// Returns the contents of a single blob
+func readBlob(ctx context.Context, authorizer autorest.Authorizer, uri string) ([]byte, error) {
+	req, err := autorest.Prepare(
+		(&http.Request{}).WithContext(ctx),
+		autorest.AsGet(),
+		autorest.WithBaseURL(uri),
+		autorest.WithHeader("x-ms-version", storageVersion),
+		authorizer.WithAuthorization(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := autorest.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Uploads the given contents as a block blob, replacing any existing blob
+func uploadBlob(ctx context.Context, authorizer autorest.Authorizer, uri string, contents []byte) error {
+	req, err := autorest.Prepare(
+		(&http.Request{}).WithContext(ctx),
+		autorest.AsPut(),
+		autorest.WithBaseURL(uri),
+		autorest.WithHeader("x-ms-version", storageVersion),
+		autorest.WithHeader("x-ms-blob-type", "BlockBlob"),
+		autorest.WithHeader("Content-Type", "application/json"),
+		autorest.WithBytes(&contents),
+		authorizer.WithAuthorization(),
+	)
+	if err != nil {
+		return err
+	}
+
+	resp, err := autorest.Send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Captures diagnostics for the given instances and logs pointers to the
+// collected artifacts. Used when a new instance fails its health checks,
+// just ahead of aborting the run. The run's own context may already have
+// expired at this point, so the capture gets a fresh deadline of its own.
+func (s *azureSession) reportFailedInstances(instanceIDs []string, dir string) {
+	if len(instanceIDs) == 0 || dir == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeoutMinutes*time.Minute)
+	defer cancel()
+
+	log.Infof("Capturing boot diagnostics for %d failed instances...", len(instanceIDs))
+
+	captures, err := s.captureBootDiagnostics(ctx, instanceIDs, dir)
+	if err != nil {
+		log.Warnf("Unable to capture boot diagnostics: %v", err)
+	}
+
+	for _, capture := range captures {
+		log.WithFields(log.Fields{
+			"instance": capture.InstanceID,
+			"files":    capture.Files,
+			"blobs":    capture.BlobURIs,
+		}).Error("Instance failed health checks, diagnostics captured")
+	}
+}
+
+// Looks up any unhealthy new instances and reports on them. Used when the
+// scale-out itself fails and we don't yet know which instances are at fault.
+func (s *azureSession) reportFailedNewInstances(dir string) {
+	if dir == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeoutMinutes*time.Minute)
+	defer cancel()
+
+	failed, err := s.getFailedNewInstances(ctx)
+	if err != nil {
+		log.Warnf("Unable to list failed instances: %v", err)
+		return
+	}
+
+	s.reportFailedInstances(failed, dir)
+}
@@ -0,0 +1,300 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// fieldDiff is a single field which differs between an instance and the
+// scale set model
+type fieldDiff struct {
+	Field    string `json:"field"`
+	Instance string `json:"instance"`
+	Model    string `json:"model"`
+}
+
+// instanceDiff lists the fields of one instance an upgrade would change
+type instanceDiff struct {
+	InstanceID string      `json:"instanceId"`
+	Name       string      `json:"name"`
+	Fields     []fieldDiff `json:"fields"`
+}
+
+// Flattens a value into dotted JSON paths (e.g. 'linuxConfiguration.ssh.
+// publicKeys[0].path') mapped to their JSON-encoded leaf values.
+func flattenFields(prefix string, v interface{}, out map[string]string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flattenFields(path, child, out)
+		}
+	case []interface{}:
+		for i, child := range value {
+			flattenFields(fmt.Sprintf("%s[%d]", prefix, i), child, out)
+		}
+	case nil:
+	default:
+		encoded, _ := json.Marshal(value)
+		out[prefix] = string(encoded)
+	}
+}
+
+// Compares two values field by field through their JSON representations,
+// ignoring any fields (relative to 'prefix') named in 'omit'.
+func diffFields(prefix string, instance interface{}, model interface{}, omit ...string) []fieldDiff {
+	var diffs []fieldDiff
+
+	flatten := func(v interface{}) map[string]string {
+		var generic interface{}
+		out := map[string]string{}
+
+		encoded, err := json.Marshal(v)
+		if err != nil || json.Unmarshal(encoded, &generic) != nil {
+			return out
+		}
+
+		if m, ok := generic.(map[string]interface{}); ok {
+			for _, field := range omit {
+				delete(m, field)
+			}
+		}
+
+		flattenFields(prefix, generic, out)
+		return out
+	}
+
+	current, desired := flatten(instance), flatten(model)
+
+	fields := map[string]bool{}
+	for field := range current {
+		fields[field] = true
+	}
+	for field := range desired {
+		fields[field] = true
+	}
+
+	sorted := make([]string, 0, len(fields))
+	for field := range fields {
+		sorted = append(sorted, field)
+	}
+	sort.Strings(sorted)
+
+	for _, field := range sorted {
+		if current[field] != desired[field] {
+			diffs = append(diffs, fieldDiff{Field: field, Instance: current[field], Model: desired[field]})
+		}
+	}
+
+	return diffs
+}
+
+// extensionFields are the parts of an extension which an upgrade applies
+type extensionFields struct {
+	Publisher               *string     `json:"publisher,omitempty"`
+	Type                    *string     `json:"type,omitempty"`
+	TypeHandlerVersion      *string     `json:"typeHandlerVersion,omitempty"`
+	AutoUpgradeMinorVersion *bool       `json:"autoUpgradeMinorVersion,omitempty"`
+	Settings                interface{} `json:"settings,omitempty"`
+}
+
+// Returns the scale set model's extensions, keyed by name
+func modelExtensions(scaleSet compute.VirtualMachineScaleSet) map[string]extensionFields {
+	extensions := map[string]extensionFields{}
+
+	profile := scaleSet.VirtualMachineProfile
+	if profile == nil || profile.ExtensionProfile == nil || profile.ExtensionProfile.Extensions == nil {
+		return extensions
+	}
+
+	for _, ext := range *profile.ExtensionProfile.Extensions {
+		fields := extensionFields{}
+		if props := ext.VirtualMachineScaleSetExtensionProperties; props != nil {
+			fields = extensionFields{props.Publisher, props.Type, props.TypeHandlerVersion, props.AutoUpgradeMinorVersion, props.Settings}
+		}
+		extensions[to.String(ext.Name)] = fields
+	}
+
+	return extensions
+}
+
+// Returns an instance's extensions, keyed by name
+func instanceExtensions(vm compute.VirtualMachineScaleSetVM) map[string]extensionFields {
+	extensions := map[string]extensionFields{}
+
+	if vm.Resources == nil {
+		return extensions
+	}
+
+	for _, ext := range *vm.Resources {
+		fields := extensionFields{}
+		if props := ext.VirtualMachineExtensionProperties; props != nil {
+			fields = extensionFields{props.Publisher, props.Type, props.TypeHandlerVersion, props.AutoUpgradeMinorVersion, props.Settings}
+		}
+		extensions[to.String(ext.Name)] = fields
+	}
+
+	return extensions
+}
+
+// Lists the differences between an instance and the scale set model in
+// the areas an upgrade changes: VM size, image, OS profile and extensions.
+func diffInstance(scaleSet compute.VirtualMachineScaleSet, vm compute.VirtualMachineScaleSetVM) []fieldDiff {
+	var diffs []fieldDiff
+
+	var modelSize, instanceSize string
+	if scaleSet.Sku != nil {
+		modelSize = to.String(scaleSet.Sku.Name)
+	}
+	if vm.Sku != nil {
+		instanceSize = to.String(vm.Sku.Name)
+	} else if vm.VirtualMachineScaleSetVMProperties != nil && vm.HardwareProfile != nil {
+		instanceSize = string(vm.HardwareProfile.VMSize)
+	}
+	if instanceSize != modelSize {
+		diffs = append(diffs, fieldDiff{Field: "vmSize", Instance: instanceSize, Model: modelSize})
+	}
+
+	var modelImage, modelOS, instanceImage, instanceOS interface{}
+	if profile := scaleSet.VirtualMachineProfile; profile != nil {
+		if profile.StorageProfile != nil {
+			modelImage = profile.StorageProfile.ImageReference
+		}
+		modelOS = profile.OsProfile
+	}
+	if vm.VirtualMachineScaleSetVMProperties != nil {
+		if vm.StorageProfile != nil {
+			instanceImage = vm.StorageProfile.ImageReference
+		}
+		instanceOS = vm.OsProfile
+	}
+
+	diffs = append(diffs, diffFields("image", instanceImage, modelImage, "exactVersion")...)
+	diffs = append(diffs, diffFields("osProfile", instanceOS, modelOS,
+		"computerName", "computerNamePrefix", "adminPassword", "customData", "allowExtensionOperations", "requireGuestProvisionSignal")...)
+
+	current, desired := instanceExtensions(vm), modelExtensions(scaleSet)
+	names := map[string]bool{}
+	for name := range current {
+		names[name] = true
+	}
+	for name := range desired {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		instanceExt, onInstance := current[name]
+		modelExt, inModel := desired[name]
+
+		switch {
+		case !onInstance:
+			diffs = append(diffs, fieldDiff{Field: "extensions." + name, Instance: "(absent)", Model: "(added)"})
+		case !inModel:
+			diffs = append(diffs, fieldDiff{Field: "extensions." + name, Instance: "(present)", Model: "(removed)"})
+		default:
+			diffs = append(diffs, diffFields("extensions."+name, instanceExt, modelExt)...)
+		}
+	}
+
+	return diffs
+}
+
+// Compares every instance against the scale set model, returning the
+// fields an upgrade would change on each instance which differs.
+func (s *azureSession) diffInstances(ctx context.Context) ([]instanceDiff, error) {
+	changed := []instanceDiff{}
+
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return changed, err
+	}
+
+	instanceIDs, err := s.getInstanceIDs(ctx, "")
+	if err != nil {
+		return changed, err
+	}
+
+	for _, instanceID := range instanceIDs {
+		vm, err := s.getVMSSVMClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName, instanceID)
+		if err != nil {
+			return changed, err
+		}
+
+		if diffs := diffInstance(scaleSet, vm); len(diffs) > 0 {
+			changed = append(changed, instanceDiff{InstanceID: instanceID, Name: to.String(vm.Name), Fields: diffs})
+		}
+	}
+
+	log.Infof("%d of %d instances differ from the scale set model", len(changed), len(instanceIDs))
+	return changed, nil
+}
+
+// Prints instance diffs as text
+func printDiffs(diffs []instanceDiff) {
+	for _, instance := range diffs {
+		fmt.Printf("instance %s (%s):\n", instance.InstanceID, instance.Name)
+		for _, diff := range instance.Fields {
+			fmt.Printf("  %s: %s -> %s\n", diff.Field, orNone(diff.Instance), orNone(diff.Model))
+		}
+	}
+}
+
+func orNone(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "(none)"
+	}
+	return value
+}
+
+// RunDiff prints the changes an upgrade would make to each instance
+func RunDiff(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	diffs, err := sess.diffInstances(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		err = printJSON(diffs)
+	} else {
+		printDiffs(diffs)
+	}
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+}
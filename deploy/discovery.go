@@ -0,0 +1,291 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	privateDNSAPIVersion = "2018-09-01"
+
+	discoveryPollInterval   = 15 * time.Second
+	defaultDiscoveryTimeout = 5 * time.Minute
+)
+
+// discoverySpec describes the service discovery system new instances are
+// expected to register with. It is read from the 'discovery' key of the
+// config file.
+type discoverySpec struct {
+	// One of 'privateDNS', 'consul' or 'http'
+	Type    string        `mapstructure:"type"`
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	PrivateDNS struct {
+		// Resource ID of the Private DNS zone
+		ZoneID string `mapstructure:"zoneID"`
+	} `mapstructure:"privateDNS"`
+
+	Consul struct {
+		Address string `mapstructure:"address"`
+		Service string `mapstructure:"service"`
+		// ACL token reference, see resolveSecret. Defaults to the
+		// CONSUL_HTTP_TOKEN environment variable.
+		Token string `mapstructure:"token"`
+	} `mapstructure:"consul"`
+
+	HTTP struct {
+		// Endpoint returning a JSON array of registered IP addresses
+		URL string `mapstructure:"url"`
+		// Bearer token reference, see resolveSecret
+		Token string `mapstructure:"token"`
+	} `mapstructure:"http"`
+}
+
+// discoveryBackend reports the set of addresses currently registered in a
+// service discovery system.
+type discoveryBackend interface {
+	registeredAddresses(ctx context.Context) (map[string]bool, error)
+	// Returns a remediation hint for when registration doesn't converge
+	hint(registered bool) string
+}
+
+type privateDNSBackend struct {
+	sess   *azureSession
+	zoneID string
+}
+
+type consulBackend struct {
+	address string
+	service string
+	token   secret
+}
+
+type httpRegistryBackend struct {
+	url   string
+	token secret
+}
+
+// Reads the discovery spec from the config file. Returns nil when no
+// discovery system is configured.
+func loadDiscoverySpec() (*discoverySpec, error) {
+	if !viper.IsSet("discovery") {
+		return nil, nil
+	}
+
+	spec := &discoverySpec{Timeout: defaultDiscoveryTimeout}
+	spec.Consul.Token = secretFromEnv + "CONSUL_HTTP_TOKEN"
+	if err := viper.UnmarshalKey("discovery", spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Builds the backend described by the spec, resolving its credentials
+func (s *azureSession) newDiscoveryBackend(ctx context.Context, spec *discoverySpec) (discoveryBackend, error) {
+	switch spec.Type {
+	case "privateDNS":
+		return &privateDNSBackend{sess: s, zoneID: spec.PrivateDNS.ZoneID}, nil
+	case "consul":
+		token, err := resolveSecret(ctx, spec.Consul.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve Consul token: %v", err)
+		}
+		return &consulBackend{address: strings.TrimRight(spec.Consul.Address, "/"), service: spec.Consul.Service, token: token}, nil
+	case "http":
+		token, err := resolveSecret(ctx, spec.HTTP.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve registry token: %v", err)
+		}
+		return &httpRegistryBackend{url: spec.HTTP.URL, token: token}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery type %q", spec.Type)
+	}
+}
+
+// Collects every A record IPv4 address in the zone
+func (b *privateDNSBackend) registeredAddresses(ctx context.Context) (map[string]bool, error) {
+	var recordSets []struct {
+		Properties struct {
+			ARecords []struct {
+				IPv4Address string `json:"ipv4Address"`
+			} `json:"aRecords"`
+		} `json:"properties"`
+	}
+	addresses := map[string]bool{}
+
+	query := map[string]interface{}{"api-version": privateDNSAPIVersion}
+	if err := b.sess.armList(ctx, b.zoneID+"/A", query, &recordSets); err != nil {
+		return addresses, err
+	}
+
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Properties.ARecords {
+			addresses[record.IPv4Address] = true
+		}
+	}
+
+	return addresses, nil
+}
+
+func (b *privateDNSBackend) hint(registered bool) string {
+	if registered {
+		return fmt.Sprintf("check that new instances are creating their A records in %s, and that the registering identity has 'Private DNS Zone Contributor' on the zone", b.zoneID)
+	}
+	return fmt.Sprintf("stale A records remain in %s, remove them by hand or check the deregistration hook on shutdown", b.zoneID)
+}
+
+// Collects the addresses of every instance of the service in the Consul catalog
+func (b *consulBackend) registeredAddresses(ctx context.Context) (map[string]bool, error) {
+	var entries []struct {
+		Address        string `json:"Address"`
+		ServiceAddress string `json:"ServiceAddress"`
+	}
+	addresses := map[string]bool{}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/catalog/service/%s", b.address, b.service), nil)
+	if err != nil {
+		return addresses, err
+	}
+	if b.token != "" {
+		req.Header.Set("X-Consul-Token", b.token.reveal())
+	}
+
+	if err = getJSON(ctx, req, &entries); err != nil {
+		return addresses, err
+	}
+
+	for _, entry := range entries {
+		addresses[entry.Address] = true
+		if entry.ServiceAddress != "" {
+			addresses[entry.ServiceAddress] = true
+		}
+	}
+
+	return addresses, nil
+}
+
+func (b *consulBackend) hint(registered bool) string {
+	if registered {
+		return fmt.Sprintf("check that the Consul agent on new instances is running, has joined the cluster and registers service '%s'", b.service)
+	}
+	return fmt.Sprintf("removed instances are still registered for service '%s', force-leave their nodes with 'consul force-leave'", b.service)
+}
+
+// Fetches a JSON array of registered addresses from a custom registry
+func (b *httpRegistryBackend) registeredAddresses(ctx context.Context) (map[string]bool, error) {
+	var entries []string
+	addresses := map[string]bool{}
+
+	req, err := http.NewRequest(http.MethodGet, b.url, nil)
+	if err != nil {
+		return addresses, err
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token.reveal())
+	}
+
+	if err = getJSON(ctx, req, &entries); err != nil {
+		return addresses, err
+	}
+
+	for _, entry := range entries {
+		addresses[entry] = true
+	}
+
+	return addresses, nil
+}
+
+func (b *httpRegistryBackend) hint(registered bool) string {
+	if registered {
+		return fmt.Sprintf("check that new instances register themselves with %s", b.url)
+	}
+	return fmt.Sprintf("removed instances are still listed by %s, check the registry's deregistration or TTL settings", b.url)
+}
+
+// Sends a request and decodes its JSON response
+func getJSON(ctx context.Context, req *http.Request, result interface{}) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Returns the primary private IP of every instance matching the filter,
+// keyed by instance ID.
+func (s *azureSession) getInstanceIPs(ctx context.Context, filter string) (map[string]string, error) {
+	addresses := map[string]string{}
+
+	instanceIDs, err := s.getInstanceIDs(ctx, filter)
+	if err != nil {
+		return addresses, err
+	}
+
+	for _, instanceID := range instanceIDs {
+		address, err := s.getInstancePrivateIP(ctx, instanceID)
+		if err != nil {
+			return addresses, err
+		}
+		addresses[instanceID] = address
+	}
+
+	return addresses, nil
+}
+
+// Polls the discovery backend until every one of the given instance
+// addresses is registered (or, if 'registered' is false, deregistered).
+// Times out with a remediation hint if the registry doesn't converge.
+func awaitDiscovery(ctx context.Context, backend discoveryBackend, instances map[string]string, registered bool, timeout time.Duration) error {
+	state := "deregister"
+	if registered {
+		state = "register"
+	}
+
+	log.Infof("Waiting for %d instances to %s with service discovery...", len(instances), state)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := backend.registeredAddresses(ctx)
+		if err != nil {
+			return err
+		}
+
+		var pending []string
+		for instanceID, address := range instances {
+			if current[address] != registered {
+				pending = append(pending, fmt.Sprintf("%s (%s)", instanceID, address))
+			}
+		}
+		sort.Strings(pending)
+
+		if len(pending) == 0 {
+			log.Infof("All instances %sed with service discovery", state)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instances failed to %s after %s: %s; hint: %s", state, timeout, strings.Join(pending, ", "), backend.hint(registered))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(discoveryPollInterval):
+		}
+	}
+}
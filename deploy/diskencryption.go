@@ -0,0 +1,185 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	keyVaultARMAPIVersion = "2019-09-01"
+)
+
+// Key permissions a disk encryption set's identity needs on its vault
+var diskEncryptionKeyPermissions = []string{"get", "wrapKey", "unwrapKey"}
+
+// Returns the session's Disk Encryption Set client for a subscription
+func (s *azureSession) getDiskEncryptionSetsClient(subscription string) compute.DiskEncryptionSetsClient {
+	return s.cachedClient("diskEncryptionSets/"+subscription, func() interface{} {
+		client := compute.NewDiskEncryptionSetsClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.DiskEncryptionSetsClient)
+}
+
+// Returns the IDs of the disk encryption sets the scale set model's OS
+// and data disks are encrypted with, sorted and without duplicates
+func modelDiskEncryptionSets(scaleSet compute.VirtualMachineScaleSet) []string {
+	if scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.VirtualMachineProfile == nil ||
+		scaleSet.VirtualMachineProfile.StorageProfile == nil {
+		return nil
+	}
+	storage := scaleSet.VirtualMachineProfile.StorageProfile
+
+	var disks []*compute.VirtualMachineScaleSetManagedDiskParameters
+	if storage.OsDisk != nil {
+		disks = append(disks, storage.OsDisk.ManagedDisk)
+	}
+	if storage.DataDisks != nil {
+		for _, disk := range *storage.DataDisks {
+			disks = append(disks, disk.ManagedDisk)
+		}
+	}
+
+	unique := map[string]string{}
+	for _, disk := range disks {
+		if disk != nil && disk.DiskEncryptionSet != nil && disk.DiskEncryptionSet.ID != nil {
+			unique[strings.ToLower(*disk.DiskEncryptionSet.ID)] = *disk.DiskEncryptionSet.ID
+		}
+	}
+
+	ids := make([]string, 0, len(unique))
+	for _, id := range unique {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Checks a disk encryption set is usable: it exists and is provisioned,
+// its key is enabled and unexpired, and its identity may use the key.
+// Whether the key is enabled is read from Key Vault with the caller's own
+// access, so it's skipped with a warning where the caller has none.
+func (s *azureSession) checkDiskEncryptionSet(ctx context.Context, desID string) error {
+	id, err := azure.ParseResourceID(desID)
+	if err != nil {
+		return err
+	}
+
+	des, err := s.getDiskEncryptionSetsClient(id.SubscriptionID).Get(ctx, id.ResourceGroup, id.ResourceName)
+	if err != nil {
+		return fmt.Errorf("disk encryption set %s can't be read: %v", id.ResourceName, err)
+	}
+
+	props := des.EncryptionSetProperties
+	if props == nil || props.ActiveKey == nil || props.ActiveKey.KeyURL == nil {
+		return fmt.Errorf("disk encryption set %s has no active key", id.ResourceName)
+	}
+	if state := to.String(props.ProvisioningState); !strings.EqualFold(state, "Succeeded") {
+		return fmt.Errorf("disk encryption set %s is in provisioning state %s", id.ResourceName, state)
+	}
+
+	keyURL := *props.ActiveKey.KeyURL
+
+	var key struct {
+		Attributes struct {
+			Enabled bool  `json:"enabled"`
+			Expires int64 `json:"exp"`
+		} `json:"attributes"`
+	}
+	if err = keyVaultGet(ctx, keyURL, "/keys/", &key); err != nil {
+		log.Warnf("Unable to read key %s of disk encryption set %s, skipping the key check: %v", keyURL, id.ResourceName, err)
+	} else {
+		if !key.Attributes.Enabled {
+			return fmt.Errorf("key %s of disk encryption set %s is disabled, new instances' disks couldn't be encrypted", keyURL, id.ResourceName)
+		}
+		if key.Attributes.Expires != 0 && time.Unix(key.Attributes.Expires, 0).Before(time.Now()) {
+			return fmt.Errorf("key %s of disk encryption set %s expired at %s", keyURL, id.ResourceName, time.Unix(key.Attributes.Expires, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	if des.Identity == nil || des.Identity.PrincipalID == nil {
+		return fmt.Errorf("disk encryption set %s has no managed identity to access its key with", id.ResourceName)
+	}
+	if props.ActiveKey.SourceVault == nil || props.ActiveKey.SourceVault.ID == nil {
+		return nil
+	}
+
+	return s.checkVaultKeyAccess(ctx, *props.ActiveKey.SourceVault.ID, *des.Identity.PrincipalID, id.ResourceName)
+}
+
+// Checks a vault's access policies grant a principal the key permissions
+// disk encryption needs. Vaults using Azure RBAC instead are left to the
+// platform, since role assignments can be inherited from anywhere above.
+func (s *azureSession) checkVaultKeyAccess(ctx context.Context, vaultID string, principalID string, desName string) error {
+	var vault struct {
+		Properties struct {
+			EnableRbacAuthorization bool `json:"enableRbacAuthorization"`
+			AccessPolicies          []struct {
+				ObjectID    string `json:"objectId"`
+				Permissions struct {
+					Keys []string `json:"keys"`
+				} `json:"permissions"`
+			} `json:"accessPolicies"`
+		} `json:"properties"`
+	}
+
+	if err := s.armGet(ctx, vaultID, keyVaultARMAPIVersion, &vault); err != nil {
+		return fmt.Errorf("key vault of disk encryption set %s can't be read: %v", desName, err)
+	}
+
+	if vault.Properties.EnableRbacAuthorization {
+		log.Infof("Key vault of disk encryption set %s uses Azure RBAC, not checking its identity's access", desName)
+		return nil
+	}
+
+	granted := map[string]bool{}
+	for _, policy := range vault.Properties.AccessPolicies {
+		if !strings.EqualFold(policy.ObjectID, principalID) {
+			continue
+		}
+		for _, permission := range policy.Permissions.Keys {
+			granted[strings.ToLower(permission)] = true
+		}
+	}
+
+	var missing []string
+	for _, permission := range diskEncryptionKeyPermissions {
+		if !granted[strings.ToLower(permission)] && !granted["all"] {
+			missing = append(missing, permission)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("identity %s of disk encryption set %s lacks key permissions %s on %s; grant them in the vault's access policies",
+			principalID, desName, strings.Join(missing, ", "), vaultID)
+	}
+
+	return nil
+}
+
+// Validates every disk encryption set the scale set model uses, so a
+// missing set, disabled key or revoked access fails the preflight rather
+// than surfacing as opaque provisioning errors on the surged instances
+func (s *azureSession) preflightDiskEncryption(ctx context.Context) error {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	for _, desID := range modelDiskEncryptionSets(scaleSet) {
+		if err = s.checkDiskEncryptionSet(ctx, desID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
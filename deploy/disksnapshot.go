@@ -0,0 +1,105 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tags recording which scale set a snapshot of an old instance's data disk
+// was taken from, and when it may be deleted
+const (
+	sourceScaleSetTag  = "azure-cluster-upgrade-source-scale-set"
+	snapshotExpiresTag = "azure-cluster-upgrade-expires"
+)
+
+// Deletes the snapshots taken of the scale set's old instances' data disks
+// whose retention has passed
+func (s *azureSession) pruneDiskSnapshots(ctx context.Context) error {
+	var snapshots []struct {
+		ID   string            `json:"id"`
+		Tags map[string]string `json:"tags"`
+	}
+
+	path := s.resourceGroupPath() + "/providers/Microsoft.Compute/snapshots"
+	if err := s.armList(ctx, path, map[string]interface{}{"api-version": disksAPIVersion}, &snapshots); err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Tags[sourceScaleSetTag] != s.ScaleSetName {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, snapshot.Tags[snapshotExpiresTag])
+		if err != nil || time.Now().Before(expires) {
+			continue
+		}
+
+		log.Infof("Deleting snapshot %s, retained until %s", snapshot.ID, expires.Format(time.RFC3339))
+		if err = s.armDoAsync(ctx, http.MethodDelete, snapshot.ID, disksAPIVersion, nil, nil); err != nil {
+			log.Warnf("Unable to delete expired snapshot %s: %v", snapshot.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// Snapshots the data disks of the given old instances before they're
+// removed if --snapshot-data-disks is given, so data found missing after
+// the upgrade can be recovered from them. Snapshots are tagged with the
+// run, the instance and LUN they were taken of, and when --snapshot-retention
+// lets them be deleted; the expired ones are deleted first.
+func (r *upgradeRun) snapshotDataDisks(ctx context.Context, instanceIDs []string) error {
+	if snapshot, _ := r.cmd.Flags().GetBool("snapshot-data-disks"); !snapshot {
+		return nil
+	}
+	if r.sess.Simulated {
+		log.Infof("Not snapshotting the data disks of %d instances, which the simulation doesn't model", len(instanceIDs))
+		return nil
+	}
+
+	if err := r.sess.pruneDiskSnapshots(ctx); err != nil {
+		log.Warnf("Unable to delete expired data disk snapshots: %v", err)
+	}
+
+	location, err := r.scaleSetRegion(ctx)
+	if err != nil {
+		return err
+	}
+
+	retention, _ := r.cmd.Flags().GetDuration("snapshot-retention")
+
+	for _, instanceID := range instanceIDs {
+		vm, err := r.sess.getVMSSVMClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, instanceID)
+		if err != nil {
+			return err
+		}
+
+		for lun, disk := range instanceDataDisks(vm) {
+			tags := map[string]string{
+				upgradeRunIDTag:   r.runID,
+				sourceScaleSetTag: r.sess.ScaleSetName,
+				sourceInstanceTag: to.String(vm.Name),
+				sourceLunTag:      strconv.Itoa(int(lun)),
+			}
+			if retention > 0 {
+				tags[snapshotExpiresTag] = time.Now().Add(retention).UTC().Format(time.RFC3339)
+			}
+			name := fmt.Sprintf("%s-%s-lun%d-%s-final", r.sess.ScaleSetName, instanceID, lun, r.runID[:8])
+
+			log.Infof("Snapshotting data disk at LUN %d of instance %s...", lun, instanceID)
+			id, err := r.sess.snapshotDisk(ctx, to.String(disk.ManagedDisk.ID), location, name, tags)
+			if err != nil {
+				return err
+			}
+			r.diskSnapshots = append(r.diskSnapshots, id)
+		}
+	}
+
+	return nil
+}
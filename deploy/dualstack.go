@@ -0,0 +1,165 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Host names --dual-stack-probe-target may give
+var probeHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+
+// Checks a --dual-stack-probe-target value is an IP address or host name
+func validateProbeTarget(value string) error {
+	if net.ParseIP(value) == nil && !probeHostPattern.MatchString(value) {
+		return fmt.Errorf("'%s' is neither an IP address nor a host name", value)
+	}
+	return nil
+}
+
+// Returns the IP families a probe target is reached over: its own for an
+// address, or every family for a host name
+func probeFamilies(target string, families []string) []string {
+	ip := net.ParseIP(target)
+	switch {
+	case ip == nil:
+		return families
+	case ip.To4() != nil:
+		return []string{"IPv4"}
+	default:
+		return []string{"IPv6"}
+	}
+}
+
+// Builds a script printing 'FAMILY <family> ok' for each IP family an
+// instance has a global address and a default route for, or
+// 'FAMILY <family> missing' otherwise. Given a target, it's then pinged
+// over each of the families, printing 'REACH <family> ok' or
+// 'REACH <family> failed'.
+func dualStackScript(commandID string, target string, reach []string) []string {
+	var script []string
+
+	if commandID == windowsRunCommandID {
+		script = []string{
+			`foreach ($f in @(@('IPv4','0.0.0.0/0'),@('IPv6','::/0'))) { $a = Get-NetIPAddress -AddressFamily $f[0] -ErrorAction SilentlyContinue | Where-Object { $_.PrefixOrigin -ne 'WellKnown' -and $_.IPAddress -notlike 'fe80*' -and $_.IPAddress -ne '127.0.0.1' }; $r = Get-NetRoute -DestinationPrefix $f[1] -ErrorAction SilentlyContinue; if ($a -and $r) { Write-Output "FAMILY $($f[0]) ok" } else { Write-Output "FAMILY $($f[0]) missing" } }`,
+		}
+	} else {
+		script = []string{
+			`for f in 4 6; do if [ -n "$(ip -$f addr show scope global)" ] && [ -n "$(ip -$f route show default)" ]; then echo "FAMILY IPv$f ok"; else echo "FAMILY IPv$f missing"; fi; done`,
+		}
+	}
+
+	for _, family := range reach {
+		version := strings.TrimPrefix(family, "IPv")
+		if commandID == windowsRunCommandID {
+			script = append(script, fmt.Sprintf("ping.exe -%s -n 3 -w 5000 %s | Out-Null; if ($LASTEXITCODE -eq 0) { Write-Output 'REACH %s ok' } else { Write-Output 'REACH %s failed' }",
+				version, quotePowerShell(target), family, family))
+			continue
+		}
+		script = append(script, fmt.Sprintf("if ping -%s -c 3 -W 5 %s >/dev/null 2>&1; then echo 'REACH %s ok'; else echo 'REACH %s failed'; fi",
+			version, quoteShell(target), family, family))
+	}
+
+	return script
+}
+
+// Parses the output of dualStackScript, returning the given families the
+// lines of the kind, FAMILY or REACH, don't report ok for an instance
+func parseDualStackProbe(stdout string, kind string, families []string) []string {
+	ok := map[string]bool{}
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == kind && fields[2] == "ok" {
+			ok[fields[1]] = true
+		}
+	}
+
+	var missing []string
+	for _, family := range families {
+		if !ok[family] {
+			missing = append(missing, family)
+		}
+	}
+
+	return missing
+}
+
+// Confirms every new instance of a dual-stack scale set has an address
+// and a default route for both IP families before the old instances are
+// removed. ARM reporting an IPv6 address doesn't mean the guest OS
+// configured it, e.g. where an image disables IPv6 or its DHCPv6 client.
+// Given --dual-stack-probe-target, each instance must also reach it over
+// both families, as a route alone doesn't mean traffic gets through.
+func (r *upgradeRun) verifyDualStack(ctx context.Context) error {
+	if verify, _ := r.cmd.Flags().GetBool("verify-dual-stack"); !verify {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	families := modelIPFamilies(scaleSet)
+	if len(families) < 2 {
+		log.Infof("Scale set %s isn't dual-stack, no IPv6 connectivity to verify", r.sess.ScaleSetName)
+		return nil
+	}
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+	target := r.cmd.Flags().Lookup("dual-stack-probe-target").Value.String()
+
+	var reach []string
+	if target != "" {
+		reach = probeFamilies(target, families)
+		log.Infof("Checking new instances are configured for %s, and reach %s over %s...", strings.Join(families, " and "), target, strings.Join(reach, " and "))
+	} else {
+		log.Infof("Checking new instances are configured for %s; without --dual-stack-probe-target, reachability isn't checked...", strings.Join(families, " and "))
+	}
+
+	results, err := r.sess.runCommandOnInstances(ctx, "properties/latestModelApplied eq true", dualStackScript(commandID, target, reach), timeout)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+		return err
+	}
+
+	var problems []string
+	var failedInstances []string
+	for _, result := range results {
+		var missing []string
+		for _, family := range parseDualStackProbe(result.Stdout, "FAMILY", families) {
+			missing = append(missing, "no "+family)
+		}
+		for _, family := range parseDualStackProbe(result.Stdout, "REACH", reach) {
+			missing = append(missing, fmt.Sprintf("%s unreachable over %s", target, family))
+		}
+
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s)", result.InstanceID, strings.Join(missing, ", ")))
+			failedInstances = append(failedInstances, result.InstanceID)
+		}
+	}
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		r.sess.reportFailedInstances(failedInstances, r.diagnosticsDir)
+		return fmt.Errorf("new instances lack an address or default route for an IP family, or can't reach the probe target over it: %s", strings.Join(problems, "; "))
+	}
+
+	if target != "" {
+		log.Infof("Every new instance is configured for %s, and reaches %s", strings.Join(families, " and "), target)
+		return nil
+	}
+	log.Infof("Every new instance is configured for %s", strings.Join(families, " and "))
+	return nil
+}
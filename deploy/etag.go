@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read-modify-write updates are guarded with the ETag of the resource as
+// it was read. ARM rejects the write with 412 Precondition Failed if the
+// resource has changed since, e.g. because other tooling updated it, and
+// the update is retried against fresh state instead of overwriting theirs.
+const maxConflictRetries = 5
+
+// Resources mid-operation reject updates with 409 Conflict until the
+// operation completes, so these are retried at this interval
+const busyRetryInterval = 10 * time.Second
+
+type ifMatchKey struct{}
+
+// Returns a context whose requests only succeed if the resource still has
+// the given ETag. An empty ETag leaves requests unconditional.
+func withIfMatch(ctx context.Context, etag string) context.Context {
+	if etag == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, ifMatchKey{}, etag)
+}
+
+// Decorates a sender to add the If-Match header requested through a
+// request's context. Polling a long-running operation is unconditional.
+func conditional(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		if etag, ok := req.Context().Value(ifMatchKey{}).(string); ok && req.Method != http.MethodGet {
+			req.Header.Set("If-Match", etag)
+		}
+		return sender.Do(req)
+	})
+}
+
+// Returns the ETag of a resource read, or "" if it has none
+func etagOf(resp autorest.Response) string {
+	if resp.Response == nil {
+		return ""
+	}
+	return resp.Header.Get("ETag")
+}
+
+// Returns the HTTP status an ARM request failed with, or 0 if unknown
+func errorStatus(err error) int {
+	detailed, ok := err.(autorest.DetailedError)
+	if !ok {
+		return 0
+	}
+
+	if code, ok := detailed.StatusCode.(int); ok && code != 0 {
+		return code
+	}
+	if detailed.Response != nil {
+		return detailed.Response.StatusCode
+	}
+	return 0
+}
+
+// Reports whether an update was rejected because the resource changed
+// since it was read
+func isConflict(err error) bool {
+	return errorStatus(err) == http.StatusPreconditionFailed
+}
+
+// Reports whether an update was rejected because the resource is busy
+// with another operation, e.g. an instance still provisioning
+func isBusy(err error) bool {
+	return errorStatus(err) == http.StatusConflict
+}
+
+// Runs a read-modify-write, retrying it from a fresh read when the write
+// conflicts with a concurrent change
+func retryOnConflict(what string, attempt func() error) error {
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || !isConflict(err) || i >= maxConflictRetries {
+			return err
+		}
+		log.Warnf("Update of %s conflicted with a concurrent change, retrying with fresh state", what)
+	}
+}
+
+// Runs an update, retrying it while the resource is busy with another
+// operation, until the context is done
+func retryWhileBusy(ctx context.Context, what string, attempt func() error) error {
+	for {
+		err := attempt()
+		if err == nil || !isBusy(err) {
+			return err
+		}
+
+		log.Warnf("Update of %s waiting for another operation to finish: %v", what, err)
+
+		select {
+		case <-time.After(busyRetryInterval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
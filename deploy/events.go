@@ -0,0 +1,301 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	eventGridResource  = "https://eventgrid.azure.net"
+	serviceBusResource = "https://servicebus.azure.net"
+
+	// Prefix of the type of every lifecycle event
+	eventTypePrefix = "com.github.krarey.azure-cluster-upgrade."
+)
+
+// Lifecycle transitions published as events
+const (
+	eventUpgradeStarted   = "upgrade.started"
+	eventUpgradeCompleted = "upgrade.completed"
+	eventUpgradeFailed    = "upgrade.failed"
+	eventUpgradeStopped   = "upgrade.stopped"
+	eventPhaseStarted     = "phase.started"
+	eventPhaseCompleted   = "phase.completed"
+	eventPhaseFailed      = "phase.failed"
+	eventPhaseRolledBack  = "phase.rolledBack"
+)
+
+// eventSpec describes where upgrade lifecycle events are published. It is
+// read from the 'events' key of the config file.
+type eventSpec struct {
+	// One of 'eventGrid' or 'serviceBus'
+	Type string `mapstructure:"type"`
+
+	EventGrid struct {
+		// Topic endpoint, e.g.
+		// https://<topic>.<region>-1.eventgrid.azure.net/api/events. The
+		// topic must take the CloudEvents schema.
+		Endpoint string `mapstructure:"endpoint"`
+		// Access key reference, see resolveSecret. Azure AD credentials
+		// are used when there is none.
+		Key string `mapstructure:"key"`
+	} `mapstructure:"eventGrid"`
+
+	ServiceBus struct {
+		// Queue or topic URL, e.g. https://<namespace>.servicebus.windows.net/<queue>
+		URL string `mapstructure:"url"`
+	} `mapstructure:"serviceBus"`
+}
+
+// cloudEvent is a CloudEvents 1.0 event in its structured JSON form
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	Type            string      `json:"type"`
+	Source          string      `json:"source"`
+	ID              string      `json:"id"`
+	Time            time.Time   `json:"time"`
+	Subject         string      `json:"subject,omitempty"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// upgradeEventData is the payload of every lifecycle event
+type upgradeEventData struct {
+	RunID            string `json:"runID"`
+	ResourceGroup    string `json:"resourceGroup"`
+	ScaleSet         string `json:"scaleSet"`
+	Phase            string `json:"phase,omitempty"`
+	OriginalCapacity int64  `json:"originalCapacity,omitempty"`
+	SurgeSize        int64  `json:"surgeSize,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// eventPublisher delivers lifecycle events to downstream systems
+type eventPublisher interface {
+	publish(ctx context.Context, event cloudEvent) error
+}
+
+type eventGridPublisher struct {
+	endpoint   string
+	key        secret
+	authorizer autorest.Authorizer
+}
+
+type serviceBusPublisher struct {
+	url        string
+	authorizer autorest.Authorizer
+}
+
+// Reads the event spec from the config file. Returns nil when no events
+// are to be published.
+func loadEventSpec() (*eventSpec, error) {
+	if !viper.IsSet("events") {
+		return nil, nil
+	}
+
+	spec := &eventSpec{}
+	if err := viper.UnmarshalKey("events", spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Builds the publisher described by the spec, resolving its credentials
+func newEventPublisher(ctx context.Context, spec *eventSpec) (eventPublisher, error) {
+	switch spec.Type {
+	case "eventGrid":
+		key, err := resolveSecret(ctx, spec.EventGrid.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve Event Grid key: %v", err)
+		}
+		publisher := &eventGridPublisher{endpoint: spec.EventGrid.Endpoint, key: key}
+		if key == "" {
+			if publisher.authorizer, err = newAuthorizerForResource(eventGridResource); err != nil {
+				return nil, err
+			}
+		}
+		return publisher, nil
+	case "serviceBus":
+		authorizer, err := newAuthorizerForResource(serviceBusResource)
+		if err != nil {
+			return nil, err
+		}
+		return &serviceBusPublisher{url: strings.TrimRight(spec.ServiceBus.URL, "/"), authorizer: authorizer}, nil
+	default:
+		return nil, fmt.Errorf("unknown events type %q", spec.Type)
+	}
+}
+
+// Events are sent to the topic as a batch of one
+func (p *eventGridPublisher) publish(ctx context.Context, event cloudEvent) error {
+	headers := map[string]interface{}{}
+	if p.key != "" {
+		headers["aeg-sas-key"] = p.key.reveal()
+	}
+	return postEvent(ctx, p.endpoint, "application/cloudevents-batch+json; charset=utf-8", []cloudEvent{event}, headers, p.authorizer)
+}
+
+// Events are sent as brokered messages in the CloudEvents structured mode
+func (p *serviceBusPublisher) publish(ctx context.Context, event cloudEvent) error {
+	return postEvent(ctx, p.url+"/messages", "application/cloudevents+json; charset=utf-8", event, nil, p.authorizer)
+}
+
+// POSTs an event as JSON, authorized with a bearer token where an
+// authorizer is given
+func postEvent(ctx context.Context, url string, contentType string, body interface{}, headers map[string]interface{}, authorizer autorest.Authorizer) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	decorators := []autorest.PrepareDecorator{
+		autorest.WithMethod(http.MethodPost),
+		autorest.WithBaseURL(url),
+		autorest.WithHeader("Content-Type", contentType),
+		autorest.WithHeaders(headers),
+		autorest.WithBytes(&encoded),
+	}
+	if authorizer != nil {
+		decorators = append(decorators, authorizer.WithAuthorization())
+	}
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx), decorators...)
+	if err != nil {
+		return err
+	}
+
+	resp, err := autorest.SendWithSender(autorest.NewClientWithUserAgent(userAgent), req)
+	if err != nil {
+		return err
+	}
+
+	return autorest.Respond(resp,
+		autorest.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated, http.StatusAccepted),
+		autorest.ByClosing())
+}
+
+// Returns a random event ID
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Publishes a lifecycle event about the run, if events are configured.
+// Failing to publish is only worth a warning, since downstream systems
+// mustn't be able to fail an upgrade.
+func (r *upgradeRun) publishEvent(ctx context.Context, eventType string, phaseName string, err error) {
+	if r.events == nil {
+		return
+	}
+
+	data := upgradeEventData{
+		RunID:            r.runID,
+		ResourceGroup:    r.sess.ResourceGroupName,
+		ScaleSet:         r.sess.ScaleSetName,
+		Phase:            phaseName,
+		OriginalCapacity: r.originalCapacity,
+		SurgeSize:        r.surgeSize,
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            eventTypePrefix + eventType,
+		Source:          r.sess.scaleSetPath(),
+		ID:              newEventID(),
+		Time:            time.Now().UTC(),
+		Subject:         phaseName,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	if err := r.events.publish(ctx, event); err != nil {
+		log.Warnf("Unable to publish %s event: %v", eventType, err)
+	}
+}
+
+// publishedStep announces a phase's execution and rollback as lifecycle
+// events and on the change record, along with the start of the upgrade
+// ahead of its first phase, and records how each went for the CI summary
+type publishedStep struct {
+	phase.Step
+	run *upgradeRun
+}
+
+func (s publishedStep) Execute(ctx context.Context) error {
+	if !s.run.announced {
+		if err := s.run.openChange(ctx); err != nil {
+			return err
+		}
+		s.run.announced = true
+		s.run.publishEvent(ctx, eventUpgradeStarted, "", nil)
+	}
+
+	if s.run.control != nil {
+		if err := s.run.control.wait(ctx, s.Name()); err != nil {
+			return err
+		}
+	}
+
+	if s.run.healthWatch != nil {
+		if err := s.run.healthWatch.hold(ctx, s.Name()); err != nil {
+			return err
+		}
+	}
+
+	if err := s.run.holdForServiceHealth(ctx, s.Name()); err != nil {
+		return err
+	}
+
+	if err := s.run.holdForStop(ctx, s.Name()); err != nil {
+		return err
+	}
+
+	s.run.phase.set(s.Name())
+	s.run.publishEvent(ctx, eventPhaseStarted, s.Name(), nil)
+
+	start := time.Now()
+	err := s.Step.Execute(ctx)
+	result := phaseResult{Name: s.Name(), Status: "completed", Duration: time.Since(start)}
+
+	if err != nil {
+		result.Status = "failed"
+		s.run.publishEvent(ctx, eventPhaseFailed, s.Name(), err)
+		s.run.updateChange(ctx, fmt.Sprintf("Phase %s failed: %v", s.Name(), err))
+	} else {
+		s.run.publishEvent(ctx, eventPhaseCompleted, s.Name(), nil)
+		s.run.updateChange(ctx, fmt.Sprintf("Phase %s completed", s.Name()))
+	}
+	s.run.phaseResults = append(s.run.phaseResults, result)
+
+	return err
+}
+
+func (s publishedStep) Commits() bool {
+	return phase.Commits(s.Step)
+}
+
+func (s publishedStep) Rollback(ctx context.Context) error {
+	err := s.Step.Rollback(ctx)
+	if err == nil {
+		s.run.publishEvent(ctx, eventPhaseRolledBack, s.Name(), nil)
+		s.run.updateChange(ctx, fmt.Sprintf("Phase %s rolled back", s.Name()))
+		s.run.phaseResults = append(s.run.phaseResults, phaseResult{Name: s.Name(), Status: "rolled back"})
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package deploy
+
+import (
+	"errors"
+	"os"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes, distinct for each outcome so scripts can act on it without
+// parsing logs
+const (
+	exitSucceeded = 0
+	// Failed before changing anything, or for any other reason
+	exitFailed = 1
+	// Failed part way through, leaving the scale set mid-upgrade, or some
+	// scale sets of a fleet failed
+	exitPartialFailure = 2
+	// Failed, and every phase was rolled back
+	exitRolledBack = 3
+
+	// With --detailed-exit-codes only: nothing needed upgrading
+	exitNoOp = 4
+	// With --detailed-exit-codes only: a plan or validation found an
+	// upgrade to do
+	exitUpgradeNeeded = 5
+)
+
+// exitError is a failure exiting with a code other than exitFailed
+type exitError struct {
+	err  error
+	code int
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// Marks a failed upgrade with the exit code for how far it got. One which
+// failed executing its phases changed the scale set, unless they were all
+// rolled back.
+func upgradeFailure(err error, started bool) error {
+	if err == nil || !started {
+		return err
+	}
+
+	code := exitPartialFailure
+	var phaseErr *phase.Error
+	if errors.As(err, &phaseErr) && phaseErr.RolledBack {
+		code = exitRolledBack
+	}
+
+	return &exitError{err: err, code: code}
+}
+
+// Logs a failure and exits with its code
+func fail(err error) {
+	code := exitFailed
+	var exit *exitError
+	if errors.As(err, &exit) {
+		code = exit.code
+	}
+
+	log.Error(err)
+	os.Exit(code)
+}
+
+// Exits with a code telling a successful outcome apart, if
+// --detailed-exit-codes is given
+func exitDetailed(cmd *cobra.Command, code int) {
+	if detailed, _ := cmd.Flags().GetBool("detailed-exit-codes"); detailed {
+		os.Exit(code)
+	}
+}
+
+// Exits with the outcome of an upgrade run
+func (r *upgradeRun) finish(err error) {
+	if err != nil {
+		fail(err)
+	}
+	if r.upToDate {
+		exitDetailed(r.cmd, exitNoOp)
+	}
+}
@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns an extension's provisioning state as reported in an instance
+// view, e.g. 'succeeded', along with the message of its status, if any
+func extensionProvisioningState(extension compute.VirtualMachineExtensionInstanceView) (string, string) {
+	state, message := "no status reported", ""
+	if extension.Statuses == nil {
+		return state, message
+	}
+
+	for _, status := range *extension.Statuses {
+		if code := to.String(status.Code); strings.HasPrefix(code, "ProvisioningState/") {
+			state = strings.TrimPrefix(code, "ProvisioningState/")
+			message = strings.TrimSpace(to.String(status.Message))
+		}
+	}
+
+	return state, message
+}
+
+// Fails the health gate unless every extension in the scale set model,
+// such as monitoring and security agents or custom scripts, provisioned
+// successfully on every new instance. Each failing or missing extension is
+// reported along with the message it gave.
+func (r *upgradeRun) verifyExtensions(ctx context.Context) error {
+	if verify, _ := r.cmd.Flags().GetBool("verify-extensions"); !verify {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	var required []string
+	for name := range modelExtensions(scaleSet) {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+
+	if len(required) == 0 {
+		log.Infof("Scale set %s has no extensions to verify", r.sess.ScaleSetName)
+		return nil
+	}
+
+	vms, err := r.sess.getVMSSVMClient().List(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, "properties/latestModelApplied eq true", "instanceView")
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	var failedInstances []string
+	for _, vm := range vms {
+		instanceID := to.String(vm.InstanceID)
+
+		reported := map[string]compute.VirtualMachineExtensionInstanceView{}
+		if vm.VirtualMachineScaleSetVMProperties != nil && vm.InstanceView != nil && vm.InstanceView.Extensions != nil {
+			for _, extension := range *vm.InstanceView.Extensions {
+				reported[strings.ToLower(to.String(extension.Name))] = extension
+			}
+		}
+
+		failed := false
+		for _, name := range required {
+			extension, ok := reported[strings.ToLower(name)]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: %s missing", instanceID, name))
+				failed = true
+				continue
+			}
+
+			state, message := extensionProvisioningState(extension)
+			if state == "succeeded" {
+				continue
+			}
+
+			problem := fmt.Sprintf("%s: %s %s", instanceID, name, state)
+			if message != "" {
+				problem += fmt.Sprintf(" (%s)", message)
+			}
+			problems = append(problems, problem)
+			failed = true
+		}
+
+		if failed {
+			failedInstances = append(failedInstances, instanceID)
+		}
+	}
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		r.sess.reportFailedInstances(failedInstances, r.diagnosticsDir)
+		return fmt.Errorf("extensions did not provision on new instances: %s", strings.Join(problems, "; "))
+	}
+
+	log.Infof("Extensions %s provisioned on every new instance", strings.Join(required, ", "))
+	return nil
+}
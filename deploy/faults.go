@@ -0,0 +1,175 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/vmss"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// faultInjection describes failures to inject into a run, so the rollback
+// and retry behaviour of the upgrade can be exercised on demand. Each
+// instance and scale-in fault fires once.
+type faultInjection struct {
+	// Fail the scale-in protection update of this instance
+	ProtectFailureInstance string
+	// Time out waiting for the scale-in to complete
+	ScaleInTimeout bool
+	// Fraction of ARM requests answered with 429 Too Many Requests
+	ThrottleRate float64
+	// Report this instance unhealthy after it was first listed
+	UnhealthyInstance string
+
+	mu    sync.Mutex
+	fired map[string]bool
+}
+
+// Reads the hidden fault injection flags. Returns nil when none are set.
+func faultsFromFlags(cmd *cobra.Command) (*faultInjection, error) {
+	faults := &faultInjection{fired: map[string]bool{}}
+	var err error
+
+	faults.ProtectFailureInstance = cmd.Flags().Lookup("inject-protect-failure").Value.String()
+	faults.UnhealthyInstance = cmd.Flags().Lookup("inject-unhealthy-instance").Value.String()
+
+	if faults.ScaleInTimeout, err = cmd.Flags().GetBool("inject-scale-in-timeout"); err != nil {
+		return nil, err
+	}
+
+	if faults.ThrottleRate, err = cmd.Flags().GetFloat64("inject-throttle-rate"); err != nil {
+		return nil, err
+	}
+	if faults.ThrottleRate < 0 || faults.ThrottleRate > 1 {
+		return nil, fmt.Errorf("--inject-throttle-rate must be between 0 and 1, got %v", faults.ThrottleRate)
+	}
+
+	if faults.ProtectFailureInstance == "" && !faults.ScaleInTimeout && faults.ThrottleRate == 0 && faults.UnhealthyInstance == "" {
+		return nil, nil
+	}
+
+	log.Warnf("Injecting faults: protect failure on instance '%s', scale-in timeout %t, throttle rate %v, unhealthy instance '%s'",
+		faults.ProtectFailureInstance, faults.ScaleInTimeout, faults.ThrottleRate, faults.UnhealthyInstance)
+
+	return faults, nil
+}
+
+// Reports whether the named fault should fire, marking it as fired
+func (f *faultInjection) fire(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fired[name] {
+		return false
+	}
+	f.fired[name] = true
+	return true
+}
+
+// Wraps the session's scale set clients with the configured faults
+func (s *azureSession) injectFaults() {
+	if s.Faults == nil {
+		return
+	}
+
+	if s.Faults.ScaleInTimeout {
+		s.ScaleSets = faultyScaleSets{s.ScaleSets, s.Faults}
+	}
+
+	if s.Faults.ProtectFailureInstance != "" || s.Faults.UnhealthyInstance != "" {
+		s.VMs = faultyVMs{s.VMs, s.Faults}
+	}
+}
+
+// Decorates a sender so that a random share of requests are throttled
+// without reaching ARM.
+func (f *faultInjection) throttle(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		if rand.Float64() >= f.ThrottleRate {
+			return sender.Do(req)
+		}
+
+		log.Debugf("Injecting 429 for %s %s", req.Method, req.URL.Path)
+
+		return &http.Response{
+			Status:     "429 Too Many Requests",
+			StatusCode: http.StatusTooManyRequests,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Retry-After": []string{"1"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error":{"code":"TooManyRequests","message":"injected fault"}}`)),
+			Request:    req,
+		}, nil
+	})
+}
+
+// faultyScaleSets times out the first scale-in
+type faultyScaleSets struct {
+	vmss.ScaleSetsClient
+	faults *faultInjection
+}
+
+func (c faultyScaleSets) Update(ctx context.Context, resourceGroup string, scaleSet string, parameters compute.VirtualMachineScaleSetUpdate) (vmss.Future, error) {
+	scaleIn := false
+	if parameters.Sku != nil && parameters.Sku.Capacity != nil {
+		current, err := c.ScaleSetsClient.Get(ctx, resourceGroup, scaleSet)
+		if err != nil {
+			return nil, err
+		}
+		scaleIn = *parameters.Sku.Capacity < *current.Sku.Capacity
+	}
+
+	future, err := c.ScaleSetsClient.Update(ctx, resourceGroup, scaleSet, parameters)
+	if err != nil || !scaleIn || !c.faults.fire("scale-in-timeout") {
+		return future, err
+	}
+
+	log.Warn("Injecting a timeout into the scale-in")
+	return timedOutFuture{}, nil
+}
+
+// timedOutFuture never completes
+type timedOutFuture struct{}
+
+func (timedOutFuture) Wait(ctx context.Context) error {
+	return fmt.Errorf("injected fault: %v", context.DeadlineExceeded)
+}
+
+// faultyVMs fails the scale-in protection update of one instance, and
+// reports one instance unhealthy
+type faultyVMs struct {
+	vmss.VMsClient
+	faults *faultInjection
+}
+
+func (c faultyVMs) Update(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, vm compute.VirtualMachineScaleSetVM) (vmss.VMFuture, error) {
+	if instanceID == c.faults.ProtectFailureInstance && c.faults.fire("protect-failure") {
+		return nil, fmt.Errorf("injected fault: failed to update protection of instance %s", instanceID)
+	}
+
+	return c.VMsClient.Update(ctx, resourceGroup, scaleSet, instanceID, vm)
+}
+
+func (c faultyVMs) List(ctx context.Context, resourceGroup string, scaleSet string, filter string, expand string) ([]compute.VirtualMachineScaleSetVM, error) {
+	vms, err := c.VMsClient.List(ctx, resourceGroup, scaleSet, filter, expand)
+	if err != nil || c.faults.UnhealthyInstance == "" || expand != "instanceView" || c.faults.fire("unhealthy-listed") {
+		return vms, err
+	}
+
+	for _, vm := range vms {
+		if to.String(vm.InstanceID) == c.faults.UnhealthyInstance && vm.VirtualMachineScaleSetVMProperties != nil && vm.InstanceView != nil {
+			vm.InstanceView.VMHealth = &compute.VirtualMachineHealthStatus{Status: &compute.InstanceViewStatus{Code: to.StringPtr("HealthState/unhealthy")}}
+		}
+	}
+	return vms, nil
+}
@@ -0,0 +1,154 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Checks a scale-out-only upgrade can hold its surge beyond the run.
+// Capacity reserved and hosts added for the surge are only released by the
+// run which added them, and recycled instances run the latest model, so
+// once held can't be told apart from the new ones. Options removing old
+// instances are given to finish instead.
+func (r *upgradeRun) checkScaleOutOnly(ctx context.Context) error {
+	reserve, _ := r.cmd.Flags().GetBool("reserve-surge-capacity")
+	hosts, _ := r.cmd.Flags().GetBool("add-dedicated-hosts")
+	steps, _ := r.cmd.Flags().GetInt("warm-up-steps")
+
+	switch {
+	case r.retiring != nil:
+		return fmt.Errorf("recycled instances can't be told apart from new ones once the surge is held, so --strategy=%s can't recycle", strategyScaleOutOnly)
+	case reserve || hosts:
+		return fmt.Errorf("--strategy=%s holds the surge beyond the run, so can't be used with --reserve-surge-capacity or --add-dedicated-hosts, which would never be released", strategyScaleOutOnly)
+	case steps > 1 || r.cmd.Flags().Lookup("carry-disks").Value.String() != "":
+		return fmt.Errorf("--strategy=%s leaves the old instances in place, so --warm-up-steps and --carry-disks are given to finish instead", strategyScaleOutOnly)
+	}
+
+	return nil
+}
+
+// Records the surge as held in place of scaling back in, so a re-run
+// refuses to start over it and finish can remove the old instances later.
+// The new instances stay protected from scale-in, so whatever retires the
+// old ones by scaling in can't take them. The surge's cost is reported up
+// to the hold, and its instances' cost center tags removed, since the
+// capacity is now the scale set's own to retire.
+func (r *upgradeRun) holdSurge(ctx context.Context) error {
+	state := &upgradeState{State: upgradeStateSurged, OriginalCapacity: r.originalCapacity, SurgeSize: r.surgeSize, RunID: r.runID}
+	if err := r.sess.setUpgradeState(ctx, state); err != nil {
+		return err
+	}
+	r.surgeMeter.set(0)
+	r.untagSurgeInstances(ctx)
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Holding the surge of %s at %d instances, leaving old instances %s to be retired; run finish to remove any left",
+		r.sess.ScaleSetName, r.originalCapacity+r.surgeSize, strings.Join(old, ", "))
+	return nil
+}
+
+// Picks up an upgrade whose surge was held by --strategy=scale-out-only,
+// with the capacity, surge size and run ID recorded when it began. Fails if
+// no surge is held, since there's nothing for finish to do.
+func (r *upgradeRun) detectHeldSurge(ctx context.Context) (bool, error) {
+	state, err := r.sess.getUpgradeState(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	switch state.State {
+	case upgradeStateSurged:
+	case "":
+		return false, fmt.Errorf("no scale-out-only upgrade of %s is holding its surge, so there's nothing to finish", r.sess.ScaleSetName)
+	default:
+		return false, fmt.Errorf("the upgrade of %s left in state '%s' wasn't held by --strategy=%s; re-run it with --on-rerun=%s instead",
+			r.sess.ScaleSetName, state.State, strategyScaleOutOnly, rerunResume)
+	}
+
+	log.Infof("Finishing the upgrade holding a surge of %d instances, original capacity %d", state.SurgeSize, state.OriginalCapacity)
+	r.resuming = true
+	r.originalCapacity = state.OriginalCapacity
+	r.surgeSize = state.SurgeSize
+	if state.RunID != "" {
+		log.Infof("Continuing run %s", state.RunID)
+		r.setRunID(state.RunID)
+	}
+
+	return true, nil
+}
+
+// Starts watching the scale set from its capacity when finish begins,
+// which is below the held surge's if old instances were already retired
+func (r *upgradeRun) resumeHeldSurge(ctx context.Context) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	capacity := *scaleSet.Sku.Capacity
+	if retired := r.originalCapacity + r.surgeSize - capacity; retired > 0 {
+		log.Infof("%d old instances of %s were retired while the surge was held", retired, r.sess.ScaleSetName)
+	}
+
+	return r.watchFrom(ctx, capacity)
+}
+
+// Returns the phases finishing a held surge: the preflight checks which
+// still apply, then the removal of the old instances as the upgrade would
+// have once its gates passed
+func (r *upgradeRun) finishSteps() []phase.Step {
+	steps := []phase.Step{
+		&phase.Func{StepName: "permissions", ValidateFunc: r.sess.preflightPermissions},
+		&phase.Func{StepName: "resource-locks", ValidateFunc: r.checkLocks},
+		&phase.Func{StepName: "load-specs", ValidateFunc: r.loadSpecs},
+		&phase.Func{StepName: "repairs", ValidateFunc: r.checkRepairs},
+		&phase.Func{StepName: "held-surge", ExecuteFunc: r.resumeHeldSurge},
+	}
+
+	liftLocks, _ := r.cmd.Flags().GetBool("lift-delete-locks")
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "lift-delete-locks", ExecuteFunc: r.liftLocks, RollbackFunc: r.restoreLocks})
+	}
+	suspendRepairs, _ := r.cmd.Flags().GetBool("suspend-repairs")
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "suspend-repairs", ExecuteFunc: r.suspendRepairs, RollbackFunc: r.resumeRepairs})
+	}
+
+	for _, step := range r.removalSteps(liftLocks, suspendRepairs) {
+		steps = append(steps, watchedStep{step, r})
+	}
+
+	return r.prepareSteps(steps)
+}
+
+// RunFinish removes the old instances of an upgrade whose surge was held
+// by --strategy=scale-out-only, along with any left by whatever was
+// retiring them, then tidies up as the upgrade would have. Exits the
+// process on failure.
+func RunFinish(cmd *cobra.Command, args []string) {
+	log.Info("Finishing held Cluster Blue/Green Upgrade")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	run := newUpgradeRun(sess, cmd)
+	run.finishing = true
+
+	run.finish(run.execute(ctx))
+}
@@ -0,0 +1,283 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	subscriptionIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// Letters, digits, underscores, hyphens, periods and parentheses, not
+	// ending in a period
+	resourceGroupPattern = regexp.MustCompile(`^[\p{L}\p{N}_\-.()]*[\p{L}\p{N}_\-()]$`)
+
+	// Letters, digits, underscores, hyphens and periods, starting with a
+	// letter or digit and ending with a letter, digit or underscore
+	scaleSetNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.\-]*[a-zA-Z0-9_])?$`)
+)
+
+// Checks a subscription ID is a GUID
+func validateSubscriptionID(id string) error {
+	if !subscriptionIDPattern.MatchString(id) {
+		return fmt.Errorf("subscription ID '%s' is not a GUID, e.g. 00000000-0000-0000-0000-000000000000", id)
+	}
+	return nil
+}
+
+// Checks a name against Azure's rules for resource group names
+func validateResourceGroupName(name string) error {
+	if len([]rune(name)) > 90 || !resourceGroupPattern.MatchString(name) {
+		return fmt.Errorf("resource group name '%s' is invalid, it must be 1-90 letters, digits, underscores, hyphens, periods or parentheses and not end in a period", name)
+	}
+	return nil
+}
+
+// Checks a name against Azure's rules for scale set names
+func validateScaleSetName(name string) error {
+	if len(name) > 64 || !scaleSetNamePattern.MatchString(name) {
+		return fmt.Errorf("scale set name '%s' is invalid, it must be 1-64 letters, digits, underscores, hyphens or periods, start with a letter or digit and end with a letter, digit or underscore", name)
+	}
+	return nil
+}
+
+// Checks a value is one of a set of choices
+func oneOf(choices ...string) func(string) error {
+	return func(value string) error {
+		for _, choice := range choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' is not one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+// Checks a duration flag's value isn't negative
+func nonNegativeDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration < 0 {
+		return fmt.Errorf("%s must not be negative", value)
+	}
+	return nil
+}
+
+// Checks a duration flag's value is positive
+func positiveDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("%s must be positive", value)
+	}
+	return nil
+}
+
+// Checks a count flag's value isn't negative
+func nonNegativeCount(value string) error {
+	if count, err := strconv.ParseInt(value, 10, 64); err != nil || count < 0 {
+		return fmt.Errorf("%s must be a count of zero or more", value)
+	}
+	return nil
+}
+
+// Checks a count flag's value is at least one
+func positiveCount(value string) error {
+	if count, err := strconv.ParseInt(value, 10, 64); err != nil || count < 1 {
+		return fmt.Errorf("%s must be a count of one or more", value)
+	}
+	return nil
+}
+
+// Checks the form of a --max-unavailable value, which is resolved against
+// the scale set's capacity once it's known
+func validateMaxUnavailable(value string) error {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("%s is not a percentage above 0%% and up to 100%%", value)
+		}
+		return nil
+	}
+
+	if count, err := strconv.ParseInt(value, 10, 64); err != nil || count < 1 {
+		return fmt.Errorf("%s is not a count of at least 1 or a percentage", value)
+	}
+	return nil
+}
+
+func validateSelector(value string) error {
+	_, err := parseSelector(value)
+	return err
+}
+
+func validateMinImageVersion(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := parseImageVersion(value)
+	return err
+}
+
+// Validators for the values of flags, which apply to whichever commands
+// define them
+var flagValidators = map[string]func(string) error{
+	"subscription-id":              validateSubscriptionID,
+	"resource-group":               validateResourceGroupName,
+	"vm-scale-set":                 validateScaleSetName,
+	"output":                       oneOf(outputText, outputJSON),
+	"ci":                           oneOf(ciAzureDevOps, ciGitHub),
+	"on-rerun":                     oneOf(rerunRefuse, rerunResume),
+	"on-external-change":           oneOf(externalChangeAbort, externalChangeReconcile),
+	"max-unavailable":              validateMaxUnavailable,
+	"max-recycled":                 validateMaxUnavailable,
+	"min-healthy":                  nonNegativeCount,
+	"expected-gpus":                nonNegativeCount,
+	"vulnerability-block-severity": oneOf(severityLow, severityMedium, severityHigh, severityCritical),
+	"run-command-timeout":          positiveDuration,
+	"approval-timeout":             positiveDuration,
+	"timeout":                      nonNegativeDuration,
+	"lb-health-timeout":            nonNegativeDuration,
+	"warm-up-steps":                nonNegativeCount,
+	"warm-up-interval":             positiveDuration,
+	"warm-up-max-latency":          nonNegativeDuration,
+	"warm-up-max-failed-requests":  nonNegativeCount,
+	"batch-pause":                  nonNegativeDuration,
+	"batch-jitter":                 nonNegativeDuration,
+	"since":                        positiveDuration,
+	"older-than":                   positiveDuration,
+	"poll-interval":                positiveDuration,
+	"max-recent-upgrades":          nonNegativeCount,
+	"recent-upgrade-window":        positiveDuration,
+	"restart":                      oneOf("always", "on-failure"),
+	"restart-delay":                nonNegativeDuration,
+	"selector":                     validateSelector,
+	"simulate-tags":                validateSelector,
+	"min-image-version":            validateMinImageVersion,
+	"arm-reads-per-minute":         nonNegativeCount,
+	"arm-writes-per-minute":        nonNegativeCount,
+	"run-id":                       validateRunID,
+	"health-watch-interval":        nonNegativeDuration,
+	"health-watch-max-failing":     positiveCount,
+	"health-watch-timeout":         positiveDuration,
+	"service-health":               oneOf(serviceHealthOff, serviceHealthWarn, serviceHealthPause),
+	"service-health-timeout":       positiveDuration,
+	"terminate-notification":       validateTerminateNotification,
+	"health-extension":             oneOf(healthProtocolHTTP, healthProtocolHTTPS, healthProtocolTCP),
+	"health-extension-port":        positiveCount,
+	"carry-disks":                  validateCarryDisks,
+	"snapshot-retention":           nonNegativeDuration,
+	"backup-vault":                 validateBackupVault,
+	"backup-max-age":               positiveDuration,
+	"backup-retention":             positiveDuration,
+	"backup-timeout":               positiveDuration,
+	"approve":                      validateApprovals,
+	"subscriptions":                validateSubscriptionIDs,
+	"orphaned-resources":           oneOf(orphansOff, orphansReport, orphansDelete),
+	"hourly-price":                 validateHourlyPrice,
+	"currency":                     validateCurrency,
+	"max-eviction-rate":            validateEvictionRate,
+	"rotate-identity-from":         validateUserAssignedIdentity,
+	"rotate-identity-to":           validateUserAssignedIdentity,
+	"surge-priority":               oneOf(surgePriorityModel, surgePriorityRegular, surgePrioritySpot),
+	"strategy":                     validateStrategy,
+	"to-capacity":                  nonNegativeCount,
+	"victims":                      oneOf(victimsOldest, victimsStaleModel, victimsLeastLoaded),
+	"load-window":                  positiveDuration,
+	"removal-order":                oneOf(removalOrderListed, removalOrderCPU, removalOrderNetwork, removalOrderConnections),
+	"sessions-from":                validateSessionsFrom,
+	"max-sessions":                 nonNegativeCount,
+	"sessions-max-wait":            positiveDuration,
+	"shutdown-timeout":             positiveDuration,
+	"shutdown-retries":             nonNegativeCount,
+	"dual-stack-probe-target":      validateProbeTarget,
+}
+
+// Reports whether a flag was marked required with MarkFlagRequired
+func isRequiredFlag(flag *pflag.Flag) bool {
+	required, ok := flag.Annotations[cobra.BashCompOneRequiredFlag]
+	return ok && len(required) > 0 && required[0] == "true"
+}
+
+// Checks every flag of the command against its validator, and that
+// required flags are given, returning the problems found
+func flagProblems(cmd *cobra.Command) []string {
+	var problems []string
+
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		value := flag.Value.String()
+
+		if isRequiredFlag(flag) && strings.TrimSpace(value) == "" {
+			problems = append(problems, fmt.Sprintf("--%s is required", flag.Name))
+			return
+		}
+
+		validate, ok := flagValidators[flag.Name]
+		if !ok || (value == "" && !isRequiredFlag(flag)) {
+			return
+		}
+
+		if err := validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("--%s: %v", flag.Name, err))
+		}
+	})
+
+	return problems
+}
+
+// ValidateFlags checks the command's flags before it runs, so mistakes are
+// reported with the flag at fault rather than as an Azure API error, or
+// not at all. Required flags must be given a non-blank value, and every
+// flag with a validator is checked, unless it's empty and optional. A
+// scale set must be named or selected, but not both. Variables are first
+// substituted into the config file and any profile applied, so the flags
+// it sets are checked too. Once valid, CI annotations are set up and logs
+// tagged with the run's ID.
+func ValidateFlags(cmd *cobra.Command, args []string) error {
+	if err := substituteConfig(cmd); err != nil {
+		return err
+	}
+
+	if err := applyProfile(cmd); err != nil {
+		return err
+	}
+
+	problems := flagProblems(cmd)
+
+	// A scale set is either named or selected by its tags
+	if selector := cmd.Flags().Lookup("selector"); selector != nil && cmd.Flags().Lookup("vm-scale-set") != nil {
+		named := cmd.Flags().Lookup("vm-scale-set").Value.String() != ""
+		switch {
+		case selector.Value.String() != "" && named:
+			problems = append(problems, "--selector and --vm-scale-set can't be used together")
+		case selector.Value.String() == "" && !named:
+			problems = append(problems, "--vm-scale-set or --selector is required")
+		case selector.Value.String() == "" && cmd.Flags().Lookup("resource-group").Value.String() == "":
+			problems = append(problems, "--resource-group is required with --vm-scale-set")
+		}
+	}
+
+	// Phases mustn't be able to wait longer than the upgrade may take
+	if cmd.Flags().Lookup("timeout") != nil {
+		problems = append(problems, timeoutProblems(cmd)...)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid flags:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	configureCI(cmd)
+	configureRunID(cmd)
+
+	return nil
+}
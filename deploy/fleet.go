@@ -0,0 +1,900 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Regions are upgraded one after another, with every scale set in a
+	// region upgraded at once
+	fleetOrderRegionByRegion = "region-by-region"
+	// Scale sets are upgraded one at a time, in manifest order
+	fleetOrderSequential = "sequential"
+	// Scale sets in every region are upgraded together by a pool of
+	// workers, up to the fleet's limits
+	fleetOrderConcurrent = "concurrent"
+
+	// Priority classes, upgraded in this order
+	fleetPriorityCanary   = "canary"
+	fleetPriorityStandard = "standard"
+	fleetPriorityCritical = "critical"
+
+	fleetSucceeded = "succeeded"
+	fleetFailed    = "failed"
+	fleetSkipped   = "skipped"
+)
+
+// fleetManifest lists the scale sets a fleet upgrade drives, across
+// regions and subscriptions, and the order to upgrade them in.
+type fleetManifest struct {
+	// One of 'region-by-region' (the default), 'sequential' or
+	// 'concurrent'
+	Order string `mapstructure:"order"`
+	// Region upgraded on its own ahead of every other, if any
+	CanaryRegion string `mapstructure:"canaryRegion"`
+	// Stop starting upgrades once any scale set fails. Defaults to true.
+	PauseOnFailure bool `mapstructure:"pauseOnFailure"`
+	// Most scale sets upgraded at once within a region, or across the
+	// fleet when upgraded concurrently; 0 for no limit
+	MaxParallel int `mapstructure:"maxParallel"`
+	// Most scale sets of one subscription upgraded at once, 0 for no limit
+	MaxPerSubscription int `mapstructure:"maxPerSubscription"`
+	// Most instances disrupted at once across the fleet, as a count or a
+	// share of its total capacity, e.g. '5%'
+	MaxDisruption string `mapstructure:"maxDisruption"`
+
+	// Soak time and approval gate of each priority class
+	Priorities map[string]fleetPriority `mapstructure:"priorities"`
+
+	Groups    []fleetGroup  `mapstructure:"groups"`
+	ScaleSets []fleetTarget `mapstructure:"scaleSets"`
+}
+
+// The priority classes in the order they're upgraded, each only once the
+// one before it has finished and soaked
+var fleetPriorities = []string{fleetPriorityCanary, fleetPriorityStandard, fleetPriorityCritical}
+
+// fleetPriority is the policy of a priority class of scale sets
+type fleetPriority struct {
+	// Time the class's scale sets run before the next class is started
+	Soak time.Duration `mapstructure:"soak"`
+	// The class is only upgraded when approved with --approve
+	RequireApproval bool `mapstructure:"requireApproval"`
+}
+
+// fleetGroup declares how one group of scale sets (e.g. a cluster's
+// servers) is ordered against others (e.g. its clients). Within each
+// wave, a group starts only once the groups it comes after have finished.
+type fleetGroup struct {
+	Name string `mapstructure:"name"`
+	// Groups which must finish upgrading first, and succeed
+	After []string `mapstructure:"after"`
+	// Groups never upgraded at the same time as this one
+	NotConcurrentWith []string `mapstructure:"notConcurrentWith"`
+}
+
+// fleetTarget is a single scale set in a fleet manifest
+type fleetTarget struct {
+	SubscriptionID string `mapstructure:"subscriptionID"`
+	ResourceGroup  string `mapstructure:"resourceGroup"`
+	Name           string `mapstructure:"name"`
+	// Looked up from the scale set when not given
+	Region string `mapstructure:"region"`
+	// Group the scale set belongs to, if any
+	Group string `mapstructure:"group"`
+	// Priority class: 'canary', 'standard' (the default) or 'critical'
+	Priority string `mapstructure:"priority"`
+}
+
+func (t fleetTarget) String() string {
+	return fmt.Sprintf("%s/%s/%s", t.SubscriptionID, t.ResourceGroup, t.Name)
+}
+
+// fleetResult is the outcome of upgrading one scale set of a fleet
+type fleetResult struct {
+	Target   fleetTarget
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// Reads and validates a fleet manifest from a YAML or JSON file
+func loadFleetManifest(path string) (*fleetManifest, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	manifest := &fleetManifest{Order: fleetOrderRegionByRegion, PauseOnFailure: true}
+	if err := v.Unmarshal(manifest); err != nil {
+		return nil, err
+	}
+
+	switch manifest.Order {
+	case fleetOrderRegionByRegion, fleetOrderSequential, fleetOrderConcurrent:
+	default:
+		return nil, fmt.Errorf("unknown fleet order '%s', expected %s, %s or %s", manifest.Order, fleetOrderRegionByRegion, fleetOrderSequential, fleetOrderConcurrent)
+	}
+
+	if manifest.MaxParallel < 0 || manifest.MaxPerSubscription < 0 {
+		return nil, fmt.Errorf("fleet manifest %s limits must not be negative", path)
+	}
+
+	if manifest.MaxDisruption != "" {
+		if err := validateMaxUnavailable(manifest.MaxDisruption); err != nil {
+			return nil, fmt.Errorf("maxDisruption of fleet manifest %s: %v", path, err)
+		}
+	}
+
+	if len(manifest.ScaleSets) == 0 {
+		return nil, fmt.Errorf("fleet manifest %s lists no scale sets", path)
+	}
+
+	classes := map[string]bool{}
+	for _, class := range fleetPriorities {
+		classes[class] = true
+	}
+	for class := range manifest.Priorities {
+		if !classes[class] {
+			return nil, fmt.Errorf("unknown priority class '%s' in fleet manifest %s, expected %s", class, path, strings.Join(fleetPriorities, ", "))
+		}
+	}
+
+	groups := map[string]bool{}
+	for _, group := range manifest.Groups {
+		groups[group.Name] = true
+	}
+	for _, group := range manifest.Groups {
+		for _, other := range append(append([]string{}, group.After...), group.NotConcurrentWith...) {
+			if !groups[other] {
+				return nil, fmt.Errorf("group %s of fleet manifest %s refers to undeclared group %s", group.Name, path, other)
+			}
+		}
+	}
+
+	for i, target := range manifest.ScaleSets {
+		if target.SubscriptionID == "" || target.ResourceGroup == "" || target.Name == "" {
+			return nil, fmt.Errorf("scale set %d of fleet manifest %s needs a subscriptionID, resourceGroup and name", i, path)
+		}
+		for _, err := range []error{validateSubscriptionID(target.SubscriptionID), validateResourceGroupName(target.ResourceGroup), validateScaleSetName(target.Name)} {
+			if err != nil {
+				return nil, fmt.Errorf("scale set %d of fleet manifest %s: %v", i, path, err)
+			}
+		}
+		if target.Group != "" && !groups[target.Group] {
+			return nil, fmt.Errorf("scale set %s of fleet manifest %s is in undeclared group %s", target, path, target.Group)
+		}
+		if target.Priority == "" {
+			manifest.ScaleSets[i].Priority = fleetPriorityStandard
+		} else if !classes[target.Priority] {
+			return nil, fmt.Errorf("scale set %s of fleet manifest %s has unknown priority class '%s'", target, path, target.Priority)
+		}
+	}
+
+	if _, err := manifest.groupStages(); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Assigns each group the stage it runs in within a wave: after every group
+// it comes after, and apart from every group it can't run alongside. Scale
+// sets outside any group run in the first stage.
+func (m *fleetManifest) groupStages() (map[string]int, error) {
+	stages := map[string]int{}
+	for _, group := range m.Groups {
+		stages[group.Name] = 0
+	}
+
+	// Each pass can only push a group one stage later, so a group still
+	// moving after as many passes as there are groups is part of a cycle
+	for pass := 0; pass <= len(m.Groups); pass++ {
+		changed := false
+
+		for i, group := range m.Groups {
+			stage := stages[group.Name]
+			for _, other := range group.After {
+				if stages[other] >= stage {
+					stage = stages[other] + 1
+				}
+			}
+
+			// Of two groups which can't run together, the one declared
+			// later gives way
+			for _, earlier := range m.Groups[:i] {
+				if stages[earlier.Name] == stage && m.notConcurrent(group.Name, earlier.Name) {
+					stage++
+				}
+			}
+
+			if stage != stages[group.Name] {
+				stages[group.Name] = stage
+				changed = true
+			}
+		}
+
+		if !changed {
+			return stages, nil
+		}
+	}
+
+	return nil, fmt.Errorf("fleet manifest groups have a dependency cycle")
+}
+
+// Reports whether either group declares it can't run alongside the other
+func (m *fleetManifest) notConcurrent(a string, b string) bool {
+	for _, group := range m.Groups {
+		if group.Name != a && group.Name != b {
+			continue
+		}
+		for _, other := range group.NotConcurrentWith {
+			if (group.Name == a && other == b) || (group.Name == b && other == a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the groups a group comes after
+func (m *fleetManifest) dependencies(name string) []string {
+	for _, group := range m.Groups {
+		if group.Name == name {
+			return group.After
+		}
+	}
+	return nil
+}
+
+// Checks an --approve value names priority classes. Slice flags render
+// as a bracketed list, e.g. [standard,critical].
+func validateApprovals(value string) error {
+	for _, class := range strings.Split(strings.Trim(value, "[]"), ",") {
+		if class == "" {
+			continue
+		}
+		if err := oneOf(fleetPriorities...)(class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the positions of the scale sets in a priority class
+func (m *fleetManifest) inPriority(class string) []int {
+	var indices []int
+	for i, target := range m.ScaleSets {
+		if target.Priority == class {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// Groups the given scale sets into waves, each of which is upgraded only
+// once the one before it has finished. The canary region, if any, always
+// forms the first wave, and when upgrading concurrently, every other scale
+// set forms the second.
+func (m *fleetManifest) waves(indices []int) [][]int {
+	var waves [][]int
+
+	var canary, rest []int
+	for _, i := range indices {
+		if target := m.ScaleSets[i]; m.CanaryRegion != "" && strings.EqualFold(target.Region, m.CanaryRegion) {
+			canary = append(canary, i)
+		} else {
+			rest = append(rest, i)
+		}
+	}
+
+	if len(canary) > 0 {
+		waves = append(waves, canary)
+	} else if m.CanaryRegion != "" {
+		log.Warnf("No scale sets in canary region %s", m.CanaryRegion)
+	}
+
+	if m.Order == fleetOrderConcurrent {
+		if len(rest) > 0 {
+			waves = append(waves, rest)
+		}
+		return waves
+	}
+
+	if m.Order == fleetOrderSequential {
+		stages, _ := m.groupStages()
+		sort.SliceStable(rest, func(a, b int) bool {
+			return stages[m.ScaleSets[rest[a]].Group] < stages[m.ScaleSets[rest[b]].Group]
+		})
+		for _, i := range rest {
+			waves = append(waves, []int{i})
+		}
+		return waves
+	}
+
+	regions := map[string]int{}
+	for _, i := range rest {
+		region := strings.ToLower(m.ScaleSets[i].Region)
+		wave, ok := regions[region]
+		if !ok {
+			wave = len(waves)
+			regions[region] = wave
+			waves = append(waves, nil)
+		}
+		waves[wave] = append(waves[wave], i)
+	}
+
+	return waves
+}
+
+// fleetRun tracks the progress of a fleet upgrade across its waves
+type fleetRun struct {
+	cmd      *cobra.Command
+	manifest *fleetManifest
+	sessions []*azureSession
+
+	// Pause between stages, extended by up to 'jitter'
+	pause   time.Duration
+	jitter  time.Duration
+	started bool
+
+	mu           sync.Mutex
+	results      []fleetResult
+	paused       bool
+	finished     int
+	failed       int
+	failedGroups map[string]bool
+
+	// Scale sets being upgraded, in all and by subscription, and the
+	// instances they disrupt, signalled as each finishes; and the most
+	// there have been at once
+	slots          *sync.Cond
+	running        int
+	bySubscription map[string]int
+	peak           int
+	disruption     *fleetDisruption
+	disrupted      int64
+	peakDisrupted  int64
+}
+
+// fleetSummary aggregates the outcome of a fleet upgrade
+type fleetSummary struct {
+	Counts         map[string]int            `json:"counts"`
+	BySubscription map[string]map[string]int `json:"bySubscription"`
+	ByRegion       map[string]map[string]int `json:"byRegion"`
+	// Wall time of the whole fleet upgrade, and the longest of one scale
+	// set's
+	Duration        time.Duration `json:"-"`
+	Longest         time.Duration `json:"-"`
+	PeakConcurrency int           `json:"peakConcurrency"`
+	PeakDisruption  int64         `json:"peakDisruption,omitempty"`
+}
+
+// Totals the results of a fleet upgrade by status, overall and by
+// subscription and region
+func summarizeFleet(results []fleetResult) fleetSummary {
+	summary := fleetSummary{
+		Counts:         map[string]int{},
+		BySubscription: map[string]map[string]int{},
+		ByRegion:       map[string]map[string]int{},
+	}
+
+	for _, result := range results {
+		summary.Counts[result.Status]++
+
+		subscription := strings.ToLower(result.Target.SubscriptionID)
+		if summary.BySubscription[subscription] == nil {
+			summary.BySubscription[subscription] = map[string]int{}
+		}
+		summary.BySubscription[subscription][result.Status]++
+
+		region := strings.ToLower(result.Target.Region)
+		if summary.ByRegion[region] == nil {
+			summary.ByRegion[region] = map[string]int{}
+		}
+		summary.ByRegion[region][result.Status]++
+
+		if result.Duration > summary.Longest {
+			summary.Longest = result.Duration
+		}
+	}
+
+	return summary
+}
+
+// Upgrades every scale set in the fleet, priority class by priority class
+// and wave by wave, logging progress as each finishes. Each class soaks for
+// its time before the next starts, and a class needing approval stops the
+// fleet unless approved with --approve. Within a wave, groups run stage by
+// stage so that dependencies finish first, with the configured pause
+// between stages. Once a scale set fails, upgrades not yet started are
+// skipped if the manifest pauses on failure, those in groups which depend
+// on it are skipped regardless, and so are later priority classes.
+func runFleet(cmd *cobra.Command, manifest *fleetManifest, sessions []*azureSession, disruption *fleetDisruption) ([]fleetResult, fleetSummary) {
+	run := &fleetRun{
+		cmd:            cmd,
+		manifest:       manifest,
+		sessions:       sessions,
+		results:        make([]fleetResult, len(manifest.ScaleSets)),
+		failedGroups:   map[string]bool{},
+		bySubscription: map[string]int{},
+		disruption:     disruption,
+	}
+	run.slots = sync.NewCond(&run.mu)
+	start := time.Now()
+	for i, target := range manifest.ScaleSets {
+		run.results[i] = fleetResult{Target: target, Status: fleetSkipped}
+	}
+
+	run.pause, _ = cmd.Flags().GetDuration("batch-pause")
+	run.jitter, _ = cmd.Flags().GetDuration("batch-jitter")
+
+	approved := map[string]bool{}
+	approvals, _ := cmd.Flags().GetStringSlice("approve")
+	for _, class := range approvals {
+		approved[class] = true
+	}
+
+	var soak time.Duration
+	for _, class := range fleetPriorities {
+		indices := manifest.inPriority(class)
+		if len(indices) == 0 || run.isPaused() {
+			continue
+		}
+
+		if run.failed > 0 {
+			log.Warnf("Skipping the %d scale sets of priority class %s, since an earlier class failed", len(indices), class)
+			break
+		}
+
+		policy := manifest.Priorities[class]
+		if policy.RequireApproval && !approved[class] {
+			log.Warnf("Priority class %s needs approval, so its %d scale sets are skipped; once the earlier classes are judged healthy, rerun with --approve %s",
+				class, len(indices), class)
+			break
+		}
+
+		if soak > 0 {
+			log.Infof("Soaking for %s before priority class %s", soak, class)
+			batchPause(context.Background(), soak, 0)
+
+			// The soak stands in for the pause between batches
+			run.started = false
+		}
+
+		log.Infof("Starting priority class %s: %d scale sets", class, len(indices))
+		run.runWaves(indices)
+		soak = policy.Soak
+	}
+
+	summary := summarizeFleet(run.results)
+	summary.Duration = time.Since(start).Round(time.Second)
+	summary.PeakConcurrency = run.peak
+	summary.PeakDisruption = run.peakDisrupted
+
+	return run.results, summary
+}
+
+// Upgrades the given scale sets wave by wave, and group stage by group
+// stage within each wave
+func (r *fleetRun) runWaves(indices []int) {
+	stages, _ := r.manifest.groupStages()
+
+	for n, wave := range r.manifest.waves(indices) {
+		if r.isPaused() {
+			break
+		}
+
+		first := r.manifest.ScaleSets[wave[0]]
+		if r.manifest.Order == fleetOrderConcurrent && (n > 0 || !strings.EqualFold(first.Region, r.manifest.CanaryRegion)) {
+			log.Infof("Starting fleet wave %d: %d scale sets across regions", n+1, len(wave))
+		} else {
+			log.Infof("Starting fleet wave %d: %d scale sets in %s", n+1, len(wave), first.Region)
+		}
+
+		byStage := map[int][]int{}
+		last := 0
+		for _, i := range wave {
+			stage := stages[r.manifest.ScaleSets[i].Group]
+			byStage[stage] = append(byStage[stage], i)
+			if stage > last {
+				last = stage
+			}
+		}
+
+		for stage := 0; stage <= last; stage++ {
+			if len(byStage[stage]) == 0 || r.isPaused() {
+				continue
+			}
+
+			if r.started {
+				batchPause(context.Background(), r.pause, r.jitter)
+			}
+			r.started = true
+
+			r.runStage(byStage[stage])
+		}
+	}
+}
+
+func (r *fleetRun) isPaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+// Reports why a scale set can't start yet, or "" if it can
+func (r *fleetRun) gate(target fleetTarget) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.paused {
+		return "the fleet is paused"
+	}
+	for _, group := range r.manifest.dependencies(target.Group) {
+		if r.failedGroups[group] {
+			return fmt.Sprintf("group %s failed", group)
+		}
+	}
+	return ""
+}
+
+// Upgrades a set of scale sets at once, up to the manifest's limits, with
+// a worker started for each as a slot frees up
+func (r *fleetRun) runStage(stage []int) {
+	limit := r.manifest.MaxParallel
+	if limit <= 0 || limit > len(stage) {
+		limit = len(stage)
+	}
+
+	pending := append([]int{}, stage...)
+
+	var wg sync.WaitGroup
+	for len(pending) > 0 {
+		n := r.acquire(pending, limit)
+		i := pending[n]
+		pending = append(pending[:n], pending[n+1:]...)
+
+		target := r.manifest.ScaleSets[i]
+		if reason := r.gate(target); reason != "" {
+			log.Warnf("Skipping %s, %s", target, reason)
+			r.release(i)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer r.release(i)
+			r.upgradeTarget(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Waits for a slot to upgrade one of the pending scale sets, within the
+// stage's limit, the manifest's limit per subscription and the fleet's
+// disruption budget, and returns its position in pending. Scale sets start
+// in order, passing over those whose subscription has no slot free or
+// which would disrupt more than the budget has left.
+func (r *fleetRun) acquire(pending []int, limit int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if r.running < limit {
+			for n, i := range pending {
+				subscription := strings.ToLower(r.manifest.ScaleSets[i].SubscriptionID)
+				if r.manifest.MaxPerSubscription > 0 && r.bySubscription[subscription] >= r.manifest.MaxPerSubscription {
+					continue
+				}
+				if !r.disruption.allows(r.disrupted, i) {
+					continue
+				}
+
+				r.running++
+				r.bySubscription[subscription]++
+				if r.running > r.peak {
+					r.peak = r.running
+				}
+				r.disrupted += r.disruption.cost(i)
+				if r.disrupted > r.peakDisrupted {
+					r.peakDisrupted = r.disrupted
+				}
+				return n
+			}
+		}
+
+		r.slots.Wait()
+	}
+}
+
+// Frees the slot the scale set at a position held
+func (r *fleetRun) release(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.running--
+	r.bySubscription[strings.ToLower(r.manifest.ScaleSets[i].SubscriptionID)]--
+	r.disrupted -= r.disruption.cost(i)
+	r.slots.Broadcast()
+}
+
+// Upgrades a single scale set of the fleet and records the outcome
+func (r *fleetRun) upgradeTarget(i int) {
+	target := r.manifest.ScaleSets[i]
+	log.Infof("Upgrading %s in %s", target, target.Region)
+
+	ctx, cancel := upgradeContext(r.cmd)
+	defer cancel()
+
+	start := time.Now()
+	err := r.sessions[i].runUpgrade(ctx, r.cmd)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results[i].Duration = time.Since(start).Round(time.Second)
+	r.results[i].Status = fleetSucceeded
+	if err != nil {
+		r.results[i].Status, r.results[i].Err = fleetFailed, err
+		r.failed++
+		if target.Group != "" {
+			r.failedGroups[target.Group] = true
+		}
+		if r.manifest.PauseOnFailure && !r.paused {
+			log.Errorf("Upgrade of %s failed, pausing the fleet: %v", target, err)
+			r.paused = true
+		} else {
+			log.Errorf("Upgrade of %s failed: %v", target, err)
+		}
+	}
+	r.finished++
+
+	log.Infof("Fleet progress: %d/%d scale sets finished, %d failed", r.finished, len(r.results), r.failed)
+}
+
+// Prints a consolidated report of the fleet upgrade as JSON
+func printFleetReportJSON(results []fleetResult, summary fleetSummary) error {
+	type entry struct {
+		SubscriptionID string `json:"subscriptionId"`
+		ResourceGroup  string `json:"resourceGroup"`
+		ScaleSet       string `json:"scaleSet"`
+		Region         string `json:"region"`
+		Group          string `json:"group,omitempty"`
+		Status         string `json:"status"`
+		Duration       string `json:"duration"`
+		Error          string `json:"error,omitempty"`
+	}
+
+	type aggregate struct {
+		fleetSummary
+		Duration string `json:"duration"`
+		Longest  string `json:"longest"`
+	}
+
+	report := struct {
+		ScaleSets []entry   `json:"scaleSets"`
+		Summary   aggregate `json:"summary"`
+	}{
+		ScaleSets: make([]entry, 0, len(results)),
+		Summary:   aggregate{summary, summary.Duration.String(), summary.Longest.String()},
+	}
+	for _, result := range results {
+		e := entry{
+			SubscriptionID: result.Target.SubscriptionID,
+			ResourceGroup:  result.Target.ResourceGroup,
+			ScaleSet:       result.Target.Name,
+			Region:         result.Target.Region,
+			Group:          result.Target.Group,
+			Status:         result.Status,
+			Duration:       result.Duration.String(),
+		}
+		if result.Err != nil {
+			e.Error = result.Err.Error()
+		}
+		report.ScaleSets = append(report.ScaleSets, e)
+	}
+
+	return printJSON(report)
+}
+
+// Prints a consolidated report of the fleet upgrade, followed by its
+// totals by subscription and region
+func printFleetReport(results []fleetResult, summary fleetSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REGION\tSCALE SET\tSTATUS\tDURATION\tERROR")
+	for _, result := range results {
+		errText := ""
+		if result.Err != nil {
+			errText = result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Target.Region, result.Target, result.Status, result.Duration, errText)
+	}
+	w.Flush()
+
+	for _, totals := range []struct {
+		heading string
+		counts  map[string]map[string]int
+	}{{"SUBSCRIPTION", summary.BySubscription}, {"REGION", summary.ByRegion}} {
+		var keys []string
+		for key := range totals.counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Println()
+		fmt.Fprintf(w, "%s\tSUCCEEDED\tFAILED\tSKIPPED\n", totals.heading)
+		for _, key := range keys {
+			counts := totals.counts[key]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", key, counts[fleetSucceeded], counts[fleetFailed], counts[fleetSkipped])
+		}
+		w.Flush()
+	}
+
+	disruption := ""
+	if summary.PeakDisruption > 0 {
+		disruption = fmt.Sprintf(", disrupting at most %d instances", summary.PeakDisruption)
+	}
+	fmt.Printf("\n%d scale sets: %d succeeded, %d failed, %d skipped in %s (longest %s, at most %d at once%s)\n",
+		len(results), summary.Counts[fleetSucceeded], summary.Counts[fleetFailed], summary.Counts[fleetSkipped],
+		summary.Duration, summary.Longest, summary.PeakConcurrency, disruption)
+}
+
+// Fills in the region of every manifest entry which doesn't name one. The
+// regions are looked up with one Resource Graph query across the fleet's
+// subscriptions; any it can't answer for are read from each scale set.
+func resolveFleetRegions(ctx context.Context, manifest *fleetManifest, sessions []*azureSession) error {
+	var missing []int
+	subscriptions := map[string]bool{}
+	for i, target := range manifest.ScaleSets {
+		if target.Region == "" {
+			missing = append(missing, i)
+			subscriptions[target.SubscriptionID] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	regions := map[string]string{}
+	if first := sessions[missing[0]]; !first.Simulated {
+		var subs []string
+		for subscription := range subscriptions {
+			subs = append(subs, subscription)
+		}
+		sort.Strings(subs)
+
+		var err error
+		if regions, err = first.graphScaleSetRegions(ctx, subs); err != nil {
+			log.Warnf("Unable to query Resource Graph, reading each scale set's region instead: %v", err)
+			regions = map[string]string{}
+		}
+	}
+
+	for _, i := range missing {
+		sess := sessions[i]
+		if region, ok := regions[strings.ToLower(sess.scaleSetPath())]; ok {
+			manifest.ScaleSets[i].Region = region
+			continue
+		}
+
+		scaleSet, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+		if err != nil {
+			return err
+		}
+		manifest.ScaleSets[i].Region = to.String(scaleSet.Location)
+	}
+
+	return nil
+}
+
+// Returns the session options for each of the fleet's subscriptions, keyed
+// by the lower-cased subscription ID. Each is given its own rate limits,
+// leaving the rest of the options shared.
+func subscriptionSessionOptions(cmd *cobra.Command, manifest *fleetManifest, opts sessionOptions) map[string]sessionOptions {
+	reads, _ := cmd.Flags().GetInt("arm-reads-per-minute")
+	writes, _ := cmd.Flags().GetInt("arm-writes-per-minute")
+
+	bySubscription := map[string]sessionOptions{}
+	for _, target := range manifest.ScaleSets {
+		subscription := strings.ToLower(target.SubscriptionID)
+		if _, ok := bySubscription[subscription]; ok {
+			continue
+		}
+
+		// The first subscription takes the limiter already made
+		options := opts
+		if opts.Limiter != nil && len(bySubscription) > 0 {
+			options.Limiter = newARMRateLimiter(reads, writes)
+		}
+		bySubscription[subscription] = options
+	}
+
+	return bySubscription
+}
+
+// RunFleetUpgrade upgrades every scale set listed in a fleet manifest
+func RunFleetUpgrade(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Fleet Blue/Green Upgrade")
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	manifest, err := loadFleetManifest(cmd.Flags().Lookup("manifest").Value.String())
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Every session shares one recorder, and the sessions of each
+	// subscription one set of rate limits, as ARM meters requests by
+	// subscription
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	bySubscription := subscriptionSessionOptions(cmd, manifest, opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sessions := make([]*azureSession, len(manifest.ScaleSets))
+	for i, target := range manifest.ScaleSets {
+		if sessions[i], err = newSessionWithOptions(cmd, target.SubscriptionID, target.ResourceGroup, target.Name, bySubscription[strings.ToLower(target.SubscriptionID)]); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	if err = resolveFleetRegions(ctx, manifest, sessions); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	disruption, err := newFleetDisruption(ctx, cmd, manifest, sessions)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	results, summary := runFleet(cmd, manifest, sessions, disruption)
+	if format == outputJSON {
+		if err = printFleetReportJSON(results, summary); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	} else {
+		printFleetReport(results, summary)
+	}
+
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	if counts[fleetSucceeded] < len(results) {
+		fail(&exitError{
+			err:  fmt.Errorf("fleet upgrade incomplete, %d scale sets failed and %d were skipped", counts[fleetFailed], counts[fleetSkipped]),
+			code: exitPartialFailure,
+		})
+	}
+
+	log.Infof("Fleet upgrade complete, %d scale sets upgraded", len(results))
+}
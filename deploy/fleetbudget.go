@@ -0,0 +1,85 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// fleetDisruption is the fleet's blast-radius budget: the most instances,
+// across every scale set being upgraded, which may be disrupted at once
+type fleetDisruption struct {
+	// Instances each scale set disrupts while it's upgraded, by position
+	// in the manifest
+	costs  []int64
+	budget int64
+}
+
+// Resolves the manifest's maxDisruption against the fleet's total
+// capacity, returning nil if it sets no limit. While a scale set is
+// upgraded it counts as disrupting all of its instances, or as many as
+// --max-unavailable allows at once. A scale set which would alone exceed
+// the budget is refused, since it could never start.
+func newFleetDisruption(ctx context.Context, cmd *cobra.Command, manifest *fleetManifest, sessions []*azureSession) (*fleetDisruption, error) {
+	if manifest.MaxDisruption == "" {
+		return nil, nil
+	}
+
+	disruption := &fleetDisruption{costs: make([]int64, len(sessions))}
+	capacities := make([]int64, len(sessions))
+
+	var total int64
+	for i, sess := range sessions {
+		scaleSet, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+		if err != nil {
+			return nil, err
+		}
+		if scaleSet.Sku != nil {
+			capacities[i] = to.Int64(scaleSet.Sku.Capacity)
+		}
+		total += capacities[i]
+	}
+
+	budget, err := parseInstanceShare("maxDisruption", manifest.MaxDisruption, total)
+	if err != nil {
+		return nil, err
+	}
+	disruption.budget = budget
+
+	maxUnavailable := cmd.Flags().Lookup("max-unavailable").Value.String()
+	for i, capacity := range capacities {
+		cost := capacity
+		if maxUnavailable != "" && capacity > 0 {
+			if allowed, err := parseMaxUnavailable(maxUnavailable, capacity); err == nil && allowed < cost {
+				cost = allowed
+			}
+		}
+
+		if cost > budget {
+			return nil, fmt.Errorf("upgrading %s disrupts %d instances at once, more than the fleet's budget of %d; limit it with --max-unavailable",
+				manifest.ScaleSets[i], cost, budget)
+		}
+		disruption.costs[i] = cost
+	}
+
+	log.Infof("Disrupting at most %d of the fleet's %d instances at once", budget, total)
+
+	return disruption, nil
+}
+
+// Reports whether a scale set can start without taking the instances
+// disrupted past the budget
+func (d *fleetDisruption) allows(disrupted int64, i int) bool {
+	return d == nil || disrupted+d.costs[i] <= d.budget
+}
+
+// Returns the instances a scale set disrupts while it's upgraded
+func (d *fleetDisruption) cost(i int) int64 {
+	if d == nil {
+		return 0
+	}
+	return d.costs[i]
+}
@@ -0,0 +1,452 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	gitopsInSync    = "inSync"
+	gitopsSucceeded = "succeeded"
+	gitopsFailed    = "failed"
+
+	// Commit status states of the GitHub API
+	githubPending = "pending"
+	githubSuccess = "success"
+	githubFailure = "failure"
+)
+
+// gitopsSpec describes the Git repository holding the desired state of
+// the scale sets. It is read from the 'gitops' key of the config file.
+type gitopsSpec struct {
+	// URL of the repository, cloned with the git CLI and its credentials
+	Repository string `mapstructure:"repository"`
+	// Branch to follow, 'main' by default
+	Branch string `mapstructure:"branch"`
+	// Path of the desired-state file within the repository
+	Path string `mapstructure:"path"`
+	// Path of a status file committed back to the branch, if any
+	StatusFile string `mapstructure:"statusFile"`
+
+	GitHub struct {
+		// Repository commit statuses are reported on, as owner/name
+		Repository string `mapstructure:"repository"`
+		// Token reference, see resolveSecret
+		Token string `mapstructure:"token"`
+	} `mapstructure:"github"`
+}
+
+// desiredImage is the image one scale set should run, as listed in the
+// desired-state file:
+//
+//	scaleSets:
+//	  - subscriptionID: <subscription>
+//	    resourceGroup: prod
+//	    name: workers
+//	    galleryImage: /subscriptions/.../galleries/g/images/workers/versions/1.4.2
+type desiredImage struct {
+	fleetTarget `mapstructure:",squash"`
+	// Resource ID of the gallery image version to run
+	GalleryImage string `mapstructure:"galleryImage"`
+}
+
+// gitopsResult is the outcome of bringing one scale set to its desired
+// image
+type gitopsResult struct {
+	ScaleSet     string `json:"scaleSet"`
+	GalleryImage string `json:"galleryImage"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	// ID of the upgrade's run, if one was needed
+	RunID string `json:"runID,omitempty"`
+}
+
+// gitopsStatus is written to the status file after each change to the
+// desired state
+type gitopsStatus struct {
+	// Commit of the desired-state file applied
+	Commit    string         `json:"commit"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	ScaleSets []gitopsResult `json:"scaleSets"`
+}
+
+// gitopsRun follows the desired-state file, upgrading scale sets whose
+// desired image changes
+type gitopsRun struct {
+	cmd         *cobra.Command
+	spec        *gitopsSpec
+	opts        sessionOptions
+	dir         string
+	githubToken secret
+	health      *healthServer
+
+	// Commit of the desired-state file last applied
+	applied string
+
+	mu sync.Mutex
+	// Closed on shutdown, so no further upgrades start
+	stopping chan struct{}
+	// Control of the upgrade running, if any
+	control *runControl
+}
+
+// Reads the GitOps spec from the config file
+func loadGitopsSpec() (*gitopsSpec, error) {
+	if !viper.IsSet("gitops") {
+		return nil, fmt.Errorf("the config file has no 'gitops' section")
+	}
+
+	spec := &gitopsSpec{Branch: "main"}
+	if err := viper.UnmarshalKey("gitops", spec); err != nil {
+		return nil, err
+	}
+	if spec.Repository == "" || spec.Path == "" {
+		return nil, fmt.Errorf("the gitops config needs a repository and path")
+	}
+
+	return spec, nil
+}
+
+// Reads and checks the desired-state file
+func loadDesiredImages(path string) ([]desiredImage, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var desired []desiredImage
+	if err := v.UnmarshalKey("scaleSets", &desired); err != nil {
+		return nil, err
+	}
+
+	for i, image := range desired {
+		if image.SubscriptionID == "" || image.ResourceGroup == "" || image.Name == "" {
+			return nil, fmt.Errorf("scale set %d of %s needs a subscriptionID, resourceGroup and name", i, path)
+		}
+		if _, err := parseGalleryImageVersionID(image.GalleryImage); err != nil {
+			return nil, fmt.Errorf("scale set %s of %s: %v", image.fleetTarget, path, err)
+		}
+	}
+
+	return desired, nil
+}
+
+// Runs git in the working copy, returning its trimmed output
+func (r *gitopsRun) git(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", append([]string{"-C", r.dir}, args...)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Brings the working copy up to date with the branch, returning the last
+// commit changing the desired-state file. Commits of the status file
+// alone don't change it, so don't trigger a further reconcile.
+func (r *gitopsRun) sync(ctx context.Context) (string, error) {
+	if _, err := os.Stat(filepath.Join(r.dir, ".git")); os.IsNotExist(err) {
+		out, err := exec.CommandContext(ctx, "git", "clone", "--quiet", "--branch", r.spec.Branch, r.spec.Repository, r.dir).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git clone: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		if _, err = r.git(ctx, "fetch", "--quiet", "origin", r.spec.Branch); err != nil {
+			return "", err
+		}
+		if _, err = r.git(ctx, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+
+	return r.git(ctx, "log", "-1", "--format=%H", "--", r.spec.Path)
+}
+
+// Reports a scale set's progress as a commit status, if GitHub is
+// configured. Failing to is only worth a warning.
+func (r *gitopsRun) setCommitStatus(ctx context.Context, commit string, target fleetTarget, state string, description string) {
+	if r.spec.GitHub.Repository == "" {
+		return
+	}
+
+	url := fmt.Sprintf("https://api.github.com/repos/%s/statuses/%s", r.spec.GitHub.Repository, commit)
+	body := map[string]string{
+		"state":       state,
+		"context":     "azure-cluster-upgrade/" + target.Name,
+		"description": description,
+	}
+
+	if err := sendJSONRequest(ctx, http.MethodPost, url, body, nil, autorest.WithBearerAuthorization(r.githubToken.reveal())); err != nil {
+		log.Warnf("Unable to set commit status of %s for %s: %v", commit, target, err)
+	}
+}
+
+// Upgrades each scale set whose model doesn't reference its desired image,
+// each with the timeout of a single upgrade
+func (r *gitopsRun) reconcile(commit string, desired []desiredImage) []gitopsResult {
+	results := make([]gitopsResult, len(desired))
+
+	for i, image := range desired {
+		results[i] = gitopsResult{ScaleSet: image.fleetTarget.String(), GalleryImage: image.GalleryImage}
+		if r.isStopping() {
+			log.Infof("Shutting down, leaving %s for the next run", image.fleetTarget)
+			continue
+		}
+
+		ctx, cancel := upgradeContext(r.cmd)
+		err := r.upgradeTo(ctx, commit, image, &results[i])
+		cancel()
+
+		if err != nil {
+			log.Errorf("Upgrade of %s to %s failed: %v", image.fleetTarget, image.GalleryImage, err)
+			results[i].Status, results[i].Error = gitopsFailed, err.Error()
+
+			// The upgrade may have failed for running out of time
+			ctx, cancel = context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+			r.setCommitStatus(ctx, commit, image.fleetTarget, githubFailure, "Upgrade failed")
+			cancel()
+		}
+	}
+
+	return results
+}
+
+func (r *gitopsRun) upgradeTo(ctx context.Context, commit string, image desiredImage, result *gitopsResult) error {
+	sess, err := newSessionWithOptions(r.cmd, image.SubscriptionID, image.ResourceGroup, image.Name, r.opts)
+	if err != nil {
+		return err
+	}
+
+	current, _, err := sess.getModelImage(ctx)
+	if err != nil {
+		return err
+	}
+	if current != nil && sameImage(current, &compute.ImageReference{ID: to.StringPtr(image.GalleryImage)}) {
+		log.Infof("%s already runs %s", image.fleetTarget, image.GalleryImage)
+		result.Status = gitopsInSync
+		return nil
+	}
+
+	result.RunID = newRunID()
+	log.Infof("Desired image of %s changed to %s, upgrading as run %s", image.fleetTarget, image.GalleryImage, result.RunID)
+	r.setCommitStatus(ctx, commit, image.fleetTarget, githubPending, "Upgrading, run "+result.RunID)
+
+	run := newUpgradeRun(sess, r.cmd)
+	run.setRunID(result.RunID)
+	run.modelChanging = true
+	run.control = r.startControl()
+	defer r.endControl()
+
+	if err = run.execute(ctx, sess.modelImageStep(image.GalleryImage)); err != nil {
+		return err
+	}
+
+	result.Status = gitopsSucceeded
+	r.setCommitStatus(ctx, commit, image.fleetTarget, githubSuccess, "Upgrade complete, run "+result.RunID)
+	return nil
+}
+
+// Reports whether the process is shutting down
+func (r *gitopsRun) isStopping() bool {
+	select {
+	case <-r.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the control of an upgrade about to start
+func (r *gitopsRun) startControl() *runControl {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.control = newRunControl()
+	return r.control
+}
+
+func (r *gitopsRun) endControl() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.control = nil
+}
+
+// Returns the control of the upgrade running, or nil
+func (r *gitopsRun) current() *runControl {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.control
+}
+
+// Commits the outcome of applying the desired state to the status file
+// and pushes it, if a status file is configured
+func (r *gitopsRun) writeStatus(ctx context.Context, commit string, results []gitopsResult) error {
+	if r.spec.StatusFile == "" {
+		return nil
+	}
+
+	encoded, err := json.MarshalIndent(gitopsStatus{Commit: commit, UpdatedAt: time.Now().UTC(), ScaleSets: results}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, r.spec.StatusFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(encoded, '\n'), 0644); err != nil {
+		return err
+	}
+
+	steps := [][]string{
+		{"add", "--", r.spec.StatusFile},
+		{"-c", "user.name=azure-cluster-upgrade", "-c", "user.email=azure-cluster-upgrade@localhost",
+			"commit", "--quiet", "-m", fmt.Sprintf("Record upgrade status for %.12s", commit), "--", r.spec.StatusFile},
+		{"push", "--quiet", "origin", "HEAD:" + r.spec.Branch},
+	}
+	for _, args := range steps {
+		if _, err = r.git(ctx, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies the desired state if it changed since last applied. A failed
+// upgrade isn't retried until the desired state changes again.
+func (r *gitopsRun) poll() error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	commit, err := r.sync(ctx)
+	if err != nil {
+		return err
+	}
+	if commit == "" {
+		return fmt.Errorf("%s isn't in branch %s of %s", r.spec.Path, r.spec.Branch, r.spec.Repository)
+	}
+	if commit == r.applied {
+		return nil
+	}
+
+	log.Infof("Applying desired state %s at %.12s", r.spec.Path, commit)
+	r.applied = commit
+
+	desired, err := loadDesiredImages(filepath.Join(r.dir, r.spec.Path))
+	if err != nil {
+		return err
+	}
+
+	results := r.reconcile(commit, desired)
+	if r.isStopping() {
+		// Applied in full once restarted
+		return nil
+	}
+
+	// The upgrades are likely to have outlasted the sync's timeout
+	ctx, cancel = context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	return r.writeStatus(ctx, commit, results)
+}
+
+// RunGitOps follows a desired-state file in a Git repository, upgrading
+// each scale set it lists onto its image whenever the file changes, so
+// upgrades go through Git review. Outcomes are written back as commit
+// statuses or to a status file in the repository. On SIGTERM, polling stops
+// and a running upgrade is held ahead of its next phase, or before the
+// next scale set, before the process exits.
+func RunGitOps(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green GitOps")
+
+	spec, err := loadGitopsSpec()
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	run := &gitopsRun{
+		cmd:      cmd,
+		spec:     spec,
+		dir:      cmd.Flags().Lookup("work-dir").Value.String(),
+		health:   &healthServer{},
+		stopping: make(chan struct{}),
+	}
+	if run.dir == "" {
+		run.dir = filepath.Join(os.TempDir(), "azure-cluster-upgrade-gitops")
+	}
+
+	if run.githubToken, err = resolveSecret(context.Background(), spec.GitHub.Token); err != nil {
+		log.Fatal(fmt.Errorf("unable to resolve GitHub token: %v", err))
+		os.Exit(1)
+	}
+
+	// Every session shares one set of options, so rate limits apply
+	// across scale sets
+	if run.opts, err = sessionOptionsFromFlags(cmd); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	run.health.serve(cmd.Flags().Lookup("health-listen").Value.String())
+
+	interval, _ := cmd.Flags().GetDuration("poll-interval")
+	log.Infof("Following %s in branch %s of %s every %s", spec.Path, spec.Branch, spec.Repository, interval)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if err := run.poll(); err != nil {
+				log.Errorf("GitOps poll failed: %v", err)
+			} else {
+				run.health.setReady(true)
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-run.stopping:
+				return
+			}
+		}
+	}()
+
+	sig := <-shutdownSignals()
+	log.Infof("Received %s, holding any running upgrade ahead of its next phase", sig)
+	run.health.setReady(false)
+	close(run.stopping)
+
+	// Waits for the poll under way to finish, or its upgrade to be held
+	for {
+		if control := run.current(); control != nil {
+			control.pause()
+			if control.isHeld() {
+				break
+			}
+		}
+
+		select {
+		case <-done:
+			log.Info("Shut down")
+			return
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+	log.Info("Shut down")
+}
@@ -0,0 +1,132 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Extension types of the NVIDIA GPU driver extensions, e.g.
+// Microsoft.HpcCompute.NvidiaGpuDriverLinux, matched case-insensitively
+const nvidiaDriverExtension = "nvidiagpudriver"
+
+// Returns the new instances whose NVIDIA driver extension, where they
+// have one, didn't provision successfully, with the status each reported.
+// Instances without the extension are assumed to have the driver baked
+// into their image.
+func (s *azureSession) getFailedGPUDriverExtensions(ctx context.Context) ([]string, error) {
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "properties/latestModelApplied eq true", "instanceView")
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	for _, vm := range vms {
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.InstanceView == nil || vm.InstanceView.Extensions == nil {
+			continue
+		}
+
+		for _, extension := range *vm.InstanceView.Extensions {
+			if !strings.Contains(strings.ToLower(to.String(extension.Type)), nvidiaDriverExtension) {
+				continue
+			}
+
+			if state, _ := extensionProvisioningState(extension); state != "succeeded" {
+				failed = append(failed, fmt.Sprintf("%s (%s %s)", to.String(vm.InstanceID), to.String(extension.Name), state))
+			}
+		}
+	}
+	sort.Strings(failed)
+
+	return failed, nil
+}
+
+// Builds a script printing 'GPUS <count>' with the number of devices
+// nvidia-smi reports, or 'GPUS -1' when nvidia-smi fails
+func gpuCountScript(commandID string) []string {
+	if commandID == windowsRunCommandID {
+		return []string{
+			`$smi = 'C:\Windows\System32\nvidia-smi.exe'`,
+			`if (-not (Test-Path $smi)) { $smi = 'C:\Program Files\NVIDIA Corporation\NVSMI\nvidia-smi.exe' }`,
+			`try { $gpus = & $smi --query-gpu=uuid --format=csv,noheader; if ($LASTEXITCODE -ne 0) { throw } ; Write-Output "GPUS $(@($gpus).Count)" } catch { Write-Output 'GPUS -1' }`,
+		}
+	}
+
+	return []string{
+		`if gpus=$(nvidia-smi --query-gpu=uuid --format=csv,noheader); then echo "GPUS $(echo "$gpus" | grep -c .)"; else echo 'GPUS -1'; fi`,
+	}
+}
+
+// Parses the device count printed by gpuCountScript, or -1 if absent
+func parseGPUCount(stdout string) int {
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "GPUS" {
+			if count, err := strconv.Atoi(fields[1]); err == nil {
+				return count
+			}
+		}
+	}
+	return -1
+}
+
+// Holds the upgrade until the GPUs of every new instance are usable: the
+// NVIDIA driver extension provisioned, and nvidia-smi sees the expected
+// number of devices. A driver which failed to load otherwise goes
+// unnoticed until workloads are scheduled onto the instance.
+func (r *upgradeRun) gpuReadiness(ctx context.Context) error {
+	expected, _ := r.cmd.Flags().GetInt("expected-gpus")
+	if expected <= 0 {
+		return nil
+	}
+
+	failed, err := r.sess.getFailedGPUDriverExtensions(ctx)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("NVIDIA driver extension failed on new instances: %s", strings.Join(failed, ", "))
+	}
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	log.Infof("Checking new instances each report %d GPUs...", expected)
+	results, err := r.sess.runCommandOnInstances(ctx, "properties/latestModelApplied eq true", gpuCountScript(commandID), timeout)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+		return err
+	}
+
+	var problems []string
+	var failedInstances []string
+	for _, result := range results {
+		switch count := parseGPUCount(result.Stdout); {
+		case count < 0:
+			problems = append(problems, result.InstanceID+" (nvidia-smi failed)")
+		case count != expected:
+			problems = append(problems, fmt.Sprintf("%s (%d GPUs)", result.InstanceID, count))
+		default:
+			continue
+		}
+		failedInstances = append(failedInstances, result.InstanceID)
+	}
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		r.sess.reportFailedInstances(failedInstances, r.diagnosticsDir)
+		return fmt.Errorf("new instances don't report the expected %d GPUs: %s", expected, strings.Join(problems, ", "))
+	}
+
+	log.Infof("Every new instance reports %d GPUs", expected)
+	return nil
+}
@@ -0,0 +1,100 @@
+package deploy
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a shutdown checks whether running upgrades are held
+const shutdownPollInterval = time.Second
+
+// healthServer answers the liveness and readiness probes of the
+// long-running commands, so Kubernetes restarts one which hangs and only
+// routes requests to one able to take them
+type healthServer struct {
+	mu    sync.Mutex
+	ready bool
+}
+
+func (h *healthServer) setReady(ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = ready
+}
+
+func (h *healthServer) isReady() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ready
+}
+
+// Answers the liveness probe for as long as the process serves requests
+func (h *healthServer) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// Answers the readiness probe once the command is able to take work, until
+// it starts shutting down
+func (h *healthServer) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	if !h.isReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Adds the probes to a mux, as /healthz and /readyz
+func (h *healthServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+}
+
+// Serves the probes on their own address, if one is given
+func (h *healthServer) serve(listen string) {
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	h.register(mux)
+
+	go func() {
+		log.Infof("Serving health probes on %s", listen)
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// Returns a channel receiving the signals which shut down the long-running
+// commands: SIGTERM, as sent by Kubernetes and systemd, and interrupts
+func shutdownSignals() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return stop
+}
+
+// Pauses the upgrades 'running' returns ahead of their next phase, and
+// waits until each is held there or has finished, so the process can exit
+// without interrupting a phase. The scale sets' upgrade state tags let an
+// upgrade held part way through be picked up with --on-rerun resume.
+func holdRuns(running func() []*runControl) {
+	for {
+		held := true
+		for _, control := range running() {
+			control.pause()
+			held = held && control.isHeld()
+		}
+		if held {
+			return
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+}
@@ -0,0 +1,146 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Publisher of the Application Health extensions
+	healthExtensionPublisher = "Microsoft.ManagedServices"
+	// Prefix of the extension types, ApplicationHealthLinux and
+	// ApplicationHealthWindows
+	healthExtensionType = "ApplicationHealth"
+
+	// Protocols the Application Health extension probes with
+	healthProtocolHTTP  = "http"
+	healthProtocolHTTPS = "https"
+	healthProtocolTCP   = "tcp"
+)
+
+// Reports whether the scale set has a health signal of its own: the
+// Application Health extension, or a load balancer probe in its network
+// profile
+func hasHealthSignal(scaleSet compute.VirtualMachineScaleSet) bool {
+	profile := scaleSet.VirtualMachineProfile
+	if profile == nil {
+		return false
+	}
+
+	if profile.NetworkProfile != nil && profile.NetworkProfile.HealthProbe != nil {
+		return true
+	}
+
+	for _, extension := range modelExtensions(scaleSet) {
+		if strings.EqualFold(to.String(extension.Publisher), healthExtensionPublisher) &&
+			strings.HasPrefix(strings.ToLower(to.String(extension.Type)), strings.ToLower(healthExtensionType)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Builds the Application Health extension probing the given protocol, port
+// and, for HTTP(S), path, matching the scale set's OS
+func healthExtension(scaleSet compute.VirtualMachineScaleSet, protocol string, port int, path string) compute.VirtualMachineScaleSetExtension {
+	extensionType := healthExtensionType + "Linux"
+	if profile := scaleSet.VirtualMachineProfile; profile != nil && profile.OsProfile != nil && profile.OsProfile.WindowsConfiguration != nil {
+		extensionType = healthExtensionType + "Windows"
+	}
+
+	settings := map[string]interface{}{"protocol": protocol, "port": port}
+	if protocol != healthProtocolTCP {
+		settings["requestPath"] = path
+	}
+
+	return compute.VirtualMachineScaleSetExtension{
+		Name: to.StringPtr(extensionType),
+		VirtualMachineScaleSetExtensionProperties: &compute.VirtualMachineScaleSetExtensionProperties{
+			Publisher:               to.StringPtr(healthExtensionPublisher),
+			Type:                    to.StringPtr(extensionType),
+			TypeHandlerVersion:      to.StringPtr("1.0"),
+			AutoUpgradeMinorVersion: to.BoolPtr(true),
+			Settings:                settings,
+		},
+	}
+}
+
+// Returns the ARM path of one of the scale set model's extensions
+func (s *azureSession) scaleSetExtensionPath(name string) string {
+	return fmt.Sprintf("%s/extensions/%s", s.scaleSetPath(), name)
+}
+
+// Returns a phase which adds the Application Health extension to the scale
+// set model if it has no health signal, so automatic instance repairs and
+// the health gates have one to work from on the new instances. Without
+// --health-extension, the missing signal is only warned about. Rolling back
+// removes the extension again.
+func (r *upgradeRun) healthExtensionStep() phase.Step {
+	var added string
+
+	protocol := r.cmd.Flags().Lookup("health-extension").Value.String()
+	port, _ := r.cmd.Flags().GetInt("health-extension-port")
+	path := r.cmd.Flags().Lookup("health-extension-path").Value.String()
+
+	return &phase.Func{
+		StepName: "health-extension",
+		ValidateFunc: func(ctx context.Context) error {
+			if protocol != "" {
+				return nil
+			}
+
+			scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			if !hasHealthSignal(scaleSet) {
+				log.Warnf("Scale set %s has neither the Application Health extension nor a load balancer probe, so instance health is only judged by their provisioning; add the extension with --health-extension",
+					r.sess.ScaleSetName)
+			}
+			return nil
+		},
+		ExecuteFunc: func(ctx context.Context) error {
+			if protocol == "" {
+				return nil
+			}
+
+			scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			if hasHealthSignal(scaleSet) {
+				log.Infof("Scale set %s already has a health signal, not adding the Application Health extension", r.sess.ScaleSetName)
+				return nil
+			}
+
+			extension := healthExtension(scaleSet, protocol, port, path)
+			name := to.String(extension.Name)
+
+			log.Infof("Adding the %s extension to the scale set model, probing %s on port %d...", name, protocol, port)
+			if err = r.sess.armDoAsync(ctx, http.MethodPut, r.sess.scaleSetExtensionPath(name), newerComputeAPIVersion, extension, nil); err != nil {
+				return fmt.Errorf("unable to add the %s extension: %v", name, err)
+			}
+			added = name
+
+			return nil
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			if added == "" {
+				return nil
+			}
+
+			log.Infof("Removing the %s extension from the scale set model", added)
+			return r.sess.armDoAsync(ctx, http.MethodDelete, r.sess.scaleSetExtensionPath(added), newerComputeAPIVersion, nil, nil)
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Phases which take old instances out of service, after which their
+// failing is expected rather than a sign of trouble
+var disruptivePhases = map[string]bool{"warm-up": true, "budgeted-scale-in": true, "drain": true, "scale-in": true}
+
+// healthWatcher polls the health of every instance of the scale set while
+// an upgrade runs, so instances the upgrade hasn't touched failing, e.g.
+// in a platform incident, hold the run rather than it carrying on and
+// removing the old instances too. Health is otherwise only checked at
+// gates on the new instances.
+type healthWatcher struct {
+	run        *upgradeRun
+	interval   time.Duration
+	timeout    time.Duration
+	maxFailing int
+
+	mu sync.Mutex
+	// Instances seen available, which are expected to stay so
+	seenHealthy map[string]bool
+	// Instances seen available which no longer are, by ID
+	failing []string
+	// Set once old instances start being taken out of service
+	disrupting bool
+}
+
+// Starts watching instance health in the background if
+// --health-watch-interval is given, returning a func to stop it
+func (r *upgradeRun) startHealthWatch(ctx context.Context) func() {
+	interval, _ := r.cmd.Flags().GetDuration("health-watch-interval")
+	if interval <= 0 {
+		return func() {}
+	}
+
+	w := &healthWatcher{run: r, interval: interval, seenHealthy: map[string]bool{}}
+	w.timeout, _ = r.cmd.Flags().GetDuration("health-watch-timeout")
+	w.maxFailing, _ = r.cmd.Flags().GetInt("health-watch-max-failing")
+	r.healthWatch = w
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for {
+			if err := w.poll(ctx); err != nil && ctx.Err() == nil {
+				log.Warnf("Unable to check instance health: %v", err)
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// Reports whether an instance's failing would be unrelated to the upgrade.
+// Old instances are, until they start being taken out of service; new
+// instances always are once they were seen healthy.
+func (w *healthWatcher) unrelated(id string) bool {
+	if !w.disrupting {
+		return true
+	}
+
+	// A resumed run doesn't know which instances are old
+	if len(w.run.originalInstances) == 0 {
+		return false
+	}
+
+	for _, original := range w.run.originalInstances {
+		if original == id {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the instances and their health, noting those which were seen
+// healthy and no longer are
+func (w *healthWatcher) poll(ctx context.Context) error {
+	sess := w.run.sess
+	vms, err := sess.getVMSSVMClient().List(ctx, sess.ResourceGroupName, sess.ScaleSetName, "", "instanceView")
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var failing []string
+	for _, vm := range vms {
+		id := to.String(vm.InstanceID)
+		switch {
+		case isAvailable(vm):
+			w.seenHealthy[id] = true
+		case w.seenHealthy[id] && w.unrelated(id):
+			failing = append(failing, id)
+		}
+	}
+
+	sort.Strings(failing)
+	if len(failing) > 0 && len(w.failing) == 0 {
+		log.Warnf("Instances %s of %s stopped being healthy while the upgrade ran", strings.Join(failing, ", "), sess.ScaleSetName)
+	}
+	w.failing = failing
+
+	return nil
+}
+
+// Returns the instances failing, once there are enough to hold the run
+func (w *healthWatcher) tripped() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.failing) < w.maxFailing {
+		return nil
+	}
+	return w.failing
+}
+
+// Holds the run ahead of a phase while too many instances are failing,
+// until they recover or --health-watch-timeout passes
+func (w *healthWatcher) hold(ctx context.Context, phaseName string) error {
+	failing := w.tripped()
+	if len(failing) == 0 {
+		w.enter(phaseName)
+		return nil
+	}
+
+	log.Warnf("%d instances unrelated to the upgrade are failing (%s), likely a platform issue; pausing ahead of phase %s until they recover",
+		len(failing), strings.Join(failing, ", "), phaseName)
+
+	deadline := time.After(w.timeout)
+	for len(failing) > 0 {
+		select {
+		case <-time.After(w.interval):
+		case <-deadline:
+			return fmt.Errorf("instances %s were still failing after %s, so phase %s wasn't started; check Azure Service Health for the region",
+				strings.Join(failing, ", "), w.timeout, phaseName)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		failing = w.tripped()
+	}
+
+	log.Info("Failing instances recovered, resuming the upgrade")
+	w.enter(phaseName)
+	return nil
+}
+
+// Notes the phase about to run, so old instances taken out of service
+// aren't taken for failures
+func (w *healthWatcher) enter(phaseName string) {
+	if !disruptivePhases[phaseName] {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.disrupting = true
+}
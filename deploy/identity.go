@@ -0,0 +1,161 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://management.azure.com/"
+
+	// Name the system-assigned identity is reported under
+	systemAssignedIdentity = "system-assigned"
+)
+
+// modelIdentity is a managed identity instances of the scale set should
+// be able to obtain tokens for. User-assigned identities are picked by
+// client ID; the system-assigned identity has none.
+type modelIdentity struct {
+	Name     string
+	ClientID string
+}
+
+// Returns the managed identities assigned to the scale set, sorted by name
+func modelIdentities(scaleSet compute.VirtualMachineScaleSet) []modelIdentity {
+	var identities []modelIdentity
+	if scaleSet.Identity == nil {
+		return identities
+	}
+
+	switch scaleSet.Identity.Type {
+	case compute.ResourceIdentityTypeSystemAssigned, compute.ResourceIdentityTypeSystemAssignedUserAssigned:
+		identities = append(identities, modelIdentity{Name: systemAssignedIdentity})
+	}
+
+	for resourceID, identity := range scaleSet.Identity.UserAssignedIdentities {
+		name := resourceID
+		if id, err := azure.ParseResourceID(resourceID); err == nil {
+			name = id.ResourceName
+		}
+		if identity == nil || identity.ClientID == nil {
+			log.Warnf("User-assigned identity %s has no client ID reported, not probing it", name)
+			continue
+		}
+		identities = append(identities, modelIdentity{Name: name, ClientID: *identity.ClientID})
+	}
+
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Name < identities[j].Name })
+
+	return identities
+}
+
+// Builds a script which requests a token from IMDS for each identity,
+// printing 'IDENTITY <name> <HTTP status>' for each
+func identityProbeScript(commandID string, identities []modelIdentity) []string {
+	var script []string
+
+	for _, identity := range identities {
+		url := imdsTokenURL
+		if identity.ClientID != "" {
+			url += "&client_id=" + identity.ClientID
+		}
+
+		if commandID == windowsRunCommandID {
+			script = append(script, fmt.Sprintf(
+				`try { $r = Invoke-WebRequest -UseBasicParsing -Headers @{Metadata='true'} -Uri '%s'; Write-Output "IDENTITY %s $($r.StatusCode)" } catch { Write-Output "IDENTITY %s $([int]$_.Exception.Response.StatusCode)" }`,
+				url, identity.Name, identity.Name))
+		} else {
+			script = append(script, fmt.Sprintf(`echo "IDENTITY %s $(curl -s -o /dev/null -w '%%{http_code}' -H Metadata:true '%s')"`, identity.Name, url))
+		}
+	}
+
+	return script
+}
+
+// Parses the output of identityProbeScript, returning the identities an
+// instance failed to obtain a token for along with the status it got
+func parseIdentityProbe(stdout string, identities []modelIdentity) []string {
+	statuses := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "IDENTITY" {
+			statuses[fields[1]] = fields[2]
+		}
+	}
+
+	var failed []string
+	for _, identity := range identities {
+		status, ok := statuses[identity.Name]
+		switch {
+		case !ok:
+			failed = append(failed, identity.Name+" (no response)")
+		case status != "200":
+			failed = append(failed, fmt.Sprintf("%s (HTTP %s)", identity.Name, status))
+		}
+	}
+
+	return failed
+}
+
+// Confirms every new instance can obtain a token from IMDS for each of
+// the scale set's managed identities before the old instances are
+// removed, catching images whose workloads would lose their identity
+func (r *upgradeRun) verifyIdentities(ctx context.Context) error {
+	if verify, _ := r.cmd.Flags().GetBool("verify-identities"); !verify {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	identities := modelIdentities(scaleSet)
+	if len(identities) == 0 {
+		log.Infof("Scale set %s has no managed identities to verify", r.sess.ScaleSetName)
+		return nil
+	}
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	log.Infof("Checking new instances obtain tokens for %d managed identities...", len(identities))
+	results, err := r.sess.runCommandOnInstances(ctx, "properties/latestModelApplied eq true", identityProbeScript(commandID, identities), timeout)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+		return err
+	}
+
+	var problems []string
+	var failedInstances []string
+	for _, result := range results {
+		if failed := parseIdentityProbe(result.Stdout, identities); len(failed) > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", result.InstanceID, strings.Join(failed, ", ")))
+			failedInstances = append(failedInstances, result.InstanceID)
+		}
+	}
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		r.sess.reportFailedInstances(failedInstances, r.diagnosticsDir)
+		return fmt.Errorf("new instances could not obtain managed identity tokens: %s", strings.Join(problems, "; "))
+	}
+
+	names := make([]string, len(identities))
+	for i, identity := range identities {
+		names[i] = identity.Name
+	}
+	log.Infof("Every new instance obtained tokens for %s", strings.Join(names, ", "))
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	managedIdentityAPIVersion = "2018-11-30"
+	roleAssignmentsAPIVersion = "2022-04-01"
+
+	// Resources other than the scale set given a user-assigned identity
+	graphIdentityUsersQuery = `resources
+| where isnotnull(identity.userAssignedIdentities)
+| where tolower(id) != '%s'
+| mv-expand identityID = bag_keys(identity.userAssignedIdentities)
+| where tolower(tostring(identityID)) == '%s'
+| project id`
+)
+
+// identityRotation swaps one of the scale set's user-assigned identities
+// for another, given by resource ID
+type identityRotation struct {
+	From string
+	To   string
+
+	// Client ID of the new identity, looked up during validation
+	clientID string
+	// Set once the new identity is added to the model, and once the old
+	// one is removed
+	added   bool
+	retired bool
+}
+
+// Checks a value is the resource ID of a user-assigned identity
+func validateUserAssignedIdentity(value string) error {
+	id, err := azure.ParseResourceID(value)
+	if err != nil || !strings.EqualFold(id.Provider, "Microsoft.ManagedIdentity") || !strings.EqualFold(id.ResourceType, "userAssignedIdentities") {
+		return fmt.Errorf("%s is not the resource ID of a user-assigned identity", value)
+	}
+	return nil
+}
+
+// Returns the identity rotation asked for by --rotate-identity-to, or nil
+func identityRotationFromFlags(cmd *cobra.Command) *identityRotation {
+	flag := cmd.Flags().Lookup("rotate-identity-to")
+	if flag == nil || flag.Value.String() == "" {
+		return nil
+	}
+	return &identityRotation{From: cmd.Flags().Lookup("rotate-identity-from").Value.String(), To: flag.Value.String()}
+}
+
+// Returns the key of a user-assigned identity in the scale set's
+// identities, whose case ARM doesn't preserve, or "" if it isn't assigned
+func assignedIdentityKey(scaleSet compute.VirtualMachineScaleSet, resourceID string) string {
+	if scaleSet.Identity == nil {
+		return ""
+	}
+	for key := range scaleSet.Identity.UserAssignedIdentities {
+		if strings.EqualFold(key, resourceID) {
+			return key
+		}
+	}
+	return ""
+}
+
+// Adds or removes one of the scale set's user-assigned identities, keeping
+// any system-assigned identity
+func (s *azureSession) setUserAssignedIdentity(ctx context.Context, resourceID string, assigned bool) error {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	identityType := compute.ResourceIdentityTypeUserAssigned
+	if scaleSet.Identity != nil && (scaleSet.Identity.Type == compute.ResourceIdentityTypeSystemAssigned ||
+		scaleSet.Identity.Type == compute.ResourceIdentityTypeSystemAssignedUserAssigned) {
+		identityType = compute.ResourceIdentityTypeSystemAssignedUserAssigned
+	}
+
+	// A null value removes an identity
+	identities := map[string]*compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+	if assigned {
+		identities[resourceID] = &compute.VirtualMachineScaleSetIdentityUserAssignedIdentitiesValue{}
+	} else {
+		identities[assignedIdentityKey(scaleSet, resourceID)] = nil
+	}
+
+	return s.updateModel(ctx, compute.VirtualMachineScaleSetUpdate{
+		Identity: &compute.VirtualMachineScaleSetIdentity{Type: identityType, UserAssignedIdentities: identities},
+	})
+}
+
+// Returns the client and principal IDs of a user-assigned identity
+func (s *azureSession) userAssignedIdentityIDs(ctx context.Context, resourceID string) (string, string, error) {
+	var identity struct {
+		Properties struct {
+			ClientID    string `json:"clientId"`
+			PrincipalID string `json:"principalId"`
+		} `json:"properties"`
+	}
+	if err := s.armGet(ctx, resourceID, managedIdentityAPIVersion, &identity); err != nil {
+		return "", "", err
+	}
+	return identity.Properties.ClientID, identity.Properties.PrincipalID, nil
+}
+
+// Checks the identities given to rotate: the old one must be assigned to
+// the scale set and the new one exist and not be
+func (r *upgradeRun) checkIdentityRotation(ctx context.Context) error {
+	if r.rotation.From == "" {
+		return fmt.Errorf("--rotate-identity-to needs --rotate-identity-from, the identity it replaces")
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	if assignedIdentityKey(scaleSet, r.rotation.From) == "" {
+		return fmt.Errorf("identity %s isn't assigned to scale set %s, so can't be rotated", r.rotation.From, r.sess.ScaleSetName)
+	}
+	if assignedIdentityKey(scaleSet, r.rotation.To) != "" {
+		return fmt.Errorf("identity %s is already assigned to scale set %s", r.rotation.To, r.sess.ScaleSetName)
+	}
+
+	if r.rotation.clientID, _, err = r.sess.userAssignedIdentityIDs(ctx, r.rotation.To); err != nil {
+		return fmt.Errorf("unable to look up identity %s: %v", r.rotation.To, err)
+	}
+
+	return nil
+}
+
+// Assigns the new identity to the scale set alongside the old one, so
+// old instances keep working with the old identity while new instances
+// are proven with the new
+func (r *upgradeRun) addRotatedIdentity(ctx context.Context) error {
+	log.Infof("Assigning identity %s to scale set %s alongside %s...", r.rotation.To, r.sess.ScaleSetName, r.rotation.From)
+	if err := r.sess.setUserAssignedIdentity(ctx, r.rotation.To, true); err != nil {
+		return err
+	}
+	r.rotation.added = true
+
+	return nil
+}
+
+// Removes the new identity again, unless the old one was already retired
+func (r *upgradeRun) removeRotatedIdentity(ctx context.Context) error {
+	if !r.rotation.added || r.rotation.retired {
+		return nil
+	}
+
+	log.Infof("Removing identity %s from scale set %s", r.rotation.To, r.sess.ScaleSetName)
+	if err := r.sess.setUserAssignedIdentity(ctx, r.rotation.To, false); err != nil {
+		return err
+	}
+	r.rotation.added = false
+
+	return nil
+}
+
+// Confirms every new instance obtains a token for the new identity before
+// the old instances are removed
+func (r *upgradeRun) verifyRotatedIdentity(ctx context.Context) error {
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	id, _ := azure.ParseResourceID(r.rotation.To)
+	identities := []modelIdentity{{Name: id.ResourceName, ClientID: r.rotation.clientID}}
+
+	log.Infof("Checking new instances obtain tokens for identity %s...", id.ResourceName)
+	results, err := r.sess.runCommandOnInstances(ctx, "properties/latestModelApplied eq true", identityProbeScript(commandID, identities), timeout)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+		return err
+	}
+
+	var failedInstances []string
+	for _, result := range results {
+		if failed := parseIdentityProbe(result.Stdout, identities); len(failed) > 0 {
+			failedInstances = append(failedInstances, result.InstanceID)
+		}
+	}
+	if len(failedInstances) > 0 {
+		r.sess.reportFailedInstances(failedInstances, r.diagnosticsDir)
+		return fmt.Errorf("new instances %s could not obtain tokens for identity %s", strings.Join(failedInstances, ", "), id.ResourceName)
+	}
+
+	log.Infof("Every new instance obtained a token for identity %s", id.ResourceName)
+	return nil
+}
+
+// Lists the resources other than the scale set the identity is assigned
+// to, in the scale set's and the identity's subscriptions. Resource Graph
+// lags ARM by seconds, so an assignment made just now may be missed.
+func (s *azureSession) otherIdentityUsers(ctx context.Context, identityID string) ([]string, error) {
+	id, err := azure.ParseResourceID(identityID)
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := []string{s.SubscriptionID}
+	if !strings.EqualFold(id.SubscriptionID, s.SubscriptionID) {
+		subscriptions = append(subscriptions, id.SubscriptionID)
+	}
+
+	query := fmt.Sprintf(graphIdentityUsersQuery, strings.ToLower(s.scaleSetPath()), strings.ToLower(identityID))
+	rows, err := s.queryResourceGraph(ctx, subscriptions, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, row := range rows {
+		var resource struct {
+			ID string `json:"id"`
+		}
+		if err = json.Unmarshal(row, &resource); err != nil {
+			return nil, err
+		}
+		users = append(users, resource.ID)
+	}
+	return users, nil
+}
+
+// Removes the old identity from the scale set once the old instances are
+// gone and, with --remove-retired-roles, its role assignments in the
+// subscription. The roles are left in place, with a warning, while the
+// identity is still assigned to other resources, or if that can't be told,
+// as they may rely on them. Role assignments which can't be removed, such
+// as those inherited from a management group, are only warned about.
+func (r *upgradeRun) retireIdentity(ctx context.Context) error {
+	log.Infof("Removing retired identity %s from scale set %s...", r.rotation.From, r.sess.ScaleSetName)
+	if err := r.sess.setUserAssignedIdentity(ctx, r.rotation.From, false); err != nil {
+		return err
+	}
+	r.rotation.retired = true
+
+	if remove, _ := r.cmd.Flags().GetBool("remove-retired-roles"); !remove {
+		return nil
+	}
+
+	users, err := r.sess.otherIdentityUsers(ctx, r.rotation.From)
+	if err != nil {
+		log.Warnf("Unable to tell whether retired identity %s is assigned to other resources, leaving its role assignments in place: %v", r.rotation.From, err)
+		return nil
+	}
+	if len(users) > 0 {
+		log.Warnf("Retired identity %s is still assigned to %d other resources, leaving its role assignments in place: %s", r.rotation.From, len(users), strings.Join(users, ", "))
+		return nil
+	}
+
+	_, principalID, err := r.sess.userAssignedIdentityIDs(ctx, r.rotation.From)
+	if err != nil {
+		return fmt.Errorf("unable to look up identity %s: %v", r.rotation.From, err)
+	}
+
+	var assignments []struct {
+		ID         string `json:"id"`
+		Properties struct {
+			Scope string `json:"scope"`
+		} `json:"properties"`
+	}
+	query := map[string]interface{}{
+		"api-version": roleAssignmentsAPIVersion,
+		"$filter":     fmt.Sprintf("principalId eq '%s'", principalID),
+	}
+	if err = r.sess.armList(ctx, fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Authorization/roleAssignments", r.sess.SubscriptionID), query, &assignments); err != nil {
+		return fmt.Errorf("unable to list the role assignments of identity %s: %v", r.rotation.From, err)
+	}
+
+	for _, assignment := range assignments {
+		log.Infof("Removing role assignment %s of retired identity, scoped to %s", assignment.ID, assignment.Properties.Scope)
+		if err = r.sess.armDo(ctx, http.MethodDelete, assignment.ID, roleAssignmentsAPIVersion, nil, nil, http.StatusOK, http.StatusNoContent); err != nil {
+			log.Warnf("Unable to remove role assignment %s of retired identity %s, remove it manually: %v", assignment.ID, r.rotation.From, err)
+		}
+	}
+
+	return nil
+}
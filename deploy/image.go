@@ -0,0 +1,426 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// galleryImageVersion identifies a Shared Image Gallery image version
+type galleryImageVersion struct {
+	ID             string
+	SubscriptionID string
+	ResourceGroup  string
+	Gallery        string
+	Image          string
+	Version        string
+}
+
+// Parses a gallery image version resource ID of the form
+// '/subscriptions/.../resourceGroups/.../providers/Microsoft.Compute/galleries/g/images/i/versions/v'
+func parseGalleryImageVersionID(id string) (galleryImageVersion, error) {
+	parsed, err := parseGalleryImageID(id)
+	if err == nil && parsed.Version == "" {
+		err = fmt.Errorf("%s is not a gallery image version ID", id)
+	}
+	return parsed, err
+}
+
+// Parses a gallery image resource ID, which may name either an image
+// definition ('.../galleries/g/images/i') or one of its versions. Version
+// is empty for an image definition.
+func parseGalleryImageID(id string) (galleryImageVersion, error) {
+	parsed := galleryImageVersion{ID: id}
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+
+	for i := 0; i < len(parts)-1; i += 2 {
+		switch strings.ToLower(parts[i]) {
+		case "subscriptions":
+			parsed.SubscriptionID = parts[i+1]
+		case "resourcegroups":
+			parsed.ResourceGroup = parts[i+1]
+		case "galleries":
+			parsed.Gallery = parts[i+1]
+		case "images":
+			parsed.Image = parts[i+1]
+		case "versions":
+			parsed.Version = parts[i+1]
+		}
+	}
+
+	if parsed.SubscriptionID == "" || parsed.ResourceGroup == "" || parsed.Gallery == "" || parsed.Image == "" {
+		return parsed, fmt.Errorf("%s is not a gallery image ID", id)
+	}
+
+	return parsed, nil
+}
+
+// Returns the session's Gallery Image Version client for a subscription
+func (s *azureSession) getGalleryImageVersionsClient(subscription string) compute.GalleryImageVersionsClient {
+	return s.cachedClient("galleryImageVersions/"+subscription, func() interface{} {
+		client := compute.NewGalleryImageVersionsClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.GalleryImageVersionsClient)
+}
+
+// Confirms the image version finished provisioning and is replicated to
+// the scale set's region, so the surge won't fail to find it.
+func (s *azureSession) validateGalleryImage(ctx context.Context, image galleryImageVersion, location string) error {
+	client := s.getGalleryImageVersionsClient(image.SubscriptionID)
+
+	version, err := client.Get(ctx, image.ResourceGroup, image.Gallery, image.Image, image.Version, "")
+	if err != nil {
+		return err
+	}
+
+	if version.GalleryImageVersionProperties == nil {
+		return fmt.Errorf("image version %s has no properties", image.ID)
+	}
+
+	if version.ProvisioningState != compute.ProvisioningState3Succeeded {
+		return fmt.Errorf("image version %s is in provisioning state %s", image.Version, version.ProvisioningState)
+	}
+
+	if version.PublishingProfile != nil && version.PublishingProfile.TargetRegions != nil {
+		for _, region := range *version.PublishingProfile.TargetRegions {
+			if normalizeRegion(to.String(region.Name)) == normalizeRegion(location) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("image version %s is not replicated to %s", image.Version, location)
+	}
+
+	return nil
+}
+
+// Returns the image reference in the scale set model, or nil if it has none
+func (s *azureSession) getModelImage(ctx context.Context) (*compute.ImageReference, string, error) {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	profile := scaleSet.VirtualMachineProfile
+	if profile == nil || profile.StorageProfile == nil {
+		return nil, to.String(scaleSet.Location), nil
+	}
+
+	return profile.StorageProfile.ImageReference, to.String(scaleSet.Location), nil
+}
+
+// Points the scale set model at an image. Fields the reference doesn't
+// set are cleared, as the update would otherwise keep those of the image
+// it replaces, such as a marketplace image's publisher alongside a gallery
+// image's ID. Existing instances are left untouched until the upgrade
+// replaces them.
+func (s *azureSession) setModelImage(ctx context.Context, ref *compute.ImageReference) error {
+	encoded, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	image := map[string]interface{}{}
+	if err = json.Unmarshal(encoded, &image); err != nil {
+		return err
+	}
+	for _, field := range []string{"id", "publisher", "offer", "sku", "version"} {
+		if _, ok := image[field]; !ok {
+			image[field] = nil
+		}
+	}
+
+	return s.patchModel(ctx, map[string]interface{}{
+		"properties": map[string]interface{}{
+			"virtualMachineProfile": map[string]interface{}{
+				"storageProfile": map[string]interface{}{"imageReference": image},
+			},
+		},
+	})
+}
+
+// Applies an update to the scale set model, conditional on the model not
+// having changed since it was last read. A concurrent change is logged
+// and the update re-applied on top of it. With --record-deployment, the
+// update is made as an ARM deployment instead.
+func (s *azureSession) updateModel(ctx context.Context, parameters compute.VirtualMachineScaleSetUpdate) error {
+	if s.RecordDeployments {
+		return s.deployModel(ctx, parameters)
+	}
+
+	client := s.getVMSSClient()
+
+	return retryOnConflict("scale set "+s.ScaleSetName+" model", func() error {
+		scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+		if err != nil {
+			return err
+		}
+
+		future, err := client.Update(withIfMatch(ctx, etagOf(scaleSet.Response)), s.ResourceGroupName, s.ScaleSetName, parameters)
+		if err != nil {
+			return err
+		}
+
+		return future.Wait(ctx)
+	})
+}
+
+// Applies a JSON merge patch, where null clears a field, to the scale set
+// model, as for updateModel
+func (s *azureSession) patchModel(ctx context.Context, patch map[string]interface{}) error {
+	if s.RecordDeployments {
+		return s.deployModelPatch(ctx, patch)
+	}
+
+	client := s.getVMSSClient()
+
+	return retryOnConflict("scale set "+s.ScaleSetName+" model", func() error {
+		scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+		if err != nil {
+			return err
+		}
+
+		return s.armDoAsync(withIfMatch(ctx, etagOf(scaleSet.Response)), http.MethodPatch, s.scaleSetPath(), newerComputeAPIVersion, patch, nil)
+	})
+}
+
+// Returns a phase which validates the gallery image version, then points
+// the scale set model at it. Rolling back restores the previous image.
+func (s *azureSession) modelImageStep(imageID string) phase.Step {
+	return s.imageStep("model-image", &compute.ImageReference{ID: to.StringPtr(imageID)}, func(ctx context.Context) error {
+		image, err := parseGalleryImageVersionID(imageID)
+		if err != nil {
+			return err
+		}
+
+		_, location, err := s.getModelImage(ctx)
+		if err != nil {
+			return err
+		}
+
+		return s.validateGalleryImage(ctx, image, location)
+	})
+}
+
+// Returns a phase which points the scale set model back at an image it
+// previously ran. Gallery images are validated as for a new image, others
+// are assumed to still exist.
+func (s *azureSession) rollbackImageStep(ref *compute.ImageReference) phase.Step {
+	return s.imageStep("rollback-image", ref, func(ctx context.Context) error {
+		image, err := parseGalleryImageVersionID(to.String(ref.ID))
+		if err != nil {
+			return nil
+		}
+
+		_, location, err := s.getModelImage(ctx)
+		if err != nil {
+			return err
+		}
+
+		return s.validateGalleryImage(ctx, image, location)
+	})
+}
+
+// imagePhase is a phase moving the scale set model onto an image, which
+// the run's gates can look at before the image is applied
+type imagePhase struct {
+	*phase.Func
+	image *compute.ImageReference
+}
+
+// Returns a phase which points the scale set model at an image, recording
+// the image it replaces in the previous image tag. Rolling back restores
+// both the image and the tag. Validating also checks Azure Policy would
+// allow the model with the new image.
+func (s *azureSession) imageStep(name string, ref *compute.ImageReference, validate func(context.Context) error) phase.Step {
+	var previous *compute.ImageReference
+	var previousTag string
+
+	step := &phase.Func{
+		StepName: name,
+		ValidateFunc: func(ctx context.Context) error {
+			if err := validate(ctx); err != nil {
+				return err
+			}
+			return s.preflightPolicy(ctx, ref)
+		},
+		ExecuteFunc: func(ctx context.Context) error {
+			current, _, err := s.getModelImage(ctx)
+			if err != nil {
+				return err
+			}
+
+			if current != nil {
+				if sameImage(current, ref) {
+					log.Infof("Scale set model already references image %s", imageReferenceString(ref))
+					return nil
+				}
+				log.Infof("Replacing model image %s", imageReferenceString(current))
+			}
+
+			if previousTag, err = s.getTag(ctx, previousImageTag); err != nil {
+				return err
+			}
+
+			log.Infof("Updating scale set model to image %s...", imageReferenceString(ref))
+
+			if err = s.setModelImage(ctx, ref); err != nil {
+				return err
+			}
+			previous = current
+
+			if current == nil {
+				return nil
+			}
+			return s.setTags(ctx, map[string]string{previousImageTag: imageReferenceString(current)})
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			if previous == nil {
+				return nil
+			}
+
+			log.Infof("Restoring model image %s", imageReferenceString(previous))
+			if err := s.setModelImage(ctx, previous); err != nil {
+				return err
+			}
+
+			return s.setTags(ctx, map[string]string{previousImageTag: previousTag})
+		},
+	}
+
+	return imagePhase{Func: step, image: ref}
+}
+
+// Reports whether two image references name the same image
+func sameImage(a *compute.ImageReference, b *compute.ImageReference) bool {
+	return strings.EqualFold(imageReferenceString(a), imageReferenceString(b))
+}
+
+// Renders an image reference for logging, whether it points at a custom
+// or gallery image by ID, or at a marketplace image.
+func imageReferenceString(ref *compute.ImageReference) string {
+	if ref.ID != nil {
+		return *ref.ID
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", to.String(ref.Publisher), to.String(ref.Offer), to.String(ref.Sku), to.String(ref.Version))
+}
+
+// Parses an image reference rendered by imageReferenceString
+func parseImageReference(value string) (*compute.ImageReference, error) {
+	if strings.HasPrefix(value, "/") {
+		return &compute.ImageReference{ID: to.StringPtr(value)}, nil
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("%s is neither an image ID nor a publisher:offer:sku:version image", value)
+	}
+
+	return &compute.ImageReference{
+		Publisher: to.StringPtr(parts[0]),
+		Offer:     to.StringPtr(parts[1]),
+		Sku:       to.StringPtr(parts[2]),
+		Version:   to.StringPtr(parts[3]),
+	}, nil
+}
+
+// RunImage updates the scale set model to a new gallery image version and
+// executes the upgrade operation
+func RunImage(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Image Upgrade")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	opts, err := imageVersionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	imageID, err := sess.resolveGalleryImage(ctx, cmd.Flags().Lookup("gallery-image").Value.String(), opts)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	sess.describeGalleryImage(ctx, imageID, opts)
+
+	current, _, err := sess.getModelImage(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Once the model references the image, this is a plain upgrade (or a
+	// re-run of one which may already be complete)
+	if current != nil && sameImage(current, &compute.ImageReference{ID: to.StringPtr(imageID)}) {
+		log.Infof("Scale set model already references image %s", imageID)
+		sess.upgrade(ctx, cmd)
+		return
+	}
+
+	sess.upgrade(ctx, cmd, sess.modelImageStep(imageID))
+}
+
+// RunRollbackImage points the scale set model back at the image it ran
+// before the last image upgrade and executes the upgrade operation
+func RunRollbackImage(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Image Rollback")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	recorded, err := sess.getTag(ctx, previousImageTag)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	if recorded == "" {
+		log.Fatal(fmt.Errorf("no previous image is recorded on %s (tag %s)", sess.ScaleSetName, previousImageTag))
+		os.Exit(1)
+	}
+
+	ref, err := parseImageReference(recorded)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	current, _, err := sess.getModelImage(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Once the model references the previous image, this is a plain
+	// upgrade (or a re-run of one which may already be complete)
+	if current != nil && sameImage(current, ref) {
+		log.Infof("Scale set model already references image %s", recorded)
+		sess.upgrade(ctx, cmd)
+		return
+	}
+
+	sess.upgrade(ctx, cmd, sess.rollbackImageStep(ref))
+}
@@ -0,0 +1,267 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Version tag which, when set, points at release notes for that
+	// version in preference to the image definition's release notes
+	releaseNotesTag = "releaseNotes"
+
+	// Release notes longer than this are truncated in the plan output
+	maxReleaseNotesBytes = 4096
+)
+
+// imageVersionOptions control which gallery image version an image
+// definition resolves to, and how much of it is shown before rolling out
+type imageVersionOptions struct {
+	// Consider versions marked exclude-from-latest when resolving
+	IncludeExcluded bool
+	// Lowest acceptable version, or "" for no constraint
+	MinVersion string
+	// Fetch and print the version's release notes
+	ShowReleaseNotes bool
+}
+
+// Reads the image version options from the command's flags
+func imageVersionOptionsFromFlags(cmd *cobra.Command) (imageVersionOptions, error) {
+	opts := imageVersionOptions{MinVersion: cmd.Flags().Lookup("min-image-version").Value.String()}
+	var err error
+
+	if opts.IncludeExcluded, err = cmd.Flags().GetBool("include-excluded-from-latest"); err != nil {
+		return opts, err
+	}
+
+	if opts.ShowReleaseNotes, err = cmd.Flags().GetBool("show-release-notes"); err != nil {
+		return opts, err
+	}
+
+	if opts.MinVersion != "" {
+		if _, err = parseImageVersion(opts.MinVersion); err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Parses a gallery image version name of the form 'major.minor.patch'
+func parseImageVersion(version string) ([3]int, error) {
+	var parsed [3]int
+
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return parsed, fmt.Errorf("%s is not a major.minor.patch image version", version)
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("%s is not a major.minor.patch image version", version)
+		}
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
+
+// Compares two image versions, returning -1, 0 or 1. Unparseable versions
+// sort before any valid one.
+func compareImageVersions(a string, b string) int {
+	parsedA, errA := parseImageVersion(a)
+	parsedB, errB := parseImageVersion(b)
+
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+
+	for i := range parsedA {
+		if parsedA[i] != parsedB[i] {
+			if parsedA[i] < parsedB[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Returns the session's Gallery Image client for a subscription
+func (s *azureSession) getGalleryImagesClient(subscription string) compute.GalleryImagesClient {
+	return s.cachedClient("galleryImages/"+subscription, func() interface{} {
+		client := compute.NewGalleryImagesClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.GalleryImagesClient)
+}
+
+// Resolves a gallery image to a version ID. A version ID is checked
+// against the minimum version; an image definition ID resolves to its
+// newest provisioned version, skipping versions excluded from latest
+// unless asked otherwise.
+func (s *azureSession) resolveGalleryImage(ctx context.Context, id string, opts imageVersionOptions) (string, error) {
+	image, err := parseGalleryImageID(id)
+	if err != nil {
+		return "", err
+	}
+
+	if image.Version != "" {
+		if opts.MinVersion != "" && compareImageVersions(image.Version, opts.MinVersion) < 0 {
+			return "", fmt.Errorf("image version %s is below the minimum version %s", image.Version, opts.MinVersion)
+		}
+		return id, nil
+	}
+
+	client := s.getGalleryImageVersionsClient(image.SubscriptionID)
+
+	iter, err := client.ListByGalleryImageComplete(ctx, image.ResourceGroup, image.Gallery, image.Image)
+	if err != nil {
+		return "", err
+	}
+
+	var candidates []compute.GalleryImageVersion
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return "", err
+		}
+
+		version := iter.Value()
+		name := to.String(version.Name)
+		props := version.GalleryImageVersionProperties
+
+		switch {
+		case props == nil || props.ProvisioningState != compute.ProvisioningState3Succeeded:
+			log.Debugf("Skipping image version %s, which isn't provisioned", name)
+		case !opts.IncludeExcluded && props.PublishingProfile != nil && to.Bool(props.PublishingProfile.ExcludeFromLatest):
+			log.Debugf("Skipping image version %s, which is excluded from latest", name)
+		case opts.MinVersion != "" && compareImageVersions(name, opts.MinVersion) < 0:
+			log.Debugf("Skipping image version %s, which is below the minimum version %s", name, opts.MinVersion)
+		default:
+			candidates = append(candidates, version)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("image %s has no eligible versions", id)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return compareImageVersions(to.String(candidates[i].Name), to.String(candidates[j].Name)) > 0
+	})
+
+	resolved := to.String(candidates[0].ID)
+	log.Infof("Resolved image %s to version %s", image.Image, to.String(candidates[0].Name))
+
+	return resolved, nil
+}
+
+// Prints the gallery image version about to roll out: when it was
+// published, its tags, and where its release notes are, fetching them if
+// asked to. It goes to stderr alongside the logs, and failures are logged
+// rather than returned, since this is for the operator's information only.
+func (s *azureSession) describeGalleryImage(ctx context.Context, imageID string, opts imageVersionOptions) {
+	image, err := parseGalleryImageVersionID(imageID)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+
+	version, err := s.getGalleryImageVersionsClient(image.SubscriptionID).Get(ctx, image.ResourceGroup, image.Gallery, image.Image, image.Version, "")
+	if err != nil {
+		log.Warnf("Unable to fetch image version %s: %v", image.Version, err)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Image: %s/%s version %s\n", image.Gallery, image.Image, image.Version)
+
+	if props := version.GalleryImageVersionProperties; props != nil && props.PublishingProfile != nil {
+		if published := props.PublishingProfile.PublishedDate; published != nil {
+			fmt.Fprintf(os.Stderr, "  published: %s\n", published.String())
+		}
+		fmt.Fprintf(os.Stderr, "  excluded from latest: %t\n", to.Bool(props.PublishingProfile.ExcludeFromLatest))
+	}
+
+	keys := make([]string, 0, len(version.Tags))
+	for key := range version.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(os.Stderr, "  tag %s: %s\n", key, to.String(version.Tags[key]))
+	}
+
+	notes := to.String(version.Tags[releaseNotesTag])
+	if notes == "" {
+		definition, err := s.getGalleryImagesClient(image.SubscriptionID).Get(ctx, image.ResourceGroup, image.Gallery, image.Image)
+		if err != nil {
+			log.Warnf("Unable to fetch image definition %s: %v", image.Image, err)
+		} else if definition.GalleryImageProperties != nil {
+			notes = to.String(definition.ReleaseNoteURI)
+		}
+	}
+
+	if notes == "" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "  release notes: %s\n", notes)
+
+	if !opts.ShowReleaseNotes {
+		return
+	}
+
+	contents, err := fetchReleaseNotes(ctx, notes)
+	if err != nil {
+		log.Warnf("Unable to fetch release notes from %s: %v", notes, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, contents)
+}
+
+// Fetches release notes from a URL, truncated for display
+func fetchReleaseNotes(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	contents, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxReleaseNotesBytes + 1})
+	if err != nil {
+		return "", err
+	}
+
+	if len(contents) > maxReleaseNotesBytes {
+		return string(contents[:maxReleaseNotesBytes]) + "\n...", nil
+	}
+
+	return string(contents), nil
+}
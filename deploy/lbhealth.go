@@ -0,0 +1,284 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	appGatewayAPIVersion = "2019-11-01"
+	metricsAPIVersion    = "2018-01-01"
+
+	// Percentage reported by the 'Health Probe Status' metric for a backend
+	// which is passing every probe
+	healthyDipAvailability = 100
+
+	lbHealthPollInterval = 30 * time.Second
+)
+
+// backendTarget is a single new instance IP address which is expected to
+// be reported healthy by a load balancer or application gateway.
+type backendTarget struct {
+	InstanceID string
+	Address    string
+	PoolID     string
+}
+
+type appGatewayBackendHealth struct {
+	BackendAddressPools []struct {
+		BackendAddressPool            subResource `json:"backendAddressPool"`
+		BackendHTTPSettingsCollection []struct {
+			Servers []struct {
+				Address string `json:"address"`
+				Health  string `json:"health"`
+			} `json:"servers"`
+		} `json:"backendHttpSettingsCollection"`
+	} `json:"backendAddressPools"`
+}
+
+type metricsResponse struct {
+	Value []struct {
+		Timeseries []struct {
+			MetadataValues []struct {
+				Name struct {
+					Value string `json:"value"`
+				} `json:"name"`
+				Value string `json:"value"`
+			} `json:"metadatavalues"`
+			Data []struct {
+				Average *float64 `json:"average"`
+			} `json:"data"`
+		} `json:"timeseries"`
+	} `json:"value"`
+}
+
+// Trims a backend pool ID down to the ID of the load balancer or
+// application gateway which owns it.
+func poolParentID(poolID string) string {
+	if idx := strings.Index(strings.ToLower(poolID), "/backendaddresspools/"); idx >= 0 {
+		return poolID[:idx]
+	}
+	return poolID
+}
+
+// Collects the backend pool memberships of every new instance, keyed by
+// the ID of the owning load balancer or application gateway.
+func (s *azureSession) getBackendTargets(ctx context.Context) (map[string][]backendTarget, map[string][]backendTarget, error) {
+	loadBalancers := map[string][]backendTarget{}
+	appGateways := map[string][]backendTarget{}
+
+	instanceIDs, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq true")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, instanceID := range instanceIDs {
+		nics, err := s.getInstanceNetworkInterfaces(ctx, instanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, nic := range nics {
+			for _, ipConfig := range nic.Properties.IPConfigurations {
+				address := ipConfig.Properties.PrivateIPAddress
+
+				for _, pool := range ipConfig.Properties.LoadBalancerBackendAddressPools {
+					parent := poolParentID(pool.ID)
+					loadBalancers[parent] = append(loadBalancers[parent], backendTarget{instanceID, address, pool.ID})
+				}
+				for _, pool := range ipConfig.Properties.ApplicationGatewayBackendAddressPools {
+					parent := poolParentID(pool.ID)
+					appGateways[parent] = append(appGateways[parent], backendTarget{instanceID, address, pool.ID})
+				}
+			}
+		}
+	}
+
+	return loadBalancers, appGateways, nil
+}
+
+// Reports whether a load balancer is of the Basic SKU, whose health probe
+// status isn't published to Azure Monitor
+func (s *azureSession) isBasicLoadBalancer(ctx context.Context, loadBalancerID string) (bool, error) {
+	var lb struct {
+		Sku struct {
+			Name string `json:"name"`
+		} `json:"sku"`
+	}
+	if err := s.armGet(ctx, loadBalancerID, networkAPIVersion, &lb); err != nil {
+		return false, err
+	}
+
+	// Load balancers created before SKUs were introduced have none, and are Basic
+	return lb.Sku.Name == "" || strings.EqualFold(lb.Sku.Name, "Basic"), nil
+}
+
+// Returns the latest 'Health Probe Status' for each backend IP of a
+// Standard load balancer, via Azure Monitor.
+func (s *azureSession) getLoadBalancerProbeStatus(ctx context.Context, loadBalancerID string) (map[string]float64, error) {
+	var metrics metricsResponse
+	status := map[string]float64{}
+
+	end := time.Now().UTC()
+	start := end.Add(-5 * time.Minute)
+
+	err := s.armGetWithQuery(ctx, loadBalancerID+"/providers/microsoft.insights/metrics", map[string]interface{}{
+		"api-version": metricsAPIVersion,
+		"metricnames": "DipAvailability",
+		"aggregation": "Average",
+		"interval":    "PT1M",
+		"timespan":    fmt.Sprintf("%s/%s", start.Format(time.RFC3339), end.Format(time.RFC3339)),
+		"$filter":     "BackendIPAddress eq '*'",
+	}, &metrics)
+	if err != nil {
+		return status, err
+	}
+
+	for _, metric := range metrics.Value {
+		for _, series := range metric.Timeseries {
+			var address string
+			for _, meta := range series.MetadataValues {
+				if strings.EqualFold(meta.Name.Value, "backendipaddress") {
+					address = meta.Value
+				}
+			}
+
+			// Use the most recent populated data point
+			for i := len(series.Data) - 1; i >= 0; i-- {
+				if series.Data[i].Average != nil {
+					status[address] = *series.Data[i].Average
+					break
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// Returns the health of each server in an application gateway, keyed
+// by pool ID and then by server address.
+func (s *azureSession) getAppGatewayBackendHealth(ctx context.Context, appGatewayID string) (map[string]map[string]string, error) {
+	var health appGatewayBackendHealth
+	status := map[string]map[string]string{}
+
+	if err := s.armDoAsync(ctx, http.MethodPost, appGatewayID+"/backendhealth", appGatewayAPIVersion, nil, &health); err != nil {
+		return status, err
+	}
+
+	for _, pool := range health.BackendAddressPools {
+		poolID := strings.ToLower(pool.BackendAddressPool.ID)
+		if status[poolID] == nil {
+			status[poolID] = map[string]string{}
+		}
+
+		for _, settings := range pool.BackendHTTPSettingsCollection {
+			for _, server := range settings.Servers {
+				// A server is only healthy if it's healthy under every HTTP setting
+				if current, ok := status[poolID][server.Address]; !ok || current == "Healthy" {
+					status[poolID][server.Address] = server.Health
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// Checks every backend target once, returning a description of each
+// target not yet reported healthy.
+func (s *azureSession) getUnhealthyBackends(ctx context.Context, loadBalancers map[string][]backendTarget, appGateways map[string][]backendTarget) ([]string, error) {
+	var unhealthy []string
+
+	for lb, targets := range loadBalancers {
+		status, err := s.getLoadBalancerProbeStatus(ctx, lb)
+		if err != nil {
+			return unhealthy, err
+		}
+
+		for _, target := range targets {
+			if availability, ok := status[target.Address]; !ok || availability < healthyDipAvailability {
+				unhealthy = append(unhealthy, fmt.Sprintf("instance %s (%s) in load balancer %s", target.InstanceID, target.Address, lb))
+			}
+		}
+	}
+
+	for gw, targets := range appGateways {
+		status, err := s.getAppGatewayBackendHealth(ctx, gw)
+		if err != nil {
+			return unhealthy, err
+		}
+
+		for _, target := range targets {
+			if status[strings.ToLower(target.PoolID)][target.Address] != "Healthy" {
+				unhealthy = append(unhealthy, fmt.Sprintf("instance %s (%s) in application gateway %s", target.InstanceID, target.Address, gw))
+			}
+		}
+	}
+
+	return unhealthy, nil
+}
+
+// Blocks until every new instance is reported healthy by the health probes
+// of each load balancer and application gateway backend pool it belongs to,
+// or until the timeout elapses. A running VM is not necessarily one which
+// is serving traffic, so this closes the gap before old instances are removed.
+func (s *azureSession) awaitBackendHealth(ctx context.Context, timeout time.Duration) error {
+	loadBalancers, appGateways, err := s.getBackendTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(loadBalancers) == 0 && len(appGateways) == 0 {
+		log.Info("New instances are not members of any backend pools, skipping health probe gate")
+		return nil
+	}
+
+	for lb := range loadBalancers {
+		basic, err := s.isBasicLoadBalancer(ctx, lb)
+		if err != nil {
+			return err
+		}
+		if basic {
+			log.Warnf("Load balancer %s is of the Basic SKU, which doesn't report health probe status, skipping its health probe gate", lb)
+			delete(loadBalancers, lb)
+		}
+	}
+
+	if len(loadBalancers) == 0 && len(appGateways) == 0 {
+		log.Info("New instances are only members of Basic load balancers, skipping health probe gate")
+		return nil
+	}
+
+	log.Info("Waiting for new instances to pass load balancer health probes...")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		unhealthy, err := s.getUnhealthyBackends(ctx, loadBalancers, appGateways)
+		if err != nil {
+			return err
+		}
+
+		if len(unhealthy) == 0 {
+			log.Info("All new instances are healthy in their backend pools")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("backends not healthy after %s: %s", timeout, strings.Join(unhealthy, "; "))
+		}
+
+		log.Infof("%d backends not yet healthy, waiting...", len(unhealthy))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lbHealthPollInterval):
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	leaderPollInterval   = 5 * time.Second
+	defaultLeaderTimeout = 2 * time.Minute
+
+	// Line the leader script prints on the instance which leads
+	leaderScriptMarker = "leader"
+)
+
+// leaderSpec describes the cluster whose leader the instances elect, so it
+// can be removed last and hand over leadership first. It is read from the
+// 'leader' key of the config file.
+type leaderSpec struct {
+	// One of 'consul', 'nomad', 'etcd' or 'script'
+	Type string `mapstructure:"type"`
+	// How long leadership may take to move once handed over
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	Consul struct {
+		Address string `mapstructure:"address"`
+		// ACL token reference, see resolveSecret. Defaults to the
+		// CONSUL_HTTP_TOKEN environment variable.
+		Token string `mapstructure:"token"`
+	} `mapstructure:"consul"`
+
+	Nomad struct {
+		Address string `mapstructure:"address"`
+		// ACL token reference, see resolveSecret. Defaults to the
+		// NOMAD_TOKEN environment variable.
+		Token string `mapstructure:"token"`
+	} `mapstructure:"nomad"`
+
+	Etcd struct {
+		// Client URL of any member, serving the v3 JSON gateway
+		Endpoint string `mapstructure:"endpoint"`
+	} `mapstructure:"etcd"`
+
+	Script struct {
+		// Script run on every instance via Run Command, printing 'leader'
+		// on the one which leads
+		Find string `mapstructure:"find"`
+		// Script run on the leader via Run Command to hand leadership to
+		// the member at $LEADER_TARGET
+		Transfer string `mapstructure:"transfer"`
+	} `mapstructure:"script"`
+}
+
+// leaderBackend finds and moves the leader of a cluster
+type leaderBackend interface {
+	// Returns the address of the leader, and of every member which could
+	// take over from it
+	members(ctx context.Context) (string, []string, error)
+	// Hands leadership from the member at one address to another
+	transfer(ctx context.Context, from string, to string) error
+}
+
+// raftBackend reaches the leader of a Consul or Nomad cluster through its
+// operator Raft API, which both serve alike
+type raftBackend struct {
+	address     string
+	token       secret
+	tokenHeader string
+	// Method and path transferring leadership to a server by its ID
+	transferMethod string
+	transferPath   string
+}
+
+type etcdBackend struct {
+	endpoint string
+}
+
+type scriptLeaderBackend struct {
+	sess           *azureSession
+	findScript     []string
+	transferScript []string
+	timeout        time.Duration
+}
+
+// Reads the leader spec from the config file. Returns nil when no cluster
+// leader is configured.
+func loadLeaderSpec() (*leaderSpec, error) {
+	if !viper.IsSet("leader") {
+		return nil, nil
+	}
+
+	spec := &leaderSpec{Timeout: defaultLeaderTimeout}
+	spec.Consul.Token = secretFromEnv + "CONSUL_HTTP_TOKEN"
+	spec.Nomad.Token = secretFromEnv + "NOMAD_TOKEN"
+	if err := viper.UnmarshalKey("leader", spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Builds the backend described by the spec, resolving its credentials and
+// reading its scripts
+func (s *azureSession) newLeaderBackend(ctx context.Context, spec *leaderSpec, timeout time.Duration) (leaderBackend, error) {
+	switch spec.Type {
+	case "consul":
+		token, err := resolveSecret(ctx, spec.Consul.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve Consul token: %v", err)
+		}
+		return &raftBackend{
+			address:        strings.TrimRight(spec.Consul.Address, "/"),
+			token:          token,
+			tokenHeader:    "X-Consul-Token",
+			transferMethod: http.MethodPost,
+			transferPath:   "/v1/operator/raft/transfer-leader",
+		}, nil
+	case "nomad":
+		token, err := resolveSecret(ctx, spec.Nomad.Token)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve Nomad token: %v", err)
+		}
+		return &raftBackend{
+			address:        strings.TrimRight(spec.Nomad.Address, "/"),
+			token:          token,
+			tokenHeader:    "X-Nomad-Token",
+			transferMethod: http.MethodPut,
+			transferPath:   "/v1/operator/raft/transfer-leadership",
+		}, nil
+	case "etcd":
+		return &etcdBackend{endpoint: strings.TrimRight(spec.Etcd.Endpoint, "/")}, nil
+	case "script":
+		if spec.Script.Find == "" {
+			return nil, fmt.Errorf("the leader script needs a 'find' script")
+		}
+		backend := &scriptLeaderBackend{sess: s, timeout: timeout}
+		var err error
+		if backend.findScript, err = loadScript(spec.Script.Find); err != nil {
+			return nil, err
+		}
+		if spec.Script.Transfer != "" {
+			if backend.transferScript, err = loadScript(spec.Script.Transfer); err != nil {
+				return nil, err
+			}
+		}
+		return backend, nil
+	default:
+		return nil, fmt.Errorf("unknown leader type %q", spec.Type)
+	}
+}
+
+// Returns the host of an address given as 'host:port', a URL, or bare
+func addressHost(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		address = u.Host
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+type raftServer struct {
+	ID      string `json:"ID"`
+	Address string `json:"Address"`
+	Leader  bool   `json:"Leader"`
+}
+
+// Sets the token on a request to the Raft API, if there is one
+func (b *raftBackend) auth() autorest.PrepareDecorator {
+	if b.token == "" {
+		return autorest.WithNothing()
+	}
+	return autorest.WithHeader(b.tokenHeader, b.token.reveal())
+}
+
+// Reads the servers of the Raft configuration
+func (b *raftBackend) servers(ctx context.Context) ([]raftServer, error) {
+	var configuration struct {
+		Servers []raftServer `json:"Servers"`
+	}
+
+	err := sendJSONRequest(ctx, http.MethodGet, b.address+"/v1/operator/raft/configuration", nil, &configuration, b.auth())
+	return configuration.Servers, err
+}
+
+func (b *raftBackend) members(ctx context.Context) (string, []string, error) {
+	servers, err := b.servers(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var leader string
+	var members []string
+	for _, server := range servers {
+		if server.Leader {
+			leader = addressHost(server.Address)
+		}
+		members = append(members, addressHost(server.Address))
+	}
+
+	return leader, members, nil
+}
+
+// Hands leadership to the server at the address by its Raft ID
+func (b *raftBackend) transfer(ctx context.Context, from string, to string) error {
+	servers, err := b.servers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		if addressHost(server.Address) != to {
+			continue
+		}
+
+		return sendJSONRequest(ctx, b.transferMethod, fmt.Sprintf("%s%s?id=%s", b.address, b.transferPath, url.QueryEscape(server.ID)), nil, nil, b.auth())
+	}
+
+	return fmt.Errorf("no server at %s in the Raft configuration", to)
+}
+
+type etcdMember struct {
+	// Member IDs are 64-bit, so the JSON gateway gives them as strings
+	ID         string   `json:"ID"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+}
+
+// Reads the members of the cluster along with the ID of its leader, as
+// seen by the given member's client URL
+func (b *etcdBackend) status(ctx context.Context, endpoint string) ([]etcdMember, string, error) {
+	var list struct {
+		Members []etcdMember `json:"members"`
+	}
+	var status struct {
+		Leader string `json:"leader"`
+	}
+
+	if err := sendJSONRequest(ctx, http.MethodPost, endpoint+"/v3/cluster/member/list", struct{}{}, &list); err != nil {
+		return nil, "", err
+	}
+	if err := sendJSONRequest(ctx, http.MethodPost, endpoint+"/v3/maintenance/status", struct{}{}, &status); err != nil {
+		return nil, "", err
+	}
+
+	return list.Members, status.Leader, nil
+}
+
+func (b *etcdBackend) members(ctx context.Context) (string, []string, error) {
+	list, leaderID, err := b.status(ctx, b.endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var leader string
+	var members []string
+	for _, member := range list {
+		if len(member.PeerURLs) == 0 {
+			continue
+		}
+		if member.ID == leaderID {
+			leader = addressHost(member.PeerURLs[0])
+		}
+		members = append(members, addressHost(member.PeerURLs[0]))
+	}
+
+	return leader, members, nil
+}
+
+// Asks the leader to hand leadership to the member at the address, which
+// etcd only accepts from the leader itself
+func (b *etcdBackend) transfer(ctx context.Context, from string, to string) error {
+	list, _, err := b.status(ctx, b.endpoint)
+	if err != nil {
+		return err
+	}
+
+	var endpoint, targetID string
+	for _, member := range list {
+		if len(member.PeerURLs) == 0 {
+			continue
+		}
+		switch addressHost(member.PeerURLs[0]) {
+		case from:
+			if len(member.ClientURLs) > 0 {
+				endpoint = strings.TrimRight(member.ClientURLs[0], "/")
+			}
+		case to:
+			targetID = member.ID
+		}
+	}
+
+	if endpoint == "" || targetID == "" {
+		return fmt.Errorf("unable to find the client URL of the leader at %s or the member at %s", from, to)
+	}
+
+	return sendJSONRequest(ctx, http.MethodPost, endpoint+"/v3/maintenance/transfer-leadership", map[string]string{"targetID": targetID}, nil)
+}
+
+// Runs the find script on every instance, taking the one printing 'leader'
+// to lead and every instance it succeeded on as a member. Instances it
+// failed on are left out, unless it failed on every one.
+func (b *scriptLeaderBackend) members(ctx context.Context) (string, []string, error) {
+	addresses, err := b.sess.getInstanceIPs(ctx, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	var instanceIDs []string
+	for instanceID := range addresses {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+
+	results, err := b.sess.runCommandOnInstanceIDs(ctx, instanceIDs, b.findScript, b.timeout)
+	if err != nil && len(failedCommandInstances(results)) == len(results) {
+		return "", nil, err
+	}
+
+	var leader string
+	var members []string
+	for _, res := range results {
+		if res.Err != nil {
+			log.Warnf("Leaving instance %s out of the cluster's members, as the find script failed on it: %v", res.InstanceID, res.Err)
+			continue
+		}
+		for _, line := range strings.Split(res.Stdout, "\n") {
+			if strings.TrimSpace(line) == leaderScriptMarker {
+				leader = addresses[res.InstanceID]
+			}
+		}
+		members = append(members, addresses[res.InstanceID])
+	}
+
+	return leader, members, nil
+}
+
+// Runs the transfer script on the leader with the target's address in
+// $LEADER_TARGET. Without a transfer script, leadership can't be handed
+// over, so the leader is only removed last.
+func (b *scriptLeaderBackend) transfer(ctx context.Context, from string, to string) error {
+	if b.transferScript == nil {
+		return fmt.Errorf("no 'transfer' script is configured to hand over leadership")
+	}
+
+	addresses, err := b.sess.getInstanceIPs(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	commandID, err := b.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := "export LEADER_TARGET=" + quoteShell(to)
+	if commandID == windowsRunCommandID {
+		target = "$env:LEADER_TARGET = " + quotePowerShell(to)
+	}
+
+	for instanceID, address := range addresses {
+		if address == from {
+			res := b.sess.runCommand(ctx, commandID, instanceID, append([]string{target}, b.transferScript...), b.timeout)
+			logCommandResult(res)
+			return res.Err
+		}
+	}
+
+	return fmt.Errorf("no instance has the leader's address %s", from)
+}
+
+// Returns the instance leading the cluster, or "" if its leader isn't one
+// of the scale set's instances, along with the instances of its members
+func (r *upgradeRun) findLeader(ctx context.Context) (string, []string, error) {
+	leader, members, err := r.leader.members(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	addresses, err := r.sess.getInstanceIPs(ctx, "")
+	if err != nil {
+		return "", nil, err
+	}
+	instanceIDs := map[string]string{}
+	for instanceID, address := range addresses {
+		instanceIDs[address] = instanceID
+	}
+
+	var memberIDs []string
+	for _, member := range members {
+		if instanceID, ok := instanceIDs[member]; ok {
+			memberIDs = append(memberIDs, instanceID)
+		}
+	}
+	sort.Strings(memberIDs)
+
+	return instanceIDs[leader], memberIDs, nil
+}
+
+// Moves the instance leading the cluster to the end of the instances to be
+// removed, so the rest go first without forcing an election. The leader is
+// left where it is if it can't be found.
+func (r *upgradeRun) leaderLast(ctx context.Context, instanceIDs []string) []string {
+	if r.leader == nil || r.sess.Simulated || len(instanceIDs) < 2 {
+		return instanceIDs
+	}
+
+	leader, _, err := r.findLeader(ctx)
+	if err != nil {
+		log.Warnf("Unable to find the leader of the %s cluster, it may be removed before other instances: %v", r.leaderSpec.Type, err)
+		return instanceIDs
+	}
+
+	ordered := []string{}
+	found := false
+	for _, id := range instanceIDs {
+		if id == leader {
+			found = true
+			continue
+		}
+		ordered = append(ordered, id)
+	}
+	if !found {
+		return instanceIDs
+	}
+
+	log.Infof("Instance %s leads the %s cluster, removing it last", leader, r.leaderSpec.Type)
+	return append(ordered, leader)
+}
+
+// Hands leadership of the cluster to a member which is staying, if the
+// leader is among the instances about to be removed, then waits for a
+// leader outside them to be elected. Fails if no member is staying or
+// leadership doesn't move.
+func (r *upgradeRun) handOffLeadership(ctx context.Context, removing []string) error {
+	if r.leader == nil || r.sess.Simulated || len(removing) == 0 {
+		return nil
+	}
+
+	leaving := map[string]bool{}
+	for _, id := range removing {
+		leaving[id] = true
+	}
+
+	leader, members, err := r.findLeader(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find the leader of the %s cluster: %v", r.leaderSpec.Type, err)
+	}
+	if !leaving[leader] {
+		return nil
+	}
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range old {
+		leaving[id] = true
+	}
+
+	var target string
+	for _, id := range members {
+		if !leaving[id] {
+			target = id
+			break
+		}
+	}
+	if target == "" {
+		return fmt.Errorf("instance %s leads the %s cluster, but no member is staying to hand leadership to", leader, r.leaderSpec.Type)
+	}
+
+	addresses, err := r.sess.getInstanceIPs(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Handing leadership of the %s cluster from instance %s to %s...", r.leaderSpec.Type, leader, target)
+	if err = r.leader.transfer(ctx, addresses[leader], addresses[target]); err != nil {
+		return fmt.Errorf("unable to hand leadership of the %s cluster from instance %s to %s: %v", r.leaderSpec.Type, leader, target, err)
+	}
+
+	deadline := time.Now().Add(r.leaderSpec.Timeout)
+	for {
+		current, _, err := r.findLeader(ctx)
+		if err != nil {
+			return err
+		}
+		if current != "" && !leaving[current] {
+			log.Infof("Instance %s now leads the %s cluster", current, r.leaderSpec.Type)
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("leadership of the %s cluster didn't move off the instances being removed within %s", r.leaderSpec.Type, r.leaderSpec.Timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leaderPollInterval):
+		}
+	}
+}
+
+// Hands leadership of the cluster off the old instances ahead of their
+// removal, so the roll causes a single, planned election
+func (r *upgradeRun) leaderHandoff(ctx context.Context) error {
+	if r.leader == nil {
+		return nil
+	}
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.handOffLeadership(ctx, old)
+}
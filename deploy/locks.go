@@ -0,0 +1,118 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	locksAPIVersion = "2016-09-01"
+
+	// Lock levels
+	lockReadOnly     = "ReadOnly"
+	lockCanNotDelete = "CanNotDelete"
+)
+
+// managementLock is a lock on the scale set, its resource group or its
+// subscription
+type managementLock struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		Level  string `json:"level"`
+		Notes  string `json:"notes,omitempty"`
+		Owners []struct {
+			ApplicationID string `json:"applicationId"`
+		} `json:"owners,omitempty"`
+	} `json:"properties"`
+}
+
+func (l managementLock) String() string {
+	return fmt.Sprintf("%s lock %s (%s)", l.Properties.Level, l.Name, l.ID)
+}
+
+// Lists the management locks which apply to the scale set, whether set on
+// the scale set itself or inherited from its resource group or subscription
+func (s *azureSession) getLocks(ctx context.Context) ([]managementLock, error) {
+	var locks []managementLock
+
+	query := map[string]interface{}{"api-version": locksAPIVersion, "$filter": "atScope()"}
+	err := s.armList(ctx, s.scaleSetPath()+"/providers/Microsoft.Authorization/locks", query, &locks)
+
+	return locks, err
+}
+
+// Refuses an upgrade a management lock would stop partway through. A
+// read-only lock blocks the surge itself; a delete lock blocks removing
+// the old instances, unless the run may lift it for the duration.
+func (r *upgradeRun) checkLocks(ctx context.Context) error {
+	lift, _ := r.cmd.Flags().GetBool("lift-delete-locks")
+
+	locks, err := r.sess.getLocks(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range locks {
+		switch {
+		case strings.EqualFold(lock.Properties.Level, lockReadOnly):
+			return fmt.Errorf("%s prevents any change to %s; remove it before upgrading", lock, r.sess.ScaleSetName)
+		case strings.EqualFold(lock.Properties.Level, lockCanNotDelete) && !lift:
+			return fmt.Errorf("%s would prevent removing the old instances of %s; remove it, or re-run with --lift-delete-locks to lift it for the upgrade", lock, r.sess.ScaleSetName)
+		}
+	}
+
+	return nil
+}
+
+// Removes the delete locks on the scale set for the remainder of the
+// upgrade, remembering them so they can be restored. The locks are logged
+// in full, should the run be interrupted before restoring them.
+func (r *upgradeRun) liftLocks(ctx context.Context) error {
+	locks, err := r.sess.getLocks(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range locks {
+		if !strings.EqualFold(lock.Properties.Level, lockCanNotDelete) {
+			continue
+		}
+
+		log.Warnf("Lifting %s for the upgrade, notes: '%s'", lock, lock.Properties.Notes)
+		if err = r.sess.armDo(ctx, http.MethodDelete, lock.ID, locksAPIVersion, nil, nil, http.StatusOK, http.StatusNoContent); err != nil {
+			return fmt.Errorf("unable to lift %s: %v", lock, err)
+		}
+		r.liftedLocks = append(r.liftedLocks, lock)
+	}
+
+	return nil
+}
+
+// Puts back every delete lock lifted for the upgrade. Safe to call more
+// than once, since restored locks are forgotten.
+func (r *upgradeRun) restoreLocks(ctx context.Context) error {
+	var failed []managementLock
+	var errs []string
+
+	for _, lock := range r.liftedLocks {
+		body := map[string]interface{}{"properties": lock.Properties}
+		if err := r.sess.armDo(ctx, http.MethodPut, lock.ID, locksAPIVersion, body, nil, http.StatusOK, http.StatusCreated); err != nil {
+			failed = append(failed, lock)
+			errs = append(errs, fmt.Sprintf("%s: %v", lock, err))
+			continue
+		}
+		log.Infof("Restored %s", lock)
+	}
+
+	r.liftedLocks = failed
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to restore delete locks, recreate them manually: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
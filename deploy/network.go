@@ -0,0 +1,138 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const (
+	// The scale set NIC views are served by the network RP, but only
+	// under this older API version.
+	vmssNetworkAPIVersion = "2018-10-01"
+)
+
+type subResource struct {
+	ID string `json:"id"`
+}
+
+type ipConfiguration struct {
+	Name       string `json:"name"`
+	Properties struct {
+		Primary                               bool          `json:"primary"`
+		PrivateIPAddress                      string        `json:"privateIPAddress"`
+		PrivateIPAddressVersion               string        `json:"privateIPAddressVersion"`
+		Subnet                                *subResource  `json:"subnet"`
+		PublicIPAddress                       *subResource  `json:"publicIPAddress"`
+		LoadBalancerBackendAddressPools       []subResource `json:"loadBalancerBackendAddressPools"`
+		LoadBalancerInboundNatRules           []subResource `json:"loadBalancerInboundNatRules"`
+		ApplicationGatewayBackendAddressPools []subResource `json:"applicationGatewayBackendAddressPools"`
+	} `json:"properties"`
+}
+
+type networkInterface struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		Primary          bool              `json:"primary"`
+		IPConfigurations []ipConfiguration `json:"ipConfigurations"`
+	} `json:"properties"`
+}
+
+// Lists the network interfaces attached to a single scale set instance
+func (s *azureSession) getInstanceNetworkInterfaces(ctx context.Context, instanceID string) ([]networkInterface, error) {
+	var nics []networkInterface
+
+	path := fmt.Sprintf("%s/virtualMachines/%s/networkInterfaces", s.scaleSetPath(), instanceID)
+	if err := s.armList(ctx, path, map[string]interface{}{"api-version": vmssNetworkAPIVersion}, &nics); err != nil {
+		return nil, err
+	}
+
+	return nics, nil
+}
+
+// Returns the private IP address of an instance's primary IP configuration
+// on its primary network interface.
+func (s *azureSession) getInstancePrivateIP(ctx context.Context, instanceID string) (string, error) {
+	nics, err := s.getInstanceNetworkInterfaces(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, nic := range nics {
+		if !nic.Properties.Primary && len(nics) > 1 {
+			continue
+		}
+		for _, ipConfig := range nic.Properties.IPConfigurations {
+			if ipConfig.Properties.Primary || len(nic.Properties.IPConfigurations) == 1 {
+				return ipConfig.Properties.PrivateIPAddress, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no primary IP configuration found for instance %s", instanceID)
+}
+
+// modelIPConfiguration pairs an IP configuration from the scale set model
+// with the name of the network interface configuration it belongs to.
+type modelIPConfiguration struct {
+	NICName string
+	Name    string
+	*compute.VirtualMachineScaleSetIPConfigurationProperties
+}
+
+// Flattens the network profile of the scale set model into its IP configurations
+func getModelIPConfigurations(scaleSet compute.VirtualMachineScaleSet) []modelIPConfiguration {
+	var configs []modelIPConfiguration
+
+	if scaleSet.VirtualMachineScaleSetProperties == nil ||
+		scaleSet.VirtualMachineProfile == nil ||
+		scaleSet.VirtualMachineProfile.NetworkProfile == nil ||
+		scaleSet.VirtualMachineProfile.NetworkProfile.NetworkInterfaceConfigurations == nil {
+		return configs
+	}
+
+	for _, nic := range *scaleSet.VirtualMachineProfile.NetworkProfile.NetworkInterfaceConfigurations {
+		if nic.VirtualMachineScaleSetNetworkConfigurationProperties == nil || nic.IPConfigurations == nil {
+			continue
+		}
+
+		for _, ipConfig := range *nic.IPConfigurations {
+			if ipConfig.VirtualMachineScaleSetIPConfigurationProperties == nil {
+				continue
+			}
+			configs = append(configs, modelIPConfiguration{
+				NICName: to.String(nic.Name),
+				Name:    to.String(ipConfig.Name),
+				VirtualMachineScaleSetIPConfigurationProperties: ipConfig.VirtualMachineScaleSetIPConfigurationProperties,
+			})
+		}
+	}
+
+	return configs
+}
+
+// Returns the IP families the scale set model configures, 'IPv4' and/or
+// 'IPv6', in that order
+func modelIPFamilies(scaleSet compute.VirtualMachineScaleSet) []string {
+	var hasV4, hasV6 bool
+	for _, ipConfig := range getModelIPConfigurations(scaleSet) {
+		if ipConfig.PrivateIPAddressVersion == compute.IPv6 {
+			hasV6 = true
+		} else {
+			hasV4 = true
+		}
+	}
+
+	var families []string
+	if hasV4 {
+		families = append(families, string(compute.IPv4))
+	}
+	if hasV6 {
+		families = append(families, string(compute.IPv6))
+	}
+
+	return families
+}
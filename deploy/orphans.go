@@ -0,0 +1,165 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	orphansOff    = "off"
+	orphansReport = "report"
+	orphansDelete = "delete"
+)
+
+// Records the managed disks, network interfaces and public IPs of the
+// given old instances ahead of their removal, so any the platform leaves
+// behind can be found afterwards. Network interfaces of instances in
+// uniform orchestration belong to the scale set and go with the instance,
+// so aren't recorded.
+func (r *upgradeRun) recordInstanceResources(ctx context.Context, instanceIDs []string) error {
+	if r.cmd.Flags().Lookup("orphaned-resources").Value.String() == orphansOff || r.sess.Simulated {
+		return nil
+	}
+
+	for _, instanceID := range instanceIDs {
+		vm, err := r.sess.getVMSSVMClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, instanceID)
+		if err != nil {
+			return err
+		}
+
+		if vm.VirtualMachineScaleSetVMProperties != nil && vm.StorageProfile != nil {
+			if os := vm.StorageProfile.OsDisk; os != nil && os.ManagedDisk != nil && os.ManagedDisk.ID != nil {
+				r.removedResources = append(r.removedResources, *os.ManagedDisk.ID)
+			}
+		}
+		for _, disk := range instanceDataDisks(vm) {
+			r.removedResources = append(r.removedResources, to.String(disk.ManagedDisk.ID))
+		}
+
+		nics, err := r.sess.getInstanceNetworkInterfaces(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+		for _, nic := range nics {
+			if !strings.Contains(strings.ToLower(nic.ID), "/virtualmachinescalesets/") {
+				r.removedResources = append(r.removedResources, nic.ID)
+			}
+			for _, ipConfig := range nic.Properties.IPConfigurations {
+				if pip := ipConfig.Properties.PublicIPAddress; pip != nil && !strings.Contains(strings.ToLower(pip.ID), "/virtualmachinescalesets/") {
+					r.removedResources = append(r.removedResources, pip.ID)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reports whether a resource recorded ahead of its instance's removal was
+// left behind, detached from any instance. Resources which are gone, or
+// of types not tracked, aren't.
+func (s *azureSession) isOrphaned(ctx context.Context, resourceID string) (bool, error) {
+	id, err := azure.ParseResourceID(resourceID)
+	if err != nil {
+		return false, err
+	}
+
+	var resource struct {
+		ID         string `json:"id"`
+		ManagedBy  string `json:"managedBy"`
+		Properties struct {
+			DiskState       string       `json:"diskState"`
+			VirtualMachine  *subResource `json:"virtualMachine"`
+			IPConfiguration *subResource `json:"ipConfiguration"`
+		} `json:"properties"`
+	}
+
+	switch strings.ToLower(id.ResourceType) {
+	case "disks":
+		err = s.armDo(ctx, http.MethodGet, resourceID, disksAPIVersion, nil, &resource, http.StatusOK, http.StatusNotFound)
+		return err == nil && resource.ID != "" && resource.ManagedBy == "" && strings.EqualFold(resource.Properties.DiskState, "Unattached"), err
+	case "networkinterfaces":
+		err = s.armDo(ctx, http.MethodGet, resourceID, networkAPIVersion, nil, &resource, http.StatusOK, http.StatusNotFound)
+		return err == nil && resource.ID != "" && resource.Properties.VirtualMachine == nil, err
+	case "publicipaddresses":
+		err = s.armDo(ctx, http.MethodGet, resourceID, networkAPIVersion, nil, &resource, http.StatusOK, http.StatusNotFound)
+		return err == nil && resource.ID != "" && resource.Properties.IPConfiguration == nil, err
+	}
+
+	return false, nil
+}
+
+// Looks for disks, network interfaces and public IPs the removed old
+// instances left behind detached, which go on costing money, and with
+// --orphaned-resources=delete deletes them. Network interfaces are deleted
+// ahead of the public IPs they may still reference. What was found and
+// cleaned is reported, and failing to clean any is only worth a warning.
+func (r *upgradeRun) cleanOrphans(ctx context.Context) error {
+	mode := r.cmd.Flags().Lookup("orphaned-resources").Value.String()
+	if mode == orphansOff || len(r.removedResources) == 0 {
+		return nil
+	}
+
+	var orphans []string
+	for _, resourceID := range r.removedResources {
+		orphaned, err := r.sess.isOrphaned(ctx, resourceID)
+		if err != nil {
+			log.Warnf("Unable to check whether %s was left behind: %v", resourceID, err)
+			continue
+		}
+		if orphaned {
+			orphans = append(orphans, resourceID)
+		}
+	}
+
+	if len(orphans) == 0 {
+		log.Info("Removed instances left no disks, network interfaces or public IPs behind")
+		return nil
+	}
+
+	if mode == orphansReport {
+		for _, resourceID := range orphans {
+			log.Warnf("Removed instances left %s behind, delete it or pass --orphaned-resources=delete", resourceID)
+		}
+		r.orphans = orphans
+		return nil
+	}
+
+	for _, kind := range []string{"networkinterfaces", "publicipaddresses", "disks"} {
+		for _, resourceID := range orphans {
+			if id, _ := azure.ParseResourceID(resourceID); !strings.EqualFold(id.ResourceType, kind) {
+				continue
+			}
+
+			version := networkAPIVersion
+			if kind == "disks" {
+				version = disksAPIVersion
+			}
+
+			log.Infof("Deleting %s, left behind by a removed instance", resourceID)
+			if err := r.sess.armDoAsync(ctx, http.MethodDelete, resourceID, version, nil, nil); err != nil {
+				log.Warnf("Unable to delete %s, delete it manually: %v", resourceID, err)
+				continue
+			}
+			r.orphans = append(r.orphans, resourceID)
+		}
+	}
+
+	log.Infof("Deleted %d of %d resources left behind by removed instances", len(r.orphans), len(orphans))
+	r.orphansDeleted = true
+	return nil
+}
+
+// Describes the resources left behind for the CI summary
+func (r *upgradeRun) orphansSummary() string {
+	if r.orphansDeleted {
+		return fmt.Sprintf("Deleted %d resources left behind by removed instances:", len(r.orphans))
+	}
+	return fmt.Sprintf("Removed instances left %d resources behind:", len(r.orphans))
+}
@@ -0,0 +1,34 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Formats reports are printed in, chosen with --output
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Returns the report format the command's --output flag asks for
+func outputFormat(cmd *cobra.Command) (string, error) {
+	format := cmd.Flags().Lookup("output").Value.String()
+	if format != outputText && format != outputJSON {
+		return "", fmt.Errorf("unknown --output format '%s', expected %s or %s", format, outputText, outputJSON)
+	}
+	return format, nil
+}
+
+// Prints a report to stdout as indented JSON
+func printJSON(v interface{}) error {
+	encoded, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(encoded))
+	return nil
+}
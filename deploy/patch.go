@@ -0,0 +1,151 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Version a marketplace image reference uses to follow the newest release
+const latestImageVersion = "latest"
+
+// Returns the session's marketplace image client for a subscription
+func (s *azureSession) getVirtualMachineImagesClient(subscription string) compute.VirtualMachineImagesClient {
+	return s.cachedClient("virtualMachineImages/"+subscription, func() interface{} {
+		client := compute.NewVirtualMachineImagesClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.VirtualMachineImagesClient)
+}
+
+// Returns the newest version of a marketplace image published to a region
+func (s *azureSession) getLatestPlatformImageVersion(ctx context.Context, location string, ref *compute.ImageReference) (string, error) {
+	images, err := s.getVirtualMachineImagesClient(s.SubscriptionID).List(ctx, location,
+		to.String(ref.Publisher), to.String(ref.Offer), to.String(ref.Sku), "", nil, "")
+	if err != nil {
+		return "", err
+	}
+
+	var versions []string
+	if images.Value != nil {
+		for _, image := range *images.Value {
+			versions = append(versions, to.String(image.Name))
+		}
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no versions of image %s:%s:%s are published in %s", to.String(ref.Publisher), to.String(ref.Offer), to.String(ref.Sku), location)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return compareImageVersions(versions[i], versions[j]) > 0 })
+
+	return versions[0], nil
+}
+
+// Returns the instances created from an older version of the image than
+// the given one. Only a model following the latest version leaves these
+// behind without the model itself changing.
+func (s *azureSession) getUnpatchedInstances(ctx context.Context, latest string) (map[string]bool, error) {
+	unpatched := map[string]bool{}
+
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "")
+	if err != nil {
+		return unpatched, err
+	}
+
+	for _, vm := range vms {
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.StorageProfile == nil || vm.StorageProfile.ImageReference == nil {
+			continue
+		}
+
+		exact := to.String(vm.StorageProfile.ImageReference.ExactVersion)
+		if exact != "" && compareImageVersions(exact, latest) < 0 {
+			log.Infof("Instance %s runs image version %s, behind %s", *vm.InstanceID, exact, latest)
+			unpatched[*vm.InstanceID] = true
+		}
+	}
+
+	return unpatched, nil
+}
+
+// RunPatch replaces in-place OS patching with image-based patching: when a
+// newer version of the scale set's marketplace image has been published,
+// the model is moved onto it and the upgrade executed. A model following
+// the latest version is left as it is, and only instances created from an
+// older version are replaced.
+func RunPatch(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Image Patching")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	current, location, err := sess.getModelImage(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	if current == nil || current.ID != nil {
+		log.Fatal(fmt.Errorf("scale set %s doesn't run a marketplace image, use the image command to roll out gallery images", sess.ScaleSetName))
+		os.Exit(1)
+	}
+
+	latest, err := sess.getLatestPlatformImageVersion(ctx, location, current)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	log.Infof("Latest version of image %s:%s:%s in %s is %s", to.String(current.Publisher), to.String(current.Offer), to.String(current.Sku), location, latest)
+
+	version := to.String(current.Version)
+
+	if strings.EqualFold(version, latestImageVersion) {
+		unpatched, err := sess.getUnpatchedInstances(ctx, latest)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+
+		run := newUpgradeRun(sess, cmd)
+		if len(unpatched) > 0 {
+			// Instances behind the model go too, as their replacements
+			// will run it
+			stale, err := sess.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+			if err != nil {
+				log.Fatal(err)
+				os.Exit(1)
+			}
+			for _, instanceID := range stale {
+				unpatched[instanceID] = true
+			}
+			run.retiring = unpatched
+		}
+
+		run.finish(run.execute(ctx))
+		return
+	}
+
+	if compareImageVersions(version, latest) >= 0 {
+		log.Infof("Scale set model already references the latest image version %s", version)
+		sess.upgrade(ctx, cmd)
+		return
+	}
+
+	patched := *current
+	patched.Version = to.StringPtr(latest)
+	patched.ExactVersion = nil
+	log.Infof("Image version %s is behind the latest patch level %s", version, latest)
+
+	sess.upgrade(ctx, cmd, sess.imageStep("patch-image", &patched, func(context.Context) error { return nil }))
+}
@@ -0,0 +1,235 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reports an instance's OS, kernel or build, pending and pending security
+// updates, and a fingerprint of its installed packages, as 'PATCH <field>
+// <value>' lines, for whichever package manager it has
+var linuxPatchLevelScript = []string{
+	`. /etc/os-release 2>/dev/null; echo "PATCH os ${PRETTY_NAME:-unknown}"`,
+	`echo "PATCH kernel $(uname -r)"`,
+	`if command -v apt-get >/dev/null; then`,
+	`  pending=$(apt-get -s upgrade 2>/dev/null | grep '^Inst')`,
+	`  echo "PATCH pending $(printf '%s' "$pending" | grep -c .)"`,
+	`  echo "PATCH security $(printf '%s' "$pending" | grep -ci security)"`,
+	`  echo "PATCH packages $(dpkg-query -W 2>/dev/null | sort | md5sum | cut -c1-12)"`,
+	`elif command -v yum >/dev/null; then`,
+	`  echo "PATCH pending $(yum -q check-update 2>/dev/null | grep -c '^[[:alnum:]]')"`,
+	`  echo "PATCH security $(yum -q updateinfo list security 2>/dev/null | grep -c .)"`,
+	`  echo "PATCH packages $(rpm -qa 2>/dev/null | sort | md5sum | cut -c1-12)"`,
+	`fi`,
+}
+
+var windowsPatchLevelScript = []string{
+	`$os = Get-CimInstance Win32_OperatingSystem`,
+	`$ubr = (Get-ItemProperty 'HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion').UBR`,
+	`Write-Output "PATCH os $($os.Caption)"`,
+	`Write-Output "PATCH kernel $($os.Version).$ubr"`,
+	`$updates = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher().Search("IsInstalled=0 and Type='Software'").Updates`,
+	`Write-Output "PATCH pending $($updates.Count)"`,
+	`Write-Output "PATCH security $(@($updates | Where-Object { $_.MsrcSeverity }).Count)"`,
+	`$hotfixes = (Get-HotFix | Sort-Object HotFixID | ForEach-Object { $_.HotFixID }) -join ','`,
+	`$md5 = [Security.Cryptography.MD5]::Create().ComputeHash([Text.Encoding]::UTF8.GetBytes($hotfixes))`,
+	`Write-Output "PATCH packages $(([BitConverter]::ToString($md5) -replace '-', '').Substring(0, 12).ToLower())"`,
+}
+
+// patchLevel is the patch level one instance reported
+type patchLevel struct {
+	OS       string
+	Kernel   string
+	Pending  int
+	Security int
+	Packages string
+}
+
+// patchSummary sums up the patch levels of a group of instances
+type patchSummary struct {
+	Instances int
+	OS        []string
+	Kernels   []string
+	// Fewest and most updates pending on any instance
+	Pending  [2]int
+	Security [2]int
+	// Distinct sets of installed packages
+	PackageSets int
+}
+
+// Parses the output of the patch level script
+func parsePatchLevel(stdout string) patchLevel {
+	var level patchLevel
+	for _, line := range strings.Split(stdout, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+		if len(fields) != 3 || fields[0] != "PATCH" {
+			continue
+		}
+		switch fields[1] {
+		case "os":
+			level.OS = fields[2]
+		case "kernel":
+			level.Kernel = fields[2]
+		case "pending":
+			level.Pending, _ = strconv.Atoi(fields[2])
+		case "security":
+			level.Security, _ = strconv.Atoi(fields[2])
+		case "packages":
+			level.Packages = fields[2]
+		}
+	}
+	return level
+}
+
+// Sums up the patch levels of instances
+func summarizePatchLevels(levels []patchLevel) *patchSummary {
+	summary := &patchSummary{Instances: len(levels)}
+	os, kernels, packages := map[string]bool{}, map[string]bool{}, map[string]bool{}
+
+	for i, level := range levels {
+		os[level.OS], kernels[level.Kernel], packages[level.Packages] = true, true, true
+		if i == 0 || level.Pending < summary.Pending[0] {
+			summary.Pending[0] = level.Pending
+		}
+		if level.Pending > summary.Pending[1] {
+			summary.Pending[1] = level.Pending
+		}
+		if i == 0 || level.Security < summary.Security[0] {
+			summary.Security[0] = level.Security
+		}
+		if level.Security > summary.Security[1] {
+			summary.Security[1] = level.Security
+		}
+	}
+
+	for value := range os {
+		summary.OS = append(summary.OS, orNone(value))
+	}
+	for value := range kernels {
+		summary.Kernels = append(summary.Kernels, orNone(value))
+	}
+	sort.Strings(summary.OS)
+	sort.Strings(summary.Kernels)
+	summary.PackageSets = len(packages)
+
+	return summary
+}
+
+// Formats a range of counts, or a single count when they're the same
+func formatRange(counts [2]int) string {
+	if counts[0] == counts[1] {
+		return strconv.Itoa(counts[0])
+	}
+	return fmt.Sprintf("%d-%d", counts[0], counts[1])
+}
+
+// Collects the patch level of the given instances via Run Command. Those
+// which fail to report are warned about and left out.
+func (r *upgradeRun) collectPatchLevels(ctx context.Context, instanceIDs []string) (*patchSummary, error) {
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	script := linuxPatchLevelScript
+	if commandID == windowsRunCommandID {
+		script = windowsPatchLevelScript
+	}
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	results, err := r.sess.runCommandOnInstanceIDs(ctx, instanceIDs, script, timeout)
+	if err != nil {
+		log.Warnf("Instances %s didn't report their patch level: %v", strings.Join(failedCommandInstances(results), ", "), err)
+	}
+
+	var levels []patchLevel
+	for _, result := range results {
+		if result.Err == nil {
+			levels = append(levels, parsePatchLevel(result.Stdout))
+		}
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("no instance reported its patch level")
+	}
+
+	return summarizePatchLevels(levels), nil
+}
+
+// Records the patch level of the instances the upgrade replaces, with
+// --patch-report, for comparison with the new instances. Failing to is
+// only worth a warning, the report being informational.
+func (r *upgradeRun) patchLevelBefore(ctx context.Context) error {
+	if report, _ := r.cmd.Flags().GetBool("patch-report"); !report {
+		return nil
+	}
+
+	instanceIDs, err := r.replacedInstances(ctx)
+	if err != nil || len(instanceIDs) == 0 {
+		return err
+	}
+
+	log.Infof("Collecting the patch level of %d instances to be replaced...", len(instanceIDs))
+	if r.patchBefore, err = r.collectPatchLevels(ctx, instanceIDs); err != nil {
+		log.Warnf("Unable to collect the patch level of the old instances: %v", err)
+	}
+	return nil
+}
+
+// Records the patch level of the new instances once they've passed the
+// gates and reports it against the old instances'
+func (r *upgradeRun) patchLevelAfter(ctx context.Context) error {
+	if report, _ := r.cmd.Flags().GetBool("patch-report"); !report {
+		return nil
+	}
+
+	surged, err := r.surgedInstances(ctx)
+	if err != nil || len(surged) == 0 {
+		return err
+	}
+
+	log.Infof("Collecting the patch level of %d new instances...", len(surged))
+	if r.patchAfter, err = r.collectPatchLevels(ctx, surged); err != nil {
+		log.Warnf("Unable to collect the patch level of the new instances: %v", err)
+		return nil
+	}
+
+	for _, row := range r.patchReport() {
+		log.Infof("Patch level %s: %s -> %s", row[0], row[1], row[2])
+	}
+	return nil
+}
+
+// Fields of the patch report, and how each is shown
+var patchReportFields = []struct {
+	name string
+	get  func(*patchSummary) string
+}{
+	{"OS", func(s *patchSummary) string { return strings.Join(s.OS, ", ") }},
+	{"kernel", func(s *patchSummary) string { return strings.Join(s.Kernels, ", ") }},
+	{"pending updates", func(s *patchSummary) string { return formatRange(s.Pending) }},
+	{"pending security updates", func(s *patchSummary) string { return formatRange(s.Security) }},
+	{"package sets", func(s *patchSummary) string { return strconv.Itoa(s.PackageSets) }},
+}
+
+// Compares the patch levels of the old and new instances, a row per field
+// of the field and the two levels
+func (r *upgradeRun) patchReport() [][3]string {
+	if r.patchAfter == nil {
+		return nil
+	}
+
+	var rows [][3]string
+	for _, field := range patchReportFields {
+		before := "(unknown)"
+		if r.patchBefore != nil {
+			before = field.get(r.patchBefore)
+		}
+		rows = append(rows, [3]string{field.name, before, field.get(r.patchAfter)})
+	}
+	return rows
+}
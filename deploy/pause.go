@@ -0,0 +1,37 @@
+package deploy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Waits between batches so caches warm and autoscalers settle before the
+// next disruption. The pause is extended by a random share of 'jitter', so
+// concurrent runs don't move in lockstep. Signalling the process (see
+// skipPauseSignals) cuts the pause short.
+func batchPause(ctx context.Context, pause time.Duration, jitter time.Duration) error {
+	if jitter > 0 {
+		pause += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	if pause <= 0 {
+		return nil
+	}
+
+	skip, stop := skipPauseSignals()
+	defer stop()
+
+	log.Infof("Pausing %s before the next batch", pause.Round(time.Second))
+
+	select {
+	case <-time.After(pause):
+		return nil
+	case <-skip:
+		log.Info("Pause skipped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package deploy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Returns a channel receiving SIGUSR1, which skips the current batch
+// pause, and a func to stop listening for it
+func skipPauseSignals() (<-chan os.Signal, func()) {
+	skip := make(chan os.Signal, 1)
+	signal.Notify(skip, syscall.SIGUSR1)
+	return skip, func() { signal.Stop(skip) }
+}
@@ -0,0 +1,8 @@
+package deploy
+
+import "os"
+
+// Windows has no SIGUSR1, so batch pauses can't be skipped
+func skipPauseSignals() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,149 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	permissionsAPIVersion = "2015-07-01"
+)
+
+// requiredPermission is an action the upgrade performs, and the built-in
+// role which grants it
+type requiredPermission struct {
+	Action string
+	Role   string
+	Reason string
+}
+
+// Actions performed against the scale set itself
+var scaleSetPermissions = []requiredPermission{
+	{"Microsoft.Compute/virtualMachineScaleSets/read", "Virtual Machine Contributor", "read the scale set"},
+	{"Microsoft.Compute/virtualMachineScaleSets/write", "Virtual Machine Contributor", "surge, scale in and record upgrade state"},
+	{"Microsoft.Compute/virtualMachineScaleSets/delete/action", "Virtual Machine Contributor", "delete old instances"},
+	{"Microsoft.Compute/virtualMachineScaleSets/virtualMachines/read", "Virtual Machine Contributor", "list instances"},
+	{"Microsoft.Compute/virtualMachineScaleSets/virtualMachines/write", "Virtual Machine Contributor", "protect new instances from scale-in"},
+}
+
+// Actions performed against the virtual networks the scale set's NICs
+// are placed in, which may live in another resource group
+var networkPermissions = []requiredPermission{
+	{"Microsoft.Network/virtualNetworks/read", "Reader", "check subnet capacity"},
+	{"Microsoft.Network/virtualNetworks/subnets/read", "Reader", "check subnet capacity"},
+	{"Microsoft.Network/virtualNetworks/subnets/join/action", "Network Contributor", "place new instances' NICs in the subnet"},
+}
+
+// permission is an entry of the caller's effective permissions at a scope
+type permission struct {
+	Actions    []string `json:"actions"`
+	NotActions []string `json:"notActions"`
+}
+
+// Reports whether an action matches a permission pattern, which may use
+// '*' wildcards. Actions are case-insensitive.
+func actionMatches(pattern string, action string) bool {
+	expr := "(?i)^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+	matched, err := regexp.MatchString(expr, action)
+	return err == nil && matched
+}
+
+// Reports whether any permission entry allows an action: one of its
+// actions matches, and none of its not-actions excludes it
+func isAllowed(permissions []permission, action string) bool {
+	for _, p := range permissions {
+		allowed := false
+		for _, pattern := range p.Actions {
+			if actionMatches(pattern, action) {
+				allowed = true
+				break
+			}
+		}
+		for _, pattern := range p.NotActions {
+			if actionMatches(pattern, action) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the caller's effective permissions at an ARM scope
+func (s *azureSession) getPermissions(ctx context.Context, scope string) ([]permission, error) {
+	var permissions []permission
+
+	query := map[string]interface{}{"api-version": permissionsAPIVersion}
+	err := s.armList(ctx, scope+"/providers/Microsoft.Authorization/permissions", query, &permissions)
+	return permissions, err
+}
+
+// Checks that the caller holds every action the upgrade performs, on the
+// scale set and on the virtual networks its instances join, so a missing
+// role assignment fails the run before anything is changed rather than
+// with a 403 partway through. The missing actions are listed with a role
+// which grants them. Should the caller's permissions be unreadable, the
+// check is skipped with a warning.
+func (s *azureSession) preflightPermissions(ctx context.Context) error {
+	scopes := map[string][]requiredPermission{s.scaleSetPath(): scaleSetPermissions}
+
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	for subnetID := range ipsPerInstanceBySubnet(getModelIPConfigurations(scaleSet)) {
+		scopes[subnetVNetID(subnetID)] = networkPermissions
+	}
+
+	paths := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		paths = append(paths, scope)
+	}
+	sort.Strings(paths)
+
+	var missing []string
+	roles := map[string]map[string]bool{}
+
+	for _, scope := range paths {
+		permissions, err := s.getPermissions(ctx, scope)
+		if err != nil {
+			log.Warnf("Unable to read permissions on %s, skipping the permission check: %v", scope, err)
+			return nil
+		}
+
+		for _, required := range scopes[scope] {
+			if isAllowed(permissions, required.Action) {
+				continue
+			}
+			missing = append(missing, fmt.Sprintf("%s on %s, to %s", required.Action, scope, required.Reason))
+			if roles[required.Role] == nil {
+				roles[required.Role] = map[string]bool{}
+			}
+			roles[required.Role][scope] = true
+		}
+	}
+
+	if len(missing) == 0 {
+		log.Info("Caller holds every permission the upgrade needs")
+		return nil
+	}
+
+	var assignments []string
+	for role, roleScopes := range roles {
+		for scope := range roleScopes {
+			assignments = append(assignments, fmt.Sprintf("az role assignment create --assignee <principal> --role '%s' --scope %s", role, scope))
+		}
+	}
+	sort.Strings(assignments)
+
+	return fmt.Errorf("caller is missing %d permissions the upgrade needs:\n  %s\ngrant them with role assignments such as:\n  %s",
+		len(missing), strings.Join(missing, "\n  "), strings.Join(assignments, "\n  "))
+}
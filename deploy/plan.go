@@ -0,0 +1,223 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// upgradePlan describes what an upgrade of the scale set's current model
+// would do, without doing any of it
+type upgradePlan struct {
+	ResourceGroup string `json:"resourceGroup"`
+	ScaleSet      string `json:"scaleSet"`
+	// False when every instance already runs the latest model
+	Needed    bool  `json:"needed"`
+	Resuming  bool  `json:"resuming"`
+	Capacity  int64 `json:"capacity"`
+	SurgeSize int64 `json:"surgeSize"`
+	// IP families the instances are configured for, e.g. IPv4 and IPv6
+	IPFamilies []string `json:"ipFamilies,omitempty"`
+	Phases     []string `json:"phases"`
+
+	// The registered strategy chosen in place of the blue/green surge, if
+	// any, and the steps it plans
+	Strategy      string   `json:"strategy,omitempty"`
+	StrategySteps []string `json:"strategySteps,omitempty"`
+
+	// With --what-if, the changes ARM predicts the model change makes, and
+	// what the upgrade does to which instances, step by step
+	ModelChanges []whatIfChange `json:"modelChanges,omitempty"`
+	Choreography []string       `json:"choreography,omitempty"`
+}
+
+// Plans an upgrade onto the scale set's current model and validates every
+// phase of it. Validation only reads, so nothing is modified. Model changes
+// predicted by What-If, nil unless --what-if is given, are planned as
+// though made: a change to the scale set replaces every instance.
+func (s *azureSession) planUpgrade(ctx context.Context, cmd *cobra.Command, modelChanges []whatIfChange) (*upgradePlan, error) {
+	plan := &upgradePlan{ResourceGroup: s.ResourceGroupName, ScaleSet: s.ScaleSetName, Phases: []string{}, ModelChanges: modelChanges}
+
+	run := newUpgradeRun(s, cmd)
+	run.modelChanging = s.changesScaleSet(modelChanges) || run.rotation != nil
+
+	proceed, err := run.detectRerun(ctx, cmd.Flags().Lookup("on-rerun").Value.String(), run.modelChanging)
+	if err != nil || !proceed {
+		return plan, err
+	}
+
+	steps := run.steps()
+	if err = phase.NewEngine(steps...).Validate(ctx); err != nil {
+		return plan, err
+	}
+
+	plan.Needed = true
+	plan.Resuming = run.resuming
+	plan.SurgeSize = run.surgeSize
+
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return plan, err
+	}
+	plan.IPFamilies = modelIPFamilies(scaleSet)
+
+	if plan.Capacity = run.originalCapacity; !run.resuming {
+		plan.Capacity = *scaleSet.Sku.Capacity
+	}
+
+	for _, step := range steps {
+		plan.Phases = append(plan.Phases, step.Name())
+	}
+
+	if run.strategy != nil {
+		plan.Strategy, plan.StrategySteps = run.strategyName, run.strategySteps
+		plan.SurgeSize = 0
+		return plan, nil
+	}
+
+	if modelChanges != nil {
+		if plan.Choreography, err = run.choreography(ctx, plan.Phases); err != nil {
+			return plan, err
+		}
+	}
+
+	return plan, nil
+}
+
+// Formats an upgrade plan as text
+func formatPlan(plan *upgradePlan) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Scale set: %s/%s\n", plan.ResourceGroup, plan.ScaleSet)
+
+	if !plan.Needed {
+		fmt.Fprintln(&b, "Every instance already runs the latest model, nothing to upgrade")
+		return b.String()
+	}
+
+	if plan.Resuming {
+		fmt.Fprintln(&b, "Resumes an upgrade left in progress")
+	}
+	if plan.Strategy != "" {
+		fmt.Fprintf(&b, "Capacity: %d\n", plan.Capacity)
+		fmt.Fprintf(&b, "Strategy: %s\n", plan.Strategy)
+		for i, step := range plan.StrategySteps {
+			fmt.Fprintf(&b, "  %2d. %s\n", i+1, step)
+		}
+	} else {
+		fmt.Fprintf(&b, "Capacity: %d, %d to replace and %d to keep\n", plan.Capacity, plan.SurgeSize, plan.Capacity-plan.SurgeSize)
+		fmt.Fprintf(&b, "Surge: +%d instances, peaking at %d\n", plan.SurgeSize, plan.Capacity+plan.SurgeSize)
+	}
+	if len(plan.IPFamilies) > 0 {
+		fmt.Fprintf(&b, "IP families: %s\n", strings.Join(plan.IPFamilies, ", "))
+	}
+	fmt.Fprintln(&b, "Phases:")
+	for i, name := range plan.Phases {
+		fmt.Fprintf(&b, "  %2d. %s\n", i+1, name)
+	}
+
+	if plan.ModelChanges != nil {
+		fmt.Fprintln(&b, "Model changes (ARM What-If):")
+		if len(plan.ModelChanges) == 0 {
+			fmt.Fprintln(&b, "  none")
+		}
+		for _, change := range plan.ModelChanges {
+			fmt.Fprintf(&b, "  %s %s\n", change.ChangeType, change.ResourceID)
+			formatPropertyChanges(&b, change.Delta, "    ")
+		}
+	}
+
+	if len(plan.Choreography) > 0 {
+		fmt.Fprintln(&b, "Choreography:")
+		for i, step := range plan.Choreography {
+			fmt.Fprintf(&b, "  %2d. %s\n", i+1, step)
+		}
+	}
+
+	return b.String()
+}
+
+// Prints an upgrade plan as text
+func printPlan(plan *upgradePlan) {
+	fmt.Print(formatPlan(plan))
+}
+
+// RunPlan prints what an upgrade would do, having validated every phase
+func RunPlan(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	var modelChanges []whatIfChange
+	if whatIf, _ := cmd.Flags().GetBool("what-if"); whatIf {
+		if modelChanges, err = sess.whatIfFromFlags(ctx, cmd); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	plan, err := sess.planUpgrade(ctx, cmd, modelChanges)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		if err = printJSON(plan); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	} else {
+		printPlan(plan)
+	}
+
+	exitDetailed(cmd, planExitCode(plan))
+}
+
+// Returns the detailed exit code of a plan or validation
+func planExitCode(plan *upgradePlan) int {
+	if plan.Needed {
+		return exitUpgradeNeeded
+	}
+	return exitNoOp
+}
+
+// RunValidate runs every preflight check of an upgrade without starting it
+func RunValidate(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	plan, err := sess.planUpgrade(ctx, cmd, nil)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if plan.Needed {
+		log.Infof("Every phase of the upgrade of %s passed validation", sess.ScaleSetName)
+	}
+
+	exitDetailed(cmd, planExitCode(plan))
+}
@@ -0,0 +1,96 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	policyInsightsAPIVersion = "2020-07-01"
+
+	// The compute API version scale set content is evaluated as
+	computeAPIVersion = "2019-07-01"
+)
+
+// policyEvaluation is a policy's verdict on the scale set as it would be
+// written
+type policyEvaluation struct {
+	PolicyInfo struct {
+		PolicyDefinitionID string `json:"policyDefinitionId"`
+		PolicyAssignmentID string `json:"policyAssignmentId"`
+	} `json:"policyInfo"`
+	EvaluationResult string `json:"evaluationResult"`
+}
+
+// Asks Azure Policy whether writing the scale set model, with its image
+// replaced by 'image' if given, would be denied. Every surge and scale-in
+// rewrites the model, so a model a deny policy rejects fails the upgrade
+// at its first write. Should Policy Insights be unavailable, the check is
+// skipped with a warning.
+func (s *azureSession) preflightPolicy(ctx context.Context, image *compute.ImageReference) error {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	if image != nil && scaleSet.VirtualMachineScaleSetProperties != nil && scaleSet.VirtualMachineProfile != nil &&
+		scaleSet.VirtualMachineProfile.StorageProfile != nil {
+		scaleSet.VirtualMachineProfile.StorageProfile.ImageReference = image
+	}
+
+	encoded, err := json.Marshal(scaleSet)
+	if err != nil {
+		return err
+	}
+
+	var content map[string]interface{}
+	if err = json.Unmarshal(encoded, &content); err != nil {
+		return err
+	}
+	content["type"] = "Microsoft.Compute/virtualMachineScaleSets"
+	content["name"] = to.String(scaleSet.Name)
+
+	body := map[string]interface{}{
+		"resourceDetails": map[string]interface{}{
+			"resourceContent": content,
+			"apiVersion":      computeAPIVersion,
+		},
+	}
+
+	var result struct {
+		ContentEvaluationResult struct {
+			PolicyEvaluations []policyEvaluation `json:"policyEvaluations"`
+		} `json:"contentEvaluationResult"`
+	}
+
+	path := s.resourceGroupPath() + "/providers/Microsoft.PolicyInsights/checkPolicyRestrictions"
+	if err = s.armDo(ctx, http.MethodPost, path, policyInsightsAPIVersion, body, &result); err != nil {
+		log.Warnf("Unable to evaluate Azure Policy for %s, skipping the policy check: %v", s.ScaleSetName, err)
+		return nil
+	}
+
+	var denied []string
+	for _, evaluation := range result.ContentEvaluationResult.PolicyEvaluations {
+		if evaluation.EvaluationResult != "NonCompliant" {
+			continue
+		}
+		denied = append(denied, fmt.Sprintf("assignment %s (definition %s)", evaluation.PolicyInfo.PolicyAssignmentID, evaluation.PolicyInfo.PolicyDefinitionID))
+	}
+
+	if len(denied) > 0 {
+		what := "the scale set model"
+		if image != nil {
+			what += " with image " + imageReferenceString(image)
+		}
+		return fmt.Errorf("%s would be denied by Azure Policy:\n  %s", what, strings.Join(denied, "\n  "))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Profile whose settings a profile starts from
+	profileInheritsKey = "inherits"
+	// Flag values a profile sets, by flag name
+	profileFlagsKey = "flags"
+)
+
+// Returns a config value as a map of settings, if it is one. YAML decodes
+// nested maps with interface{} keys.
+func asSettings(value interface{}) (map[string]interface{}, bool) {
+	switch value.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		settings, err := cast.ToStringMapE(value)
+		return settings, err == nil
+	default:
+		return nil, false
+	}
+}
+
+// Returns the settings of base overridden by those of over, merging maps
+// key by key so a profile need only give what it changes. Neither is
+// modified.
+func mergeSettings(base map[string]interface{}, over map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(over))
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range over {
+		overMap, overIsMap := asSettings(value)
+		baseMap, baseIsMap := asSettings(merged[key])
+		if overIsMap && baseIsMap {
+			merged[key] = mergeSettings(baseMap, overMap)
+		} else {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
+
+// Returns a profile's settings merged over those of the profiles it
+// inherits from
+func resolveProfile(name string, seen []string) (map[string]interface{}, error) {
+	for _, ancestor := range seen {
+		if strings.EqualFold(ancestor, name) {
+			return nil, fmt.Errorf("profile %s inherits from itself: %s", name, strings.Join(append(seen, name), " -> "))
+		}
+	}
+
+	profile, ok := asSettings(viper.Get("profiles." + name))
+	if !ok {
+		return nil, fmt.Errorf("the config file has no profile %s", name)
+	}
+
+	settings := map[string]interface{}{}
+	if parent, ok := profile[profileInheritsKey]; ok {
+		var err error
+		if settings, err = resolveProfile(cast.ToString(parent), append(seen, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	settings = mergeSettings(settings, profile)
+	delete(settings, profileInheritsKey)
+
+	return settings, nil
+}
+
+// Formats a config value as a flag value. Lists become comma separated.
+func profileFlagValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		return strings.Join(cast.ToStringSlice(list), ",")
+	}
+	return cast.ToString(value)
+}
+
+// Applies the profile named by --profile, so one config file covers every
+// environment. Profiles live under the 'profiles' key of the config file,
+// each optionally inheriting another's settings:
+//
+//	profiles:
+//	  base:
+//	    flags:
+//	      max-unavailable: 1
+//	      rollback-on-failure: true
+//	  prod:
+//	    inherits: base
+//	    flags:
+//	      batch-pause: 10m
+//	    events:
+//	      type: eventGrid
+//
+// A profile's flags apply unless given on the command line. Any other key,
+// such as 'smokeTests', 'discovery', 'events' or 'changeManagement', is
+// merged over the same section at the top of the config file.
+func applyProfile(cmd *cobra.Command) error {
+	profileFlag := cmd.Flags().Lookup("profile")
+	if profileFlag == nil || profileFlag.Value.String() == "" {
+		return nil
+	}
+	name := profileFlag.Value.String()
+
+	settings, err := resolveProfile(name, nil)
+	if err != nil {
+		return err
+	}
+
+	if flags, ok := asSettings(settings[profileFlagsKey]); ok {
+		for flagName, value := range flags {
+			flag := cmd.Flags().Lookup(flagName)
+			if flag == nil {
+				log.Debugf("Profile %s sets --%s, which %s doesn't take", name, flagName, cmd.Name())
+				continue
+			}
+			if flag.Changed {
+				continue
+			}
+			if err = cmd.Flags().Set(flagName, profileFlagValue(value)); err != nil {
+				return fmt.Errorf("profile %s sets --%s: %v", name, flagName, err)
+			}
+		}
+	} else if _, set := settings[profileFlagsKey]; set {
+		return fmt.Errorf("profile %s: '%s' must map flag names to values", name, profileFlagsKey)
+	}
+
+	for key, value := range settings {
+		if key == profileFlagsKey {
+			continue
+		}
+		if section, ok := asSettings(value); ok {
+			if base, ok := asSettings(viper.Get(key)); ok {
+				value = mergeSettings(base, section)
+			}
+		}
+		viper.Set(key, value)
+	}
+
+	log.Infof("Using profile %s", name)
+	return nil
+}
@@ -0,0 +1,160 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	log "github.com/sirupsen/logrus"
+)
+
+type publicIPAddress struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Properties struct {
+		IPAddress       string       `json:"ipAddress"`
+		IPConfiguration *subResource `json:"ipConfiguration"`
+	} `json:"properties"`
+}
+
+// Extracts the instance ID from the ID of a scale set instance's sub-resource,
+// e.g. '.../virtualMachines/3/networkInterfaces/nic/ipConfigurations/ip'
+func instanceIDFromResourceID(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], "virtualMachines") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// Returns the public IP addresses currently assigned to scale set
+// instances, keyed by instance ID.
+func (s *azureSession) getInstancePublicIPs(ctx context.Context) (map[string][]string, error) {
+	var ips []publicIPAddress
+	addresses := map[string][]string{}
+
+	query := map[string]interface{}{"api-version": vmssNetworkAPIVersion}
+	if err := s.armList(ctx, s.scaleSetPath()+"/publicipaddresses", query, &ips); err != nil {
+		return addresses, err
+	}
+
+	for _, ip := range ips {
+		if ip.Properties.IPConfiguration == nil || ip.Properties.IPAddress == "" {
+			continue
+		}
+		instanceID := instanceIDFromResourceID(ip.Properties.IPConfiguration.ID)
+		addresses[instanceID] = append(addresses[instanceID], ip.Properties.IPAddress)
+	}
+
+	return addresses, nil
+}
+
+// Warns about public-facing addresses which the upgrade is going to change.
+// Instance-level public IPs are released along with the instance, and NAT
+// pool frontend ports are re-assigned to the replacement instances, so any
+// external allowlists or connection strings built on them will break.
+func (s *azureSession) warnPublicIPChanges(ctx context.Context) error {
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	hasPublicIPs, hasNATPools := false, false
+	for _, ipConfig := range getModelIPConfigurations(scaleSet) {
+		if ipConfig.PublicIPAddressConfiguration != nil {
+			hasPublicIPs = true
+		}
+		if ipConfig.LoadBalancerInboundNatPools != nil && len(*ipConfig.LoadBalancerInboundNatPools) > 0 {
+			hasNATPools = true
+		}
+	}
+
+	if hasPublicIPs {
+		addresses, err := s.getInstancePublicIPs(ctx)
+		if err != nil {
+			return err
+		}
+
+		for instanceID, ips := range addresses {
+			log.Warnf("Instance %s will be replaced, releasing public IPs: %s", instanceID, strings.Join(ips, ", "))
+		}
+	}
+
+	if hasNATPools {
+		log.Warn("Scale set uses inbound NAT pools, NAT frontend port mappings will move to new instances")
+	}
+
+	return nil
+}
+
+// Verifies that every new instance received each NIC and IP configuration
+// in its scale set model, along with the public IPs, IPv6 addresses and
+// inbound NAT rules those configurations ask for.
+func (s *azureSession) verifyNewInstanceNetworking(ctx context.Context) error {
+	var problems []string
+
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	expected := map[string]modelIPConfiguration{}
+	for _, ipConfig := range getModelIPConfigurations(scaleSet) {
+		expected[ipConfig.NICName+"/"+ipConfig.Name] = ipConfig
+	}
+
+	instanceIDs, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq true")
+	if err != nil {
+		return err
+	}
+
+	for _, instanceID := range instanceIDs {
+		nics, err := s.getInstanceNetworkInterfaces(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		for _, nic := range nics {
+			for _, ipConfig := range nic.Properties.IPConfigurations {
+				model, ok := expected[nic.Name+"/"+ipConfig.Name]
+				if !ok {
+					continue
+				}
+				seen[nic.Name+"/"+ipConfig.Name] = true
+
+				if model.PublicIPAddressConfiguration != nil && ipConfig.Properties.PublicIPAddress == nil {
+					problems = append(problems, fmt.Sprintf("instance %s is missing a public IP on %s/%s", instanceID, nic.Name, ipConfig.Name))
+				}
+
+				if model.PrivateIPAddressVersion == compute.IPv6 &&
+					(ipConfig.Properties.PrivateIPAddress == "" || !strings.EqualFold(ipConfig.Properties.PrivateIPAddressVersion, string(compute.IPv6))) {
+					problems = append(problems, fmt.Sprintf("instance %s has no IPv6 address on %s/%s", instanceID, nic.Name, ipConfig.Name))
+				}
+
+				if model.LoadBalancerInboundNatPools != nil && len(*model.LoadBalancerInboundNatPools) > 0 && len(ipConfig.Properties.LoadBalancerInboundNatRules) == 0 {
+					problems = append(problems, fmt.Sprintf("instance %s has no inbound NAT rules on %s/%s", instanceID, nic.Name, ipConfig.Name))
+				}
+			}
+		}
+
+		for key := range expected {
+			if !seen[key] {
+				problems = append(problems, fmt.Sprintf("instance %s is missing IP configuration %s", instanceID, key))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("new instances are missing expected networking configuration: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
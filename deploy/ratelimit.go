@@ -0,0 +1,102 @@
+package deploy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenBucket allows up to 'rate' operations per second, with bursts of
+// up to 'burst' operations.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns a bucket allowing 'perMinute' operations a minute, which may
+// burst up to ten seconds' worth at once.
+func newTokenBucket(perMinute int) *tokenBucket {
+	rate := float64(perMinute) / 60
+	burst := math.Max(1, rate*10)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Blocks until a token is available, or the context is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// armRateLimiter keeps ARM reads and writes under separate per-minute
+// budgets, mirroring how ARM meters subscription requests. It is shared
+// by every client in a session, so concurrent phases draw from the same
+// budget.
+type armRateLimiter struct {
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+// Returns a limiter for the given budgets, where zero means unlimited.
+// Returns nil if neither is limited.
+func newARMRateLimiter(readsPerMinute int, writesPerMinute int) *armRateLimiter {
+	if readsPerMinute <= 0 && writesPerMinute <= 0 {
+		return nil
+	}
+
+	limiter := &armRateLimiter{}
+	if readsPerMinute > 0 {
+		limiter.reads = newTokenBucket(readsPerMinute)
+	}
+	if writesPerMinute > 0 {
+		limiter.writes = newTokenBucket(writesPerMinute)
+	}
+
+	log.Infof("Limiting ARM requests to %d reads and %d writes per minute (0 is unlimited)", readsPerMinute, writesPerMinute)
+
+	return limiter
+}
+
+// Decorates a sender to wait for budget before each request
+func (l *armRateLimiter) limit(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		bucket := l.writes
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			bucket = l.reads
+		}
+
+		if bucket != nil {
+			if err := bucket.wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		return sender.Do(req)
+	})
+}
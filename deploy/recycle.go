@@ -0,0 +1,196 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Returns the session's managed disk client for a subscription
+func (s *azureSession) getDisksClient(subscription string) compute.DisksClient {
+	return s.cachedClient("disks/"+subscription, func() interface{} {
+		client := compute.NewDisksClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.DisksClient)
+}
+
+// Returns when each instance was created, taken from the creation time of
+// its managed OS disk. Instances whose disk can't be found are left out
+// with a warning, so they're never recycled by mistake.
+func (s *azureSession) getInstanceCreationTimes(ctx context.Context) (map[string]time.Time, error) {
+	created := map[string]time.Time{}
+
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "")
+	if err != nil {
+		return created, err
+	}
+
+	for _, vm := range vms {
+		instanceID := *vm.InstanceID
+
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.StorageProfile == nil || vm.StorageProfile.OsDisk == nil ||
+			vm.StorageProfile.OsDisk.ManagedDisk == nil || vm.StorageProfile.OsDisk.ManagedDisk.ID == nil {
+			log.Warnf("Instance %s has no managed OS disk to tell its age from, skipping it", instanceID)
+			continue
+		}
+
+		id, err := azure.ParseResourceID(*vm.StorageProfile.OsDisk.ManagedDisk.ID)
+		if err != nil {
+			return created, err
+		}
+
+		disk, err := s.getDisksClient(id.SubscriptionID).Get(ctx, id.ResourceGroup, id.ResourceName)
+		if err != nil {
+			return created, fmt.Errorf("OS disk of instance %s can't be read: %v", instanceID, err)
+		}
+		if disk.DiskProperties == nil || disk.TimeCreated == nil {
+			log.Warnf("OS disk of instance %s reports no creation time, skipping it", instanceID)
+			continue
+		}
+
+		created[instanceID] = disk.TimeCreated.Time
+	}
+
+	return created, nil
+}
+
+// Returns the instances to recycle: those created longer ago than the
+// maximum age, along with any not running the latest model, since the
+// instances replacing them will. Where a limit is given, only that many
+// of the aged instances are recycled, oldest first, so running on a
+// schedule rolls the scale set gradually; outdated instances are always
+// recycled.
+func (s *azureSession) selectRecycledInstances(ctx context.Context, maxAge time.Duration, limit int64) (map[string]bool, error) {
+	retiring := map[string]bool{}
+
+	created, err := s.getInstanceCreationTimes(ctx)
+	if err != nil {
+		return retiring, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var aged []string
+	for instanceID, at := range created {
+		if at.Before(cutoff) {
+			aged = append(aged, instanceID)
+		}
+	}
+	sort.Slice(aged, func(i, j int) bool { return created[aged[i]].Before(created[aged[j]]) })
+
+	if limit > 0 && int64(len(aged)) > limit {
+		log.Infof("%d instances are older than %s, recycling the oldest %d and leaving the rest to a later run", len(aged), maxAge, limit)
+		aged = aged[:limit]
+	}
+
+	for _, instanceID := range aged {
+		log.Infof("Instance %s was created %s ago, recycling it", instanceID, time.Since(created[instanceID]).Round(time.Minute))
+		retiring[instanceID] = true
+	}
+
+	stale, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+	if err != nil {
+		return retiring, err
+	}
+	for _, instanceID := range stale {
+		if !retiring[instanceID] {
+			log.Infof("Instance %s doesn't run the latest model, recycling it", instanceID)
+			retiring[instanceID] = true
+		}
+	}
+
+	return retiring, nil
+}
+
+// Returns the instances the run is replacing and which still exist: the
+// recycled instances when recycling, otherwise those not running the
+// latest model
+func (r *upgradeRun) oldInstanceIDs(ctx context.Context) ([]string, error) {
+	if r.retiring == nil {
+		return r.sess.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+	}
+
+	current, err := r.sess.getInstanceIDs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var old []string
+	for _, instanceID := range current {
+		if r.retiring[instanceID] {
+			old = append(old, instanceID)
+		}
+	}
+
+	return old, nil
+}
+
+// RunRecycle replaces every instance older than --older-than through the
+// same surge and scale-in as an upgrade, whether or not its model has
+// drifted, so no instance outlives a maximum age. With --max-recycled, a
+// run replaces only part of the scale set, so it can be scheduled to keep
+// instances continuously fresh.
+func RunRecycle(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Instance Recycle")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	maxAge, _ := cmd.Flags().GetDuration("older-than")
+
+	var limit int64
+	if maxRecycled := cmd.Flags().Lookup("max-recycled").Value.String(); maxRecycled != "" {
+		scaleSet, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+		if limit, err = parseInstanceShare("--max-recycled", maxRecycled, *scaleSet.Sku.Capacity); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	}
+
+	retiring, err := sess.selectRecycledInstances(ctx, maxAge, limit)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	state, err := sess.getUpgradeState(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	if len(retiring) == 0 && state.State == "" {
+		log.Infof("No instance of %s is older than %s, nothing to recycle", sess.ScaleSetName, maxAge)
+		exitDetailed(cmd, exitNoOp)
+		return
+	}
+
+	ids := make([]string, 0, len(retiring))
+	for instanceID := range retiring {
+		ids = append(ids, instanceID)
+	}
+	sort.Strings(ids)
+	log.Infof("Recycling %d instances: %s", len(ids), strings.Join(ids, ", "))
+
+	run := newUpgradeRun(sess, cmd)
+	run.retiring = retiring
+
+	run.finish(run.execute(ctx))
+}
@@ -0,0 +1,166 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Orders old instances are removed in: as the scale set lists them, or
+	// least busy first by a load metric
+	removalOrderListed      = "listed"
+	removalOrderCPU         = "cpu"
+	removalOrderNetwork     = "network"
+	removalOrderConnections = "connections"
+)
+
+// Azure Monitor metrics of the scale set's instances each load-based
+// removal order ranks by, summed where there are several
+var loadMetrics = map[string]string{
+	removalOrderCPU:         "Percentage CPU",
+	removalOrderNetwork:     "Network In Total,Network Out Total",
+	removalOrderConnections: "Inbound Flows,Outbound Flows",
+}
+
+// Returns the load of each instance over the window, by instance ID: the
+// average of each of the comma-separated metrics, summed, via Azure
+// Monitor. Instances which reported none of the metrics are left out.
+func (s *azureSession) getInstanceLoads(ctx context.Context, metricNames string, window time.Duration) (map[string]float64, error) {
+	loads := map[string]float64{}
+
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "")
+	if err != nil {
+		return loads, err
+	}
+	if len(vms) == 0 {
+		return loads, nil
+	}
+	instanceIDs := map[string]string{}
+	for _, vm := range vms {
+		instanceIDs[strings.ToLower(to.String(vm.Name))] = to.String(vm.InstanceID)
+	}
+
+	var metrics struct {
+		Value []struct {
+			Timeseries []struct {
+				MetadataValues []struct {
+					Name struct {
+						Value string `json:"value"`
+					} `json:"name"`
+					Value string `json:"value"`
+				} `json:"metadatavalues"`
+				Data []struct {
+					Average *float64 `json:"average"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"value"`
+	}
+
+	// Azure Monitor returns the first 10 series unless asked for more
+	end := time.Now().UTC()
+	err = s.armGetWithQuery(ctx, s.scaleSetPath()+"/providers/microsoft.insights/metrics", map[string]interface{}{
+		"api-version": metricsAPIVersion,
+		"metricnames": metricNames,
+		"aggregation": "Average",
+		"interval":    "PT1M",
+		"timespan":    fmt.Sprintf("%s/%s", end.Add(-window).Format(time.RFC3339), end.Format(time.RFC3339)),
+		"$filter":     "VMName eq '*'",
+		"top":         len(vms),
+	}, &metrics)
+	if err != nil {
+		return loads, err
+	}
+
+	for _, metric := range metrics.Value {
+		for _, series := range metric.Timeseries {
+			var name string
+			for _, metadata := range series.MetadataValues {
+				if strings.EqualFold(metadata.Name.Value, "vmname") {
+					name = strings.ToLower(metadata.Value)
+				}
+			}
+
+			instanceID, ok := instanceIDs[name]
+			if !ok {
+				continue
+			}
+
+			var sum float64
+			var points int
+			for _, data := range series.Data {
+				if data.Average != nil {
+					sum += *data.Average
+					points++
+				}
+			}
+			if points > 0 {
+				loads[instanceID] += sum / float64(points)
+			}
+		}
+	}
+
+	return loads, nil
+}
+
+// Orders old instances least busy first by the metric given by
+// --removal-order, so warm-up steps and budgeted batches take the instances
+// whose removal disrupts the fewest requests and connections first. Loads
+// are read once, when the first instances are about to be removed, and
+// instances reporting none rank last, as their load is unknown. Failing to
+// read them only leaves the instances in the order they're listed.
+func (r *upgradeRun) rankByLoad(ctx context.Context, instanceIDs []string) []string {
+	order := r.cmd.Flags().Lookup("removal-order").Value.String()
+	metrics := loadMetrics[order]
+	if metrics == "" || len(instanceIDs) < 2 {
+		return instanceIDs
+	}
+
+	if r.removalLoads == nil {
+		window, _ := r.cmd.Flags().GetDuration("load-window")
+
+		r.removalLoads = map[string]float64{}
+		if r.sess.Simulated {
+			log.Info("The simulation has no metrics, removing old instances in the order they're listed")
+			return instanceIDs
+		}
+
+		loads, err := r.sess.getInstanceLoads(ctx, metrics, window)
+		if err != nil {
+			log.Warnf("Unable to read the %s of the instances of %s, removing old instances in the order they're listed: %v", order, r.sess.ScaleSetName, err)
+			return instanceIDs
+		}
+		r.removalLoads = loads
+	}
+
+	ranked := append([]string{}, instanceIDs...)
+	sort.SliceStable(ranked, func(i, j int) bool { return lessLoaded(r.removalLoads, ranked[i], ranked[j]) })
+
+	var loads []string
+	for _, id := range ranked {
+		if load, ok := r.removalLoads[id]; ok {
+			loads = append(loads, fmt.Sprintf("%s (%.1f)", id, load))
+		} else {
+			loads = append(loads, fmt.Sprintf("%s (no data)", id))
+		}
+	}
+	log.Infof("Removing old instances least busy by %s first: %s", order, strings.Join(loads, ", "))
+
+	return ranked
+}
+
+// Reports whether instance a is less loaded than instance b, ranking
+// instances which reported no load after those which did
+func lessLoaded(loads map[string]float64, a string, b string) bool {
+	loadA, okA := loads[a]
+	loadB, okB := loads[b]
+	if okA != okB {
+		return okA
+	}
+	return loadA < loadB
+}
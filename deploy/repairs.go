@@ -0,0 +1,141 @@
+package deploy
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+// Grace period automatic repairs default to
+const defaultRepairGracePeriod = 30 * time.Minute
+
+// Matches the ISO 8601 durations repair grace periods are given in, such
+// as PT30M or PT1H30M
+var isoDurationPattern = regexp.MustCompile(`^PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+
+// Returns the scale set's automatic repairs policy if repairs are enabled,
+// or nil
+func repairsPolicy(scaleSet compute.VirtualMachineScaleSet) *compute.AutomaticRepairsPolicy {
+	if scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.AutomaticRepairsPolicy == nil ||
+		!to.Bool(scaleSet.AutomaticRepairsPolicy.Enabled) {
+		return nil
+	}
+	return scaleSet.AutomaticRepairsPolicy
+}
+
+// Returns the grace period of a repairs policy, after a state change of
+// an instance during which it isn't repaired
+func repairGracePeriod(policy *compute.AutomaticRepairsPolicy) time.Duration {
+	match := isoDurationPattern.FindStringSubmatch(to.String(policy.GracePeriod))
+	if match == nil {
+		return defaultRepairGracePeriod
+	}
+
+	var period time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if n, err := strconv.Atoi(match[i+1]); err == nil {
+			period += time.Duration(n) * unit
+		}
+	}
+	return period
+}
+
+// Sets whether the scale set repairs its instances automatically, keeping
+// the policy's grace period
+func (s *azureSession) setRepairs(ctx context.Context, policy compute.AutomaticRepairsPolicy, enabled bool) error {
+	policy.Enabled = to.BoolPtr(enabled)
+
+	return s.updateModel(ctx, compute.VirtualMachineScaleSetUpdate{
+		VirtualMachineScaleSetUpdateProperties: &compute.VirtualMachineScaleSetUpdateProperties{
+			AutomaticRepairsPolicy: &policy,
+		},
+	})
+}
+
+// Notes whether the scale set repairs its instances automatically. Repairs
+// replace instances which stay unhealthy past the grace period, which can
+// take a new instance out from under a health gate still waiting on it, so
+// a gate allowed longer than the grace period is warned about.
+func (r *upgradeRun) checkRepairs(ctx context.Context) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	policy := repairsPolicy(scaleSet)
+	if policy == nil {
+		return nil
+	}
+	r.repairs = policy
+
+	grace := repairGracePeriod(policy)
+	if suspend, _ := r.cmd.Flags().GetBool("suspend-repairs"); suspend {
+		log.Infof("Scale set %s repairs instances automatically after %s; repairs will be suspended during the upgrade", r.sess.ScaleSetName, grace)
+		return nil
+	}
+
+	log.Infof("Scale set %s repairs instances automatically after %s; new instances are protected again ahead of scale-in in case repairs replace any",
+		r.sess.ScaleSetName, grace)
+
+	if timeout, _ := r.cmd.Flags().GetDuration("lb-health-timeout"); timeout > grace {
+		log.Warnf("--lb-health-timeout of %s outlasts the %s repair grace period, so new instances slow to turn healthy may be replaced while the gate waits; consider --suspend-repairs",
+			timeout, grace)
+	}
+
+	return nil
+}
+
+// Turns off automatic repairs for the upgrade if --suspend-repairs is
+// given, so repairs don't delete and recreate instances while they're
+// being swapped
+func (r *upgradeRun) suspendRepairs(ctx context.Context) error {
+	if suspend, _ := r.cmd.Flags().GetBool("suspend-repairs"); !suspend || r.repairs == nil || r.repairsSuspended {
+		return nil
+	}
+
+	log.Infof("Suspending automatic repairs of %s for the upgrade...", r.sess.ScaleSetName)
+	if err := r.sess.setRepairs(ctx, *r.repairs, false); err != nil {
+		return err
+	}
+	r.repairsSuspended = true
+
+	return nil
+}
+
+// Turns automatic repairs suspended for the upgrade back on. Safe to call
+// more than once.
+func (r *upgradeRun) resumeRepairs(ctx context.Context) error {
+	if !r.repairsSuspended {
+		return nil
+	}
+
+	log.Infof("Resuming automatic repairs of %s...", r.sess.ScaleSetName)
+	if err := r.sess.setRepairs(ctx, *r.repairs, true); err != nil {
+		log.Errorf("Unable to resume automatic repairs of %s, turn them back on manually", r.sess.ScaleSetName)
+		return err
+	}
+	r.repairsSuspended = false
+
+	return nil
+}
+
+// Protects new instances from scale-in again while repairs are on, since
+// an instance repairs replaced comes back unprotected and could otherwise
+// be removed in place of an old one
+func (r *upgradeRun) reprotectRepaired(ctx context.Context) error {
+	if r.repairs == nil || r.repairsSuspended {
+		return nil
+	}
+
+	futures, err := r.sess.setVMProtection(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	return r.sess.awaitVMFutures(ctx, futures)
+}
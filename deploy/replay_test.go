@@ -0,0 +1,47 @@
+package deploy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/recorder"
+)
+
+// Replays a recorded run in which ARM throttled the protection of one new
+// instance part way through. The throttled update is retried, without
+// waiting out the original Retry-After, and both instances end up
+// protected.
+func TestReplayThrottledProtection(t *testing.T) {
+	rec, err := recorder.New("../recorder/testdata/throttled-protection.jsonl", recorder.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+
+	sess, err := newSession("00000000-0000-0000-0000-000000000001", "rg", "web", sessionOptions{Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	futures, err := sess.setVMProtection(ctx, true)
+	if err != nil {
+		t.Fatalf("protection failed: %v", err)
+	}
+	if len(futures) != 2 {
+		t.Fatalf("expected the protection of 2 instances, got %d", len(futures))
+	}
+
+	for res := range sess.streamVMFutures(ctx, futures) {
+		if res.Err != nil {
+			t.Fatalf("protection failed: %v", res.Err)
+		}
+		if !protectedFromScaleIn(res.VM) {
+			t.Errorf("instance %s wasn't protected", to.String(res.VM.InstanceID))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	resourceGraphAPIVersion = "2021-03-01"
+
+	// Most rows Resource Graph returns in one page
+	resourceGraphPageSize = 1000
+
+	// Scale sets, shaped like the compute API's so rows decode into
+	// compute.VirtualMachineScaleSet
+	graphScaleSetsQuery = `resources
+| where type =~ 'microsoft.compute/virtualmachinescalesets'
+| project id, name, location, tags, sku, properties`
+
+	// Instance counts per scale set and image. Images are rendered as JSON,
+	// since Kusto can't group by a dynamic value.
+	graphInstancesQuery = `computeresources
+| where type =~ 'microsoft.compute/virtualmachinescalesets/virtualmachines'
+| extend lowerID = tolower(id)
+| extend scaleSetID = substring(lowerID, 0, indexof(lowerID, '/virtualmachines/'))
+| extend latest = tobool(properties.latestModelApplied), image = tostring(properties.storageProfile.imageReference)
+| summarize instances = count(), stale = countif(latest != true) by scaleSetID, image`
+)
+
+// graphInstanceSummary counts a scale set's instances as Resource Graph
+// sees them
+type graphInstanceSummary struct {
+	Instances int
+	Stale     int
+	Images    map[string]int
+}
+
+// Runs a Resource Graph query across the given subscriptions, following
+// skip tokens until every row has been read. Resource Graph is eventually
+// consistent with ARM, typically by seconds, so it's only used for
+// inventory and never for decisions an upgrade acts on.
+func (s *azureSession) queryResourceGraph(ctx context.Context, subscriptions []string, query string) ([]json.RawMessage, error) {
+	var rows []json.RawMessage
+
+	options := map[string]interface{}{"resultFormat": "objectArray", "$top": resourceGraphPageSize}
+	request := map[string]interface{}{"subscriptions": subscriptions, "query": query, "options": options}
+
+	for {
+		var page struct {
+			Data      []json.RawMessage `json:"data"`
+			SkipToken string            `json:"$skipToken"`
+		}
+
+		if err := s.armDo(ctx, http.MethodPost, "/providers/Microsoft.ResourceGraph/resources", resourceGraphAPIVersion, request, &page); err != nil {
+			return rows, err
+		}
+		rows = append(rows, page.Data...)
+
+		if page.SkipToken == "" {
+			return rows, nil
+		}
+		options["$skipToken"] = page.SkipToken
+	}
+}
+
+// Lists every scale set in the given subscriptions with one Resource
+// Graph query, rather than a listing per subscription
+func (s *azureSession) graphScaleSets(ctx context.Context, subscriptions []string) ([]compute.VirtualMachineScaleSet, error) {
+	rows, err := s.queryResourceGraph(ctx, subscriptions, graphScaleSetsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	scaleSets := make([]compute.VirtualMachineScaleSet, 0, len(rows))
+	for _, row := range rows {
+		var scaleSet compute.VirtualMachineScaleSet
+		if err = json.Unmarshal(row, &scaleSet); err != nil {
+			return nil, fmt.Errorf("unable to decode scale set from Resource Graph: %v", err)
+		}
+		scaleSets = append(scaleSets, scaleSet)
+	}
+
+	return scaleSets, nil
+}
+
+// Counts the instances of every scale set in the given subscriptions with
+// one Resource Graph query, rather than listing each scale set's instances
+// in turn. Summaries are keyed by lower-cased scale set ID.
+func (s *azureSession) graphInstanceSummaries(ctx context.Context, subscriptions []string) (map[string]*graphInstanceSummary, error) {
+	rows, err := s.queryResourceGraph(ctx, subscriptions, graphInstancesQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := map[string]*graphInstanceSummary{}
+	for _, raw := range rows {
+		var row struct {
+			ScaleSetID string `json:"scaleSetID"`
+			Image      string `json:"image"`
+			Instances  int    `json:"instances"`
+			Stale      int    `json:"stale"`
+		}
+		if err = json.Unmarshal(raw, &row); err != nil {
+			return nil, fmt.Errorf("unable to decode instance summary from Resource Graph: %v", err)
+		}
+
+		summary, ok := summaries[row.ScaleSetID]
+		if !ok {
+			summary = &graphInstanceSummary{Images: map[string]int{}}
+			summaries[row.ScaleSetID] = summary
+		}
+		summary.Instances += row.Instances
+		summary.Stale += row.Stale
+
+		var image compute.ImageReference
+		if row.Image != "" && json.Unmarshal([]byte(row.Image), &image) == nil && image != (compute.ImageReference{}) {
+			summary.Images[imageReferenceString(&image)] += row.Instances
+		}
+	}
+
+	return summaries, nil
+}
+
+// Lists the scale sets in the session's subscription, through Resource
+// Graph where it's available and falling back to the compute API, e.g.
+// when simulating or when the Resource Graph provider isn't reachable.
+func (s *azureSession) listScaleSets(ctx context.Context) ([]compute.VirtualMachineScaleSet, error) {
+	if !s.Simulated {
+		scaleSets, err := s.graphScaleSets(ctx, []string{s.SubscriptionID})
+		if err == nil {
+			return scaleSets, nil
+		}
+		log.Warnf("Unable to query Resource Graph, listing scale sets instead: %v", err)
+	}
+
+	return s.getVMSSClient().ListAll(ctx)
+}
+
+// Looks up the region of every scale set in the given subscriptions, keyed
+// by lower-cased ID, with one Resource Graph query
+func (s *azureSession) graphScaleSetRegions(ctx context.Context, subscriptions []string) (map[string]string, error) {
+	scaleSets, err := s.graphScaleSets(ctx, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := map[string]string{}
+	for _, scaleSet := range scaleSets {
+		regions[strings.ToLower(to.String(scaleSet.ID))] = to.String(scaleSet.Location)
+	}
+
+	return regions, nil
+}
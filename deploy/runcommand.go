@@ -0,0 +1,343 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	linuxRunCommandID   = "RunShellScript"
+	windowsRunCommandID = "RunPowerShellScript"
+
+	// Printed with a script's exit code after it finishes, as Run Command
+	// only reports whether it could run the script, not how it exited
+	exitCodeMarker = "azure-cluster-upgrade-exit-code:"
+
+	// Ends the copy of a script embedded in its wrapper
+	scriptDelimiter = "AZURE_CLUSTER_UPGRADE_SCRIPT_EOF"
+
+	// Run Commands in flight at once across instances
+	runCommandConcurrency = 20
+)
+
+// commandResult holds the captured output of a RunCommand invocation
+// against a single scale set instance.
+type commandResult struct {
+	InstanceID string
+	Stdout     string
+	Stderr     string
+	Err        error
+}
+
+// Reads a script from disk and splits it into the line-oriented
+// form expected by the RunCommand API.
+func loadScript(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(strings.TrimRight(string(contents), "\n"), "\n"), nil
+}
+
+// Picks the built-in RunCommand ID matching the scale set's OS.
+// Windows scale sets carry a WindowsConfiguration in their OS profile,
+// everything else is treated as Linux.
+func (s *azureSession) getRunCommandID(ctx context.Context) (string, error) {
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return "", err
+	}
+
+	profile := scaleSet.VirtualMachineProfile
+	if profile != nil && profile.OsProfile != nil && profile.OsProfile.WindowsConfiguration != nil {
+		return windowsRunCommandID, nil
+	}
+
+	return linuxRunCommandID, nil
+}
+
+// Wraps a script so it runs as a script of its own, honoring any shebang,
+// and its exit code is printed after it on a line starting with
+// exitCodeMarker. Scripts which call exit still report their code.
+func wrapScript(commandID string, script []string) []string {
+	if commandID == windowsRunCommandID {
+		wrapped := []string{"$acuScript = @'"}
+		wrapped = append(wrapped, script...)
+		return append(wrapped,
+			"'@",
+			`$acuPath = Join-Path $env:TEMP ("acu-" + [guid]::NewGuid() + ".ps1")`,
+			"Set-Content -Path $acuPath -Value $acuScript",
+			"$global:LASTEXITCODE = 0",
+			"& powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File $acuPath",
+			"$acuStatus = $LASTEXITCODE",
+			"Remove-Item -Force $acuPath",
+			`Write-Output "`+exitCodeMarker+`$acuStatus"`,
+		)
+	}
+
+	// Scripts without a shebang run under bash, as Run Command runs them
+	run := `bash "$acu_script"`
+	if len(script) > 0 && strings.HasPrefix(script[0], "#!") {
+		run = `chmod +x "$acu_script" && "$acu_script"`
+	}
+
+	wrapped := []string{"acu_script=$(mktemp)", `cat > "$acu_script" <<'` + scriptDelimiter + `'`}
+	wrapped = append(wrapped, script...)
+	return append(wrapped,
+		scriptDelimiter,
+		run,
+		"acu_status=$?",
+		`rm -f "$acu_script"`,
+		`echo "`+exitCodeMarker+`$acu_status"`,
+	)
+}
+
+// Removes the exit code line printed by a wrapped script from its output,
+// returning the exit code, or false if the script didn't get to print it
+func takeExitCode(stdout string) (string, int, bool) {
+	lines := strings.Split(stdout, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, exitCodeMarker) {
+			continue
+		}
+
+		code, err := strconv.Atoi(strings.TrimPrefix(line, exitCodeMarker))
+		if err != nil {
+			return stdout, 0, false
+		}
+		return strings.TrimRight(strings.Join(append(lines[:i:i], lines[i+1:]...), "\n"), "\n"), code, true
+	}
+	return stdout, 0, false
+}
+
+// Executes a script on a single instance via the RunCommand API and blocks
+// until the command completes or the timeout elapses. Output is split into
+// stdout and stderr where the extension reports them separately. The
+// command fails if the script exits non-zero, or never reports how it
+// exited.
+func (s *azureSession) runCommand(ctx context.Context, commandID string, instanceID string, script []string, timeout time.Duration) commandResult {
+	result := commandResult{InstanceID: instanceID}
+	client := s.getVMSSVMClient()
+
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	wrapped := wrapScript(commandID, script)
+
+	future, err := client.RunCommand(
+		cmdCtx,
+		s.ResourceGroupName,
+		s.ScaleSetName,
+		instanceID,
+		compute.RunCommandInput{
+			CommandID: to.StringPtr(commandID),
+			Script:    &wrapped,
+		},
+	)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if err = future.Wait(cmdCtx); err != nil {
+		result.Err = err
+		return result
+	}
+
+	res, err := future.Result()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if res.Value == nil {
+		res.Value = &[]compute.InstanceViewStatus{}
+	}
+
+	for _, status := range *res.Value {
+		code := to.String(status.Code)
+		message := to.String(status.Message)
+
+		switch {
+		case strings.Contains(code, "StdOut"):
+			result.Stdout += message
+		case strings.Contains(code, "StdErr"):
+			result.Stderr += message
+		default:
+			// Linux agents report a single status with both streams inlined
+			stdout, stderr := splitCommandOutput(message)
+			result.Stdout += stdout
+			result.Stderr += stderr
+		}
+
+		if strings.HasSuffix(code, "/failed") || status.Level == compute.Error {
+			result.Err = fmt.Errorf("command failed on instance %s: %s", instanceID, to.String(status.DisplayStatus))
+		}
+	}
+
+	// Simulated instances run nothing, so report no exit code
+	if result.Err != nil || s.Simulated {
+		return result
+	}
+
+	stdout, exitCode, ok := takeExitCode(result.Stdout)
+	result.Stdout = stdout
+	switch {
+	case !ok:
+		result.Err = fmt.Errorf("command on instance %s didn't report its exit code, it may have been cut off", instanceID)
+	case exitCode != 0:
+		result.Err = fmt.Errorf("command failed on instance %s: exited with status %d", instanceID, exitCode)
+	}
+
+	return result
+}
+
+// Splits the combined '[stdout]' / '[stderr]' message emitted by the
+// Linux RunCommand extension into its two streams.
+func splitCommandOutput(message string) (string, string) {
+	stdoutIdx := strings.Index(message, "[stdout]")
+	stderrIdx := strings.Index(message, "[stderr]")
+
+	if stdoutIdx < 0 || stderrIdx < 0 || stderrIdx < stdoutIdx {
+		return message, ""
+	}
+
+	stdout := strings.TrimSpace(message[stdoutIdx+len("[stdout]") : stderrIdx])
+	stderr := strings.TrimSpace(message[stderrIdx+len("[stderr]"):])
+	return stdout, stderr
+}
+
+// Quotes a word of a shell script run via Run Command, so it's taken
+// literally
+func quoteShell(word string) string {
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// PowerShell also ends single-quoted strings at typographic quotes, so
+// those are doubled along with plain ones
+var powerShellQuotes = strings.NewReplacer(
+	"'", "''",
+	"\u2018", "\u2018\u2018",
+	"\u2019", "\u2019\u2019",
+	"\u201a", "\u201a\u201a",
+	"\u201b", "\u201b\u201b",
+)
+
+// Quotes a word of a PowerShell script run via Run Command, so it's taken
+// literally
+func quotePowerShell(word string) string {
+	return "'" + powerShellQuotes.Replace(word) + "'"
+}
+
+// Runs a script concurrently on every instance matching the given OData
+// filter. Each instance's outcome is logged as it completes. Returns the
+// per-instance results along with an error if any instance failed.
+func (s *azureSession) runCommandOnInstances(ctx context.Context, filter string, script []string, timeout time.Duration) ([]commandResult, error) {
+	instanceIDs, err := s.getInstanceIDs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.runCommandOnInstanceIDs(ctx, instanceIDs, script, timeout)
+}
+
+// Runs the script on each of the given instances concurrently, up to
+// runCommandConcurrency at a time, as for runCommandOnInstances
+func (s *azureSession) runCommandOnInstanceIDs(ctx context.Context, instanceIDs []string, script []string, timeout time.Duration) ([]commandResult, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []commandResult
+
+	commandID, err := s.getRunCommandID(ctx)
+	if err != nil {
+		return results, err
+	}
+
+	sem := make(chan struct{}, runCommandConcurrency)
+
+	for _, instanceID := range instanceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(instanceID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := s.runCommand(ctx, commandID, instanceID, script, timeout)
+			logCommandResult(res)
+
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(instanceID)
+	}
+
+	wg.Wait()
+
+	if failed := failedCommandInstances(results); len(failed) > 0 {
+		return results, fmt.Errorf("command failed on %d of %d instances: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+
+	return results, nil
+}
+
+// Logs the outcome of a single RunCommand invocation
+func logCommandResult(res commandResult) {
+	entry := log.WithField("instance", res.InstanceID)
+
+	if res.Stdout != "" {
+		entry = entry.WithField("stdout", res.Stdout)
+	}
+	if res.Stderr != "" {
+		entry = entry.WithField("stderr", res.Stderr)
+	}
+
+	if res.Err != nil {
+		entry.WithError(res.Err).Error("Run Command failed")
+		return
+	}
+
+	entry.Info("Run Command succeeded")
+}
+
+// Loads the script at the given path and runs it via RunCommand on all
+// instances matching the filter, honoring the configured command timeout.
+func (s *azureSession) runScript(ctx context.Context, cmd *cobra.Command, filter string, path string) ([]commandResult, error) {
+	script, err := loadScript(path)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, err := cmd.Flags().GetDuration("run-command-timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Executing %s on instances via Run Command...", path)
+
+	return s.runCommandOnInstances(ctx, filter, script, timeout)
+}
+
+// Returns the IDs of instances whose command did not succeed
+func failedCommandInstances(results []commandResult) []string {
+	var failed []string
+	for _, res := range results {
+		if res.Err != nil {
+			failed = append(failed, res.InstanceID)
+		}
+	}
+	return failed
+}
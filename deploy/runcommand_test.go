@@ -0,0 +1,50 @@
+package deploy
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// Runs a script wrapped as for Run Command on Linux through bash, as the
+// Run Command agent would, returning its exit code as the wrapper reports it
+func runWrapped(t *testing.T, script ...string) (string, int) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash isn't available")
+	}
+
+	out, err := exec.Command(bash, "-c", strings.Join(wrapScript(linuxRunCommandID, script), "\n")).Output()
+	if err != nil {
+		t.Fatalf("wrapper failed: %v", err)
+	}
+
+	stdout, code, ok := takeExitCode(string(out))
+	if !ok {
+		t.Fatalf("wrapper didn't report an exit code: %q", out)
+	}
+	return stdout, code
+}
+
+func TestWrappedScriptReportsExitCode(t *testing.T) {
+	if stdout, code := runWrapped(t, "echo ready"); stdout != "ready" || code != 0 {
+		t.Errorf("expected 'ready' and 0, got %q and %d", stdout, code)
+	}
+	if stdout, code := runWrapped(t, "echo draining", "false"); stdout != "draining" || code != 1 {
+		t.Errorf("expected 'draining' and 1, got %q and %d", stdout, code)
+	}
+	if _, code := runWrapped(t, "#!/bin/sh", "exit 3", "echo unreachable"); code != 3 {
+		t.Errorf("expected 3 from a script which exits, got %d", code)
+	}
+}
+
+func TestTakeExitCode(t *testing.T) {
+	if _, _, ok := takeExitCode("output cut off"); ok {
+		t.Error("expected no exit code from output without one")
+	}
+
+	stdout, code, ok := takeExitCode("a\nb\n" + exitCodeMarker + "2\n")
+	if !ok || code != 2 || stdout != "a\nb" {
+		t.Errorf("expected 'a\\nb' and 2, got %q, %d and %t", stdout, code, ok)
+	}
+}
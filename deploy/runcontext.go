@@ -0,0 +1,114 @@
+package deploy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type runContextKey struct{}
+
+// runContext is the context of a single upgrade. It expires once the
+// upgrade has run for its timeout, not counting the time it's held, e.g.
+// by an emergency stop, so a hold doesn't eat into the time the phases
+// after it have left.
+type runContext struct {
+	mu        sync.Mutex
+	done      chan struct{}
+	err       error
+	remaining time.Duration
+	started   time.Time
+	timer     *time.Timer
+	holds     int
+}
+
+// Returns the context of a single upgrade, expiring after upgradeTimeout
+// of the time it isn't held
+func upgradeContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	c := &runContext{done: make(chan struct{}), remaining: upgradeTimeout(cmd)}
+
+	c.mu.Lock()
+	c.startClock()
+	c.mu.Unlock()
+
+	return c, func() { c.end(context.Canceled) }
+}
+
+func (c *runContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c *runContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *runContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *runContext) Value(key interface{}) interface{} {
+	if key == (runContextKey{}) {
+		return c
+	}
+	return nil
+}
+
+// Ends the context with the error, unless it already ended
+func (c *runContext) end(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// Starts the clock on the time remaining. Called with the lock held.
+func (c *runContext) startClock() {
+	c.started = time.Now()
+	c.timer = time.AfterFunc(c.remaining, func() { c.end(context.DeadlineExceeded) })
+}
+
+// Stops the clock until the returned func is called
+func (c *runContext) hold() func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holds++
+	if c.holds == 1 && c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+		c.remaining -= time.Since(c.started)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+
+			c.holds--
+			if c.holds == 0 && c.err == nil {
+				c.startClock()
+			}
+		})
+	}
+}
+
+// Stops the clock of the upgrade the context belongs to, if any, until the
+// returned func is called
+func holdRunClock(ctx context.Context) func() {
+	if c, ok := ctx.Value(runContextKey{}).(*runContext); ok {
+		return c.hold()
+	}
+	return func() {}
+}
@@ -0,0 +1,99 @@
+package deploy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Header ARM records a request's correlation ID from, so every operation of
+// a run can be found in the activity log by the run's ID
+const correlationIDHeader = "x-ms-correlation-request-id"
+
+// Matches run IDs, which are UUIDs since ARM only accepts those as
+// correlation IDs
+var runIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// The ID of the run this process performs, chosen once
+var processRunID struct {
+	once sync.Once
+	id   string
+}
+
+// Returns a random run ID, as a version 4 UUID
+func newRunID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// Checks a --run-id value
+func validateRunID(value string) error {
+	if value != "" && !runIDPattern.MatchString(value) {
+		return fmt.Errorf("%s is not a UUID", value)
+	}
+	return nil
+}
+
+// Returns the ID of the run this process performs: --run-id if given, so a
+// pipeline can correlate the run with its own records, or a random one.
+// Long-running commands give each upgrade they run an ID of its own.
+func defaultRunID(cmd *cobra.Command) string {
+	processRunID.once.Do(func() {
+		if flag := cmd.Flags().Lookup("run-id"); flag != nil && flag.Value.String() != "" {
+			processRunID.id = flag.Value.String()
+		} else {
+			processRunID.id = newRunID()
+		}
+	})
+	return processRunID.id
+}
+
+// runIDHook adds the run's ID to every log entry
+type runIDHook struct {
+	id string
+}
+
+func (h runIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h runIDHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["runID"]; !ok {
+		entry.Data["runID"] = h.id
+	}
+	return nil
+}
+
+// Tags the logs of a command with the run's ID. Long-running commands run
+// many upgrades, each logging its ID as it starts instead.
+func configureRunID(cmd *cobra.Command) {
+	if serviceCommands[cmd.Name()] {
+		return
+	}
+	log.AddHook(runIDHook{id: defaultRunID(cmd)})
+}
+
+// Sends the session's run ID as the correlation ID of every ARM request
+func (s *azureSession) correlate(sender autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		if s.RunID != "" {
+			req.Header.Set(correlationIDHeader, s.RunID)
+		}
+		return sender.Do(req)
+	})
+}
+
+// Gives the run, and the session's ARM requests, the given ID
+func (r *upgradeRun) setRunID(id string) {
+	r.runID = id
+	r.sess.RunID = id
+}
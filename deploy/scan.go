@@ -0,0 +1,263 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// scanResult is the drift of a single scale set from its model
+type scanResult struct {
+	ResourceGroup string `json:"resourceGroup"`
+	Name          string `json:"scaleSet"`
+	Location      string `json:"location"`
+	Instances     int    `json:"instances"`
+	Stale         int    `json:"stale"`
+	// Image the model references, and how many instances run each image
+	ModelImage     string         `json:"modelImage,omitempty"`
+	InstanceImages map[string]int `json:"instanceImages"`
+	// Upgrade recorded as in progress, if any, and when the last one completed
+	UpgradeState string `json:"upgradeState,omitempty"`
+	LastUpgrade  string `json:"lastUpgrade,omitempty"`
+}
+
+// Starts a scan result from a scale set's model and recorded state
+func newScanResult(scaleSet compute.VirtualMachineScaleSet) (scanResult, error) {
+	id, err := azure.ParseResourceID(to.String(scaleSet.ID))
+	if err != nil {
+		return scanResult{}, err
+	}
+
+	result := scanResult{
+		ResourceGroup:  id.ResourceGroup,
+		Name:           id.ResourceName,
+		Location:       to.String(scaleSet.Location),
+		InstanceImages: map[string]int{},
+		UpgradeState:   to.String(scaleSet.Tags[upgradeStateTag]),
+		LastUpgrade:    to.String(scaleSet.Tags[lastUpgradeTag]),
+	}
+
+	if props := scaleSet.VirtualMachineScaleSetProperties; props != nil && props.VirtualMachineProfile != nil &&
+		props.VirtualMachineProfile.StorageProfile != nil && props.VirtualMachineProfile.StorageProfile.ImageReference != nil {
+		result.ModelImage = imageReferenceString(props.VirtualMachineProfile.StorageProfile.ImageReference)
+	}
+
+	return result, nil
+}
+
+// Inventories a single scale set's instances against its model
+func (s *azureSession) scanScaleSet(ctx context.Context, scaleSet compute.VirtualMachineScaleSet) (scanResult, error) {
+	result, err := newScanResult(scaleSet)
+	if err != nil {
+		return result, err
+	}
+
+	vms, err := s.getVMSSVMClient().List(ctx, result.ResourceGroup, result.Name, "", "")
+	if err != nil {
+		return result, err
+	}
+
+	result.Instances = len(vms)
+	for _, vm := range vms {
+		props := vm.VirtualMachineScaleSetVMProperties
+		if props == nil || !to.Bool(props.LatestModelApplied) {
+			result.Stale++
+		}
+		if props != nil && props.StorageProfile != nil && props.StorageProfile.ImageReference != nil {
+			result.InstanceImages[imageReferenceString(props.StorageProfile.ImageReference)]++
+		}
+	}
+
+	return result, nil
+}
+
+// Inventories the scale sets matching the selector with two Resource
+// Graph queries, one for the scale sets and one summarising every
+// instance, however many scale sets the subscription holds
+func (s *azureSession) scanWithResourceGraph(ctx context.Context, selector map[string]string) ([]scanResult, error) {
+	subscriptions := []string{s.SubscriptionID}
+
+	scaleSets, err := s.graphScaleSets(ctx, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := s.graphInstanceSummaries(ctx, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []scanResult
+	for _, scaleSet := range scaleSets {
+		if !matchesSelector(scaleSet.Tags, selector) {
+			continue
+		}
+
+		result, err := newScanResult(scaleSet)
+		if err != nil {
+			log.Warnf("Unable to scan scale set %s: %v", to.String(scaleSet.Name), err)
+			continue
+		}
+
+		if summary, ok := summaries[strings.ToLower(to.String(scaleSet.ID))]; ok {
+			result.Instances, result.Stale, result.InstanceImages = summary.Instances, summary.Stale, summary.Images
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Inventories the scale sets matching the selector by listing each one's
+// instances in turn. Scale sets which can't be read are logged and left out.
+func (s *azureSession) scanWithComputeAPI(ctx context.Context, selector map[string]string) ([]scanResult, error) {
+	scaleSets, err := s.getVMSSClient().ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []scanResult
+	for _, scaleSet := range scaleSets {
+		if !matchesSelector(scaleSet.Tags, selector) {
+			continue
+		}
+
+		result, err := s.scanScaleSet(ctx, scaleSet)
+		if err != nil {
+			log.Warnf("Unable to scan scale set %s: %v", to.String(scaleSet.Name), err)
+			continue
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Inventories every scale set in the session's subscription matching the
+// selector, ordered by how urgently each needs upgrading: upgrades left in
+// progress first, then by the share of instances on an outdated model.
+// Resource Graph answers for the whole subscription at once; should it be
+// unavailable, each scale set is listed through the compute API instead.
+func (s *azureSession) scanSubscription(ctx context.Context, selector map[string]string) ([]scanResult, error) {
+	var results []scanResult
+	var err error
+
+	if !s.Simulated {
+		if results, err = s.scanWithResourceGraph(ctx, selector); err != nil {
+			log.Warnf("Unable to query Resource Graph, listing each scale set instead: %v", err)
+		}
+	}
+	if s.Simulated || err != nil {
+		if results, err = s.scanWithComputeAPI(ctx, selector); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.UpgradeState != "") != (b.UpgradeState != "") {
+			return a.UpgradeState != ""
+		}
+		// Compare stale shares without dividing: a.Stale/a.Instances > b.Stale/b.Instances
+		if shareA, shareB := a.Stale*b.Instances, b.Stale*a.Instances; shareA != shareB {
+			return shareA > shareB
+		}
+		return a.Stale > b.Stale
+	})
+
+	return results, nil
+}
+
+// Prints scan results as a table, most urgent first
+func printScanReport(results []scanResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRIORITY\tRESOURCE GROUP\tSCALE SET\tLOCATION\tSTALE\tMODEL IMAGE\tINSTANCE IMAGES\tUPGRADE STATE\tLAST UPGRADE")
+
+	priority := 0
+	for _, result := range results {
+		rank := "-"
+		if result.Stale > 0 || result.UpgradeState != "" {
+			priority++
+			rank = fmt.Sprint(priority)
+		}
+
+		images := make([]string, 0, len(result.InstanceImages))
+		for image, count := range result.InstanceImages {
+			images = append(images, fmt.Sprintf("%s (%d)", image, count))
+		}
+		sort.Strings(images)
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\t%s\t%s\n", rank, result.ResourceGroup, result.Name, result.Location,
+			result.Stale, result.Instances, orNone(result.ModelImage), orNone(strings.Join(images, ", ")),
+			orNone(result.UpgradeState), orNone(result.LastUpgrade))
+	}
+
+	w.Flush()
+}
+
+// RunScan reports the model drift of every scale set in a subscription,
+// listing those needing an upgrade in priority order. Nothing is modified.
+func RunScan(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	selector, err := parseSelector(cmd.Flags().Lookup("selector").Value.String())
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	sess, err := newSessionWithOptions(cmd, cmd.Flags().Lookup("subscription-id").Value.String(), "", "", opts)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	results, err := sess.scanSubscription(ctx, selector)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		if results == nil {
+			results = []scanResult{}
+		}
+		if err = printJSON(results); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+	} else {
+		printScanReport(results)
+	}
+
+	needing := 0
+	for _, result := range results {
+		if result.Stale > 0 || result.UpgradeState != "" {
+			needing++
+		}
+	}
+	log.Infof("%d of %d scale sets need upgrading", needing, len(results))
+}
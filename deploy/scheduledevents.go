@@ -0,0 +1,259 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Where the termination agent and the cleanup it runs are installed
+	terminationAgentDir = "/var/lib/azure-cluster-upgrade"
+
+	// Bounds Azure puts on the notice given ahead of termination
+	minTerminateNotification = 5 * time.Minute
+	maxTerminateNotification = 15 * time.Minute
+)
+
+// Watches IMDS Scheduled Events for the instance's Terminate event, runs
+// the cleanup script once it's posted and acknowledges the event, so the
+// platform deletes the instance without waiting out the notice. The first
+// request enables Scheduled Events on the instance.
+const terminationAgent = `import json, subprocess, sys, time, urllib.request
+
+EVENTS = "http://169.254.169.254/metadata/scheduledevents?api-version=2020-07-01"
+NAME = "http://169.254.169.254/metadata/instance/compute/name?api-version=2020-09-01&format=text"
+
+def imds(url, body=None):
+    req = urllib.request.Request(url, data=body, headers={"Metadata": "true"})
+    return urllib.request.urlopen(req, timeout=10).read().decode()
+
+name = imds(NAME).strip()
+while True:
+    try:
+        events = json.loads(imds(EVENTS)).get("Events", [])
+    except Exception as e:
+        print("unable to fetch scheduled events: %s" % e, flush=True)
+        events = []
+    for event in events:
+        if event.get("EventType") == "Terminate" and name in event.get("Resources", []):
+            print("termination %s scheduled for %s, cleaning up" % (event["EventId"], event.get("NotBefore")), flush=True)
+            subprocess.call(["/bin/sh", sys.argv[1]])
+            imds(EVENTS, json.dumps({"StartRequests": [{"EventId": event["EventId"]}]}).encode())
+            print("acknowledged termination %s" % event["EventId"], flush=True)
+            sys.exit(0)
+    time.sleep(5)
+`
+
+// Builds a script which installs the termination agent along with the
+// cleanup script, and starts it in the background so it outlives the Run
+// Command. Any agent left by an earlier attempt is replaced.
+func terminationAgentScript(cleanup []string) []string {
+	script := []string{
+		"set -e",
+		"command -v python3 >/dev/null || { echo 'python3 is required by the termination agent' >&2; exit 1; }",
+		"mkdir -p " + terminationAgentDir,
+		fmt.Sprintf("cat > %s/termination-cleanup.sh <<'ACU_CLEANUP_EOF'", terminationAgentDir),
+	}
+	script = append(script, cleanup...)
+	script = append(script,
+		"ACU_CLEANUP_EOF",
+		fmt.Sprintf("cat > %s/termination-agent.py <<'ACU_AGENT_EOF'", terminationAgentDir),
+	)
+	script = append(script, strings.Split(strings.TrimRight(terminationAgent, "\n"), "\n")...)
+	script = append(script,
+		"ACU_AGENT_EOF",
+		fmt.Sprintf("pkill -f %s/termination-agent.py || true", terminationAgentDir),
+		fmt.Sprintf("nohup setsid python3 %[1]s/termination-agent.py %[1]s/termination-cleanup.sh >>%[1]s/termination-agent.log 2>&1 </dev/null &", terminationAgentDir),
+		"echo 'Termination agent started'",
+	)
+
+	return script
+}
+
+// Checks a --terminate-notification value, which Azure only accepts in
+// whole minutes from 5 to 15
+func validateTerminateNotification(value string) error {
+	notice, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if notice == 0 {
+		return nil
+	}
+	if notice < minTerminateNotification || notice > maxTerminateNotification || notice%time.Minute != 0 {
+		return fmt.Errorf("%s is not a whole number of minutes from %s to %s", value, minTerminateNotification, maxTerminateNotification)
+	}
+	return nil
+}
+
+// Returns the scale set model's terminate notification profile, or nil if
+// it has none
+func modelTerminateNotification(scaleSet compute.VirtualMachineScaleSet) *compute.TerminateNotificationProfile {
+	if scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.VirtualMachineProfile == nil ||
+		scaleSet.VirtualMachineProfile.ScheduledEventsProfile == nil {
+		return nil
+	}
+	return scaleSet.VirtualMachineProfile.ScheduledEventsProfile.TerminateNotificationProfile
+}
+
+// Returns the notice a terminate notification profile gives, or zero if it
+// isn't enabled. Azure reports the notice as an ISO 8601 duration such as
+// PT10M.
+func terminateNotice(profile *compute.TerminateNotificationProfile) time.Duration {
+	if profile == nil || !to.Bool(profile.Enable) {
+		return 0
+	}
+
+	var minutes int
+	if _, err := fmt.Sscanf(strings.ToUpper(to.String(profile.NotBeforeTimeout)), "PT%dM", &minutes); err != nil {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Reports whether the scale set's model has its instances notified of
+// their termination ahead of deletion
+func (s *azureSession) terminateNotificationEnabled(ctx context.Context) (bool, error) {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return false, err
+	}
+
+	profile := modelTerminateNotification(scaleSet)
+	return profile != nil && to.Bool(profile.Enable), nil
+}
+
+// Sets the scale set model's terminate notification profile
+func (s *azureSession) setTerminateNotification(ctx context.Context, profile *compute.TerminateNotificationProfile) error {
+	return s.updateModel(ctx, compute.VirtualMachineScaleSetUpdate{
+		VirtualMachineScaleSetUpdateProperties: &compute.VirtualMachineScaleSetUpdateProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetUpdateVMProfile{
+				ScheduledEventsProfile: &compute.ScheduledEventsProfile{
+					TerminateNotificationProfile: profile,
+				},
+			},
+		},
+	})
+}
+
+// Returns a phase which enables the scale set model's terminate
+// notification with the notice given by --terminate-notification, unless
+// it already gives it, so workloads on the old instances get that long to
+// shut down once their scale-in starts. Rolling back restores the previous
+// profile.
+func (r *upgradeRun) terminateNotificationStep(notice time.Duration) phase.Step {
+	var previous *compute.TerminateNotificationProfile
+	changed := false
+
+	return &phase.Func{
+		StepName: "terminate-notification",
+		ExecuteFunc: func(ctx context.Context) error {
+			scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			current := modelTerminateNotification(scaleSet)
+			if terminateNotice(current) == notice {
+				log.Infof("Scale set %s already gives %s notice of termination", r.sess.ScaleSetName, notice)
+				return nil
+			}
+
+			log.Infof("Updating scale set model to give %s notice of termination...", notice)
+			err = r.sess.setTerminateNotification(ctx, &compute.TerminateNotificationProfile{
+				Enable:           to.BoolPtr(true),
+				NotBeforeTimeout: to.StringPtr(fmt.Sprintf("PT%dM", int(notice/time.Minute))),
+			})
+			if err != nil {
+				return err
+			}
+			previous, changed = current, true
+
+			return nil
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			if !changed {
+				return nil
+			}
+
+			log.Info("Restoring previous terminate notification")
+			if previous == nil {
+				previous = &compute.TerminateNotificationProfile{Enable: to.BoolPtr(false)}
+			}
+			return r.sess.setTerminateNotification(ctx, previous)
+		},
+	}
+}
+
+// Confirms the scale set model still gives the notice of termination asked
+// for by --terminate-notification before any old instance is removed, so
+// they aren't deleted out from under their workloads
+func (r *upgradeRun) verifyTerminateNotification(ctx context.Context) error {
+	notice, _ := r.cmd.Flags().GetDuration("terminate-notification")
+	if notice == 0 {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	if actual := terminateNotice(modelTerminateNotification(scaleSet)); actual != notice {
+		if actual == 0 {
+			return fmt.Errorf("scale set %s doesn't give notice of termination, though %s was asked for; not removing old instances", r.sess.ScaleSetName, notice)
+		}
+		return fmt.Errorf("scale set %s gives %s notice of termination rather than the %s asked for; not removing old instances", r.sess.ScaleSetName, actual, notice)
+	}
+
+	log.Infof("Old instances of %s will be given %s notice of termination", r.sess.ScaleSetName, notice)
+	return nil
+}
+
+// Installs the termination agent on the given old instances if
+// --termination-script is given, so each runs the script when Scheduled
+// Events notifies it of its deletion and lets the platform go ahead as soon
+// as it's done, rather than being cut off or held for the whole notice.
+func (r *upgradeRun) installTerminationAgent(ctx context.Context, instanceIDs []string) error {
+	path := r.cmd.Flags().Lookup("termination-script").Value.String()
+	if path == "" {
+		return nil
+	}
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+	if commandID == windowsRunCommandID {
+		log.Warnf("The termination agent only runs on Linux, so %s won't be run on the old instances of %s", path, r.sess.ScaleSetName)
+		return nil
+	}
+
+	enabled, err := r.sess.terminateNotificationEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		log.Warnf("Scale set %s has no terminate notification enabled, so its old instances will be deleted without running %s; enable it with --terminate-notification", r.sess.ScaleSetName, path)
+		return nil
+	}
+
+	cleanup, err := loadScript(path)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+	log.Infof("Installing the termination agent on %d instances via Run Command, to run %s on their termination notice...", len(instanceIDs), path)
+
+	_, err = r.sess.runCommandOnInstanceIDs(ctx, instanceIDs, terminationAgentScript(cleanup), timeout)
+	return err
+}
@@ -0,0 +1,129 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+const (
+	keyVaultResource   = "https://vault.azure.net"
+	keyVaultAPIVersion = "7.0"
+
+	// Prefixes of secret references in the config file
+	secretFromEnv      = "env:"
+	secretFromFile     = "file:"
+	secretFromKeyVault = "keyvault:"
+)
+
+// secret holds a credential for an integration. It formats as a
+// placeholder, so a secret passed to a log line or error by mistake
+// doesn't leak; only reveal returns the value.
+type secret string
+
+func (s secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "(redacted)"
+}
+
+// GoString keeps the value out of %#v formatting too
+func (s secret) GoString() string {
+	return s.String()
+}
+
+func (s secret) reveal() string {
+	return string(s)
+}
+
+// Resolves a secret reference from the config file:
+//
+//	env:NAME          the environment variable NAME
+//	file:PATH         the contents of PATH, less surrounding whitespace
+//	keyvault:URI      the Key Vault secret at URI, e.g.
+//	                  https://myvault.vault.azure.net/secrets/consul-token
+//
+// Anything else is taken as the secret itself. Key Vault is read with a
+// client of its own rather than the session's, so the secret never passes
+// through the ARM recorder into a cassette.
+func resolveSecret(ctx context.Context, ref string) (secret, error) {
+	switch {
+	case ref == "":
+		return "", nil
+	case strings.HasPrefix(ref, secretFromEnv):
+		return secret(os.Getenv(strings.TrimPrefix(ref, secretFromEnv))), nil
+	case strings.HasPrefix(ref, secretFromFile):
+		path := strings.TrimPrefix(ref, secretFromFile)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret from %s: %v", path, err)
+		}
+		return secret(strings.TrimSpace(string(contents))), nil
+	case strings.HasPrefix(ref, secretFromKeyVault):
+		return getKeyVaultSecret(ctx, strings.TrimPrefix(ref, secretFromKeyVault))
+	default:
+		return secret(ref), nil
+	}
+}
+
+// Reads a secret from Key Vault, using the process's Azure AD credentials
+func getKeyVaultSecret(ctx context.Context, secretURI string) (secret, error) {
+	var result struct {
+		Value string `json:"value"`
+	}
+
+	if err := keyVaultGet(ctx, secretURI, "/secrets/", &result); err != nil {
+		return "", err
+	}
+
+	return secret(result.Value), nil
+}
+
+// Issues a GET against a Key Vault object URI, which must lie under
+// 'collection', e.g. '/secrets/', and decodes the JSON response
+func keyVaultGet(ctx context.Context, uri string, collection string, result interface{}) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "https" || !strings.HasPrefix(parsed.Path, collection) {
+		return fmt.Errorf("%s is not a Key Vault URI of the form https://<vault>.vault.azure.net%s<name>", uri, collection)
+	}
+
+	authorizer, err := newAuthorizerForResource(keyVaultResource)
+	if err != nil {
+		return err
+	}
+
+	client := autorest.NewClientWithUserAgent(userAgent)
+	client.Authorizer = authorizer
+
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.WithMethod(http.MethodGet),
+		autorest.WithBaseURL(parsed.Scheme+"://"+parsed.Host),
+		autorest.WithPath(parsed.Path),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": keyVaultAPIVersion}),
+		client.WithAuthorization())
+	if err != nil {
+		return err
+	}
+
+	resp, err := autorest.SendWithSender(client, req)
+	if err != nil {
+		return err
+	}
+
+	err = autorest.Respond(resp,
+		autorest.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(result),
+		autorest.ByClosing())
+	if err != nil {
+		return fmt.Errorf("unable to read Key Vault object %s: %v", parsed.Path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Parses a tag selector of the form 'key=value,key=value'
+func parseSelector(selector string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, term := range strings.Split(selector, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("selector term '%s' is not of the form key=value", term)
+		}
+		tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return tags, nil
+}
+
+// Reports whether a resource's tags satisfy every term of a selector. Tag
+// names match case-insensitively, as they do in Azure; values exactly.
+func matchesSelector(tags map[string]*string, selector map[string]string) bool {
+	for key, value := range selector {
+		found := false
+		for name, tagValue := range tags {
+			if strings.EqualFold(name, key) && to.String(tagValue) == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the scale sets in the session's subscription whose tags match the
+// selector, only those in 'resourceGroup' if it's given
+func (s *azureSession) selectScaleSets(ctx context.Context, selector map[string]string, resourceGroup string) ([]azure.Resource, error) {
+	scaleSets, err := s.listScaleSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []azure.Resource
+	for _, scaleSet := range scaleSets {
+		if !matchesSelector(scaleSet.Tags, selector) {
+			continue
+		}
+
+		id, err := azure.ParseResourceID(to.String(scaleSet.ID))
+		if err != nil {
+			return nil, err
+		}
+		if resourceGroup != "" && !strings.EqualFold(id.ResourceGroup, resourceGroup) {
+			continue
+		}
+		selected = append(selected, id)
+	}
+
+	return selected, nil
+}
+
+// Creates a session for each scale set the command's flags name: the one
+// given by --resource-group and --vm-scale-set, or every one whose tags
+// match --selector.
+func newSessionsFromFlags(ctx context.Context, cmd *cobra.Command) ([]*azureSession, error) {
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var target [4]string
+	for i, name := range []string{"subscription-id", "resource-group", "vm-scale-set", "selector"} {
+		if target[i], err = cmd.Flags().GetString(name); err != nil {
+			return nil, err
+		}
+	}
+	subscription, rg, scaleSet, selectorFlag := target[0], target[1], target[2], target[3]
+
+	if subscription == "" {
+		return nil, fmt.Errorf("--subscription-id is required")
+	}
+
+	if selectorFlag == "" {
+		if rg == "" || scaleSet == "" {
+			return nil, fmt.Errorf("--resource-group and --vm-scale-set are required without a --selector")
+		}
+
+		sess, err := newSessionWithOptions(cmd, subscription, rg, scaleSet, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*azureSession{sess}, nil
+	}
+
+	selector, err := parseSelector(selectorFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery, err := newSessionWithOptions(cmd, subscription, rg, "", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := discovery.selectScaleSets(ctx, selector, rg)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no scale sets in subscription %s match the selector '%s'", subscription, selectorFlag)
+	}
+
+	var sessions []*azureSession
+	var names []string
+	for _, id := range selected {
+		sess, err := newSessionWithOptions(cmd, subscription, id.ResourceGroup, id.ResourceName, opts)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+		names = append(names, id.ResourceGroup+"/"+id.ResourceName)
+	}
+
+	log.Infof("Selector '%s' matched %d scale sets: %s", selectorFlag, len(sessions), strings.Join(names, ", "))
+
+	return sessions, nil
+}
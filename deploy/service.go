@@ -0,0 +1,195 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Commands which run until stopped, so can be installed as a service
+var serviceCommands = map[string]bool{"gitops": true, "chatops": true}
+
+// serviceUnit is a long-running command installed as a systemd service
+type serviceUnit struct {
+	Name        string
+	Args        []string
+	Environment []string
+	User        string
+	Restart     string
+	RestartSec  time.Duration
+}
+
+// Quotes a word of a systemd unit's command line or environment where it
+// would otherwise be split or unescaped
+func quoteSystemd(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\n\"'\\$%;") {
+		return word
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$", "%", "%%", "\n", `\n`).Replace(word)
+	return `"` + escaped + `"`
+}
+
+// Renders the unit file
+func (u serviceUnit) render() string {
+	var b strings.Builder
+
+	args := make([]string, len(u.Args))
+	for i, arg := range u.Args {
+		args[i] = quoteSystemd(arg)
+	}
+
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=azure-cluster-upgrade %s\n", u.Args[1])
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=network-online.target\n\n")
+
+	fmt.Fprintf(&b, "[Service]\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	for _, variable := range u.Environment {
+		fmt.Fprintf(&b, "Environment=%s\n", quoteSystemd(variable))
+	}
+	if u.User != "" {
+		fmt.Fprintf(&b, "User=%s\n", u.User)
+	}
+	fmt.Fprintf(&b, "Restart=%s\n", u.Restart)
+	fmt.Fprintf(&b, "RestartSec=%d\n\n", int64(u.RestartSec/time.Second))
+
+	fmt.Fprintf(&b, "[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+
+	return b.String()
+}
+
+// Returns the path of a unit's file
+func serviceUnitPath(cmd *cobra.Command, name string) string {
+	return filepath.Join(cmd.Flags().Lookup("unit-dir").Value.String(), name+".service")
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Builds the unit for the command given after '--', run by this
+// executable with the config file in use
+func serviceUnitFromFlags(cmd *cobra.Command, args []string) (serviceUnit, error) {
+	var unit serviceUnit
+
+	if len(args) == 0 || !serviceCommands[args[0]] {
+		return unit, fmt.Errorf("give the command to run as a service after '--', one of gitops or chatops")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return unit, err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return unit, err
+	}
+
+	unit.Args = append([]string{executable, args[0]}, args[1:]...)
+	if config := viper.ConfigFileUsed(); config != "" {
+		if config, err = filepath.Abs(config); err != nil {
+			return unit, err
+		}
+		unit.Args = append(unit.Args, "--config", config)
+	}
+
+	unit.Name = cmd.Flags().Lookup("name").Value.String()
+	if unit.Name == "" {
+		unit.Name = "azure-cluster-upgrade-" + args[0]
+	}
+	unit.User = cmd.Flags().Lookup("user").Value.String()
+	unit.Restart = cmd.Flags().Lookup("restart").Value.String()
+	unit.RestartSec, _ = cmd.Flags().GetDuration("restart-delay")
+
+	unit.Environment, _ = cmd.Flags().GetStringArray("env")
+	for _, variable := range unit.Environment {
+		if !strings.Contains(variable, "=") {
+			return unit, fmt.Errorf("--env: '%s' is not of the form NAME=value", variable)
+		}
+	}
+
+	return unit, nil
+}
+
+// Refuses to manage services where systemd isn't available
+func checkServiceManager() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("services can only be installed with systemd on Linux, not on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+// RunServiceInstall installs a long-running command, such as gitops, as a
+// systemd service, so it can run on a management VM without hand-written
+// units. The service is enabled and started unless --no-start is given.
+func RunServiceInstall(cmd *cobra.Command, args []string) {
+	if err := checkServiceManager(); err != nil {
+		fail(err)
+	}
+
+	unit, err := serviceUnitFromFlags(cmd, args)
+	if err != nil {
+		fail(err)
+	}
+
+	path := serviceUnitPath(cmd, unit.Name)
+	if err = ioutil.WriteFile(path, []byte(unit.render()), 0644); err != nil {
+		fail(err)
+	}
+	log.Infof("Wrote systemd unit %s", path)
+
+	if noStart, _ := cmd.Flags().GetBool("no-start"); noStart {
+		return
+	}
+
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", unit.Name}} {
+		if err = systemctl(args...); err != nil {
+			fail(err)
+		}
+	}
+	log.Infof("Service %s enabled and started", unit.Name)
+}
+
+// RunServiceUninstall stops and removes a service installed by
+// RunServiceInstall
+func RunServiceUninstall(cmd *cobra.Command, args []string) {
+	if err := checkServiceManager(); err != nil {
+		fail(err)
+	}
+
+	name := cmd.Flags().Lookup("name").Value.String()
+	if name == "" {
+		if len(args) == 0 {
+			fail(fmt.Errorf("give the service's --name, or the command it runs after '--'"))
+		}
+		name = "azure-cluster-upgrade-" + args[0]
+	}
+
+	if err := systemctl("disable", "--now", name); err != nil {
+		log.Warn(err)
+	}
+
+	path := serviceUnitPath(cmd, name)
+	if err := os.Remove(path); err != nil {
+		fail(err)
+	}
+	log.Infof("Removed systemd unit %s", path)
+
+	if err := systemctl("daemon-reload"); err != nil {
+		fail(err)
+	}
+}
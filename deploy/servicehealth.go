@@ -0,0 +1,220 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	resourceHealthAPIVersion = "2022-10-01"
+
+	// Behaviours when Service Health reports trouble in the region
+	serviceHealthOff   = "off"
+	serviceHealthWarn  = "warn"
+	serviceHealthPause = "pause"
+
+	// How often Service Health is checked again between phases
+	serviceHealthCheckInterval = 5 * time.Minute
+	// How far ahead an instance's maintenance window counts as upcoming
+	maintenanceLookahead = time.Hour
+)
+
+// Services whose incidents affect the scale set
+var computeServices = map[string]bool{"virtual machines": true, "virtual machine scale sets": true}
+
+// Returns a region's name as ARM locations spell it, e.g. 'eastus' for
+// 'East US'
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.Replace(region, " ", "", -1))
+}
+
+// Lists the active Service Health incidents and planned maintenance
+// affecting compute in the region, by title
+func (s *azureSession) serviceHealthEvents(ctx context.Context, region string) ([]string, error) {
+	var events []string
+
+	var healthEvents []struct {
+		Properties struct {
+			EventType string `json:"eventType"`
+			Status    string `json:"status"`
+			Title     string `json:"title"`
+			Impact    []struct {
+				ImpactedService string `json:"impactedService"`
+				ImpactedRegions []struct {
+					ImpactedRegion string `json:"impactedRegion"`
+				} `json:"impactedRegions"`
+			} `json:"impact"`
+		} `json:"properties"`
+	}
+
+	path := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.ResourceHealth/events", s.SubscriptionID)
+	if err := s.armList(ctx, path, map[string]interface{}{"api-version": resourceHealthAPIVersion}, &healthEvents); err != nil {
+		return events, err
+	}
+
+	for _, event := range healthEvents {
+		props := event.Properties
+		if props.Status != "Active" || (props.EventType != "ServiceIssue" && props.EventType != "PlannedMaintenance") {
+			continue
+		}
+
+	impacts:
+		for _, impact := range props.Impact {
+			if !computeServices[strings.ToLower(impact.ImpactedService)] {
+				continue
+			}
+			for _, impacted := range impact.ImpactedRegions {
+				if normalizeRegion(impacted.ImpactedRegion) == normalizeRegion(region) {
+					events = append(events, fmt.Sprintf("%s: %s", props.EventType, props.Title))
+					break impacts
+				}
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// Lists the instances of the scale set whose platform maintenance window
+// is open or about to open
+func (s *azureSession) scheduledMaintenance(ctx context.Context) ([]string, error) {
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "instanceView")
+	if err != nil {
+		return nil, err
+	}
+
+	horizon := time.Now().Add(maintenanceLookahead)
+
+	var scheduled []string
+	for _, vm := range vms {
+		if vm.VirtualMachineScaleSetVMProperties == nil || vm.InstanceView == nil || vm.InstanceView.MaintenanceRedeployStatus == nil {
+			continue
+		}
+
+		status := vm.InstanceView.MaintenanceRedeployStatus
+		if status.MaintenanceWindowStartTime == nil || status.MaintenanceWindowEndTime == nil {
+			continue
+		}
+		if status.MaintenanceWindowStartTime.Before(horizon) && status.MaintenanceWindowEndTime.After(time.Now()) {
+			scheduled = append(scheduled, fmt.Sprintf("instance %s has maintenance scheduled from %s", to.String(vm.InstanceID),
+				status.MaintenanceWindowStartTime.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	return scheduled, nil
+}
+
+// Returns the region of the scale set, looking it up the first time
+func (r *upgradeRun) scaleSetRegion(ctx context.Context) (string, error) {
+	if r.region == "" {
+		scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+		if err != nil {
+			return "", err
+		}
+		r.region = to.String(scaleSet.Location)
+	}
+	return r.region, nil
+}
+
+// Returns the incidents, planned maintenance and scheduled instance
+// maintenance which make it a bad time to upgrade the scale set
+func (r *upgradeRun) serviceHealthProblems(ctx context.Context) ([]string, error) {
+	region, err := r.scaleSetRegion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	problems, err := r.sess.serviceHealthEvents(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query Service Health: %v", err)
+	}
+
+	scheduled, err := r.sess.scheduledMaintenance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.serviceHealthCheckedAt = time.Now()
+	return append(problems, scheduled...), nil
+}
+
+// Checks Service Health ahead of the upgrade, per --service-health. An
+// active incident or maintenance affecting compute in the region is worth
+// a warning, or refuses the upgrade when pausing for them.
+func (r *upgradeRun) checkServiceHealth(ctx context.Context) error {
+	mode := r.cmd.Flags().Lookup("service-health").Value.String()
+	if mode == serviceHealthOff {
+		return nil
+	}
+
+	problems, err := r.serviceHealthProblems(ctx)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if mode == serviceHealthWarn {
+		for _, problem := range problems {
+			log.Warnf("Service Health reports trouble in %s: %s", r.region, problem)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Service Health reports trouble in %s, not upgrading into it: %s; re-run once it clears, or with --service-health=%s",
+		r.region, strings.Join(problems, "; "), serviceHealthWarn)
+}
+
+// Checks Service Health again ahead of a phase, once the last check is
+// old enough. When pausing for trouble, the run is held until it clears
+// or --service-health-timeout passes.
+func (r *upgradeRun) holdForServiceHealth(ctx context.Context, phaseName string) error {
+	mode := r.cmd.Flags().Lookup("service-health").Value.String()
+	if mode == serviceHealthOff || r.sess.Simulated || time.Since(r.serviceHealthCheckedAt) < serviceHealthCheckInterval {
+		return nil
+	}
+
+	problems, err := r.serviceHealthProblems(ctx)
+	if err != nil {
+		log.Warnf("Unable to check Service Health ahead of phase %s: %v", phaseName, err)
+		return nil
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	for _, problem := range problems {
+		log.Warnf("Service Health reports trouble in %s: %s", r.region, problem)
+	}
+	if mode == serviceHealthWarn {
+		return nil
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("service-health-timeout")
+	log.Warnf("Pausing ahead of phase %s until it clears, for up to %s", phaseName, timeout)
+
+	deadline := time.After(timeout)
+	for len(problems) > 0 {
+		select {
+		case <-time.After(serviceHealthCheckInterval):
+		case <-deadline:
+			return fmt.Errorf("Service Health still reports trouble in %s after %s, so phase %s wasn't started: %s",
+				r.region, timeout, phaseName, strings.Join(problems, "; "))
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if problems, err = r.serviceHealthProblems(ctx); err != nil {
+			log.Warnf("Unable to check Service Health: %v", err)
+		}
+	}
+
+	log.Info("Service Health reports no more trouble, resuming the upgrade")
+	return nil
+}
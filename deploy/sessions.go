@@ -0,0 +1,178 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// --sessions-from value counting sessions by the inbound flows Azure
+	// Monitor reports for each instance
+	sessionsFromMetrics = "metrics"
+
+	sessionPollInterval = 30 * time.Second
+
+	// Window inbound flows are averaged over, short enough to follow
+	// sessions as they end
+	sessionMetricsWindow = 5 * time.Minute
+)
+
+// Checks a --sessions-from value is 'metrics' or an HTTP(S) endpoint
+func validateSessionsFrom(value string) error {
+	if value == "" || value == sessionsFromMetrics {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("'%s' is neither '%s' nor an HTTP(S) endpoint", value, sessionsFromMetrics)
+	}
+	return nil
+}
+
+// Asks the session endpoint how many sessions an instance holds. {ip} and
+// {instance} in the endpoint are replaced by the instance's private IP and
+// ID, and it answers with the count as a JSON number.
+func querySessionEndpoint(ctx context.Context, endpoint string, token secret, instanceID string, address string) (int64, error) {
+	target := strings.NewReplacer("{ip}", address, "{instance}", instanceID).Replace(endpoint)
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token.reveal())
+	}
+
+	var count float64
+	if err = getJSON(ctx, req, &count); err != nil {
+		return 0, err
+	}
+
+	return int64(count), nil
+}
+
+// Returns the number of active sessions each of the instances holds, from
+// the endpoint or Azure Monitor given by --sessions-from. Instances Azure
+// Monitor has no flows for are left out, as their sessions are unknown.
+func (r *upgradeRun) countSessions(ctx context.Context, source string, token secret, instanceIDs []string) (map[string]int64, error) {
+	sessions := map[string]int64{}
+
+	if source == sessionsFromMetrics {
+		flows, err := r.sess.getInstanceLoads(ctx, "Inbound Flows", sessionMetricsWindow)
+		if err != nil {
+			return sessions, err
+		}
+		for _, id := range instanceIDs {
+			if count, ok := flows[id]; ok {
+				sessions[id] = int64(math.Ceil(count))
+			}
+		}
+		return sessions, nil
+	}
+
+	for _, id := range instanceIDs {
+		address, err := r.sess.getInstancePrivateIP(ctx, id)
+		if err != nil {
+			return sessions, err
+		}
+		if sessions[id], err = querySessionEndpoint(ctx, source, token, id, address); err != nil {
+			return sessions, fmt.Errorf("unable to count the sessions of instance %s: %v", id, err)
+		}
+	}
+
+	return sessions, nil
+}
+
+// Holds off removing old instances until each holds no more than
+// --max-sessions active sessions, for workloads whose clients are pinned
+// to an instance, such as WebSockets, remote desktops or game servers.
+// Instances are polled until every one is below the threshold or
+// --sessions-max-wait elapses, after which those still holding sessions
+// are removed regardless. Given release, instances are handed to it as
+// their sessions end, so one long session doesn't hold up the rest;
+// without, they're all held until the last is free.
+func (r *upgradeRun) awaitSessions(ctx context.Context, instanceIDs []string, release func(context.Context, []string) error) error {
+	releaseAll := func(ids []string) error {
+		if release == nil || len(ids) == 0 {
+			return nil
+		}
+		return release(ctx, ids)
+	}
+
+	source := r.cmd.Flags().Lookup("sessions-from").Value.String()
+	if source == "" || len(instanceIDs) == 0 {
+		return releaseAll(instanceIDs)
+	}
+	if r.sess.Simulated {
+		log.Info("The simulation has no sessions, removing old instances without waiting for them")
+		return releaseAll(instanceIDs)
+	}
+
+	maxSessions, _ := r.cmd.Flags().GetInt64("max-sessions")
+	maxWait, _ := r.cmd.Flags().GetDuration("sessions-max-wait")
+
+	token, err := resolveSecret(ctx, r.cmd.Flags().Lookup("sessions-token").Value.String())
+	if err != nil {
+		return fmt.Errorf("unable to resolve the sessions token: %v", err)
+	}
+
+	log.Infof("Waiting up to %s for %d old instances to hold no more than %d sessions...", maxWait, len(instanceIDs), maxSessions)
+
+	pending := instanceIDs
+	deadline := time.Now().Add(maxWait)
+	for {
+		sessions, err := r.countSessions(ctx, source, token, pending)
+		if err != nil {
+			return err
+		}
+
+		var busy, idle, held []string
+		for _, id := range pending {
+			if count, ok := sessions[id]; !ok {
+				busy = append(busy, id)
+				held = append(held, fmt.Sprintf("%s (unknown)", id))
+			} else if count > maxSessions {
+				busy = append(busy, id)
+				held = append(held, fmt.Sprintf("%s (%d)", id, count))
+			} else {
+				idle = append(idle, id)
+			}
+		}
+		sort.Strings(held)
+
+		if len(busy) == 0 {
+			log.Info("Old instances' sessions have ended")
+			return releaseAll(pending)
+		}
+
+		if release != nil && len(idle) > 0 {
+			log.Infof("Sessions have ended on %d old instances, removing them ahead of the rest", len(idle))
+			if err = release(ctx, idle); err != nil {
+				return err
+			}
+			pending = busy
+		}
+
+		if time.Now().After(deadline) {
+			log.Warnf("Removing old instances still holding sessions after %s: %s", maxWait, strings.Join(held, ", "))
+			return releaseAll(pending)
+		}
+
+		log.Infof("Old instances still holding sessions: %s", strings.Join(held, ", "))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sessionPollInterval):
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Built-in strategy removing instances without replacing them, run by
+	// shrink
+	strategyScaleInOnly = "scale-in-only"
+
+	// Policies choosing which instances a shrink removes
+	victimsOldest      = "oldest"
+	victimsStaleModel  = "stale-model"
+	victimsLeastLoaded = "least-loaded"
+)
+
+// Returns the instances a shrink removes, in the order the policy ranks
+// them: 'oldest' first by creation time, 'stale-model' those not running
+// the latest model before the rest, oldest first within each, and
+// 'least-loaded' the lowest average of the metrics over the window first.
+// Instances whose age can't be told rank as the newest, and those which
+// reported no load as the busiest.
+func (s *azureSession) selectVictims(ctx context.Context, policy string, count int64, metrics string, window time.Duration) ([]string, error) {
+	current, err := s.getInstanceIDs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := s.getInstanceCreationTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Oldest first, then those of unknown age, by ID
+	older := func(a string, b string) bool {
+		atA, okA := created[a]
+		atB, okB := created[b]
+		if okA != okB {
+			return okA
+		}
+		if okA && !atA.Equal(atB) {
+			return atA.Before(atB)
+		}
+		idA, _ := strconv.Atoi(a)
+		idB, _ := strconv.Atoi(b)
+		return idA < idB
+	}
+
+	var less func(i, j int) bool
+	switch policy {
+	case victimsStaleModel:
+		staleIDs, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+		if err != nil {
+			return nil, err
+		}
+		stale := map[string]bool{}
+		for _, id := range staleIDs {
+			stale[id] = true
+		}
+		less = func(i, j int) bool {
+			if stale[current[i]] != stale[current[j]] {
+				return stale[current[i]]
+			}
+			return older(current[i], current[j])
+		}
+	case victimsLeastLoaded:
+		loads := map[string]float64{}
+		if s.Simulated {
+			log.Info("The simulation has no metrics, shrinking by age alone")
+		} else if loads, err = s.getInstanceLoads(ctx, metrics, window); err != nil {
+			return nil, fmt.Errorf("unable to read the load of the instances of %s: %v", s.ScaleSetName, err)
+		}
+		less = func(i, j int) bool {
+			if lessLoaded(loads, current[i], current[j]) {
+				return true
+			}
+			if lessLoaded(loads, current[j], current[i]) {
+				return false
+			}
+			return older(current[i], current[j])
+		}
+	default:
+		less = func(i, j int) bool { return older(current[i], current[j]) }
+	}
+
+	sort.Slice(current, less)
+	if int64(len(current)) > count {
+		current = current[:count]
+	}
+	return current, nil
+}
+
+// Returns the phases of a shrink: the preflight checks which apply to
+// removing instances, then the victims drained and removed, all together
+// or within the disruption budget, leaving the scale set at its target
+// capacity. Delete locks lifted and repairs suspended for the shrink are
+// restored once the victims are gone.
+func (r *upgradeRun) shrinkSteps() []phase.Step {
+	steps := []phase.Step{
+		&phase.Func{StepName: "permissions", ValidateFunc: r.sess.preflightPermissions},
+		&phase.Func{StepName: "resource-locks", ValidateFunc: r.checkLocks},
+		&phase.Func{StepName: "load-specs", ValidateFunc: r.loadSpecs},
+		&phase.Func{StepName: "service-health", ValidateFunc: r.checkServiceHealth},
+		&phase.Func{StepName: "repairs", ValidateFunc: r.checkRepairs},
+		&phase.Func{StepName: "change-rate", ValidateFunc: r.checkChangeRate},
+		&phase.Func{StepName: "shrink-target", ValidateFunc: r.checkShrinkTarget, ExecuteFunc: r.startShrink},
+	}
+
+	liftLocks, _ := r.cmd.Flags().GetBool("lift-delete-locks")
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "lift-delete-locks", ExecuteFunc: r.liftLocks, RollbackFunc: r.restoreLocks})
+	}
+	suspendRepairs, _ := r.cmd.Flags().GetBool("suspend-repairs")
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "suspend-repairs", ExecuteFunc: r.suspendRepairs, RollbackFunc: r.resumeRepairs})
+	}
+
+	removal := []phase.Step{&phase.Func{StepName: "leader-handoff", ExecuteFunc: r.leaderHandoff}}
+	if r.maxUnavailable != "" || r.minHealthy != 0 {
+		removal = append(removal, &phase.Func{StepName: "budgeted-scale-in", ExecuteFunc: r.budgetedScaleIn})
+	} else {
+		removal = append(removal,
+			&phase.Func{StepName: "drain", ExecuteFunc: r.drain},
+			&phase.Func{StepName: "remove-victims", ExecuteFunc: r.removeVictims},
+		)
+	}
+	removal = append(removal, &phase.Func{StepName: "orphaned-resources", ExecuteFunc: r.cleanOrphans})
+	for _, step := range removal {
+		steps = append(steps, watchedStep{step, r})
+	}
+
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "restore-delete-locks", ExecuteFunc: r.restoreLocks})
+	}
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "resume-repairs", ExecuteFunc: r.resumeRepairs})
+	}
+
+	steps = append(steps, &phase.Func{StepName: "verify-capacity", ExecuteFunc: r.verifyShrink})
+
+	return r.prepareSteps(steps)
+}
+
+// Checks the availability floor can be kept once the scale set is down to
+// its target capacity, and the disruption budget is a valid share of it
+func (r *upgradeRun) checkShrinkTarget(ctx context.Context) error {
+	if r.minHealthy > r.originalCapacity {
+		return fmt.Errorf("--min-healthy %d can't be kept, %s is shrinking to %d instances", r.minHealthy, r.sess.ScaleSetName, r.originalCapacity)
+	}
+
+	if r.maxUnavailable != "" {
+		_, err := parseMaxUnavailable(r.maxUnavailable, r.originalCapacity)
+		return err
+	}
+
+	return nil
+}
+
+// Starts watching the scale set for changes made by others from its
+// capacity ahead of the shrink
+func (r *upgradeRun) startShrink(ctx context.Context) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Shrinking %s from %d to %d instances", r.sess.ScaleSetName, *scaleSet.Sku.Capacity, r.originalCapacity)
+	return r.watchFrom(ctx, *scaleSet.Sku.Capacity)
+}
+
+// Removes the drained victims together, by ID
+func (r *upgradeRun) removeVictims(ctx context.Context) error {
+	victims, err := r.oldInstanceIDs(ctx)
+	if err != nil || len(victims) == 0 {
+		return err
+	}
+
+	log.Infof("Removing %d instances: %s", len(victims), strings.Join(victims, ", "))
+	if err = r.sess.deleteInstances(ctx, victims); err != nil {
+		return err
+	}
+	r.expectedCapacity -= int64(len(victims))
+
+	return nil
+}
+
+// Confirms the scale set ended at its target capacity
+func (r *upgradeRun) verifyShrink(ctx context.Context) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	if capacity := *scaleSet.Sku.Capacity; capacity != r.originalCapacity {
+		return fmt.Errorf("%s has %d instances rather than the %d it was shrunk to", r.sess.ScaleSetName, capacity, r.originalCapacity)
+	}
+
+	log.WithFields(log.Fields{
+		"scaleSet":  r.sess.ScaleSetName,
+		"instances": r.originalCapacity,
+	}).Info("Shrink complete")
+
+	return nil
+}
+
+// RunShrink safely reduces a scale set to --to-capacity, the second half
+// of an upgrade without the first: victims chosen by the --victims policy
+// are drained and removed, within any disruption budget, under the same
+// checks and reporting as an upgrade.
+func RunShrink(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Scale Set Shrink")
+
+	ctx, cancel := upgradeContext(cmd)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	scaleSet, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	target, _ := cmd.Flags().GetInt64("to-capacity")
+	capacity := *scaleSet.Sku.Capacity
+	if target >= capacity {
+		log.Infof("%s already has %d instances, no more than %d, nothing to shrink", sess.ScaleSetName, capacity, target)
+		exitDetailed(cmd, exitNoOp)
+		return
+	}
+
+	policy := cmd.Flags().Lookup("victims").Value.String()
+	window, _ := cmd.Flags().GetDuration("load-window")
+
+	// Load is taken as CPU, unless --removal-order ranks by another metric
+	metrics := loadMetrics[removalOrderCPU]
+	if order := cmd.Flags().Lookup("removal-order").Value.String(); loadMetrics[order] != "" {
+		metrics = loadMetrics[order]
+	}
+
+	victims, err := sess.selectVictims(ctx, policy, capacity-target, metrics, window)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+	log.Infof("Removing %d instances chosen by the %s policy: %s", len(victims), policy, strings.Join(victims, ", "))
+
+	run := newUpgradeRun(sess, cmd)
+	run.strategyName = strategyScaleInOnly
+	run.originalCapacity = target
+	run.retiring = map[string]bool{}
+	for _, id := range victims {
+		run.retiring[id] = true
+	}
+
+	run.finish(run.execute(ctx))
+}
@@ -0,0 +1,110 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const shutdownRetryDelay = 15 * time.Second
+
+// Runs a shutdown script on a single instance until it succeeds or its
+// attempts run out. Each attempt is allowed the timeout, and succeeds when
+// the script does and, if a marker is given, prints it on a line of its
+// own.
+func (s *azureSession) shutdownInstance(ctx context.Context, commandID string, instanceID string, script []string, timeout time.Duration, attempts int, marker string) commandResult {
+	var res commandResult
+
+	for attempt := 1; ; attempt++ {
+		res = s.runCommand(ctx, commandID, instanceID, script, timeout)
+		logCommandResult(res)
+
+		if res.Err == nil && marker != "" && !hasMarkerLine(res.Stdout, marker) {
+			res.Err = fmt.Errorf("shutdown script on instance %s didn't print '%s'", instanceID, marker)
+		}
+		if res.Err == nil || attempt >= attempts {
+			return res
+		}
+
+		log.Warnf("Shutdown of instance %s failed on attempt %d of %d, retrying in %s: %v", instanceID, attempt, attempts, shutdownRetryDelay, res.Err)
+
+		select {
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+			return res
+		case <-time.After(shutdownRetryDelay):
+		}
+	}
+}
+
+// Reports whether output has the marker on a line of its own
+func hasMarkerLine(output string, marker string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == marker {
+			return true
+		}
+	}
+	return false
+}
+
+// Shuts down the workload on each of the given old instances with
+// --shutdown-script via Run Command, concurrently, so it stops cleanly
+// rather than being cut off when the instance is deleted. Each instance is
+// retried up to --shutdown-retries times, and only counts as shut down
+// once the script succeeds and prints --shutdown-success-marker, if given.
+// Fails, leaving the instances in place, if any isn't shut down.
+func (r *upgradeRun) shutdownInstances(ctx context.Context, instanceIDs []string) error {
+	path := r.cmd.Flags().Lookup("shutdown-script").Value.String()
+	if path == "" || len(instanceIDs) == 0 {
+		return nil
+	}
+
+	script, err := loadScript(path)
+	if err != nil {
+		return err
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("shutdown-timeout")
+	retries, _ := r.cmd.Flags().GetInt("shutdown-retries")
+	marker := r.cmd.Flags().Lookup("shutdown-success-marker").Value.String()
+
+	commandID, err := r.sess.getRunCommandID(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Shutting down %d old instances with %s via Run Command...", len(instanceIDs), path)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []commandResult
+
+	for _, instanceID := range instanceIDs {
+		wg.Add(1)
+		go func(instanceID string) {
+			defer wg.Done()
+
+			res := r.sess.shutdownInstance(ctx, commandID, instanceID, script, timeout, retries+1, marker)
+
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(instanceID)
+	}
+
+	wg.Wait()
+
+	failed := failedCommandInstances(results)
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("shutdown failed on %d of %d instances, which were left in place: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+
+	log.Infof("Shut down %d old instances", len(instanceIDs))
+	return nil
+}
@@ -0,0 +1,109 @@
+package deploy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tag on a managed or gallery image version holding its signature
+const imageSignatureTag = "signature"
+
+// Reads a PEM encoded public key, as written by
+// 'openssl pkey -pubout'
+func loadSigningKey(path string) (crypto.PublicKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM encoded public key", path)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// Verifies a signature over an image's lower-case resource ID, as made by
+//
+//	printf %s <image ID> | openssl dgst -sha256 -sign key.pem | base64 -w0
+//
+// with an RSA or ECDSA key, or over the ID itself with an Ed25519 key
+func verifyImageSignature(key crypto.PublicKey, imageID string, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64 encoded: %v", err)
+	}
+
+	message := []byte(strings.ToLower(imageID))
+	digest := sha256.Sum256(message)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			err = fmt.Errorf("ECDSA verification failed")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, sig) {
+			err = fmt.Errorf("Ed25519 verification failed")
+		}
+	default:
+		err = fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	return err
+}
+
+// Refuses to move the model onto an image which isn't signed by the
+// --image-signing-key, if one is given. The signature is read from the
+// image's signature tag, so only managed and gallery images can carry
+// one; an image the model already runs isn't checked again.
+func (r *upgradeRun) checkImageSignature(ctx context.Context) error {
+	path := r.cmd.Flags().Lookup("image-signing-key").Value.String()
+	if path == "" || r.targetImage == nil {
+		return nil
+	}
+
+	key, err := loadSigningKey(path)
+	if err != nil {
+		return fmt.Errorf("unable to load image signing key: %v", err)
+	}
+
+	image := imageReferenceString(r.targetImage)
+	if r.targetImage.ID == nil {
+		return fmt.Errorf("marketplace image %s can't carry a signature, only signed managed or gallery images may be rolled out", image)
+	}
+
+	var resource struct {
+		Tags map[string]string `json:"tags"`
+	}
+	if err = r.sess.armGet(ctx, image, computeAPIVersion, &resource); err != nil {
+		return err
+	}
+
+	signature, ok := resource.Tags[imageSignatureTag]
+	if !ok {
+		return fmt.Errorf("image %s is unsigned, it has no '%s' tag", image, imageSignatureTag)
+	}
+
+	if err = verifyImageSignature(key, image, signature); err != nil {
+		return fmt.Errorf("image %s has an invalid signature: %v", image, err)
+	}
+
+	log.Infof("Image %s is signed by %s", image, path)
+	return nil
+}
@@ -0,0 +1,135 @@
+package deploy
+
+import (
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	"github.com/krarey/azure-cluster-upgrade/vmss/fake"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Phases which depend on networking, capacity or registry APIs that the
+// simulated scale set doesn't model, and so are skipped when simulating.
+var unsimulatedSteps = map[string]bool{
+	"permissions":             true,
+	"service-health":          true,
+	"health-extension":        true,
+	"resource-locks":          true,
+	"lift-delete-locks":       true,
+	"restore-delete-locks":    true,
+	"public-ip-check":         true,
+	"subnet-capacity":         true,
+	"proximity-placement":     true,
+	"policy":                  true,
+	"disk-encryption":         true,
+	"capacity-reservation":    true,
+	"dedicated-hosts":         true,
+	"vulnerability-gate":      true,
+	"vm-size-networking":      true,
+	"image-signature":         true,
+	"verify-networking":       true,
+	"verify-dual-stack":       true,
+	"verify-extensions":       true,
+	"gpu-readiness":           true,
+	"verify-certificates":     true,
+	"verify-identities":       true,
+	"certificates":            true,
+	"smoke-tests":             true,
+	"lb-health":               true,
+	"discovery-register":      true,
+	"warm-up":                 true,
+	"leader-handoff":          true,
+	"carry-disks":             true,
+	"orphaned-resources":      true,
+	"surge-priority":          true,
+	"identity-rotation":       true,
+	"verify-rotated-identity": true,
+	"patch-level-before":      true,
+	"patch-level-after":       true,
+	"retire-identity":         true,
+	"backup":                  true,
+	"discovery-deregister":    true,
+	"model-image":             true,
+	"rollback-image":          true,
+	"patch-image":             true,
+}
+
+// Creates a session against an in-memory scale set whose instances run an
+// outdated model, bar any asked to already be compliant, so the full
+// upgrade can be rehearsed without calling Azure. Failures are injected as
+// configured by the command's flags.
+func newSimulatedSession(cmd *cobra.Command, subscription string, rg string, scaleSetName string, faults *faultInjection) (*azureSession, error) {
+	instances, err := cmd.Flags().GetInt64("simulate-instances")
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands spanning a subscription don't name a scale set
+	if scaleSetName == "" {
+		scaleSetName = "simulated"
+	}
+
+	compliant, err := cmd.Flags().GetInt64("simulate-compliant-instances")
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := parseSelector(cmd.Flags().Lookup("simulate-tags").Value.String())
+	if err != nil {
+		return nil, err
+	}
+
+	scaleSet := fake.NewScaleSet(scaleSetName, "Standard_D2s_v3", instances)
+	for name, value := range tags {
+		scaleSet.Model.Tags[name] = to.StringPtr(value)
+	}
+	scaleSet.MarkModelChanged()
+	for i, instance := range scaleSet.Instances() {
+		if int64(i) < compliant {
+			scaleSet.SetLatestModelApplied(instance.ID, true)
+		}
+	}
+
+	if scaleSet.AllocationFailures, err = cmd.Flags().GetInt("simulate-allocation-failures"); err != nil {
+		return nil, err
+	}
+	if scaleSet.ProvisioningDelay, err = cmd.Flags().GetDuration("simulate-provisioning-delay"); err != nil {
+		return nil, err
+	}
+
+	log.Warnf("Simulating scale set %s with %d instances, no Azure resources will be changed", scaleSetName, instances)
+
+	var authorizer autorest.Authorizer = autorest.NullAuthorizer{}
+
+	sess := &azureSession{
+		SubscriptionID:    subscription,
+		ResourceGroupName: rg,
+		ScaleSetName:      scaleSetName,
+		Authorizer:        &authorizer,
+		ScaleSets:         scaleSet,
+		VMs:               scaleSet.VMs(),
+		Faults:            faults,
+		Simulated:         true,
+	}
+
+	if faults != nil && faults.ThrottleRate > 0 {
+		log.Warn("Throttling is injected into ARM requests, which a simulation doesn't make")
+	}
+	sess.injectFaults()
+
+	return sess, nil
+}
+
+// Drops the phases a simulation can't run
+func simulatedSteps(steps []phase.Step) []phase.Step {
+	var kept []phase.Step
+	for _, step := range steps {
+		if unsimulatedSteps[step.Name()] {
+			log.Infof("Skipping phase %s, which the simulation doesn't model", step.Name())
+			continue
+		}
+		kept = append(kept, step)
+	}
+	return kept
+}
@@ -0,0 +1,396 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	smokeTestPolicyAbort   = "abort"
+	smokeTestPolicyIgnore  = "ignore"
+	smokeTestPolicyReplace = "replace"
+
+	defaultSmokeTestTimeout = 10 * time.Second
+)
+
+// smokeTestSpec is the declarative set of checks every new instance must
+// pass before it is considered healthy. It is read from the 'smokeTests'
+// key of the config file.
+type smokeTestSpec struct {
+	// One of 'abort', 'replace' or 'ignore'
+	Policy string `mapstructure:"policy"`
+	// How many rounds of replacement to attempt under the 'replace' policy
+	MaxReplacements int           `mapstructure:"maxReplacements"`
+	Timeout         time.Duration `mapstructure:"timeout"`
+	HTTP            []httpCheck   `mapstructure:"http"`
+	TCP             []tcpCheck    `mapstructure:"tcp"`
+	Processes       []string      `mapstructure:"processes"`
+	SystemdUnits    []string      `mapstructure:"systemdUnits"`
+}
+
+type httpCheck struct {
+	Name         string `mapstructure:"name"`
+	Scheme       string `mapstructure:"scheme"`
+	Port         int    `mapstructure:"port"`
+	Path         string `mapstructure:"path"`
+	ExpectStatus int    `mapstructure:"expectStatus"`
+}
+
+type tcpCheck struct {
+	Name string `mapstructure:"name"`
+	Port int    `mapstructure:"port"`
+}
+
+// smokeTestResult is the outcome of a single check against a single instance
+type smokeTestResult struct {
+	InstanceID string
+	Test       string
+	Passed     bool
+	Message    string
+}
+
+// Reads the smoke test spec from the config file. Returns nil when no
+// smoke tests are configured.
+func loadSmokeTestSpec() (*smokeTestSpec, error) {
+	if !viper.IsSet("smokeTests") {
+		return nil, nil
+	}
+
+	spec := &smokeTestSpec{
+		Policy:          smokeTestPolicyAbort,
+		MaxReplacements: 1,
+		Timeout:         defaultSmokeTestTimeout,
+	}
+	if err := viper.UnmarshalKey("smokeTests", spec); err != nil {
+		return nil, err
+	}
+
+	switch spec.Policy {
+	case smokeTestPolicyAbort, smokeTestPolicyIgnore, smokeTestPolicyReplace:
+	default:
+		return nil, fmt.Errorf("unknown smoke test policy %q", spec.Policy)
+	}
+
+	return spec, nil
+}
+
+// Checks the spec's guest checks can run on the scale set's OS, given by
+// the Run Command it takes. Windows has no systemd units to check.
+func (spec *smokeTestSpec) checkGuestOS(commandID string) error {
+	if commandID == windowsRunCommandID && len(spec.SystemdUnits) > 0 {
+		return fmt.Errorf("smoke tests check systemd units %s, which Windows instances don't have; check them as processes instead", strings.Join(spec.SystemdUnits, ", "))
+	}
+	return nil
+}
+
+func (c httpCheck) name() string {
+	if c.Name != "" {
+		return "http/" + c.Name
+	}
+	return fmt.Sprintf("http/%d%s", c.Port, c.Path)
+}
+
+func (c tcpCheck) name() string {
+	if c.Name != "" {
+		return "tcp/" + c.Name
+	}
+	return fmt.Sprintf("tcp/%d", c.Port)
+}
+
+// Issues a GET against the instance and compares the response code
+func (c httpCheck) run(ctx context.Context, address string, timeout time.Duration) smokeTestResult {
+	result := smokeTestResult{Test: c.name()}
+
+	scheme, expect := c.Scheme, c.ExpectStatus
+	if scheme == "" {
+		scheme = "http"
+	}
+	if expect == 0 {
+		expect = http.StatusOK
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(address, strconv.Itoa(c.Port)), c.Path)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req.WithContext(ctx))
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	resp.Body.Close()
+
+	result.Passed = resp.StatusCode == expect
+	result.Message = fmt.Sprintf("%s returned %d", url, resp.StatusCode)
+	return result
+}
+
+// Opens (and immediately closes) a TCP connection to the instance
+func (c tcpCheck) run(ctx context.Context, address string, timeout time.Duration) smokeTestResult {
+	result := smokeTestResult{Test: c.name()}
+	target := net.JoinHostPort(address, strconv.Itoa(c.Port))
+
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", target)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	conn.Close()
+
+	result.Passed = true
+	result.Message = fmt.Sprintf("connected to %s", target)
+	return result
+}
+
+// Returns the names of the checks guestScript runs, in order
+func (spec *smokeTestSpec) guestChecks() []string {
+	var checks []string
+	for _, process := range spec.Processes {
+		checks = append(checks, "process/"+process)
+	}
+	for _, unit := range spec.SystemdUnits {
+		checks = append(checks, "systemd/"+unit)
+	}
+	return checks
+}
+
+// Builds a single script which checks every expected process and systemd
+// unit, printing one '<test> ok|failed' line per check. Batching these keeps
+// us to a single Run Command per instance, as the API serializes them anyway.
+// Names are quoted, so they're only ever taken as names.
+func (spec *smokeTestSpec) guestScript(commandID string) []string {
+	var script []string
+
+	for _, process := range spec.Processes {
+		test := "process/" + process
+		if commandID == windowsRunCommandID {
+			script = append(script, fmt.Sprintf("if (Get-Process -Name %s -ErrorAction SilentlyContinue) { %s } else { %s }",
+				quotePowerShell(process), quotePowerShell(test+" ok"), quotePowerShell(test+" failed")))
+			continue
+		}
+		script = append(script, fmt.Sprintf("pgrep -x -- %s >/dev/null && echo %s || echo %s",
+			quoteShell(process), quoteShell(test+" ok"), quoteShell(test+" failed")))
+	}
+
+	for _, unit := range spec.SystemdUnits {
+		test := "systemd/" + unit
+		// Rejected for Windows by checkGuestOS, but fails the check if
+		// it gets this far
+		if commandID == windowsRunCommandID {
+			script = append(script, quotePowerShell(test+" unsupported"))
+			continue
+		}
+		script = append(script, fmt.Sprintf("systemctl is-active --quiet -- %s && echo %s || echo %s",
+			quoteShell(unit), quoteShell(test+" ok"), quoteShell(test+" failed")))
+	}
+
+	return script
+}
+
+// Parses the output of guestScript into a result for each expected check.
+// A check which printed no result fails, as the script didn't get to it.
+func parseGuestResults(instanceID string, stdout string, expected []string) []smokeTestResult {
+	outcomes := map[string]string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(stdout))
+	for scanner.Scan() {
+		// Names may hold spaces, the outcome is the last word
+		line := strings.TrimSpace(scanner.Text())
+		split := strings.LastIndex(line, " ")
+		if split < 0 {
+			continue
+		}
+		outcomes[line[:split]] = line[split+1:]
+	}
+
+	var results []smokeTestResult
+	for _, test := range expected {
+		outcome, ok := outcomes[test]
+		if !ok {
+			outcome = "no result"
+		}
+		results = append(results, smokeTestResult{
+			InstanceID: instanceID,
+			Test:       test,
+			Passed:     outcome == "ok",
+			Message:    outcome,
+		})
+	}
+
+	return results
+}
+
+// Runs every configured check against a single instance
+func (s *azureSession) smokeTestInstance(ctx context.Context, spec *smokeTestSpec, commandID string, instanceID string, runCommandTimeout time.Duration) []smokeTestResult {
+	var results []smokeTestResult
+
+	if len(spec.HTTP) > 0 || len(spec.TCP) > 0 {
+		address, err := s.getInstancePrivateIP(ctx, instanceID)
+		if err != nil {
+			return append(results, smokeTestResult{InstanceID: instanceID, Test: "network", Message: err.Error()})
+		}
+
+		for _, check := range spec.HTTP {
+			result := check.run(ctx, address, spec.Timeout)
+			result.InstanceID = instanceID
+			results = append(results, result)
+		}
+
+		for _, check := range spec.TCP {
+			result := check.run(ctx, address, spec.Timeout)
+			result.InstanceID = instanceID
+			results = append(results, result)
+		}
+	}
+
+	if script := spec.guestScript(commandID); len(script) > 0 {
+		res := s.runCommand(ctx, commandID, instanceID, script, runCommandTimeout)
+		if res.Err != nil {
+			return append(results, smokeTestResult{InstanceID: instanceID, Test: "runcommand", Message: res.Err.Error()})
+		}
+		results = append(results, parseGuestResults(instanceID, res.Stdout, spec.guestChecks())...)
+	}
+
+	return results
+}
+
+// Evaluates the smoke test spec against every new (latest model) instance
+func (s *azureSession) evaluateSmokeTests(ctx context.Context, spec *smokeTestSpec, runCommandTimeout time.Duration) ([]smokeTestResult, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []smokeTestResult
+
+	commandID, err := s.getRunCommandID(ctx)
+	if err != nil {
+		return results, err
+	}
+
+	instanceIDs, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq true")
+	if err != nil {
+		return results, err
+	}
+
+	for _, instanceID := range instanceIDs {
+		wg.Add(1)
+		go func(instanceID string) {
+			defer wg.Done()
+
+			instanceResults := s.smokeTestInstance(ctx, spec, commandID, instanceID, runCommandTimeout)
+
+			mu.Lock()
+			results = append(results, instanceResults...)
+			mu.Unlock()
+		}(instanceID)
+	}
+
+	wg.Wait()
+	return results, nil
+}
+
+// Returns the distinct IDs of instances with at least one failed check
+func failedSmokeTestInstances(results []smokeTestResult) []string {
+	var failed []string
+	seen := map[string]bool{}
+
+	for _, result := range results {
+		if !result.Passed && !seen[result.InstanceID] {
+			seen[result.InstanceID] = true
+			failed = append(failed, result.InstanceID)
+		}
+	}
+
+	return failed
+}
+
+// Logs the per-instance, per-test smoke test summary
+func logSmokeTestSummary(results []smokeTestResult) {
+	log.Info("Smoke test summary:")
+
+	for _, result := range results {
+		entry := log.WithFields(log.Fields{
+			"instance": result.InstanceID,
+			"test":     result.Test,
+			"message":  result.Message,
+		})
+		if result.Passed {
+			entry.Info("PASS")
+		} else {
+			entry.Warn("FAIL")
+		}
+	}
+}
+
+// Deletes the given instances and raises capacity to provision their
+// replacements. Explicit deletes bypass scale-in protection.
+func (s *azureSession) replaceInstances(ctx context.Context, instanceIDs []string) error {
+	client := s.getVMSSClient()
+
+	log.Infof("Replacing %d instances which failed smoke tests...", len(instanceIDs))
+
+	if err := s.deleteInstances(ctx, instanceIDs); err != nil {
+		return err
+	}
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	return s.setVMSSCapacity(ctx, scaleSet, *scaleSet.Sku.Capacity+int64(len(instanceIDs)))
+}
+
+// Runs the smoke test spec against the new instances and applies the
+// configured failure policy. Under the 'replace' policy failed instances
+// are swapped out and the replacements re-tested, up to MaxReplacements
+// times, before giving up.
+func (s *azureSession) smokeTestNewInstances(ctx context.Context, spec *smokeTestSpec, runCommandTimeout time.Duration, diagnosticsDir string) error {
+	for attempt := 0; ; attempt++ {
+		log.Info("Running smoke tests against new instances...")
+
+		results, err := s.evaluateSmokeTests(ctx, spec, runCommandTimeout)
+		if err != nil {
+			return err
+		}
+
+		logSmokeTestSummary(results)
+
+		failed := failedSmokeTestInstances(results)
+		if len(failed) == 0 {
+			return nil
+		}
+
+		switch {
+		case spec.Policy == smokeTestPolicyIgnore:
+			log.Warnf("%d instances failed smoke tests, continuing as policy is '%s'", len(failed), spec.Policy)
+			return nil
+		case spec.Policy == smokeTestPolicyReplace && attempt < spec.MaxReplacements:
+			if err = s.replaceInstances(ctx, failed); err != nil {
+				return err
+			}
+
+			protectFutures, err := s.setVMProtection(ctx, true)
+			if err != nil {
+				return err
+			}
+			if err = s.awaitVMFutures(ctx, protectFutures); err != nil {
+				return err
+			}
+		default:
+			s.reportFailedInstances(failed, diagnosticsDir)
+			return fmt.Errorf("%d instances failed smoke tests: %s", len(failed), strings.Join(failed, ", "))
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// modelSnapshot is a point-in-time export of a scale set model and the
+// instances running it, which can later be restored to roll back.
+type modelSnapshot struct {
+	TakenAt           time.Time                      `json:"takenAt"`
+	SubscriptionID    string                         `json:"subscriptionId"`
+	ResourceGroupName string                         `json:"resourceGroup"`
+	ScaleSetName      string                         `json:"scaleSet"`
+	Model             compute.VirtualMachineScaleSet `json:"model"`
+	Instances         []snapshotInstance             `json:"instances"`
+}
+
+// snapshotInstance is a single instance in a snapshot's inventory
+type snapshotInstance struct {
+	InstanceID         string `json:"instanceId"`
+	Name               string `json:"name"`
+	LatestModelApplied bool   `json:"latestModelApplied"`
+	VMSize             string `json:"vmSize,omitempty"`
+	Image              string `json:"image,omitempty"`
+	ProvisioningState  string `json:"provisioningState,omitempty"`
+}
+
+// Exports the scale set model and its instance inventory
+func (s *azureSession) takeSnapshot(ctx context.Context) (*modelSnapshot, error) {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := s.getVMSSVMClient().List(ctx, s.ResourceGroupName, s.ScaleSetName, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &modelSnapshot{
+		TakenAt:           time.Now().UTC(),
+		SubscriptionID:    s.SubscriptionID,
+		ResourceGroupName: s.ResourceGroupName,
+		ScaleSetName:      s.ScaleSetName,
+		Model:             scaleSet,
+	}
+
+	for _, vm := range vms {
+		instance := snapshotInstance{InstanceID: to.String(vm.InstanceID), Name: to.String(vm.Name)}
+		if vm.Sku != nil {
+			instance.VMSize = to.String(vm.Sku.Name)
+		}
+		if props := vm.VirtualMachineScaleSetVMProperties; props != nil {
+			instance.LatestModelApplied = to.Bool(props.LatestModelApplied)
+			instance.ProvisioningState = to.String(props.ProvisioningState)
+			if props.StorageProfile != nil && props.StorageProfile.ImageReference != nil {
+				instance.Image = imageReferenceString(props.StorageProfile.ImageReference)
+			}
+		}
+		snapshot.Instances = append(snapshot.Instances, instance)
+	}
+
+	return snapshot, nil
+}
+
+// Writes a snapshot to a local file, or to a block blob when given an
+// https:// blob URL.
+func writeSnapshot(ctx context.Context, snapshot *modelSnapshot, dest string) error {
+	contents, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(dest, "https://") {
+		return ioutil.WriteFile(dest, contents, 0644)
+	}
+
+	authorizer, err := newAuthorizerForResource(storageResource)
+	if err != nil {
+		return err
+	}
+
+	return uploadBlob(ctx, authorizer, dest, contents)
+}
+
+// Reads a snapshot from a local file, or from a blob when given an
+// https:// blob URL.
+func readSnapshot(ctx context.Context, src string) (*modelSnapshot, error) {
+	var contents []byte
+	var err error
+
+	if strings.HasPrefix(src, "https://") {
+		authorizer, authErr := newAuthorizerForResource(storageResource)
+		if authErr != nil {
+			return nil, authErr
+		}
+		contents, err = readBlob(ctx, authorizer, src)
+	} else {
+		contents, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &modelSnapshot{}
+	if err = json.Unmarshal(contents, snapshot); err != nil {
+		return nil, fmt.Errorf("unable to parse snapshot %s: %v", src, err)
+	}
+
+	if snapshot.Model.VirtualMachineScaleSetProperties == nil || snapshot.Model.VirtualMachineProfile == nil {
+		return nil, fmt.Errorf("snapshot %s has no scale set model", src)
+	}
+
+	return snapshot, nil
+}
+
+// Converts a scale set's VM profile into the shape accepted by a scale set
+// update. Fields which can't be updated in place are dropped.
+func updateProfile(profile *compute.VirtualMachineScaleSetVMProfile) (*compute.VirtualMachineScaleSetUpdateVMProfile, error) {
+	encoded, err := json.Marshal(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &compute.VirtualMachineScaleSetUpdateVMProfile{}
+	if err = json.Unmarshal(encoded, update); err != nil {
+		return nil, err
+	}
+
+	return update, nil
+}
+
+// Applies a VM profile and VM size to the scale set model, leaving its
+// capacity alone. Existing instances are left untouched until the upgrade
+// replaces them.
+func (s *azureSession) setModelProfile(ctx context.Context, profile *compute.VirtualMachineScaleSetVMProfile, sku *compute.Sku) error {
+	update, err := updateProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	parameters := compute.VirtualMachineScaleSetUpdate{
+		VirtualMachineScaleSetUpdateProperties: &compute.VirtualMachineScaleSetUpdateProperties{
+			VirtualMachineProfile: update,
+		},
+	}
+	if sku != nil {
+		parameters.Sku = &compute.Sku{Name: sku.Name, Tier: sku.Tier}
+	}
+
+	return s.updateModel(ctx, parameters)
+}
+
+// Reports whether the scale set model already matches the snapshot
+func modelMatchesSnapshot(scaleSet compute.VirtualMachineScaleSet, snapshot *modelSnapshot) bool {
+	var currentSize, snapshotSize string
+	if scaleSet.Sku != nil {
+		currentSize = to.String(scaleSet.Sku.Name)
+	}
+	if snapshot.Model.Sku != nil {
+		snapshotSize = to.String(snapshot.Model.Sku.Name)
+	}
+
+	var currentProfile *compute.VirtualMachineScaleSetVMProfile
+	if scaleSet.VirtualMachineScaleSetProperties != nil {
+		currentProfile = scaleSet.VirtualMachineProfile
+	}
+
+	return currentSize == snapshotSize &&
+		len(diffFields("", currentProfile, snapshot.Model.VirtualMachineProfile)) == 0
+}
+
+// Returns a phase which re-applies a snapshot's model to the scale set.
+// Rolling back restores the model in place before the restore.
+func (s *azureSession) restoreModelStep(snapshot *modelSnapshot) phase.Step {
+	var previous *compute.VirtualMachineScaleSet
+
+	return &phase.Func{
+		StepName: "restore-model",
+		ValidateFunc: func(ctx context.Context) error {
+			if !strings.EqualFold(snapshot.ScaleSetName, s.ScaleSetName) {
+				return fmt.Errorf("snapshot was taken of scale set %s, not %s", snapshot.ScaleSetName, s.ScaleSetName)
+			}
+
+			// Resource SKUs aren't simulated
+			if s.Simulated {
+				return nil
+			}
+
+			current, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			size := to.String(current.Sku.Name)
+			if snapshot.Model.Sku != nil {
+				size = to.String(snapshot.Model.Sku.Name)
+			}
+
+			return s.checkVMSizeNetworking(ctx, to.String(current.Location), size, snapshot.Model.VirtualMachineProfile)
+		},
+		ExecuteFunc: func(ctx context.Context) error {
+			current, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+			if err != nil {
+				return err
+			}
+
+			if modelMatchesSnapshot(current, snapshot) {
+				log.Infof("Scale set model already matches the snapshot taken %s", snapshot.TakenAt.Format(time.RFC3339))
+				return nil
+			}
+
+			log.Infof("Restoring scale set model from the snapshot taken %s...", snapshot.TakenAt.Format(time.RFC3339))
+
+			if err = s.setModelProfile(ctx, snapshot.Model.VirtualMachineProfile, snapshot.Model.Sku); err != nil {
+				return err
+			}
+
+			previous = &current
+			return nil
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			if previous == nil || previous.VirtualMachineScaleSetProperties == nil {
+				return nil
+			}
+
+			log.Info("Restoring the scale set model in place before the restore")
+			return s.setModelProfile(ctx, previous.VirtualMachineProfile, previous.Sku)
+		},
+	}
+}
+
+// RunSnapshot exports the scale set model and instance inventory
+func RunSnapshot(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	snapshot, err := sess.takeSnapshot(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	file := cmd.Flags().Lookup("file").Value.String()
+	if err = writeSnapshot(ctx, snapshot, file); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	log.Infof("Wrote snapshot of %s and its %d instances to %s", sess.ScaleSetName, len(snapshot.Instances), file)
+}
+
+// RunRestore re-applies a snapshot's model to the scale set and executes
+// the upgrade operation, rolling every instance back onto it
+func RunRestore(cmd *cobra.Command, args []string) {
+	log.Info("Initializing Cluster Blue/Green Model Restore")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	snapshot, err := readSnapshot(ctx, cmd.Flags().Lookup("snapshot").Value.String())
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	current, err := sess.getVMSSClient().Get(ctx, sess.ResourceGroupName, sess.ScaleSetName)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Once the model matches the snapshot, this is a plain upgrade (or a
+	// re-run of one which may already be complete)
+	if modelMatchesSnapshot(current, snapshot) {
+		log.Infof("Scale set model already matches the snapshot taken %s", snapshot.TakenAt.Format(time.RFC3339))
+		sess.upgrade(ctx, cmd)
+		return
+	}
+
+	sess.upgrade(ctx, cmd, sess.restoreModelStep(snapshot))
+}
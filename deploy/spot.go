@@ -0,0 +1,286 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Priorities --surge-priority can make surged instances, or leave to
+	// the scale set model
+	surgePriorityModel   = "model"
+	surgePriorityRegular = "regular"
+	surgePrioritySpot    = "spot"
+
+	// Only uniform orchestration has the per-instance model, protection
+	// and scale-in the upgrade relies on
+	orchestrationUniform = "Uniform"
+
+	// Eviction rate band of a VM size in a region, such as 0-5 or 20+
+	graphSpotEvictionQuery = `spotresources
+| where type =~ 'microsoft.compute/skuspotevictionrate/location'
+| where location =~ '%s' and sku.name =~ '%s'
+| project evictionRate = tostring(properties.evictionRate)`
+
+	// Latest spot price of a VM size in each zone of a region
+	graphSpotPriceQuery = `spotresources
+| where type =~ 'microsoft.compute/skuspotpricehistory/ostype/location'
+| where location =~ '%s' and sku.name =~ '%s' and properties.osType =~ '%s'
+| mv-expand spotPrice = properties.spotPrices
+| project zone = tostring(spotPrice.availabilityZone), price = todouble(spotPrice.priceHistory[0].priceUSD)`
+)
+
+// surgePriority is the priority the scale set model gives new instances,
+// and how spot instances are evicted and billed
+type surgePriority struct {
+	Priority       string   `json:"priority,omitempty"`
+	EvictionPolicy string   `json:"evictionPolicy,omitempty"`
+	BillingProfile *billing `json:"billingProfile,omitempty"`
+}
+
+type billing struct {
+	MaxPrice *float64 `json:"maxPrice,omitempty"`
+}
+
+// Reports whether the priority makes spot instances
+func (p surgePriority) spot() bool {
+	return strings.EqualFold(p.Priority, "Spot")
+}
+
+// Checks a --max-eviction-rate value is a percentage
+func validateEvictionRate(value string) error {
+	if rate, err := strconv.Atoi(value); err != nil || rate < 0 || rate > 100 {
+		return fmt.Errorf("%s is not a percentage from 0 to 100", value)
+	}
+	return nil
+}
+
+// Returns the upper bound of an eviction rate band in percent, taking the
+// open-ended band, such as 20+, as 100
+func evictionRateBound(band string) (int, error) {
+	if strings.HasSuffix(band, "+") {
+		return 100, nil
+	}
+	parts := strings.Split(band, "-")
+	return strconv.Atoi(strings.TrimSpace(parts[len(parts)-1]))
+}
+
+// Returns the scale set's orchestration mode and the priority its model
+// gives new instances. Orchestration modes postdate the vendored compute
+// SDK.
+func (s *azureSession) modelPriority(ctx context.Context) (string, surgePriority, error) {
+	var scaleSet struct {
+		Properties struct {
+			OrchestrationMode     string        `json:"orchestrationMode"`
+			VirtualMachineProfile surgePriority `json:"virtualMachineProfile"`
+		} `json:"properties"`
+	}
+	if err := s.armGet(ctx, s.scaleSetPath(), newerComputeAPIVersion, &scaleSet); err != nil {
+		return "", surgePriority{}, err
+	}
+
+	mode := scaleSet.Properties.OrchestrationMode
+	if mode == "" {
+		mode = orchestrationUniform
+	}
+	return mode, scaleSet.Properties.VirtualMachineProfile, nil
+}
+
+// Points the scale set model at the priority, clearing the eviction policy
+// and price cap of regular instances, which only spot instances have
+func (s *azureSession) setModelPriority(ctx context.Context, priority surgePriority) error {
+	profile := map[string]interface{}{"priority": priority.Priority, "evictionPolicy": nil, "billingProfile": nil}
+	if priority.EvictionPolicy != "" {
+		profile["evictionPolicy"] = priority.EvictionPolicy
+	}
+	if priority.BillingProfile != nil {
+		profile["billingProfile"] = priority.BillingProfile
+	}
+
+	return s.patchModel(ctx, map[string]interface{}{
+		"properties": map[string]interface{}{"virtualMachineProfile": profile},
+	})
+}
+
+// Returns the eviction rate band of a VM size in a region, and its latest
+// spot price in US dollars in each zone, or under "" for regions without
+// zones. Spot data is only published through Resource Graph.
+func (s *azureSession) spotMarket(ctx context.Context, region string, vmSize string, windows bool) (string, map[string]float64, error) {
+	rows, err := s.queryResourceGraph(ctx, []string{s.SubscriptionID}, fmt.Sprintf(graphSpotEvictionQuery, region, vmSize))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rows) == 0 {
+		return "", nil, fmt.Errorf("no spot eviction rate is published for %s in %s", vmSize, region)
+	}
+
+	var eviction struct {
+		EvictionRate string `json:"evictionRate"`
+	}
+	if err = json.Unmarshal(rows[0], &eviction); err != nil {
+		return "", nil, err
+	}
+
+	osType := "Linux"
+	if windows {
+		osType = "Windows"
+	}
+	if rows, err = s.queryResourceGraph(ctx, []string{s.SubscriptionID}, fmt.Sprintf(graphSpotPriceQuery, region, vmSize, osType)); err != nil {
+		return "", nil, err
+	}
+
+	prices := map[string]float64{}
+	for _, row := range rows {
+		var price struct {
+			Zone  string  `json:"zone"`
+			Price float64 `json:"price"`
+		}
+		if err = json.Unmarshal(row, &price); err != nil {
+			return "", nil, err
+		}
+		prices[price.Zone] = price.Price
+	}
+	if len(prices) == 0 {
+		return "", nil, fmt.Errorf("no spot price is published for %s in %s", vmSize, region)
+	}
+
+	return eviction.EvictionRate, prices, nil
+}
+
+// Checks the scale set is in uniform orchestration, as the surge's
+// priority is chosen through its model, when it's chosen by --spot-surge
+// or --surge-priority, and that only one of them chooses it
+func (r *upgradeRun) checkSurgePriority(ctx context.Context) error {
+	spotSurge, _ := r.cmd.Flags().GetBool("spot-surge")
+	if spotSurge && r.cmd.Flags().Lookup("surge-priority").Value.String() != surgePriorityModel {
+		return fmt.Errorf("--spot-surge chooses the surge's priority itself, so can't be used with --surge-priority")
+	}
+
+	mode, _, err := r.sess.modelPriority(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(mode, orchestrationUniform) {
+		return fmt.Errorf("choosing the surge's priority needs scale set %s to be in uniform orchestration, not %s", r.sess.ScaleSetName, mode)
+	}
+	return nil
+}
+
+// Reports whether the surge should be made up of spot instances: when the
+// VM size's eviction rate in the region is within --max-eviction-rate and
+// its spot price in some zone is below the regular price, from
+// --hourly-price or the retail price. A scale set can't be told which zone
+// to scale out into, so the cheapest zone is only reported.
+func (r *upgradeRun) spotIsWorthIt(ctx context.Context) (bool, error) {
+	maxRate, _ := r.cmd.Flags().GetInt("max-eviction-rate")
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return false, err
+	}
+	vmSize, region, windows := billingOf(scaleSet)
+
+	reason := ""
+	band, prices, err := r.sess.spotMarket(ctx, region, vmSize, windows)
+	if err != nil {
+		reason = fmt.Sprintf("the spot market couldn't be checked: %v", err)
+	}
+
+	if reason == "" {
+		if rate, err := evictionRateBound(band); err != nil || rate > maxRate {
+			reason = fmt.Sprintf("its eviction rate of %s%% exceeds --max-eviction-rate of %d%%", band, maxRate)
+		}
+	}
+
+	zone, spotPrice := "", -1.0
+	for z, price := range prices {
+		if spotPrice < 0 || price < spotPrice {
+			zone, spotPrice = z, price
+		}
+	}
+
+	if reason == "" {
+		regular, _ := r.cmd.Flags().GetFloat64("hourly-price")
+		if regular == 0 {
+			if regular, err = retailHourlyPrice(ctx, region, vmSize, windows, "USD"); err != nil {
+				reason = fmt.Sprintf("its regular price couldn't be looked up: %v", err)
+			}
+		}
+		if reason == "" && spotPrice >= regular {
+			reason = fmt.Sprintf("its spot price of %.4f USD an hour isn't below the regular %.4f USD", spotPrice, regular)
+		}
+	}
+
+	if reason != "" {
+		log.Infof("Surging %s with regular instances of %s, since %s", r.sess.ScaleSetName, vmSize, reason)
+		return false, nil
+	}
+
+	if zone != "" {
+		log.Infof("Surging %s with spot instances of %s, at %.4f USD an hour in zone %s and an eviction rate of %s%%", r.sess.ScaleSetName, vmSize, spotPrice, zone, band)
+	} else {
+		log.Infof("Surging %s with spot instances of %s, at %.4f USD an hour and an eviction rate of %s%%", r.sess.ScaleSetName, vmSize, spotPrice, band)
+	}
+	return true, nil
+}
+
+// Points the scale set model at the priority --surge-priority asks for,
+// or --spot-surge finds cheapest within the eviction bound, so surged
+// instances are made with it. Spot instances are deleted when evicted, and
+// pay no more than the regular price. The priority is part of the model
+// the surged instances run, so it stays with them once they replace the
+// old instances; rolling back restores the previous priority.
+func (r *upgradeRun) setSurgePriority(ctx context.Context) error {
+	_, previous, err := r.sess.modelPriority(ctx)
+	if err != nil {
+		return err
+	}
+
+	spot := r.cmd.Flags().Lookup("surge-priority").Value.String() == surgePrioritySpot
+	if spotSurge, _ := r.cmd.Flags().GetBool("spot-surge"); spotSurge {
+		if spot, err = r.spotIsWorthIt(ctx); err != nil {
+			return err
+		}
+	}
+
+	priority, name := surgePriority{Priority: "Regular"}, surgePriorityRegular
+	if spot {
+		priority = surgePriority{Priority: "Spot", EvictionPolicy: "Delete", BillingProfile: &billing{MaxPrice: to.Float64Ptr(-1)}}
+		name = surgePrioritySpot
+	}
+	if previous.spot() == spot {
+		log.Infof("The model of %s already makes new instances %s", r.sess.ScaleSetName, name)
+		return nil
+	}
+
+	log.Infof("Setting the model of %s to make surged instances %s...", r.sess.ScaleSetName, name)
+	if err = r.sess.setModelPriority(ctx, priority); err != nil {
+		return err
+	}
+	r.previousPriority = &previous
+
+	return nil
+}
+
+// Points the scale set model back at the priority it had before the
+// surge. Safe to call more than once.
+func (r *upgradeRun) restoreSurgePriority(ctx context.Context) error {
+	if r.previousPriority == nil {
+		return nil
+	}
+
+	log.Infof("Restoring the priority of the model of %s...", r.sess.ScaleSetName)
+	if err := r.sess.setModelPriority(ctx, *r.previousPriority); err != nil {
+		log.Errorf("Unable to restore the priority of the model of %s, restore it manually", r.sess.ScaleSetName)
+		return err
+	}
+	r.previousPriority = nil
+
+	return nil
+}
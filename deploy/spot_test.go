@@ -0,0 +1,41 @@
+package deploy
+
+import "testing"
+
+func TestEvictionRateBound(t *testing.T) {
+	for band, want := range map[string]int{
+		"0-5":   5,
+		"5-10":  10,
+		"10-15": 15,
+		"15-20": 20,
+		"20+":   100,
+		"10":    10,
+	} {
+		got, err := evictionRateBound(band)
+		if err != nil {
+			t.Errorf("band %s: %v", band, err)
+		} else if got != want {
+			t.Errorf("band %s: expected %d, got %d", band, want, got)
+		}
+	}
+
+	for _, band := range []string{"", "high", "5-"} {
+		if _, err := evictionRateBound(band); err == nil {
+			t.Errorf("band '%s': expected an error", band)
+		}
+	}
+}
+
+func TestValidateEvictionRate(t *testing.T) {
+	for _, value := range []string{"0", "10", "100"} {
+		if err := validateEvictionRate(value); err != nil {
+			t.Errorf("%s: %v", value, err)
+		}
+	}
+
+	for _, value := range []string{"", "-1", "101", "10%", "ten"} {
+		if err := validateEvictionRate(value); err == nil {
+			t.Errorf("'%s': expected an error", value)
+		}
+	}
+}
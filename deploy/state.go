@@ -0,0 +1,236 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Scale set tags recording an upgrade in progress, so a re-run (e.g. a
+	// CI retry) can tell it isn't starting from scratch.
+	upgradeStateTag    = "azure-cluster-upgrade-state"
+	upgradeCapacityTag = "azure-cluster-upgrade-capacity"
+	upgradeSurgeTag    = "azure-cluster-upgrade-surge"
+	upgradeRunIDTag    = "azure-cluster-upgrade-run-id"
+
+	// Scale set tag recording when the last upgrade completed (RFC 3339)
+	lastUpgradeTag = "azure-cluster-upgrade-last-upgrade"
+	// and the ID of the run which completed it
+	lastRunIDTag = "azure-cluster-upgrade-last-run-id"
+
+	// Scale set tag recording the image the model referenced before the
+	// last image upgrade, so it can be rolled back to.
+	previousImageTag = "azure-cluster-upgrade-previous-image"
+
+	upgradeStateSurging = "surging"
+	// Old instances are being removed, the surge having completed
+	upgradeStateScalingIn = "scaling-in"
+	// The scale set is back at its original capacity, and the upgrade is
+	// tidying up
+	upgradeStateScaledIn = "scaled-in"
+	// A surge held by --strategy=scale-out-only, for finish to scale in
+	upgradeStateSurged = "surged"
+
+	rerunRefuse = "refuse"
+	rerunResume = "resume"
+)
+
+// upgradeState is the progress of an upgrade, as recorded on the scale set
+type upgradeState struct {
+	State            string
+	OriginalCapacity int64
+	// Instances added by the surge. Upgrades recorded before the surge
+	// was sized doubled the scale set.
+	SurgeSize int64
+	// ID of the run which began the upgrade, if recorded
+	RunID string
+}
+
+// Records how far the upgrade has got on the scale set's tags, along with
+// the capacity, surge size and run ID it began with
+func (r *upgradeRun) recordState(ctx context.Context, state string) error {
+	if err := r.sess.setUpgradeState(ctx, &upgradeState{State: state, OriginalCapacity: r.originalCapacity, SurgeSize: r.surgeSize, RunID: r.runID}); err != nil {
+		return err
+	}
+	r.state = state
+	return nil
+}
+
+// Reports whether the surge of the upgrade being resumed had completed, and
+// it had started removing old instances
+func (r *upgradeRun) pastSurge() bool {
+	return r.resuming && (r.state == upgradeStateScalingIn || r.state == upgradeStateScaledIn)
+}
+
+// Reads the upgrade state tags from the scale set. An empty State means no
+// upgrade is in progress.
+func (s *azureSession) getUpgradeState(ctx context.Context) (upgradeState, error) {
+	var state upgradeState
+
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return state, err
+	}
+
+	state.State = to.String(scaleSet.Tags[upgradeStateTag])
+	if state.State == "" {
+		return state, nil
+	}
+	state.RunID = to.String(scaleSet.Tags[upgradeRunIDTag])
+
+	if state.OriginalCapacity, err = strconv.ParseInt(to.String(scaleSet.Tags[upgradeCapacityTag]), 10, 64); err != nil {
+		return state, fmt.Errorf("scale set tag %s is not a valid capacity: %v", upgradeCapacityTag, err)
+	}
+
+	state.SurgeSize = state.OriginalCapacity
+	if surge, ok := scaleSet.Tags[upgradeSurgeTag]; ok {
+		if state.SurgeSize, err = strconv.ParseInt(to.String(surge), 10, 64); err != nil {
+			return state, fmt.Errorf("scale set tag %s is not a valid surge size: %v", upgradeSurgeTag, err)
+		}
+	}
+
+	return state, nil
+}
+
+// Records the upgrade state on the scale set's tags, or removes it when
+// 'state' is nil. Other tags are preserved.
+func (s *azureSession) setUpgradeState(ctx context.Context, state *upgradeState) error {
+	if state == nil {
+		return s.setTags(ctx, map[string]string{upgradeStateTag: "", upgradeCapacityTag: "", upgradeSurgeTag: "", upgradeRunIDTag: ""})
+	}
+
+	return s.setTags(ctx, map[string]string{
+		upgradeStateTag:    state.State,
+		upgradeCapacityTag: strconv.FormatInt(state.OriginalCapacity, 10),
+		upgradeSurgeTag:    strconv.FormatInt(state.SurgeSize, 10),
+		upgradeRunIDTag:    state.RunID,
+	})
+}
+
+// Clears the upgrade state and records when the upgrade completed, and the
+// ID of the run which completed it
+func (s *azureSession) completeUpgradeState(ctx context.Context, runID string) error {
+	return s.setTags(ctx, map[string]string{
+		upgradeStateTag:    "",
+		upgradeCapacityTag: "",
+		upgradeSurgeTag:    "",
+		upgradeRunIDTag:    "",
+		lastUpgradeTag:     time.Now().UTC().Format(time.RFC3339),
+		lastRunIDTag:       runID,
+	})
+}
+
+// Returns the value of a single scale set tag, or "" if it isn't set
+func (s *azureSession) getTag(ctx context.Context, name string) (string, error) {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return "", err
+	}
+
+	return to.String(scaleSet.Tags[name]), nil
+}
+
+// Merges the given tags into the scale set's tags, removing any given an
+// empty value. Skips the update when nothing would change. The update is
+// conditional on the scale set's ETag, so tags written concurrently by
+// others are merged with rather than overwritten.
+func (s *azureSession) setTags(ctx context.Context, changes map[string]string) error {
+	client := s.getVMSSClient()
+
+	return retryOnConflict("scale set "+s.ScaleSetName+" tags", func() error {
+		scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+		if err != nil {
+			return err
+		}
+
+		tags := scaleSet.Tags
+		if tags == nil {
+			tags = map[string]*string{}
+		}
+
+		changed := false
+		for name, value := range changes {
+			current, ok := tags[name]
+			switch {
+			case value == "" && ok:
+				delete(tags, name)
+				changed = true
+			case value != "" && (!ok || to.String(current) != value):
+				tags[name] = to.StringPtr(value)
+				changed = true
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+
+		future, err := client.Update(withIfMatch(ctx, etagOf(scaleSet.Response)), s.ResourceGroupName, s.ScaleSetName, compute.VirtualMachineScaleSetUpdate{Tags: tags})
+		if err != nil {
+			return err
+		}
+
+		return future.Wait(ctx)
+	})
+}
+
+// Decides how to treat a scale set which may already be part way through,
+// or done with, an upgrade. Returns false when there is nothing to do.
+//
+// An upgrade left in progress is refused unless 'onRerun' asks to resume
+// it, in which case the run picks up the capacity, surge size and run ID
+// recorded when it began.
+// When the model isn't about to change and every instance already runs
+// it, the upgrade has already completed.
+func (r *upgradeRun) detectRerun(ctx context.Context, onRerun string, modelChanging bool) (bool, error) {
+	state, err := r.sess.getUpgradeState(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if state.State != "" {
+		switch onRerun {
+		case rerunResume:
+			log.Infof("Resuming upgrade left in state '%s', original capacity %d", state.State, state.OriginalCapacity)
+			r.resuming = true
+			r.state = state.State
+			r.originalCapacity = state.OriginalCapacity
+			r.surgeSize = state.SurgeSize
+			if state.RunID != "" {
+				log.Infof("Continuing run %s", state.RunID)
+				r.setRunID(state.RunID)
+			}
+			return true, nil
+		case rerunRefuse:
+			if state.State == upgradeStateSurged {
+				return false, fmt.Errorf("a scale-out-only upgrade of %s is holding its surge of %d instances; run finish to remove the old instances", r.sess.ScaleSetName, state.SurgeSize)
+			}
+			return false, fmt.Errorf("an upgrade of %s is already in progress (state '%s', original capacity %d), re-run with --on-rerun=resume to continue it",
+				r.sess.ScaleSetName, state.State, state.OriginalCapacity)
+		default:
+			return false, fmt.Errorf("unknown --on-rerun behaviour '%s', expected %s or %s", onRerun, rerunRefuse, rerunResume)
+		}
+	}
+
+	if modelChanging {
+		return true, nil
+	}
+
+	stale, err := r.sess.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+	if err != nil {
+		return false, err
+	}
+
+	if len(stale) == 0 {
+		log.Infof("Every instance of %s already runs the latest model, nothing to upgrade", r.sess.ScaleSetName)
+		return false, nil
+	}
+
+	return true, nil
+}
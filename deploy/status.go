@@ -0,0 +1,265 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Activity log API, which records every write to the scale set
+	activityLogAPIVersion = "2015-04-01"
+
+	// The activity log only keeps events this long
+	activityLogRetention = 90 * 24 * time.Hour
+)
+
+// statusReport is the current state of a scale set and its upgrades
+type statusReport struct {
+	ResourceGroup    string   `json:"resourceGroup"`
+	ScaleSet         string   `json:"scaleSet"`
+	Location         string   `json:"location"`
+	Capacity         int64    `json:"capacity"`
+	Stale            int      `json:"stale"`
+	ModelImage       string   `json:"modelImage,omitempty"`
+	IPFamilies       []string `json:"ipFamilies,omitempty"`
+	UpgradeState     string   `json:"upgradeState,omitempty"`
+	OriginalCapacity int64    `json:"originalCapacity,omitempty"`
+	SurgeSize        int64    `json:"surgeSize,omitempty"`
+	RunID            string   `json:"runID,omitempty"`
+	LastUpgrade      string   `json:"lastUpgrade,omitempty"`
+	LastRunID        string   `json:"lastRunID,omitempty"`
+	PreviousImage    string   `json:"previousImage,omitempty"`
+}
+
+// activityEvent is a single operation on the scale set from the activity log
+type activityEvent struct {
+	Time          time.Time `json:"time"`
+	Operation     string    `json:"operation"`
+	Status        string    `json:"status"`
+	Caller        string    `json:"caller,omitempty"`
+	CorrelationID string    `json:"correlationId"`
+}
+
+// Reads the scale set's capacity, drift and recorded upgrade state
+func (s *azureSession) getStatus(ctx context.Context) (*statusReport, error) {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := s.getUpgradeState(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stale, err := s.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &statusReport{
+		ResourceGroup: s.ResourceGroupName,
+		ScaleSet:      s.ScaleSetName,
+		Location:      to.String(scaleSet.Location),
+		Capacity:      to.Int64(scaleSet.Sku.Capacity),
+		Stale:         len(stale),
+		UpgradeState:  state.State,
+		LastUpgrade:   to.String(scaleSet.Tags[lastUpgradeTag]),
+		LastRunID:     to.String(scaleSet.Tags[lastRunIDTag]),
+		PreviousImage: to.String(scaleSet.Tags[previousImageTag]),
+		IPFamilies:    modelIPFamilies(scaleSet),
+	}
+
+	if state.State != "" {
+		report.OriginalCapacity, report.SurgeSize, report.RunID = state.OriginalCapacity, state.SurgeSize, state.RunID
+	}
+
+	if props := scaleSet.VirtualMachineScaleSetProperties; props != nil && props.VirtualMachineProfile != nil &&
+		props.VirtualMachineProfile.StorageProfile != nil && props.VirtualMachineProfile.StorageProfile.ImageReference != nil {
+		report.ModelImage = imageReferenceString(props.VirtualMachineProfile.StorageProfile.ImageReference)
+	}
+
+	return report, nil
+}
+
+// Lists the completed writes to the scale set recorded in the activity log
+// since the given time, oldest first. Operations still in flight and
+// their intermediate events are left out.
+func (s *azureSession) getActivity(ctx context.Context, since time.Time) ([]activityEvent, error) {
+	events := []activityEvent{}
+
+	var logged []struct {
+		EventTimestamp time.Time `json:"eventTimestamp"`
+		Caller         string    `json:"caller"`
+		CorrelationID  string    `json:"correlationId"`
+		OperationName  struct {
+			Value string `json:"value"`
+		} `json:"operationName"`
+		Status struct {
+			Value string `json:"value"`
+		} `json:"status"`
+	}
+
+	path := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Insights/eventtypes/management/values", s.SubscriptionID)
+	query := map[string]interface{}{
+		"api-version": activityLogAPIVersion,
+		"$filter": fmt.Sprintf("eventTimestamp ge '%s' and eventTimestamp le '%s' and resourceUri eq '%s'",
+			since.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339), s.scaleSetPath()),
+	}
+
+	if err := s.armList(ctx, path, query, &logged); err != nil {
+		return events, err
+	}
+
+	for _, event := range logged {
+		if event.Status.Value != "Succeeded" && event.Status.Value != "Failed" {
+			continue
+		}
+		events = append(events, activityEvent{
+			Time:          event.EventTimestamp,
+			Operation:     event.OperationName.Value,
+			Status:        event.Status.Value,
+			Caller:        event.Caller,
+			CorrelationID: event.CorrelationID,
+		})
+	}
+
+	// The activity log lists newest first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
+
+// Prints a status report as text
+func printStatus(report *statusReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Scale set:\t%s/%s (%s)\n", report.ResourceGroup, report.ScaleSet, report.Location)
+	fmt.Fprintf(w, "Capacity:\t%d\n", report.Capacity)
+	fmt.Fprintf(w, "Outdated instances:\t%d\n", report.Stale)
+	fmt.Fprintf(w, "Model image:\t%s\n", orNone(report.ModelImage))
+	fmt.Fprintf(w, "IP families:\t%s\n", orNone(strings.Join(report.IPFamilies, ", ")))
+	if report.UpgradeState != "" {
+		fmt.Fprintf(w, "Upgrade in progress:\t%s, original capacity %d, surge of %d\n", report.UpgradeState, report.OriginalCapacity, report.SurgeSize)
+		fmt.Fprintf(w, "Run ID:\t%s\n", orNone(report.RunID))
+	} else {
+		fmt.Fprintf(w, "Upgrade in progress:\t(none)\n")
+	}
+	fmt.Fprintf(w, "Last upgrade:\t%s\n", orNone(report.LastUpgrade))
+	fmt.Fprintf(w, "Last run ID:\t%s\n", orNone(report.LastRunID))
+	fmt.Fprintf(w, "Previous image:\t%s\n", orNone(report.PreviousImage))
+	w.Flush()
+}
+
+// RunStatus reports the scale set's capacity, how many instances run an
+// outdated model, and any upgrade in progress. Nothing is modified.
+func RunStatus(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	report, err := sess.getStatus(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		if err = printJSON(report); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+		return
+	}
+	printStatus(report)
+}
+
+// RunHistory lists the operations recorded against the scale set in the
+// activity log, along with the upgrade history kept on its tags
+func RunHistory(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	since, _ := cmd.Flags().GetDuration("since")
+	if since <= 0 || since > activityLogRetention {
+		log.Fatal(fmt.Errorf("--since must be between 0 and %s, the activity log's retention", activityLogRetention))
+		os.Exit(1)
+	}
+
+	sess, err := newSessionFromFlags(ctx, cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	report, err := sess.getStatus(ctx)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	events := []activityEvent{}
+	if sess.Simulated {
+		log.Warn("The simulated scale set has no activity log")
+	} else if events, err = sess.getActivity(ctx, time.Now().Add(-since)); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	if format == outputJSON {
+		err = printJSON(struct {
+			LastUpgrade   string          `json:"lastUpgrade,omitempty"`
+			LastRunID     string          `json:"lastRunID,omitempty"`
+			PreviousImage string          `json:"previousImage,omitempty"`
+			UpgradeState  string          `json:"upgradeState,omitempty"`
+			RunID         string          `json:"runID,omitempty"`
+			Events        []activityEvent `json:"events"`
+		}{report.LastUpgrade, report.LastRunID, report.PreviousImage, report.UpgradeState, report.RunID, events})
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("Last upgrade: %s (run %s)\n", orNone(report.LastUpgrade), orNone(report.LastRunID))
+	fmt.Printf("Previous image: %s\n", orNone(report.PreviousImage))
+	if report.UpgradeState != "" {
+		fmt.Printf("Upgrade in progress: %s (run %s)\n", report.UpgradeState, orNone(report.RunID))
+	}
+	fmt.Println()
+
+	// Operations of an upgrade are correlated by its run ID
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tOPERATION\tSTATUS\tCALLER\tCORRELATION ID")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", event.Time.Format(time.RFC3339), event.Operation, event.Status, orNone(event.Caller), event.CorrelationID)
+	}
+	w.Flush()
+}
@@ -0,0 +1,830 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// upgradeRun carries the options of a single upgrade, along with the state
+// its phases hand on to one another.
+type upgradeRun struct {
+	sess  *azureSession
+	cmd   *cobra.Command
+	runID string
+
+	diagnosticsDir   string
+	maxUnavailable   string
+	minHealthy       int64
+	onExternalChange string
+	smokeTests       *smokeTestSpec
+	discovery        *discoverySpec
+	leaderSpec       *leaderSpec
+
+	resuming         bool
+	modelChanging    bool
+	upToDate         bool
+	originalCapacity int64
+	surgeSize        int64
+
+	// Upgrade state last recorded on the scale set, or resumed from
+	state string
+
+	// The image the model is being moved onto, if any
+	targetImage *compute.ImageReference
+
+	// Instances being recycled regardless of their model, nil when
+	// upgrading onto the latest model
+	retiring map[string]bool
+
+	// Set once the surge completes, to detect changes made by others
+	watching         bool
+	expectedCapacity int64
+	baselineModel    string
+
+	reservations      []reservationExpansion
+	surgeHosts        []surgeHost
+	originalInstances []string
+	registry          discoveryBackend
+	leader            leaderBackend
+	events            eventPublisher
+	announced         bool
+	changes           changeRecorder
+	changeID          string
+	phaseNames        []string
+	phaseResults      []phaseResult
+	phase             phaseTracker
+	oldInstanceIPs    map[string]string
+	liftedLocks       []managementLock
+	diskSnapshots     []string
+	recoveryPoints    []string
+
+	// Load of each instance by --removal-order, read once removal starts
+	removalLoads map[string]float64
+
+	// Resources of old instances recorded ahead of their removal, and
+	// those found left behind, or deleted if asked to
+	removedResources []string
+	orphans          []string
+	orphansDeleted   bool
+
+	// What the surge's added capacity consumed and cost, and the surge
+	// instances tagged with their cost center
+	surgeMeter       surgeMeter
+	cost             *surgeCost
+	costCenterTagged []string
+
+	// The model's priority before the surge changed it, to be restored on
+	// rollback
+	previousPriority *surgePriority
+
+	// The user-assigned identity being swapped for another, if any
+	rotation *identityRotation
+
+	// The registered strategy moving instances onto the model in place of
+	// the blue/green surge, if chosen, and the steps it planned
+	strategyName  string
+	strategy      Strategy
+	strategySteps []string
+
+	// Patch levels of the replaced and new instances, with --patch-report
+	patchBefore *patchSummary
+	patchAfter  *patchSummary
+
+	// The scale set's automatic repairs policy, if repairs are on, and
+	// whether they're suspended for the upgrade
+	repairs          *compute.AutomaticRepairsPolicy
+	repairsSuspended bool
+
+	// Pauses, aborts and approvals from outside, e.g. Slack, if any
+	control *runControl
+	// Watches the health of instances the upgrade hasn't touched, if asked to
+	healthWatch *healthWatcher
+
+	// Region of the scale set and when Service Health was last checked
+	region                 string
+	serviceHealthCheckedAt time.Time
+
+	// Set once an emergency stop was first checked for
+	stopChecked bool
+
+	// Set when finishing an upgrade whose surge was held by
+	// --strategy=scale-out-only
+	finishing bool
+}
+
+func newUpgradeRun(s *azureSession, cmd *cobra.Command) *upgradeRun {
+	minHealthy, _ := cmd.Flags().GetInt64("min-healthy")
+	strategyName, strategy := strategyFromFlags(cmd)
+
+	return &upgradeRun{
+		sess:             s,
+		cmd:              cmd,
+		runID:            s.RunID,
+		diagnosticsDir:   cmd.Flags().Lookup("diagnostics-dir").Value.String(),
+		maxUnavailable:   cmd.Flags().Lookup("max-unavailable").Value.String(),
+		minHealthy:       minHealthy,
+		onExternalChange: cmd.Flags().Lookup("on-external-change").Value.String(),
+		rotation:         identityRotationFromFlags(cmd),
+		strategyName:     strategyName,
+		strategy:         strategy,
+	}
+}
+
+// Returns the ordered phases of the upgrade. Any extra steps are run
+// after the preflight checks, immediately ahead of the surge, or of the
+// registered strategy chosen in its place.
+//
+// A resumed upgrade skips the checks and reservations made for the surge,
+// since the interrupted run already got past them.
+func (r *upgradeRun) steps(extra ...phase.Step) []phase.Step {
+	for _, step := range extra {
+		if image, ok := step.(imagePhase); ok {
+			r.targetImage = image.image
+		}
+	}
+
+	if r.finishing {
+		return r.finishSteps()
+	}
+	if r.strategyName == strategyScaleInOnly {
+		return r.shrinkSteps()
+	}
+
+	steps := []phase.Step{
+		&phase.Func{StepName: "permissions", ValidateFunc: r.sess.preflightPermissions},
+		&phase.Func{StepName: "resource-locks", ValidateFunc: r.checkLocks},
+		&phase.Func{StepName: "load-specs", ValidateFunc: r.loadSpecs},
+		&phase.Func{StepName: "plan", ValidateFunc: r.plan},
+		&phase.Func{StepName: "service-health", ValidateFunc: r.checkServiceHealth},
+		&phase.Func{StepName: "repairs", ValidateFunc: r.checkRepairs},
+	}
+
+	suspendRepairs, _ := r.cmd.Flags().GetBool("suspend-repairs")
+
+	if r.resuming {
+		log.Warn("Capacity reservations and dedicated hosts added by the interrupted run are not tracked, release them manually")
+		if suspendRepairs {
+			log.Warn("Automatic repairs suspended by the interrupted run are not tracked, turn them back on manually")
+		}
+	} else {
+		steps = append(steps,
+			&phase.Func{StepName: "change-rate", ValidateFunc: r.checkChangeRate},
+			&phase.Func{StepName: "public-ip-check", ValidateFunc: r.checkPublicIPs},
+			&phase.Func{StepName: "subnet-capacity", ValidateFunc: r.checkSubnetCapacity},
+			&phase.Func{StepName: "proximity-placement", ValidateFunc: r.sess.preflightProximityPlacementGroup},
+			&phase.Func{StepName: "policy", ValidateFunc: r.checkPolicy},
+			&phase.Func{StepName: "vm-size-networking", ValidateFunc: r.checkVMSizeNetworking},
+			&phase.Func{StepName: "vulnerability-gate", ValidateFunc: r.checkVulnerabilities},
+			&phase.Func{StepName: "image-signature", ValidateFunc: r.checkImageSignature},
+			&phase.Func{StepName: "disk-encryption", ValidateFunc: r.sess.preflightDiskEncryption},
+			&phase.Func{StepName: "backup", ExecuteFunc: r.checkBackups},
+			&phase.Func{StepName: "capacity-reservation", ExecuteFunc: r.reserveCapacity, RollbackFunc: r.releaseReservations},
+			&phase.Func{StepName: "dedicated-hosts", ExecuteFunc: r.reserveHosts, RollbackFunc: r.releaseHosts},
+		)
+	}
+
+	// The health extension and terminate notification ride along with any
+	// other model change
+	steps = append(steps, r.healthExtensionStep())
+	if notice, _ := r.cmd.Flags().GetDuration("terminate-notification"); notice > 0 {
+		steps = append(steps, r.terminateNotificationStep(notice))
+	}
+	if r.rotation != nil {
+		steps = append(steps, &phase.Func{StepName: "identity-rotation", ValidateFunc: r.checkIdentityRotation, ExecuteFunc: r.addRotatedIdentity, RollbackFunc: r.removeRotatedIdentity})
+	}
+
+	steps = append(steps, extra...)
+
+	// Delete locks are lifted ahead of the surge, so a rollback can still
+	// remove surged instances before they're restored
+	liftLocks, _ := r.cmd.Flags().GetBool("lift-delete-locks")
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "lift-delete-locks", ExecuteFunc: r.liftLocks, RollbackFunc: r.restoreLocks})
+	}
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "suspend-repairs", ExecuteFunc: r.suspendRepairs, RollbackFunc: r.resumeRepairs})
+	}
+
+	if r.strategy != nil {
+		return r.prepareSteps(r.strategyPhases(steps, liftLocks, suspendRepairs))
+	}
+
+	spotSurge, _ := r.cmd.Flags().GetBool("spot-surge")
+	surgePriority := spotSurge || r.cmd.Flags().Lookup("surge-priority").Value.String() != surgePriorityModel
+	if surgePriority {
+		steps = append(steps, &phase.Func{StepName: "surge-priority", ValidateFunc: r.checkSurgePriority, ExecuteFunc: r.setSurgePriority, RollbackFunc: r.restoreSurgePriority})
+	}
+
+	steps = append(steps,
+		&phase.Func{StepName: "patch-level-before", ExecuteFunc: r.patchLevelBefore},
+		&phase.Func{StepName: "surge", ExecuteFunc: r.surge, RollbackFunc: r.rollbackSurge},
+		&phase.Func{StepName: "protect", ExecuteFunc: r.protect, RollbackFunc: r.unprotect},
+	)
+	steps = append(steps, r.gateSteps()...)
+	steps = append(steps, &phase.Func{StepName: "patch-level-after", ExecuteFunc: r.patchLevelAfter})
+
+	// A scale-out-only upgrade holds the surge once it passes the gates,
+	// leaving the old instances for something else to retire, or finish
+	// to remove
+	if r.strategyName == strategyScaleOutOnly {
+		if liftLocks {
+			steps = append(steps, &phase.Func{StepName: "restore-delete-locks", ExecuteFunc: r.restoreLocks})
+		}
+		if suspendRepairs {
+			steps = append(steps, &phase.Func{StepName: "resume-repairs", ExecuteFunc: r.resumeRepairs})
+		}
+		steps = append(steps, &phase.Func{StepName: "hold-surge", ValidateFunc: r.checkScaleOutOnly, ExecuteFunc: r.holdSurge})
+	} else {
+		steps = append(steps, r.removalSteps(liftLocks, suspendRepairs)...)
+	}
+
+	// Every phase after the surge first checks nothing else has changed
+	// the scale set underneath the upgrade
+	for i := len(steps) - 1; i >= 0 && steps[i].Name() != "surge"; i-- {
+		steps[i] = watchedStep{steps[i], r}
+	}
+
+	return r.prepareSteps(steps)
+}
+
+// Returns the phases removing the old instances once the new ones pass the
+// gates, then tidying up after the upgrade. Delete locks lifted and
+// repairs suspended for the upgrade are restored once the old instances
+// are gone. The first phase removing old instances commits the upgrade,
+// since rolling back the surge from there on would remove the new
+// instances which replaced them.
+func (r *upgradeRun) removalSteps(liftLocks bool, suspendRepairs bool) []phase.Step {
+	warmUpSteps, _ := r.cmd.Flags().GetInt("warm-up-steps")
+	steps := []phase.Step{
+		&phase.Func{StepName: "warm-up", ExecuteFunc: r.warmUp, Commit: warmUpSteps > 1},
+		&phase.Func{StepName: "leader-handoff", ExecuteFunc: r.leaderHandoff},
+	}
+
+	// Under a disruption budget or availability floor, old instances are
+	// drained and removed a batch at a time rather than all at once.
+	// Recycled instances run the latest model just like the new ones, so
+	// scale-in protection can't tell them apart and they're always removed
+	// by ID.
+	if r.maxUnavailable != "" || r.minHealthy != 0 || r.retiring != nil {
+		steps = append(steps, &phase.Func{
+			StepName:     "budgeted-scale-in",
+			ValidateFunc: r.validateAvailabilityFloor,
+			ExecuteFunc:  r.budgetedScaleIn,
+			Commit:       true,
+		})
+	} else {
+		steps = append(steps, &phase.Func{StepName: "drain", ExecuteFunc: r.drain})
+	}
+
+	steps = append(steps,
+		&phase.Func{StepName: "carry-disks", ValidateFunc: r.checkCarryDisks, ExecuteFunc: r.carryDataDisks},
+		&phase.Func{StepName: "scale-in", ExecuteFunc: r.scaleIn, Commit: true},
+		&phase.Func{StepName: "orphaned-resources", ExecuteFunc: r.cleanOrphans},
+	)
+	if r.rotation != nil {
+		steps = append(steps, &phase.Func{StepName: "retire-identity", ExecuteFunc: r.retireIdentity})
+	}
+
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "restore-delete-locks", ExecuteFunc: r.restoreLocks})
+	}
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "resume-repairs", ExecuteFunc: r.resumeRepairs})
+	}
+
+	return append(steps,
+		&phase.Func{StepName: "unprotect", ExecuteFunc: r.unprotect},
+		&phase.Func{StepName: "release-capacity", ExecuteFunc: r.releaseCapacity},
+		&phase.Func{StepName: "discovery-deregister", ExecuteFunc: r.awaitDeregistration},
+		&phase.Func{StepName: "clear-state", ExecuteFunc: r.clearState},
+		&phase.Func{StepName: "verify", ExecuteFunc: r.sess.verifyUpgrade},
+	)
+}
+
+// Returns the gates new instances must pass before any old instance is
+// removed
+func (r *upgradeRun) gateSteps() []phase.Step {
+	gates := []phase.Step{
+		&phase.Func{StepName: "verify-networking", ExecuteFunc: r.sess.verifyNewInstanceNetworking},
+		&phase.Func{StepName: "verify-dual-stack", ExecuteFunc: r.verifyDualStack},
+		&phase.Func{StepName: "verify-extensions", ExecuteFunc: r.verifyExtensions},
+		&phase.Func{StepName: "gpu-readiness", ExecuteFunc: r.gpuReadiness},
+		&phase.Func{StepName: "verify-certificates", ExecuteFunc: r.verifyCertificates},
+		&phase.Func{StepName: "verify-identities", ExecuteFunc: r.verifyIdentities},
+	}
+	if r.rotation != nil {
+		gates = append(gates, &phase.Func{StepName: "verify-rotated-identity", ExecuteFunc: r.verifyRotatedIdentity})
+	}
+
+	return append(gates,
+		&phase.Func{StepName: "smoke-test-script", ExecuteFunc: r.smokeTestScript},
+		&phase.Func{StepName: "smoke-tests", ExecuteFunc: r.smokeTest},
+		&phase.Func{StepName: "lb-health", ExecuteFunc: r.lbHealth},
+		&phase.Func{StepName: "discovery-register", ExecuteFunc: r.awaitRegistration},
+		&phase.Func{StepName: "verify-terminate-notification", ExecuteFunc: r.verifyTerminateNotification},
+	)
+}
+
+// Records the names of the upgrade's phases and has each publish its
+// progress, leaving out those a simulation doesn't model
+func (r *upgradeRun) prepareSteps(steps []phase.Step) []phase.Step {
+	r.phaseNames = make([]string, len(steps))
+	for i := range steps {
+		r.phaseNames[i] = steps[i].Name()
+		steps[i] = publishedStep{steps[i], r}
+	}
+
+	if r.sess.Simulated {
+		return simulatedSteps(steps)
+	}
+
+	return steps
+}
+
+// Public IP changes are only worth a warning, never a failed preflight
+func (r *upgradeRun) checkPublicIPs(ctx context.Context) error {
+	if err := r.sess.warnPublicIPChanges(ctx); err != nil {
+		log.Warnf("Unable to check for public IP changes: %v", err)
+	}
+	return nil
+}
+
+// Parses the smoke test, verification, discovery, cluster leader, event
+// and change management specs, so a bad config fails the upgrade before
+// anything is changed.
+func (r *upgradeRun) loadSpecs(ctx context.Context) error {
+	var err error
+
+	if r.onExternalChange != externalChangeAbort && r.onExternalChange != externalChangeReconcile {
+		return fmt.Errorf("unknown --on-external-change behaviour '%s', expected %s or %s", r.onExternalChange, externalChangeAbort, externalChangeReconcile)
+	}
+
+	if r.smokeTests, err = loadSmokeTestSpec(); err != nil {
+		return err
+	}
+
+	if r.smokeTests != nil && len(r.smokeTests.SystemdUnits) > 0 {
+		commandID, err := r.sess.getRunCommandID(ctx)
+		if err != nil {
+			return err
+		}
+		if err = r.smokeTests.checkGuestOS(commandID); err != nil {
+			return err
+		}
+	}
+
+	if _, err = loadVerificationSpec(); err != nil {
+		return err
+	}
+
+	if r.discovery, err = loadDiscoverySpec(); err != nil {
+		return err
+	}
+
+	if r.discovery != nil {
+		if r.registry, err = r.sess.newDiscoveryBackend(ctx, r.discovery); err != nil {
+			return err
+		}
+	}
+
+	if r.leaderSpec, err = loadLeaderSpec(); err != nil {
+		return err
+	}
+
+	if r.leaderSpec != nil {
+		timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+		if r.leader, err = r.sess.newLeaderBackend(ctx, r.leaderSpec, timeout); err != nil {
+			return err
+		}
+	}
+
+	events, err := loadEventSpec()
+	if err != nil {
+		return err
+	}
+
+	if events != nil {
+		if r.events, err = newEventPublisher(ctx, events); err != nil {
+			return err
+		}
+	}
+
+	changes, err := loadChangeSpec()
+	if err != nil || changes == nil {
+		return err
+	}
+
+	r.changes, err = newChangeRecorder(ctx, changes)
+	return err
+}
+
+// Works out how many instances the surge adds: one for each instance
+// which doesn't already run the latest model, so instances left compliant
+// by an earlier, partial upgrade aren't churned. Once the model is about
+// to change, every instance will be outdated, and when recycling, one is
+// added for each recycled instance. A resumed upgrade surges by the size
+// recorded when it began.
+func (r *upgradeRun) plan(ctx context.Context) error {
+	if r.resuming {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	capacity := *scaleSet.Sku.Capacity
+
+	if r.modelChanging {
+		r.surgeSize = capacity
+		return nil
+	}
+
+	if r.retiring != nil {
+		r.surgeSize = int64(len(r.retiring))
+		return nil
+	}
+
+	stale, err := r.sess.getInstanceIDs(ctx, "properties/latestModelApplied eq false")
+	if err != nil {
+		return err
+	}
+	r.surgeSize = int64(len(stale))
+
+	if compliant := capacity - r.surgeSize; compliant > 0 {
+		log.Infof("%d of %d instances already run the latest model and will be kept, surging by %d", compliant, capacity, r.surgeSize)
+	}
+
+	return nil
+}
+
+// A changing model is checked against Azure Policy by the step changing
+// it, since only that step knows what the model will become
+func (r *upgradeRun) checkPolicy(ctx context.Context) error {
+	if r.modelChanging {
+		return nil
+	}
+	return r.sess.preflightPolicy(ctx, nil)
+}
+
+// As with Azure Policy, a changing model's size is checked by the step
+// changing it
+func (r *upgradeRun) checkVMSizeNetworking(ctx context.Context) error {
+	if r.modelChanging {
+		return nil
+	}
+	return r.sess.preflightVMSizeNetworking(ctx)
+}
+
+func (r *upgradeRun) checkSubnetCapacity(ctx context.Context) error {
+	return r.sess.preflightSubnetCapacity(ctx, r.surgeSize)
+}
+
+func (r *upgradeRun) reserveCapacity(ctx context.Context) error {
+	var err error
+	reserveSurge, _ := r.cmd.Flags().GetBool("reserve-surge-capacity")
+	r.reservations, err = r.sess.preflightCapacityReservation(ctx, reserveSurge, r.surgeSize)
+	return err
+}
+
+func (r *upgradeRun) releaseReservations(ctx context.Context) error {
+	var err error
+	r.reservations, err = r.sess.restoreCapacityReservations(ctx, r.reservations)
+	return err
+}
+
+func (r *upgradeRun) reserveHosts(ctx context.Context) error {
+	var err error
+	addHosts, _ := r.cmd.Flags().GetBool("add-dedicated-hosts")
+	r.surgeHosts, err = r.sess.preflightDedicatedHosts(ctx, addHosts, r.surgeSize)
+	return err
+}
+
+func (r *upgradeRun) releaseHosts(ctx context.Context) error {
+	if err := r.sess.removeSurgeHosts(ctx, r.surgeHosts); err != nil {
+		return err
+	}
+	r.surgeHosts = nil
+	return nil
+}
+
+// Adds an instance for each one to be replaced, recording the original
+// capacity and surge size on the scale set's tags and remembering which
+// instances existed beforehand so a rollback knows which ones to remove. A
+// resumed upgrade surges by the recorded size. Instances which already run
+// the latest model are protected along with the new ones, so the scale-in
+// removes only outdated instances. The added capacity is metered from the
+// scale-out until the scale-in, for the cost report.
+func (r *upgradeRun) surge(ctx context.Context) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	r.surgeMeter.vmSize, r.surgeMeter.region, r.surgeMeter.windows = billingOf(scaleSet)
+
+	// Surging again once old instances are being removed would add back
+	// what the interrupted run already removed
+	if r.pastSurge() {
+		log.Infof("The interrupted run's surge completed and it was removing old instances (state '%s'), not surging again", r.state)
+		return r.watchFrom(ctx, *scaleSet.Sku.Capacity)
+	}
+
+	if !r.resuming {
+		r.originalCapacity = *scaleSet.Sku.Capacity
+
+		if r.originalInstances, err = r.sess.getInstanceIDs(ctx, ""); err != nil {
+			return err
+		}
+
+		if err = r.recordState(ctx, upgradeStateSurging); err != nil {
+			return err
+		}
+	}
+
+	r.surgeMeter.set(r.surgeSize)
+	if err = r.sess.scaleVMSS(ctx, r.originalCapacity+r.surgeSize); err != nil {
+		r.sess.reportFailedNewInstances(r.diagnosticsDir)
+		return err
+	}
+
+	if err = r.tagSurgeInstances(ctx); err != nil {
+		return err
+	}
+
+	return r.watchFrom(ctx, r.originalCapacity+r.surgeSize)
+}
+
+// Deletes every instance created since the surge began
+func (r *upgradeRun) rollbackSurge(ctx context.Context) error {
+	if r.originalInstances == nil {
+		return nil
+	}
+
+	original := map[string]bool{}
+	for _, id := range r.originalInstances {
+		original[id] = true
+	}
+
+	current, err := r.sess.getInstanceIDs(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var added []string
+	for _, id := range current {
+		if !original[id] {
+			added = append(added, id)
+		}
+	}
+
+	if len(added) > 0 {
+		log.Infof("Removing %d instances created by the surge...", len(added))
+		if err = r.sess.deleteInstances(ctx, added); err != nil {
+			return err
+		}
+	}
+	r.surgeMeter.set(0)
+
+	return r.sess.setUpgradeState(ctx, nil)
+}
+
+func (r *upgradeRun) protect(ctx context.Context) error {
+	log.Info("Waiting for new instances to reach Running state...")
+
+	futures, err := r.sess.setVMProtection(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	return r.sess.awaitVMFutures(ctx, futures)
+}
+
+func (r *upgradeRun) unprotect(ctx context.Context) error {
+	futures, err := r.sess.setVMProtection(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	return r.sess.awaitVMFutures(ctx, futures)
+}
+
+// Gates the swap on a successful smoke test script run on the new instances
+func (r *upgradeRun) smokeTestScript(ctx context.Context) error {
+	script := r.cmd.Flags().Lookup("smoke-test-script").Value.String()
+	if script == "" {
+		return nil
+	}
+
+	results, err := r.sess.runScript(ctx, r.cmd, "properties/latestModelApplied eq true", script)
+	if err != nil {
+		r.sess.reportFailedInstances(failedCommandInstances(results), r.diagnosticsDir)
+	}
+	return err
+}
+
+func (r *upgradeRun) smokeTest(ctx context.Context) error {
+	if r.smokeTests == nil {
+		return nil
+	}
+
+	timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+	return r.sess.smokeTestNewInstances(ctx, r.smokeTests, timeout, r.diagnosticsDir)
+}
+
+// Don't cut over until the load balancers agree the new instances are healthy
+func (r *upgradeRun) lbHealth(ctx context.Context) error {
+	timeout, _ := r.cmd.Flags().GetDuration("lb-health-timeout")
+	if timeout <= 0 {
+		return nil
+	}
+
+	return r.sess.awaitBackendHealth(ctx, timeout)
+}
+
+// Makes sure new instances are discoverable before the old ones go away,
+// and remembers which addresses are about to be removed.
+func (r *upgradeRun) awaitRegistration(ctx context.Context) error {
+	if r.registry == nil {
+		return nil
+	}
+
+	newInstanceIPs, err := r.sess.getInstanceIPs(ctx, "properties/latestModelApplied eq true")
+	if err != nil {
+		return err
+	}
+
+	if err = awaitDiscovery(ctx, r.registry, newInstanceIPs, true, r.discovery.Timeout); err != nil {
+		return err
+	}
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	r.oldInstanceIPs = map[string]string{}
+	for _, instanceID := range old {
+		if r.oldInstanceIPs[instanceID], err = r.sess.getInstancePrivateIP(ctx, instanceID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gives old instances a chance to drain before they're removed
+func (r *upgradeRun) drain(ctx context.Context) error {
+	if !r.preparesRemoval() {
+		return nil
+	}
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil || len(old) == 0 {
+		return err
+	}
+
+	return r.drainInstances(ctx, old, nil)
+}
+
+// Reports whether old instances are drained, waited on for their sessions,
+// shut down, snapshotted, given the termination agent or have their
+// resources recorded before they're removed
+func (r *upgradeRun) preparesRemoval() bool {
+	snapshot, _ := r.cmd.Flags().GetBool("snapshot-data-disks")
+	return snapshot || r.cmd.Flags().Lookup("drain-script").Value.String() != "" ||
+		r.cmd.Flags().Lookup("sessions-from").Value.String() != "" ||
+		r.cmd.Flags().Lookup("shutdown-script").Value.String() != "" ||
+		r.cmd.Flags().Lookup("termination-script").Value.String() != "" ||
+		r.cmd.Flags().Lookup("orphaned-resources").Value.String() != orphansOff
+}
+
+// Runs the drain script, if any, on the given old instances, waits for
+// their sessions to end and shuts them down, then snapshots their data
+// disks and installs the termination agent if asked. Given remove, each
+// instance is prepared and removed with it as soon as its sessions end;
+// without, as for the drain ahead of a scale-in which removes them
+// together, every instance waits for the last.
+func (r *upgradeRun) drainInstances(ctx context.Context, instanceIDs []string, remove func(context.Context, []string) error) error {
+	if path := r.cmd.Flags().Lookup("drain-script").Value.String(); path != "" {
+		script, err := loadScript(path)
+		if err != nil {
+			return err
+		}
+
+		timeout, _ := r.cmd.Flags().GetDuration("run-command-timeout")
+
+		log.Infof("Executing %s on %d instances via Run Command...", path, len(instanceIDs))
+
+		if _, err = r.sess.runCommandOnInstanceIDs(ctx, instanceIDs, script, timeout); err != nil {
+			return err
+		}
+	}
+
+	if remove == nil {
+		if err := r.awaitSessions(ctx, instanceIDs, nil); err != nil {
+			return err
+		}
+		return r.prepareRemoval(ctx, instanceIDs)
+	}
+
+	return r.awaitSessions(ctx, instanceIDs, func(ctx context.Context, ids []string) error {
+		if err := r.prepareRemoval(ctx, ids); err != nil {
+			return err
+		}
+		return remove(ctx, ids)
+	})
+}
+
+// Shuts down the given old instances, snapshots their data disks, records
+// their resources and installs the termination agent, as asked
+func (r *upgradeRun) prepareRemoval(ctx context.Context, instanceIDs []string) error {
+	if err := r.shutdownInstances(ctx, instanceIDs); err != nil {
+		return err
+	}
+
+	if err := r.snapshotDataDisks(ctx, instanceIDs); err != nil {
+		return err
+	}
+
+	if err := r.recordInstanceResources(ctx, instanceIDs); err != nil {
+		return err
+	}
+
+	return r.installTerminationAgent(ctx, instanceIDs)
+}
+
+func (r *upgradeRun) scaleIn(ctx context.Context) error {
+	if r.resuming && r.state == upgradeStateScaledIn {
+		log.Infof("The interrupted run already scaled %s in to %d instances", r.sess.ScaleSetName, r.originalCapacity)
+		r.expectedCapacity = r.originalCapacity
+		return nil
+	}
+
+	if err := r.reprotectRepaired(ctx); err != nil {
+		return err
+	}
+
+	if err := r.recordState(ctx, upgradeStateScalingIn); err != nil {
+		return err
+	}
+
+	if err := r.sess.scaleVMSS(ctx, r.originalCapacity); err != nil {
+		return err
+	}
+	r.surgeMeter.set(0)
+	r.untagSurgeInstances(ctx)
+
+	r.expectedCapacity = r.originalCapacity
+	return r.recordState(ctx, upgradeStateScaledIn)
+}
+
+// Releases any capacity reserved or hosts added for the surge, attempting
+// both even if one fails
+func (r *upgradeRun) releaseCapacity(ctx context.Context) error {
+	reservationsErr := r.releaseReservations(ctx)
+	hostsErr := r.releaseHosts(ctx)
+
+	if reservationsErr != nil && hostsErr != nil {
+		return fmt.Errorf("%v; %v", reservationsErr, hostsErr)
+	}
+	if reservationsErr != nil {
+		return reservationsErr
+	}
+	return hostsErr
+}
+
+// Releases whatever reservations and hosts a failed run still holds, on a
+// context of its own as the run's may have expired
+func (r *upgradeRun) releaseCapacityOnFailure() {
+	if len(r.reservations) == 0 && len(r.surgeHosts) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	log.Warn("Releasing the capacity reserved and hosts added for the surge of the failed upgrade")
+	if err := r.releaseCapacity(ctx); err != nil {
+		log.Errorf("Unable to release the capacity held for the surge: %v", err)
+	}
+}
+
+// Removed instances should no longer be discoverable
+func (r *upgradeRun) awaitDeregistration(ctx context.Context) error {
+	if r.registry == nil {
+		return nil
+	}
+
+	return awaitDiscovery(ctx, r.registry, r.oldInstanceIPs, false, r.discovery.Timeout)
+}
+
+// Marks the upgrade as no longer in progress, and when it completed
+func (r *upgradeRun) clearState(ctx context.Context) error {
+	return r.sess.completeUpgradeState(ctx, r.runID)
+}
@@ -0,0 +1,203 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	"github.com/krarey/azure-cluster-upgrade/vmss/fake"
+	"github.com/spf13/cobra"
+)
+
+// Returns a command carrying the upgrade flags the surge, protect and
+// scale-in phases read, at their defaults
+func testUpgradeCommand() *cobra.Command {
+	cmd := &cobra.Command{}
+	flags := cmd.Flags()
+	flags.String("diagnostics-dir", "", "")
+	flags.String("max-unavailable", "", "")
+	flags.Int64("min-healthy", 0, "")
+	flags.String("on-external-change", "abort", "")
+	flags.String("on-rerun", rerunRefuse, "")
+	flags.String("strategy", "", "")
+	flags.String("rotate-identity-from", "", "")
+	flags.String("rotate-identity-to", "", "")
+	flags.Int("warm-up-steps", 1, "")
+	flags.String("drain-script", "", "")
+	flags.String("sessions-from", "", "")
+	flags.String("shutdown-script", "", "")
+	flags.String("termination-script", "", "")
+	flags.String("orphaned-resources", orphansOff, "")
+	flags.Bool("snapshot-data-disks", false, "")
+	flags.String("cost-center", "", "")
+	flags.String("cost-center-tag", "", "")
+	return cmd
+}
+
+// Returns a run against a fake scale set of three instances, none of which
+// run the latest model
+func newTestRun() (*upgradeRun, *fake.ScaleSet) {
+	scaleSet := fake.NewScaleSet("web", "Standard_D2s_v3", 3)
+	scaleSet.MarkModelChanged()
+
+	var authorizer autorest.Authorizer = autorest.NullAuthorizer{}
+	sess := &azureSession{
+		SubscriptionID:    "00000000-0000-0000-0000-000000000000",
+		ResourceGroupName: "simulated",
+		ScaleSetName:      "web",
+		Authorizer:        &authorizer,
+		ScaleSets:         scaleSet,
+		VMs:               scaleSet.VMs(),
+		Simulated:         true,
+	}
+
+	return newUpgradeRun(sess, testUpgradeCommand()), scaleSet
+}
+
+// Returns the phases from the surge to the end of the upgrade, as a
+// simulation runs them, with any extra phase inserted after the named one
+func testSteps(r *upgradeRun, after string, extra phase.Step) []phase.Step {
+	steps := append([]phase.Step{
+		&phase.Func{StepName: "plan", ValidateFunc: r.plan},
+		&phase.Func{StepName: "surge", ExecuteFunc: r.surge, RollbackFunc: r.rollbackSurge},
+		&phase.Func{StepName: "protect", ExecuteFunc: r.protect, RollbackFunc: r.unprotect},
+	}, r.removalSteps(false, false)...)
+
+	var kept []phase.Step
+	for _, step := range simulatedSteps(steps) {
+		kept = append(kept, step)
+		if extra != nil && step.Name() == after {
+			kept = append(kept, extra)
+		}
+	}
+	return kept
+}
+
+// Returns the IDs of the scale set's instances, and whether every one runs
+// the latest model
+func instanceState(scaleSet *fake.ScaleSet) (map[string]bool, bool) {
+	ids := map[string]bool{}
+	latest := true
+	for _, instance := range scaleSet.Instances() {
+		ids[instance.ID] = true
+		latest = latest && instance.LatestModelApplied
+	}
+	return ids, latest
+}
+
+var errInjected = errors.New("injected failure")
+
+func failingStep(name string) phase.Step {
+	return &phase.Func{StepName: name, ExecuteFunc: func(context.Context) error { return errInjected }}
+}
+
+func TestUpgradeReplacesEveryInstance(t *testing.T) {
+	r, scaleSet := newTestRun()
+	before, _ := instanceState(scaleSet)
+
+	if err := phase.NewEngine(testSteps(r, "", nil)...).Run(context.Background()); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	after, latest := instanceState(scaleSet)
+	if len(after) != 3 || !latest {
+		t.Fatalf("expected 3 instances on the latest model, got %v (latest %t)", after, latest)
+	}
+	for id := range before {
+		if after[id] {
+			t.Errorf("old instance %s wasn't removed", id)
+		}
+	}
+	for _, instance := range scaleSet.Instances() {
+		if instance.Protected {
+			t.Errorf("instance %s was left protected from scale-in", instance.ID)
+		}
+	}
+
+	state, err := r.sess.getUpgradeState(context.Background())
+	if err != nil || state.State != "" {
+		t.Errorf("expected the upgrade state to be cleared, got %+v (%v)", state, err)
+	}
+}
+
+func TestRollbackBeforeScaleInRemovesSurge(t *testing.T) {
+	r, scaleSet := newTestRun()
+	before, _ := instanceState(scaleSet)
+
+	engine := phase.NewEngine(testSteps(r, "protect", failingStep("gate"))...)
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+	var stepErr *phase.Error
+	if !errors.As(err, &stepErr) || !stepErr.RolledBack || stepErr.Committed {
+		t.Fatalf("expected a rolled back failure, got %v", err)
+	}
+
+	after, latest := instanceState(scaleSet)
+	if len(after) != len(before) || latest {
+		t.Fatalf("expected the 3 old instances back, got %v (latest %t)", after, latest)
+	}
+	for id := range before {
+		if !after[id] {
+			t.Errorf("old instance %s was removed by the rollback", id)
+		}
+	}
+}
+
+func TestRollbackAfterScaleInKeepsNewInstances(t *testing.T) {
+	r, scaleSet := newTestRun()
+
+	engine := phase.NewEngine(testSteps(r, "scale-in", failingStep("after-scale-in"))...)
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+	var stepErr *phase.Error
+	if !errors.As(err, &stepErr) || !stepErr.Committed || stepErr.RolledBack {
+		t.Fatalf("expected a committed failure which isn't rolled back, got %v", err)
+	}
+
+	after, latest := instanceState(scaleSet)
+	if len(after) != 3 || !latest {
+		t.Fatalf("expected the 3 new instances to remain, got %v (latest %t)", after, latest)
+	}
+}
+
+func TestResumeAfterScaleInDoesNotSurgeAgain(t *testing.T) {
+	r, scaleSet := newTestRun()
+
+	if err := phase.NewEngine(testSteps(r, "scale-in", failingStep("after-scale-in"))...).Run(context.Background()); err == nil {
+		t.Fatal("expected the first run to fail after scaling in")
+	}
+	upgraded, _ := instanceState(scaleSet)
+
+	resumed := newUpgradeRun(r.sess, testUpgradeCommand())
+	proceed, err := resumed.detectRerun(context.Background(), rerunResume, false)
+	if err != nil || !proceed {
+		t.Fatalf("expected the upgrade to resume, got %t (%v)", proceed, err)
+	}
+	if resumed.state != upgradeStateScaledIn {
+		t.Fatalf("expected to resume from state %s, got %s", upgradeStateScaledIn, resumed.state)
+	}
+
+	// Any scale-out of the resumed run would fail to allocate
+	scaleSet.AllocationFailures = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = phase.NewEngine(testSteps(resumed, "", nil)...).Run(ctx); err != nil {
+		t.Fatalf("resumed upgrade failed: %v", err)
+	}
+
+	after, latest := instanceState(scaleSet)
+	if len(after) != 3 || !latest {
+		t.Fatalf("expected 3 instances on the latest model, got %v (latest %t)", after, latest)
+	}
+	for id := range after {
+		if !upgraded[id] {
+			t.Errorf("instance %s was added by the resumed run", id)
+		}
+	}
+}
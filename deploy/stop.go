@@ -0,0 +1,252 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// Subscription tag asking every upgrade in the subscription to hold
+	// ahead of its next phase, set by stop-all with the reason given
+	stopTag = "azure-cluster-upgrade-stop"
+
+	tagsAPIVersion = "2021-04-01"
+
+	// How often a held upgrade checks whether the stop was released
+	stopPollInterval = 30 * time.Second
+
+	// Reason a run is held for while it can't check for a stop
+	stopUnknown = "unknown, the stop couldn't be checked"
+)
+
+// Returns the ARM path of the tags of the session's subscription
+func (s *azureSession) subscriptionTagsPath() string {
+	return fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Resources/tags/default", s.SubscriptionID)
+}
+
+// Returns the reason given for stopping every upgrade in the session's
+// subscription, or "" if they aren't stopped
+func (s *azureSession) stopRequest(ctx context.Context) (string, error) {
+	var tags struct {
+		Properties struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"properties"`
+	}
+	if err := s.armGet(ctx, s.subscriptionTagsPath(), tagsAPIVersion, &tags); err != nil {
+		return "", err
+	}
+	return tags.Properties.Tags[stopTag], nil
+}
+
+// Asks every upgrade in the session's subscription to stop for the given
+// reason, or releases them when it's ""
+func (s *azureSession) setStopRequest(ctx context.Context, reason string) error {
+	operation := "Merge"
+	if reason == "" {
+		current, err := s.stopRequest(ctx)
+		if err != nil || current == "" {
+			return err
+		}
+		operation, reason = "Delete", current
+	}
+
+	body := map[string]interface{}{
+		"operation":  operation,
+		"properties": map[string]interface{}{"tags": map[string]string{stopTag: reason}},
+	}
+	return s.armDo(ctx, http.MethodPatch, s.subscriptionTagsPath(), tagsAPIVersion, body, nil)
+}
+
+// Holds the run ahead of a phase while stop-all has stopped upgrades in
+// the scale set's subscription, reporting where it stopped, until the stop
+// is released. A run which can't check for a stop refuses to start, and
+// once started holds while it can't, as a stop may have been asked for.
+// Time held doesn't count against the run's timeout. Simulated runs aren't
+// stopped, having no subscription.
+func (r *upgradeRun) holdForStop(ctx context.Context, phaseName string) error {
+	if r.sess.Simulated {
+		return nil
+	}
+
+	reason, err := r.sess.stopRequest(ctx)
+	if err != nil {
+		if !r.stopChecked {
+			return fmt.Errorf("unable to check for an emergency stop of subscription %s, not starting an upgrade stop-all couldn't stop: %v", r.sess.SubscriptionID, err)
+		}
+		log.Warnf("Unable to check for an emergency stop of subscription %s: %v", r.sess.SubscriptionID, err)
+		reason = stopUnknown
+	}
+	r.stopChecked = true
+	if reason == "" {
+		return nil
+	}
+
+	release := holdRunClock(ctx)
+	defer release()
+
+	log.Warnf("Emergency stop: %s. Holding run %s of %s ahead of phase %s, after %d phases completed, until released with 'stop-all --release'",
+		reason, r.runID, r.sess.ScaleSetName, phaseName, len(r.phaseResults))
+	r.updateChange(ctx, fmt.Sprintf("Held ahead of phase %s by an emergency stop: %s", phaseName, reason))
+	r.publishEvent(ctx, eventUpgradeStopped, phaseName, nil)
+
+	for reason != "" {
+		select {
+		case <-time.After(stopPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if reason, err = r.sess.stopRequest(ctx); err != nil {
+			log.Warnf("Unable to check whether the emergency stop was released: %v", err)
+			reason = stopUnknown
+		}
+	}
+
+	log.Infof("Emergency stop released, resuming ahead of phase %s", phaseName)
+	r.updateChange(ctx, "Emergency stop released")
+	return nil
+}
+
+// Checks a --subscriptions value is a list of subscription IDs. Slice
+// flags render as a bracketed list.
+func validateSubscriptionIDs(value string) error {
+	for _, id := range strings.Split(strings.Trim(value, "[]"), ",") {
+		if id == "" {
+			continue
+		}
+		if err := validateSubscriptionID(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stoppedUpgrade is an upgrade found in progress by stop-all
+type stoppedUpgrade struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ResourceGroup  string `json:"resourceGroup"`
+	ScaleSet       string `json:"scaleSet"`
+	State          string `json:"state"`
+	RunID          string `json:"runId,omitempty"`
+}
+
+// Lists the upgrades recorded as in progress on the session's
+// subscription's scale sets. Upgrades still in their preflight phases
+// haven't recorded their state yet, so aren't listed, though they're held
+// all the same.
+func (s *azureSession) upgradesInProgress(ctx context.Context) ([]stoppedUpgrade, error) {
+	scaleSets, err := s.getVMSSClient().ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var upgrades []stoppedUpgrade
+	for _, scaleSet := range scaleSets {
+		state := to.String(scaleSet.Tags[upgradeStateTag])
+		if state == "" {
+			continue
+		}
+
+		id, err := azure.ParseResourceID(to.String(scaleSet.ID))
+		if err != nil {
+			return nil, err
+		}
+		upgrades = append(upgrades, stoppedUpgrade{
+			SubscriptionID: s.SubscriptionID,
+			ResourceGroup:  id.ResourceGroup,
+			ScaleSet:       id.ResourceName,
+			State:          state,
+			RunID:          to.String(scaleSet.Tags[upgradeRunIDTag]),
+		})
+	}
+
+	return upgrades, nil
+}
+
+// RunStopAll stops every upgrade in the given subscriptions ahead of its
+// next phase, or releases them with --release, and reports the upgrades in
+// progress
+func RunStopAll(cmd *cobra.Command, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutMinutes*time.Minute)
+	defer cancel()
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	subscriptions, _ := cmd.Flags().GetStringSlice("subscriptions")
+	release, _ := cmd.Flags().GetBool("release")
+	reason := cmd.Flags().Lookup("reason").Value.String()
+	if !release {
+		user := os.Getenv("USER")
+		if user == "" {
+			user = "unknown"
+		}
+		reason = fmt.Sprintf("%s (by %s at %s)", reason, user, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	upgrades := []stoppedUpgrade{}
+	for _, subscription := range subscriptions {
+		sess, err := newSessionWithOptions(cmd, subscription, "", "", opts)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+
+		if release {
+			log.Infof("Releasing the emergency stop of subscription %s", subscription)
+			err = sess.setStopRequest(ctx, "")
+		} else {
+			log.Warnf("Stopping every upgrade in subscription %s ahead of its next phase", subscription)
+			err = sess.setStopRequest(ctx, reason)
+		}
+		if err != nil {
+			fail(fmt.Errorf("unable to update the tags of subscription %s: %v", subscription, err))
+		}
+
+		found, err := sess.upgradesInProgress(ctx)
+		if err != nil {
+			log.Warnf("Unable to list the upgrades in progress in subscription %s: %v", subscription, err)
+		}
+		upgrades = append(upgrades, found...)
+	}
+
+	sort.Slice(upgrades, func(i, j int) bool {
+		return upgrades[i].SubscriptionID+upgrades[i].ResourceGroup+upgrades[i].ScaleSet <
+			upgrades[j].SubscriptionID+upgrades[j].ResourceGroup+upgrades[j].ScaleSet
+	})
+
+	if format == outputJSON {
+		if err = printJSON(upgrades); err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBSCRIPTION\tRESOURCE GROUP\tSCALE SET\tSTATE\tRUN ID")
+	for _, upgrade := range upgrades {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", upgrade.SubscriptionID, upgrade.ResourceGroup, upgrade.ScaleSet, upgrade.State, orNone(upgrade.RunID))
+	}
+	w.Flush()
+}
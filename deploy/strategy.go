@@ -0,0 +1,291 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	"github.com/krarey/azure-cluster-upgrade/vmss"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Built-in strategies: the blue/green surge, surging a replacement for
+	// every outdated instance and scaling back in once they pass the gates,
+	// and the same surge held without scaling back in, left to finish
+	strategyBlueGreen    = "blue-green"
+	strategyScaleOutOnly = "scale-out-only"
+)
+
+// Strategies built into the upgrade's phases rather than registered
+var builtinStrategies = []string{strategyBlueGreen, strategyScaleOutOnly}
+
+// Reports whether a strategy name is one of the built-in strategies
+func isBuiltinStrategy(name string) bool {
+	for _, builtin := range builtinStrategies {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// Strategy moves a scale set's instances onto its current model in place
+// of the built-in blue/green surge, such as a bespoke roll of a stateful
+// database, one member at a time. Strategies are compiled into a program
+// embedding this package, registered with RegisterStrategy and selected
+// with --strategy.
+//
+// A strategy runs as a single phase of the upgrade, after the preflight
+// checks and any model change, and ahead of the upgrade state being
+// cleared and every instance checked to run the latest model. Events, the
+// change record, CI reports and pauses apply to it as to any other phase.
+type Strategy interface {
+	// Plan checks the strategy can upgrade the scale set and returns the
+	// steps it would take, without changing anything. It's called while
+	// the upgrade is validated, so by plan and validate too, and before
+	// any model change is made.
+	Plan(ctx context.Context, run *StrategyRun) ([]string, error)
+	// Execute moves the instances onto the current model
+	Execute(ctx context.Context, run *StrategyRun) error
+	// Rollback undoes Execute when it or a later phase fails, with
+	// --rollback-on-failure. It may be called after Execute failed part
+	// way through, so must tolerate partial state.
+	Rollback(ctx context.Context, run *StrategyRun) error
+}
+
+var (
+	strategiesMu sync.Mutex
+	strategies   = map[string]func() Strategy{}
+)
+
+// RegisterStrategy makes a strategy selectable by name with --strategy.
+// Each upgrade gets a strategy of its own from newStrategy, so it can keep
+// state between its Plan, Execute and Rollback. Call it from an init
+// function; it panics if the name is empty or already taken.
+func RegisterStrategy(name string, newStrategy func() Strategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	if name == "" || isBuiltinStrategy(name) || name == strategyScaleInOnly || strategies[name] != nil {
+		panic(fmt.Sprintf("deploy: strategy %q is already registered", name))
+	}
+	if newStrategy == nil {
+		panic(fmt.Sprintf("deploy: strategy %q registered without a constructor", name))
+	}
+
+	strategies[name] = newStrategy
+}
+
+// Returns the names of the strategies which can be selected, sorted
+func strategyNames() []string {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	var registered []string
+	for name := range strategies {
+		registered = append(registered, name)
+	}
+	sort.Strings(registered)
+	return append(append([]string{}, builtinStrategies...), registered...)
+}
+
+// Checks a --strategy value names the built-in or a registered strategy
+func validateStrategy(value string) error {
+	for _, name := range strategyNames() {
+		if value == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown strategy '%s', expected one of %s", value, strings.Join(strategyNames(), ", "))
+}
+
+// Returns the name and a new instance of the strategy chosen by
+// --strategy, or nil for a built-in strategy
+func strategyFromFlags(cmd *cobra.Command) (string, Strategy) {
+	flag := cmd.Flags().Lookup("strategy")
+	if flag == nil {
+		return strategyBlueGreen, nil
+	}
+	if isBuiltinStrategy(flag.Value.String()) {
+		return flag.Value.String(), nil
+	}
+
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+
+	newStrategy, ok := strategies[flag.Value.String()]
+	if !ok {
+		return strategyBlueGreen, nil
+	}
+	return flag.Value.String(), newStrategy()
+}
+
+// StrategyRun is the upgrade a Strategy runs within. Through it, a
+// strategy reaches the upgrade's session, along with its gates and the
+// upgrade state recorded on the scale set.
+type StrategyRun struct {
+	run *upgradeRun
+}
+
+// RunID returns the ID the upgrade carries in logs, tags and events
+func (s *StrategyRun) RunID() string {
+	return s.run.runID
+}
+
+// SubscriptionID returns the subscription of the scale set being upgraded
+func (s *StrategyRun) SubscriptionID() string {
+	return s.run.sess.SubscriptionID
+}
+
+// ResourceGroup returns the resource group of the scale set being upgraded
+func (s *StrategyRun) ResourceGroup() string {
+	return s.run.sess.ResourceGroupName
+}
+
+// ScaleSet returns the name of the scale set being upgraded
+func (s *StrategyRun) ScaleSet() string {
+	return s.run.sess.ScaleSetName
+}
+
+// Flags returns the flags the upgrade was configured with, including any
+// the strategy's program added to the command
+func (s *StrategyRun) Flags() *pflag.FlagSet {
+	return s.run.cmd.Flags()
+}
+
+// Simulated reports whether the scale set is simulated, in which case its
+// clients are fakes and nothing else in Azure should be touched
+func (s *StrategyRun) Simulated() bool {
+	return s.run.sess.Simulated
+}
+
+// Resuming reports whether the upgrade picks up one left in progress
+func (s *StrategyRun) Resuming() bool {
+	return s.run.resuming
+}
+
+// ScaleSets returns the session's scale set client, which shares its
+// credentials, rate limits, recorder and correlation ID
+func (s *StrategyRun) ScaleSets() vmss.ScaleSetsClient {
+	return s.run.sess.getVMSSClient()
+}
+
+// VMs returns the session's scale set instance client
+func (s *StrategyRun) VMs() vmss.VMsClient {
+	return s.run.sess.getVMSSVMClient()
+}
+
+// OutdatedInstances returns the IDs of the instances the upgrade replaces:
+// every instance when the model is changing, otherwise those not running
+// the latest model
+func (s *StrategyRun) OutdatedInstances(ctx context.Context) ([]string, error) {
+	return s.run.replacedInstances(ctx)
+}
+
+// RunCommand runs a shell or PowerShell script on the given instances
+// concurrently via Run Command, allowing each --run-command-timeout
+func (s *StrategyRun) RunCommand(ctx context.Context, instanceIDs []string, script []string) error {
+	timeout, _ := s.run.cmd.Flags().GetDuration("run-command-timeout")
+	_, err := s.run.sess.runCommandOnInstanceIDs(ctx, instanceIDs, script, timeout)
+	return err
+}
+
+// Gates checks the instances running the latest model as the blue/green
+// surge does before removing any old instance: their networking,
+// extensions, GPUs, certificates and identities, the smoke tests, load
+// balancer health and discovery, as configured by the upgrade's flags.
+// Returns the first gate failed.
+func (s *StrategyRun) Gates(ctx context.Context) error {
+	for _, gate := range s.run.gateSteps() {
+		if s.run.sess.Simulated && unsimulatedSteps[gate.Name()] {
+			continue
+		}
+		if err := gate.Execute(ctx); err != nil {
+			return fmt.Errorf("%s: %v", gate.Name(), err)
+		}
+	}
+	return nil
+}
+
+// SetState records the strategy's progress on the scale set's tags, as an
+// upgrade in progress, so a re-run refuses to start over it or, with
+// --on-rerun=resume, picks it up. The state is cleared once the upgrade
+// completes.
+func (s *StrategyRun) SetState(ctx context.Context, state string) error {
+	return s.run.sess.setUpgradeState(ctx, &upgradeState{State: state, OriginalCapacity: s.run.originalCapacity, RunID: s.run.runID})
+}
+
+// State returns the progress last recorded with SetState, or "" if none is
+func (s *StrategyRun) State(ctx context.Context) (string, error) {
+	state, err := s.run.sess.getUpgradeState(ctx)
+	return state.State, err
+}
+
+// Returns the phase running the chosen strategy. Validating it plans the
+// strategy, and executing it records the scale set's capacity for the
+// upgrade state before handing over.
+func (r *upgradeRun) strategyStep() phase.Step {
+	run := &StrategyRun{run: r}
+
+	return &phase.Func{
+		StepName: r.strategyName,
+		ValidateFunc: func(ctx context.Context) error {
+			steps, err := r.strategy.Plan(ctx, run)
+			if err != nil {
+				return err
+			}
+			r.strategySteps = steps
+			return nil
+		},
+		ExecuteFunc: func(ctx context.Context) error {
+			if !r.resuming {
+				scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+				if err != nil {
+					return err
+				}
+				r.originalCapacity = *scaleSet.Sku.Capacity
+			}
+
+			log.Infof("Upgrading %s with the %s strategy...", r.sess.ScaleSetName, r.strategyName)
+			started := time.Now()
+			if err := r.strategy.Execute(ctx, run); err != nil {
+				return err
+			}
+			log.Infof("The %s strategy finished in %s", r.strategyName, time.Since(started).Round(time.Second))
+
+			return nil
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			log.Infof("Rolling back the %s strategy...", r.strategyName)
+			return r.strategy.Rollback(ctx, run)
+		},
+	}
+}
+
+// Appends the phases of an upgrade by a registered strategy to the
+// preflight checks and model changes. Delete locks lifted and repairs
+// suspended for the upgrade are restored after it, as for the blue/green
+// surge.
+func (r *upgradeRun) strategyPhases(steps []phase.Step, liftLocks bool, suspendRepairs bool) []phase.Step {
+	steps = append(steps, r.strategyStep())
+
+	if liftLocks {
+		steps = append(steps, &phase.Func{StepName: "restore-delete-locks", ExecuteFunc: r.restoreLocks})
+	}
+	if suspendRepairs {
+		steps = append(steps, &phase.Func{StepName: "resume-repairs", ExecuteFunc: r.resumeRepairs})
+	}
+
+	return append(steps,
+		&phase.Func{StepName: "discovery-deregister", ExecuteFunc: r.awaitDeregistration},
+		&phase.Func{StepName: "clear-state", ExecuteFunc: r.clearState},
+		&phase.Func{StepName: "verify", ExecuteFunc: r.sess.verifyUpgrade},
+	)
+}
@@ -0,0 +1,124 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	networkAPIVersion = "2019-11-01"
+)
+
+type virtualNetworkUsage struct {
+	ID           string `json:"id"`
+	CurrentValue int64  `json:"currentValue"`
+	Limit        int64  `json:"limit"`
+}
+
+// Counts how many IPv4 addresses each subnet must supply per instance,
+// across every NIC and IP configuration in the scale set model.
+func ipsPerInstanceBySubnet(configs []modelIPConfiguration) map[string]int64 {
+	demand := map[string]int64{}
+
+	for _, ipConfig := range configs {
+		if ipConfig.Subnet == nil || ipConfig.PrivateIPAddressVersion == "IPv6" {
+			continue
+		}
+		demand[strings.ToLower(to.String(ipConfig.Subnet.ID))]++
+	}
+
+	return demand
+}
+
+// Trims a subnet ID down to the ID of its virtual network
+func subnetVNetID(subnetID string) string {
+	if idx := strings.Index(strings.ToLower(subnetID), "/subnets/"); idx >= 0 {
+		return subnetID[:idx]
+	}
+	return subnetID
+}
+
+// Returns the number of unassigned addresses in each subnet of a virtual
+// network, keyed by lower-cased subnet ID, using the network usages API.
+// The reported limit already excludes the addresses Azure reserves.
+func (s *azureSession) getSubnetFreeIPs(ctx context.Context, vnetID string) (map[string]int64, error) {
+	var usages []virtualNetworkUsage
+	free := map[string]int64{}
+
+	if err := s.armList(ctx, vnetID+"/usages", map[string]interface{}{"api-version": networkAPIVersion}, &usages); err != nil {
+		return free, err
+	}
+
+	for _, usage := range usages {
+		free[strings.ToLower(usage.ID)] = usage.Limit - usage.CurrentValue
+	}
+
+	return free, nil
+}
+
+// Validates that every subnet referenced by the scale set's NIC and IP
+// configurations has enough free addresses for a surge of 'surge'
+// instances.
+func (s *azureSession) preflightSubnetCapacity(ctx context.Context, surge int64) error {
+	var problems []string
+
+	client := s.getVMSSClient()
+
+	scaleSet, err := client.Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	configs := getModelIPConfigurations(scaleSet)
+
+	nics := map[string]bool{}
+	for _, ipConfig := range configs {
+		nics[ipConfig.NICName] = true
+	}
+	log.Infof("Surge of %d instances will create %d NICs with %d IP configurations",
+		surge, surge*int64(len(nics)), surge*int64(len(configs)))
+
+	demand := ipsPerInstanceBySubnet(configs)
+
+	subnetIDs := make([]string, 0, len(demand))
+	for subnetID := range demand {
+		subnetIDs = append(subnetIDs, subnetID)
+	}
+	sort.Strings(subnetIDs)
+
+	usages := map[string]map[string]int64{}
+
+	for _, subnetID := range subnetIDs {
+		needed := demand[subnetID] * surge
+
+		vnetID := subnetVNetID(subnetID)
+		if _, ok := usages[vnetID]; !ok {
+			if usages[vnetID], err = s.getSubnetFreeIPs(ctx, vnetID); err != nil {
+				return err
+			}
+		}
+
+		free, ok := usages[vnetID][subnetID]
+		if !ok {
+			return fmt.Errorf("no usage reported for subnet %s", subnetID)
+		}
+
+		if needed > free {
+			problems = append(problems, fmt.Sprintf("subnet %s has %d free addresses but the surge needs %d", subnetID, free, needed))
+			continue
+		}
+
+		log.Infof("Subnet %s has %d free addresses, surge needs %d", subnetID, free, needed)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("doubling the scale set would exhaust its subnets, expand the subnets or reduce capacity before upgrading: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
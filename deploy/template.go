@@ -0,0 +1,132 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Matches ${name} and ${name:-default} in the config file. A leading $$
+// escapes the reference, leaving a literal ${name}.
+var configVariablePattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_.\-]*)(:-[^}]*)?\}`)
+
+// Flags whose values are available to the config file as built-in
+// variables, by variable name
+var builtinConfigVariables = map[string]string{
+	"subscriptionID": "subscription-id",
+	"resourceGroup":  "resource-group",
+	"scaleSet":       "vm-scale-set",
+}
+
+// Returns the variables given with --var, along with the built-ins: the
+// scale set named on the command line and the ID of the run
+func configVariables(cmd *cobra.Command) (map[string]string, error) {
+	vars := map[string]string{"runID": defaultRunID(cmd)}
+
+	for name, flagName := range builtinConfigVariables {
+		if flag := cmd.Flags().Lookup(flagName); flag != nil && flag.Value.String() != "" {
+			vars[name] = flag.Value.String()
+		}
+	}
+
+	if cmd.Flags().Lookup("var") == nil {
+		return vars, nil
+	}
+
+	given, _ := cmd.Flags().GetStringArray("var")
+	for _, assignment := range given {
+		parts := strings.SplitN(assignment, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("--var: '%s' is not of the form name=value", assignment)
+		}
+		vars[parts[0]] = parts[1]
+	}
+
+	return vars, nil
+}
+
+// Substitutes variables into config file contents. A variable is looked
+// up among vars, then the environment, falling back to its default; one
+// with none is an error, so a pipeline forgetting to pass it fails early.
+func expandConfig(contents string, vars map[string]string) (string, error) {
+	missing := map[string]bool{}
+
+	expanded := configVariablePattern.ReplaceAllStringFunc(contents, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+
+		match := configVariablePattern.FindStringSubmatch(ref)
+		name, fallback := match[1], match[2]
+
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if fallback != "" {
+			return strings.TrimPrefix(fallback, ":-")
+		}
+
+		missing[name] = true
+		return ref
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("the config file refers to undefined variables: %s; pass them with --var or the environment", strings.Join(names, ", "))
+	}
+
+	return expanded, nil
+}
+
+// Re-reads the config file with its variables substituted, so a pipeline
+// can reuse one config file and inject e.g. the image version built:
+//
+//	profiles:
+//	  ci:
+//	    flags:
+//	      gallery-image: ${GALLERY_ID}/images/web/versions/${IMAGE_VERSION}
+//	      min-image-version: ${MIN_IMAGE_VERSION:-1.0.0}
+//	changeManagement:
+//	  serviceNow:
+//	    fields:
+//	      correlation_id: ${runID}
+func substituteConfig(cmd *cobra.Command) error {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil || !configVariablePattern.Match(contents) {
+		return err
+	}
+
+	vars, err := configVariables(cmd)
+	if err != nil {
+		return err
+	}
+
+	expanded, err := expandConfig(string(contents), vars)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Substituted variables into config file %s", path)
+	viper.SetConfigType(strings.TrimPrefix(filepath.Ext(path), "."))
+	return viper.ReadConfig(strings.NewReader(expanded))
+}
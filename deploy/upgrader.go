@@ -0,0 +1,114 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	"github.com/spf13/cobra"
+)
+
+// Upgrader starts blue/green upgrades of scale sets for a program
+// embedding this package, such as an orchestrator multiplexing upgrades of
+// many clusters with its own scheduling. Upgrades are configured by the
+// flags of a command built by cmd.NewUpgradeCommand, and share its rate
+// limits and recorder.
+type Upgrader struct {
+	cmd  *cobra.Command
+	opts sessionOptions
+}
+
+// NewUpgrader returns an Upgrader configured by the command's flags, once
+// they're found valid
+func NewUpgrader(cmd *cobra.Command) (*Upgrader, error) {
+	if problems := flagProblems(cmd); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid flags:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	opts, err := sessionOptionsFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upgrader{cmd: cmd, opts: opts}, nil
+}
+
+// Upgrade is an upgrade started by an Upgrader, running in the background.
+// It's a phase.Poller, so can be polled alongside other runs of the engine.
+type Upgrade struct {
+	run  *upgradeRun
+	done chan struct{}
+	err  error
+}
+
+// Start begins upgrading a scale set onto its current model in the
+// background, with an ID of its own, returning the upgrade to poll
+func (u *Upgrader) Start(ctx context.Context, subscription string, resourceGroup string, scaleSet string) (*Upgrade, error) {
+	sess, err := newSessionWithOptions(u.cmd, subscription, resourceGroup, scaleSet, u.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	run := newUpgradeRun(sess, u.cmd)
+	run.setRunID(newRunID())
+
+	upgrade := &Upgrade{run: run, done: make(chan struct{})}
+	go func() {
+		defer close(upgrade.done)
+		upgrade.err = run.execute(ctx)
+	}()
+
+	return upgrade, nil
+}
+
+// RunID returns the ID the upgrade carries in logs, tags and events
+func (u *Upgrade) RunID() string {
+	return u.run.runID
+}
+
+// Done is closed once the upgrade finishes
+func (u *Upgrade) Done() <-chan struct{} {
+	return u.done
+}
+
+// Phase returns the phase being run, or the last one once the upgrade
+// finishes, or "" before the first
+func (u *Upgrade) Phase() string {
+	return u.run.currentPhase()
+}
+
+// Result returns the upgrade's failure, if any. An upgrade with nothing to
+// do succeeds. Only valid once Done is closed.
+func (u *Upgrade) Result() error {
+	return u.err
+}
+
+// UpToDate reports whether the scale set already ran its current model, so
+// the upgrade had nothing to do. Only valid once Done is closed.
+func (u *Upgrade) UpToDate() bool {
+	return u.run.upToDate
+}
+
+// An Upgrade can be polled like any other run of the engine
+var _ phase.Poller = (*Upgrade)(nil)
+
+// phaseTracker records the phase an upgrade is running, for it to be
+// polled from other goroutines
+type phaseTracker struct {
+	mu   sync.Mutex
+	name string
+}
+
+func (t *phaseTracker) set(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.name = name
+}
+
+func (r *upgradeRun) currentPhase() string {
+	r.phase.mu.Lock()
+	defer r.phase.mu.Unlock()
+	return r.phase.name
+}
@@ -0,0 +1,190 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// verificationSpec is the declarative set of assertions the scale set must
+// satisfy once the upgrade has finished changing it. It is read from the
+// 'verification' key of the config file. A failed assertion fails the
+// run, though nothing is rolled back since every change succeeded.
+type verificationSpec struct {
+	// Instances the scale set must have; 0 for its capacity before the
+	// upgrade, -1 to skip the check
+	InstanceCount int64 `mapstructure:"instanceCount"`
+	// Every instance runs the latest model
+	LatestModel bool `mapstructure:"latestModel"`
+	// Every instance is healthy in the backend pools it belongs to
+	BackendsHealthy bool `mapstructure:"backendsHealthy"`
+	// No instance is left protected from scale-in, nor the upgrade's state
+	// left on the scale set
+	NoLeftovers bool `mapstructure:"noLeftovers"`
+	// Checks run against every instance
+	HTTP    []httpCheck   `mapstructure:"http"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// assertionResult is the outcome of one post-upgrade assertion
+type assertionResult struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// Reads the verification spec from the config file. Returns nil when no
+// verification is configured.
+func loadVerificationSpec() (*verificationSpec, error) {
+	if !viper.IsSet("verification") {
+		return nil, nil
+	}
+
+	spec := &verificationSpec{LatestModel: true, NoLeftovers: true, Timeout: defaultSmokeTestTimeout}
+	if err := viper.UnmarshalKey("verification", spec); err != nil {
+		return nil, err
+	}
+
+	if spec.InstanceCount < -1 {
+		return nil, fmt.Errorf("verification instanceCount %d must be a count, 0 for the original capacity or -1 to skip it", spec.InstanceCount)
+	}
+
+	return spec, nil
+}
+
+// Evaluates every assertion of the verification spec, returning each
+// one's outcome. Only errors reaching the scale set itself are returned.
+func (r *upgradeRun) evaluateAssertions(ctx context.Context, spec *verificationSpec) ([]assertionResult, error) {
+	var results []assertionResult
+
+	vms, err := r.sess.getVMSSVMClient().List(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	if expected := spec.InstanceCount; expected != -1 {
+		if expected == 0 {
+			expected = r.originalCapacity
+		}
+		results = append(results, assertionResult{
+			Name:    "instance-count",
+			Passed:  int64(len(vms)) == expected,
+			Message: fmt.Sprintf("%d instances, expected %d", len(vms), expected),
+		})
+	}
+
+	if spec.LatestModel {
+		var stale []string
+		for _, vm := range vms {
+			if vm.VirtualMachineScaleSetVMProperties == nil || !to.Bool(vm.LatestModelApplied) {
+				stale = append(stale, to.String(vm.InstanceID))
+			}
+		}
+		results = append(results, assertionResult{Name: "latest-model", Passed: len(stale) == 0, Message: orNone(strings.Join(stale, ", ")) + " not on the latest model"})
+	}
+
+	if spec.NoLeftovers {
+		var protected []string
+		for _, vm := range vms {
+			if protectedFromScaleIn(vm) {
+				protected = append(protected, to.String(vm.InstanceID))
+			}
+		}
+		results = append(results, assertionResult{Name: "no-protection", Passed: len(protected) == 0, Message: orNone(strings.Join(protected, ", ")) + " protected from scale-in"})
+
+		state, err := r.sess.getUpgradeState(ctx)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, assertionResult{Name: "no-state", Passed: state.State == "", Message: "upgrade state " + orNone(state.State)})
+	}
+
+	if r.sess.Simulated {
+		if spec.BackendsHealthy || len(spec.HTTP) > 0 {
+			log.Info("Skipping backend health and HTTP assertions, which the simulation doesn't model")
+		}
+		return results, nil
+	}
+
+	if spec.BackendsHealthy {
+		result := assertionResult{Name: "backends-healthy"}
+		loadBalancers, appGateways, err := r.sess.getBackendTargets(ctx)
+		if err == nil {
+			var unhealthy []string
+			if unhealthy, err = r.sess.getUnhealthyBackends(ctx, loadBalancers, appGateways); err == nil {
+				result.Passed = len(unhealthy) == 0
+				result.Message = orNone(strings.Join(unhealthy, "; ")) + " unhealthy"
+			}
+		}
+		if err != nil {
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	for _, vm := range vms {
+		if len(spec.HTTP) == 0 {
+			break
+		}
+
+		instanceID := to.String(vm.InstanceID)
+		address, err := r.sess.getInstancePrivateIP(ctx, instanceID)
+		if err != nil {
+			results = append(results, assertionResult{Name: "network/" + instanceID, Message: err.Error()})
+			continue
+		}
+
+		for _, check := range spec.HTTP {
+			outcome := check.run(ctx, address, spec.Timeout)
+			results = append(results, assertionResult{Name: outcome.Test + "/" + instanceID, Passed: outcome.Passed, Message: outcome.Message})
+		}
+	}
+
+	return results, nil
+}
+
+// Verifies the scale set against the config file's verification spec, if
+// any, once the upgrade has succeeded. Every assertion is evaluated and
+// logged, then the run fails if any didn't pass.
+func (r *upgradeRun) verifyAssertions(ctx context.Context) error {
+	spec, err := loadVerificationSpec()
+	if err != nil || spec == nil {
+		return err
+	}
+
+	log.Info("Verifying the upgraded scale set...")
+	start := time.Now()
+
+	results, err := r.evaluateAssertions(ctx, spec)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, result := range results {
+		if result.Passed {
+			log.Infof("Assertion %s passed", result.Name)
+			continue
+		}
+		log.Errorf("Assertion %s failed: %s", result.Name, result.Message)
+		failed = append(failed, result.Name)
+	}
+
+	status := "completed"
+	if len(failed) > 0 {
+		status = "failed"
+	}
+	r.phaseResults = append(r.phaseResults, phaseResult{Name: "verification", Status: status, Duration: time.Since(start)})
+
+	if len(failed) > 0 {
+		return fmt.Errorf("upgrade completed, but %d of %d assertions failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+
+	log.Infof("All %d assertions passed", len(results))
+	return nil
+}
@@ -0,0 +1,101 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// Returns the session's Resource SKU client for a subscription
+func (s *azureSession) getResourceSkusClient(subscription string) compute.ResourceSkusClient {
+	return s.cachedClient("resourceSkus/"+subscription, func() interface{} {
+		client := compute.NewResourceSkusClient(subscription)
+		s.configureClient(&client.Client)
+		return client
+	}).(compute.ResourceSkusClient)
+}
+
+// Returns the capabilities of a VM size in a region, keyed by name, e.g.
+// AcceleratedNetworkingEnabled. Fails if the size isn't offered there, or
+// the subscription may not use it.
+func (s *azureSession) getVMSizeCapabilities(ctx context.Context, location string, size string) (map[string]string, error) {
+	iter, err := s.getResourceSkusClient(s.SubscriptionID).ListComplete(ctx, fmt.Sprintf("location eq '%s'", location))
+	if err != nil {
+		return nil, err
+	}
+
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return nil, err
+		}
+
+		sku := iter.Value()
+		if to.String(sku.ResourceType) != "virtualMachines" || !strings.EqualFold(to.String(sku.Name), size) {
+			continue
+		}
+
+		if sku.Restrictions != nil {
+			for _, restriction := range *sku.Restrictions {
+				if restriction.Type == compute.Location && restriction.ReasonCode == compute.NotAvailableForSubscription {
+					return nil, fmt.Errorf("VM size %s is not available to subscription %s in %s", size, s.SubscriptionID, location)
+				}
+			}
+		}
+
+		capabilities := map[string]string{}
+		if sku.Capabilities != nil {
+			for _, capability := range *sku.Capabilities {
+				capabilities[to.String(capability.Name)] = to.String(capability.Value)
+			}
+		}
+		return capabilities, nil
+	}
+
+	return nil, fmt.Errorf("VM size %s is not offered in %s", size, location)
+}
+
+// Checks a VM size supports the network features a VM profile enables:
+// accelerated networking on any of its NICs, and as many NICs as it has.
+// NICs the size can't support otherwise only fail as the surge provisions
+// them.
+func (s *azureSession) checkVMSizeNetworking(ctx context.Context, location string, size string, profile *compute.VirtualMachineScaleSetVMProfile) error {
+	if profile == nil || profile.NetworkProfile == nil || profile.NetworkProfile.NetworkInterfaceConfigurations == nil {
+		return nil
+	}
+	nics := *profile.NetworkProfile.NetworkInterfaceConfigurations
+
+	capabilities, err := s.getVMSizeCapabilities(ctx, location, size)
+	if err != nil {
+		return err
+	}
+
+	for _, nic := range nics {
+		if nic.VirtualMachineScaleSetNetworkConfigurationProperties != nil && to.Bool(nic.EnableAcceleratedNetworking) &&
+			!strings.EqualFold(capabilities["AcceleratedNetworkingEnabled"], "True") {
+			return fmt.Errorf("NIC configuration %s enables accelerated networking, which VM size %s doesn't support; disable it or choose another size", to.String(nic.Name), size)
+		}
+	}
+
+	if max, err := strconv.Atoi(capabilities["MaxNetworkInterfaces"]); err == nil && len(nics) > max {
+		return fmt.Errorf("the model has %d NIC configurations, but VM size %s supports at most %d", len(nics), size, max)
+	}
+
+	return nil
+}
+
+// Checks the scale set model's VM size supports its network features
+func (s *azureSession) preflightVMSizeNetworking(ctx context.Context) error {
+	scaleSet, err := s.getVMSSClient().Get(ctx, s.ResourceGroupName, s.ScaleSetName)
+	if err != nil {
+		return err
+	}
+	if scaleSet.Sku == nil || scaleSet.VirtualMachineScaleSetProperties == nil {
+		return nil
+	}
+
+	return s.checkVMSizeNetworking(ctx, to.String(scaleSet.Location), to.String(scaleSet.Sku.Name), scaleSet.VirtualMachineProfile)
+}
@@ -0,0 +1,127 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Severities a vulnerability gate may report, least severe first
+const (
+	severityLow      = "low"
+	severityMedium   = "medium"
+	severityHigh     = "high"
+	severityCritical = "critical"
+)
+
+var severityRank = map[string]int{
+	severityLow:      1,
+	severityMedium:   2,
+	severityHigh:     3,
+	severityCritical: 4,
+}
+
+// vulnerabilityFinding is a known vulnerability a gate reports in an image
+type vulnerabilityFinding struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+}
+
+func (f vulnerabilityFinding) String() string {
+	if f.Package == "" {
+		return fmt.Sprintf("%s (%s)", f.ID, strings.ToLower(f.Severity))
+	}
+	return fmt.Sprintf("%s in %s (%s)", f.ID, f.Package, strings.ToLower(f.Severity))
+}
+
+// Asks a vulnerability gate endpoint for the findings in an image. The
+// image is POSTed as {"image": "<image>"}, rendered as by
+// imageReferenceString, and the endpoint answers with
+// {"findings": [{"id": "CVE-...", "severity": "critical", "package": "..."}]}.
+// Scanners such as a Trivy server or Defender for Cloud are reached
+// through an endpoint adapting them to this.
+func queryVulnerabilityGate(ctx context.Context, endpoint string, token secret, image string) ([]vulnerabilityFinding, error) {
+	var result struct {
+		Findings []vulnerabilityFinding `json:"findings"`
+	}
+
+	body, err := json.Marshal(map[string]string{"image": image})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token.reveal())
+	}
+
+	if err = getJSON(ctx, req, &result); err != nil {
+		return nil, err
+	}
+
+	return result.Findings, nil
+}
+
+// Refuses to roll out an image the vulnerability gate, if one is given,
+// reports findings in at or above the blocking severity. The image is the
+// one the run is moving the model onto, otherwise the model's own.
+func (r *upgradeRun) checkVulnerabilities(ctx context.Context) error {
+	endpoint := r.cmd.Flags().Lookup("vulnerability-gate").Value.String()
+	if endpoint == "" {
+		return nil
+	}
+
+	ref := r.targetImage
+	if ref == nil {
+		var err error
+		if ref, _, err = r.sess.getModelImage(ctx); err != nil {
+			return err
+		}
+		if ref == nil {
+			return nil
+		}
+	}
+
+	token, err := resolveSecret(ctx, r.cmd.Flags().Lookup("vulnerability-gate-token").Value.String())
+	if err != nil {
+		return err
+	}
+
+	image := imageReferenceString(ref)
+	findings, err := queryVulnerabilityGate(ctx, endpoint, token, image)
+	if err != nil {
+		return fmt.Errorf("unable to check image %s for vulnerabilities: %v", image, err)
+	}
+
+	threshold := r.cmd.Flags().Lookup("vulnerability-block-severity").Value.String()
+
+	var blocking []vulnerabilityFinding
+	for _, finding := range findings {
+		if severityRank[strings.ToLower(finding.Severity)] >= severityRank[threshold] {
+			blocking = append(blocking, finding)
+		}
+	}
+	sort.Slice(blocking, func(i, j int) bool { return blocking[i].ID < blocking[j].ID })
+
+	if len(blocking) > 0 {
+		described := make([]string, len(blocking))
+		for i, finding := range blocking {
+			described[i] = finding.String()
+		}
+		return fmt.Errorf("image %s has %d known vulnerabilities of %s severity or above: %s", image, len(blocking), threshold, strings.Join(described, ", "))
+	}
+
+	log.Infof("Image %s has no known vulnerabilities of %s severity or above (%d findings in total)", image, threshold, len(findings))
+	return nil
+}
@@ -0,0 +1,189 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// appGatewayTraffic is what an application gateway's clients saw over a
+// warm-up step
+type appGatewayTraffic struct {
+	// Average time to the last byte of backend responses
+	Latency time.Duration
+	// Requests the gateway failed
+	FailedRequests float64
+}
+
+// Reads an application gateway's backend latency and failed requests
+// since the given time, via Azure Monitor
+func (s *azureSession) getAppGatewayTraffic(ctx context.Context, appGatewayID string, since time.Time) (appGatewayTraffic, error) {
+	var traffic appGatewayTraffic
+	var metrics struct {
+		Value []struct {
+			Name struct {
+				Value string `json:"value"`
+			} `json:"name"`
+			Timeseries []struct {
+				Data []struct {
+					Average *float64 `json:"average"`
+					Total   *float64 `json:"total"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"value"`
+	}
+
+	end := time.Now().UTC()
+	err := s.armGetWithQuery(ctx, appGatewayID+"/providers/microsoft.insights/metrics", map[string]interface{}{
+		"api-version": metricsAPIVersion,
+		"metricnames": "BackendLastByteResponseTime,FailedRequests",
+		"aggregation": "Average,Total",
+		"interval":    "PT1M",
+		"timespan":    fmt.Sprintf("%s/%s", since.UTC().Format(time.RFC3339), end.Format(time.RFC3339)),
+	}, &metrics)
+	if err != nil {
+		return traffic, err
+	}
+
+	for _, metric := range metrics.Value {
+		var sum float64
+		var points int
+
+		for _, series := range metric.Timeseries {
+			for _, data := range series.Data {
+				switch {
+				case strings.EqualFold(metric.Name.Value, "BackendLastByteResponseTime") && data.Average != nil:
+					sum += *data.Average
+					points++
+				case strings.EqualFold(metric.Name.Value, "FailedRequests") && data.Total != nil:
+					traffic.FailedRequests += *data.Total
+				}
+			}
+		}
+
+		if points > 0 {
+			traffic.Latency = time.Duration(sum / float64(points) * float64(time.Millisecond))
+		}
+	}
+
+	return traffic, nil
+}
+
+// Checks new instances are coping with their larger share of traffic:
+// each is still healthy in its backend pools, and the application
+// gateways in front of them are within the latency and failed request
+// limits, where given
+func (r *upgradeRun) checkWarmUp(ctx context.Context, loadBalancers map[string][]backendTarget, appGateways map[string][]backendTarget, since time.Time) error {
+	unhealthy, err := r.sess.getUnhealthyBackends(ctx, loadBalancers, appGateways)
+	if err != nil {
+		return err
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("backends became unhealthy during warm-up: %s", strings.Join(unhealthy, "; "))
+	}
+
+	maxLatency, _ := r.cmd.Flags().GetDuration("warm-up-max-latency")
+	maxFailed, _ := r.cmd.Flags().GetInt("warm-up-max-failed-requests")
+	if maxLatency <= 0 && maxFailed <= 0 {
+		return nil
+	}
+
+	for gw := range appGateways {
+		traffic, err := r.sess.getAppGatewayTraffic(ctx, gw, since)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Application gateway %s: backend latency %s, %.0f failed requests", gw, traffic.Latency, traffic.FailedRequests)
+
+		if maxLatency > 0 && traffic.Latency > maxLatency {
+			return fmt.Errorf("backend latency of application gateway %s rose to %s during warm-up, above the limit of %s", gw, traffic.Latency, maxLatency)
+		}
+		if maxFailed > 0 && traffic.FailedRequests > float64(maxFailed) {
+			return fmt.Errorf("application gateway %s failed %.0f requests during warm-up, above the limit of %d", gw, traffic.FailedRequests, maxFailed)
+		}
+	}
+
+	return nil
+}
+
+// Shifts traffic onto the new instances gradually rather than all at
+// once, so their caches warm up before they carry the full load. Old
+// instances are drained and removed over --warm-up-steps steps, waiting
+// --warm-up-interval after each while watching the new instances' health
+// and, behind application gateways, latency and failed requests. The
+// final step's old instances are left to the scale-in.
+func (r *upgradeRun) warmUp(ctx context.Context) error {
+	steps, _ := r.cmd.Flags().GetInt("warm-up-steps")
+	if steps <= 1 {
+		return nil
+	}
+	interval, _ := r.cmd.Flags().GetDuration("warm-up-interval")
+
+	old, err := r.oldInstanceIDs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	old = r.leaderLast(ctx, r.rankByLoad(ctx, old))
+
+	if err = r.recordState(ctx, upgradeStateScalingIn); err != nil {
+		return err
+	}
+
+	loadBalancers, appGateways, err := r.sess.getBackendTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for step := 1; step < steps; step++ {
+		batch := old[removed : len(old)*step/steps]
+		if len(batch) == 0 {
+			continue
+		}
+
+		if err = r.checkExternalChanges(ctx); err != nil {
+			return err
+		}
+
+		if err = r.handOffLeadership(ctx, batch); err != nil {
+			return err
+		}
+
+		err = r.drainInstances(ctx, batch, func(ctx context.Context, ids []string) error {
+			log.Infof("Warm-up step %d of %d, removing %d old instances: %s", step, steps, len(ids), strings.Join(ids, ", "))
+			if err := r.sess.deleteInstances(ctx, ids); err != nil {
+				return err
+			}
+			removed += len(ids)
+			r.expectedCapacity -= int64(len(ids))
+			r.surgeMeter.set(r.expectedCapacity - r.originalCapacity)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		since := time.Now()
+		log.Infof("%d of %d old instances remain, watching new instances for %s...", len(old)-removed, len(old), interval)
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if err = r.checkWarmUp(ctx, loadBalancers, appGateways, since); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Warm-up complete, new instances are serving without issue")
+	return nil
+}
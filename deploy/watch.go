@@ -0,0 +1,141 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/phase"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Behaviours when the scale set's capacity changes outside the upgrade
+	externalChangeAbort     = "abort"
+	externalChangeReconcile = "reconcile"
+
+	// Time capacity must hold steady before an external change is acted on
+	externalChangeSettle = 30 * time.Second
+)
+
+// Returns a fingerprint of the parts of the scale set model an upgrade
+// rolls out, which changes whenever the model is updated.
+func modelFingerprint(scaleSet compute.VirtualMachineScaleSet) string {
+	var profile *compute.VirtualMachineScaleSetVMProfile
+	if scaleSet.VirtualMachineScaleSetProperties != nil {
+		profile = scaleSet.VirtualMachineProfile
+	}
+
+	var size string
+	if scaleSet.Sku != nil {
+		size = to.String(scaleSet.Sku.Name)
+	}
+
+	encoded, _ := json.Marshal(struct {
+		Size    string
+		Profile *compute.VirtualMachineScaleSetVMProfile
+	}{size, profile})
+
+	return string(encoded)
+}
+
+// Starts watching for changes made to the scale set by anything other
+// than this upgrade, from the given capacity and the current model.
+func (r *upgradeRun) watchFrom(ctx context.Context, capacity int64) error {
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	r.watching = true
+	r.expectedCapacity = capacity
+	r.baselineModel = modelFingerprint(scaleSet)
+
+	return nil
+}
+
+// Checks the scale set for changes made by an autoscaler or a human since
+// the surge. A model change always aborts the run, since instances surged
+// before it already run an outdated model. A capacity change is left to
+// settle, then either aborts the run or, when reconciling, is taken as a
+// change to the capacity the scale set should end up with.
+func (r *upgradeRun) checkExternalChanges(ctx context.Context) error {
+	if !r.watching {
+		return nil
+	}
+
+	scaleSet, err := r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+	if err != nil {
+		return err
+	}
+
+	if modelFingerprint(scaleSet) != r.baselineModel {
+		return fmt.Errorf("the model of %s was changed outside this upgrade while it ran, so instances it surged are already outdated; re-run the upgrade to roll onto the new model",
+			r.sess.ScaleSetName)
+	}
+
+	capacity := *scaleSet.Sku.Capacity
+	if capacity == r.expectedCapacity {
+		return nil
+	}
+
+	log.Warnf("Capacity of %s was changed outside this upgrade from %d to %d, pausing for it to settle...", r.sess.ScaleSetName, r.expectedCapacity, capacity)
+
+	for {
+		select {
+		case <-time.After(externalChangeSettle):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		scaleSet, err = r.sess.getVMSSClient().Get(ctx, r.sess.ResourceGroupName, r.sess.ScaleSetName)
+		if err != nil {
+			return err
+		}
+		if *scaleSet.Sku.Capacity == capacity {
+			break
+		}
+		capacity = *scaleSet.Sku.Capacity
+	}
+
+	if r.onExternalChange != externalChangeReconcile {
+		return fmt.Errorf("capacity of %s was changed outside this upgrade from %d to %d, likely by an autoscaler; pause autoscaling, or re-run with --on-external-change=%s to adopt the change",
+			r.sess.ScaleSetName, r.expectedCapacity, capacity, externalChangeReconcile)
+	}
+
+	original := r.originalCapacity + capacity - r.expectedCapacity
+	if original < 1 {
+		return fmt.Errorf("capacity of %s was reduced outside this upgrade to %d, leaving no room for its original instances", r.sess.ScaleSetName, capacity)
+	}
+
+	log.Infof("Adopting external capacity change, %s will finish with %d instances rather than %d", r.sess.ScaleSetName, original, r.originalCapacity)
+
+	r.originalCapacity = original
+	r.expectedCapacity = capacity
+
+	state := r.state
+	if state == "" {
+		state = upgradeStateSurging
+	}
+	return r.recordState(ctx, state)
+}
+
+// watchedStep checks for external changes before executing its step
+type watchedStep struct {
+	phase.Step
+	run *upgradeRun
+}
+
+func (w watchedStep) Execute(ctx context.Context) error {
+	if err := w.run.checkExternalChanges(ctx); err != nil {
+		return err
+	}
+	return w.Step.Execute(ctx)
+}
+
+func (w watchedStep) Commits() bool {
+	return phase.Commits(w.Step)
+}
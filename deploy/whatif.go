@@ -0,0 +1,276 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const deploymentsAPIVersion = "2021-04-01"
+
+// Phases which gate the new instances ahead of the old ones' removal
+var gatePhases = map[string]bool{
+	"verify-networking":             true,
+	"verify-dual-stack":             true,
+	"verify-extensions":             true,
+	"gpu-readiness":                 true,
+	"verify-certificates":           true,
+	"verify-identities":             true,
+	"smoke-test-script":             true,
+	"smoke-tests":                   true,
+	"lb-health":                     true,
+	"discovery-register":            true,
+	"verify-terminate-notification": true,
+}
+
+// whatIfChange is a change ARM predicts a template deployment would make
+// to one resource
+type whatIfChange struct {
+	ResourceID string                 `json:"resourceId"`
+	ChangeType string                 `json:"changeType"`
+	Delta      []whatIfPropertyChange `json:"delta,omitempty"`
+}
+
+// whatIfPropertyChange is a change to one property of a resource, or to
+// its children for objects and arrays
+type whatIfPropertyChange struct {
+	Path               string                 `json:"path"`
+	PropertyChangeType string                 `json:"propertyChangeType"`
+	Before             interface{}            `json:"before,omitempty"`
+	After              interface{}            `json:"after,omitempty"`
+	Children           []whatIfPropertyChange `json:"children,omitempty"`
+}
+
+// Reads an ARM template, and the parameters file given with it if any.
+// Parameters files may give the parameters bare or under 'parameters'.
+func loadTemplate(templatePath string, parametersPath string) (map[string]interface{}, map[string]interface{}, error) {
+	var template, parameters map[string]interface{}
+
+	contents, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(contents, &template); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a JSON ARM template: %v", templatePath, err)
+	}
+
+	if parametersPath == "" {
+		return template, map[string]interface{}{}, nil
+	}
+
+	if contents, err = ioutil.ReadFile(parametersPath); err != nil {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(contents, &parameters); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a JSON parameters file: %v", parametersPath, err)
+	}
+	if wrapped, ok := parameters["parameters"].(map[string]interface{}); ok {
+		parameters = wrapped
+	}
+
+	return template, parameters, nil
+}
+
+// Asks ARM what deploying a template to the session's resource group would
+// change, without deploying it. Resources the template leaves alone are
+// left out.
+func (s *azureSession) whatIf(ctx context.Context, template map[string]interface{}, parameters map[string]interface{}) ([]whatIfChange, error) {
+	name := fmt.Sprintf("azure-cluster-upgrade-what-if-%d", time.Now().Unix())
+	body := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"mode":       "Incremental",
+			"template":   template,
+			"parameters": parameters,
+		},
+	}
+
+	var result struct {
+		Status     string `json:"status"`
+		Properties struct {
+			Changes []whatIfChange `json:"changes"`
+		} `json:"properties"`
+		Error *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+
+	path := fmt.Sprintf("%s/providers/Microsoft.Resources/deployments/%s/whatIf", s.resourceGroupPath(), name)
+	if err := s.armDoAsync(ctx, http.MethodPost, path, deploymentsAPIVersion, body, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("what-if failed: %s: %s", result.Error.Code, result.Error.Message)
+	}
+
+	changes := []whatIfChange{}
+	for _, change := range result.Properties.Changes {
+		if change.ChangeType != "Ignore" && change.ChangeType != "NoChange" {
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ResourceID < changes[j].ResourceID })
+
+	return changes, nil
+}
+
+// Runs ARM What-If on the template given by --template, the model change
+// being planned for
+func (s *azureSession) whatIfFromFlags(ctx context.Context, cmd *cobra.Command) ([]whatIfChange, error) {
+	templatePath := cmd.Flags().Lookup("template").Value.String()
+	if templatePath == "" {
+		return nil, fmt.Errorf("--what-if needs --template, the ARM template making the model change")
+	}
+
+	template, parameters, err := loadTemplate(templatePath, cmd.Flags().Lookup("template-parameters").Value.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Simulated {
+		log.Info("The simulation doesn't model What-If, so the template is planned as changing the scale set")
+		return []whatIfChange{{ResourceID: s.scaleSetPath(), ChangeType: "Modify"}}, nil
+	}
+
+	return s.whatIf(ctx, template, parameters)
+}
+
+// Reports whether What-If predicts a change to the session's scale set,
+// whose instances would then all be replaced
+func (s *azureSession) changesScaleSet(changes []whatIfChange) bool {
+	for _, change := range changes {
+		if strings.EqualFold(change.ResourceID, s.scaleSetPath()) && change.ChangeType != "Delete" {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats property changes as one line each, indented by depth
+func formatPropertyChanges(b *strings.Builder, changes []whatIfPropertyChange, indent string) {
+	symbols := map[string]string{"Create": "+", "Delete": "-", "Modify": "~", "Array": "~", "NoEffect": "="}
+
+	for _, change := range changes {
+		symbol := symbols[change.PropertyChangeType]
+		switch change.PropertyChangeType {
+		case "Create":
+			fmt.Fprintf(b, "%s%s %s: %s\n", indent, symbol, change.Path, whatIfValue(change.After))
+		case "Delete":
+			fmt.Fprintf(b, "%s%s %s: %s\n", indent, symbol, change.Path, whatIfValue(change.Before))
+		case "Modify", "NoEffect":
+			if len(change.Children) > 0 {
+				fmt.Fprintf(b, "%s%s %s:\n", indent, symbol, change.Path)
+				formatPropertyChanges(b, change.Children, indent+"    ")
+				continue
+			}
+			fmt.Fprintf(b, "%s%s %s: %s => %s\n", indent, symbol, change.Path, whatIfValue(change.Before), whatIfValue(change.After))
+		default:
+			fmt.Fprintf(b, "%s%s %s:\n", indent, symbol, change.Path)
+			formatPropertyChanges(b, change.Children, indent+"    ")
+		}
+	}
+}
+
+// Renders a value from a What-If delta compactly
+func whatIfValue(v interface{}) string {
+	encoded, _ := json.Marshal(v)
+	return orNone(string(encoded))
+}
+
+// Describes, step by step, what the upgrade does to which instances: the
+// surge, the gates the new instances must pass, and how the old ones are
+// drained and removed, for the plan's reviewers
+func (r *upgradeRun) choreography(ctx context.Context, phases []string) ([]string, error) {
+	replaced, err := r.replacedInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current, err := r.sess.getInstanceIDs(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	isReplaced := map[string]bool{}
+	for _, id := range replaced {
+		isReplaced[id] = true
+	}
+	var kept []string
+	for _, id := range current {
+		if !isReplaced[id] {
+			kept = append(kept, id)
+		}
+	}
+
+	capacity := r.originalCapacity
+	if !r.resuming {
+		capacity = int64(len(current))
+	}
+
+	var steps []string
+	steps = append(steps, fmt.Sprintf("Surge from %d to %d instances, creating %d on the new model", capacity, capacity+r.surgeSize, r.surgeSize))
+	if len(kept) > 0 {
+		steps = append(steps, fmt.Sprintf("Protect the new instances and the %d kept from scale-in: %s", len(kept), strings.Join(kept, ", ")))
+	} else {
+		steps = append(steps, "Protect the new instances from scale-in")
+	}
+
+	var gates []string
+	for _, name := range phases {
+		if gatePhases[name] {
+			gates = append(gates, name)
+		}
+	}
+	if len(gates) > 0 {
+		steps = append(steps, fmt.Sprintf("Gate the new instances on %s", strings.Join(gates, ", ")))
+	}
+
+	if r.strategyName == strategyScaleOutOnly {
+		return append(steps, fmt.Sprintf("Hold the surge at %d instances, leaving instances %s to be retired or removed by finish",
+			capacity+r.surgeSize, strings.Join(replaced, ", "))), nil
+	}
+
+	replaced = r.leaderLast(ctx, r.rankByLoad(ctx, replaced))
+	remaining := replaced
+	if warmUpSteps, _ := r.cmd.Flags().GetInt("warm-up-steps"); warmUpSteps > 1 && len(replaced) > 0 {
+		interval, _ := r.cmd.Flags().GetDuration("warm-up-interval")
+		removed := 0
+		for step := 1; step < warmUpSteps; step++ {
+			batch := replaced[removed : len(replaced)*step/warmUpSteps]
+			if len(batch) == 0 {
+				continue
+			}
+			steps = append(steps, fmt.Sprintf("Warm-up step %d of %d: drain and remove instances %s, then watch the new instances for %s",
+				step, warmUpSteps, strings.Join(batch, ", "), interval))
+			removed += len(batch)
+		}
+		remaining = replaced[removed:]
+	}
+
+	switch {
+	case len(remaining) == 0:
+	case r.maxUnavailable != "" || r.minHealthy != 0:
+		batch := int64(len(remaining))
+		if r.maxUnavailable != "" {
+			if batch, err = parseMaxUnavailable(r.maxUnavailable, capacity); err != nil {
+				return nil, err
+			}
+		}
+		removal := fmt.Sprintf("Drain and remove instances %s in batches of up to %d", strings.Join(remaining, ", "), batch)
+		if r.minHealthy != 0 {
+			removal += fmt.Sprintf(", keeping at least %d instances available", r.minHealthy)
+		}
+		steps = append(steps, removal)
+	default:
+		steps = append(steps, fmt.Sprintf("Drain instances %s and remove them together by scaling in", strings.Join(remaining, ", ")))
+	}
+
+	return append(steps, fmt.Sprintf("Scale back to %d instances, every one on the new model", capacity)), nil
+}
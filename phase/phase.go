@@ -0,0 +1,265 @@
+// Package phase provides a small engine for executing an ordered list of
+// steps, such as the phases of a blue/green upgrade. Each step can check
+// its preconditions ahead of time, and undo its work if a later step fails.
+package phase
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Step is a single unit of work within an Engine
+type Step interface {
+	// Name identifies the step in logs and errors
+	Name() string
+	// Validate checks the step's preconditions without mutating anything.
+	// Every step is validated before any step is executed.
+	Validate(ctx context.Context) error
+	// Execute performs the step's work
+	Execute(ctx context.Context) error
+	// Rollback undoes the step's work. It may be called on a step whose
+	// Execute failed part way through, so it must tolerate partial state.
+	Rollback(ctx context.Context) error
+}
+
+// Committer is implemented by steps past which a run can't be undone, such
+// as one removing what earlier steps would restore. Once such a step
+// starts executing, neither it nor any step before it is rolled back.
+type Committer interface {
+	Commits() bool
+}
+
+// Commits reports whether a step is a Committer which commits the run
+func Commits(step Step) bool {
+	committer, ok := step.(Committer)
+	return ok && committer.Commits()
+}
+
+// Func adapts plain functions to the Step interface. Any function left
+// nil is treated as a no-op.
+type Func struct {
+	StepName     string
+	ValidateFunc func(ctx context.Context) error
+	ExecuteFunc  func(ctx context.Context) error
+	RollbackFunc func(ctx context.Context) error
+	// Commit marks the step as the point of no return, see Committer
+	Commit bool
+}
+
+// Name returns the step's name
+func (f *Func) Name() string {
+	return f.StepName
+}
+
+// Validate calls ValidateFunc, if set
+func (f *Func) Validate(ctx context.Context) error {
+	if f.ValidateFunc == nil {
+		return nil
+	}
+	return f.ValidateFunc(ctx)
+}
+
+// Execute calls ExecuteFunc, if set
+func (f *Func) Execute(ctx context.Context) error {
+	if f.ExecuteFunc == nil {
+		return nil
+	}
+	return f.ExecuteFunc(ctx)
+}
+
+// Rollback calls RollbackFunc, if set
+func (f *Func) Rollback(ctx context.Context) error {
+	if f.RollbackFunc == nil {
+		return nil
+	}
+	return f.RollbackFunc(ctx)
+}
+
+// Commits reports whether Commit is set
+func (f *Func) Commits() bool {
+	return f.Commit
+}
+
+// Error reports the step which failed, along with any errors encountered
+// while rolling back.
+type Error struct {
+	Step         string
+	Err          error
+	RollbackErrs []error
+	// RolledBack reports that the failed step and every step before it
+	// were rolled back without error
+	RolledBack bool
+	// Committed reports that the step failed at or after one which
+	// commits the run, so the steps up to it were left in place
+	Committed bool
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Step, e.Err)
+	if len(e.RollbackErrs) > 0 {
+		var errs []string
+		for _, err := range e.RollbackErrs {
+			errs = append(errs, err.Error())
+		}
+		msg += fmt.Sprintf(" (rollback failed: %s)", strings.Join(errs, "; "))
+	}
+	return msg
+}
+
+// Engine executes an ordered list of steps
+type Engine struct {
+	steps []Step
+
+	// RollbackOnFailure rolls back the failed step and every step before
+	// it, in reverse order, when a step fails to execute, stopping short
+	// of any step which committed the run.
+	RollbackOnFailure bool
+	// RollbackTimeout limits how long rolling back may take. Rollbacks
+	// run on a context of their own, since the run's may have expired,
+	// without a limit if zero.
+	RollbackTimeout time.Duration
+
+	mu      sync.Mutex
+	current string
+}
+
+// Poller tracks a run started in the background, so a program embedding
+// the engine can multiplex many runs with its own scheduling rather than
+// blocking on each
+type Poller interface {
+	// Done is closed once the run finishes
+	Done() <-chan struct{}
+	// Phase returns the name of the step being executed, or of the last
+	// one once the run finishes, or "" before any has started
+	Phase() string
+	// Result returns the run's outcome, as Run would. Only valid once Done
+	// is closed.
+	Result() error
+}
+
+// NewEngine returns an Engine which executes the given steps in order
+func NewEngine(steps ...Step) *Engine {
+	return &Engine{steps: steps}
+}
+
+// Add appends steps to the end of the engine's list
+func (e *Engine) Add(steps ...Step) {
+	e.steps = append(e.steps, steps...)
+}
+
+// Steps returns the engine's steps, in execution order
+func (e *Engine) Steps() []Step {
+	return e.steps
+}
+
+// Current returns the name of the step being executed, or of the last one
+// executed, or "" before any has started
+func (e *Engine) Current() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.current
+}
+
+func (e *Engine) setCurrent(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = name
+}
+
+// Validate checks the preconditions of every step, returning the first failure
+func (e *Engine) Validate(ctx context.Context) error {
+	for _, step := range e.steps {
+		if err := step.Validate(ctx); err != nil {
+			return &Error{Step: step.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// Run validates every step, then executes them in order. Execution stops
+// at the first failing step, which is rolled back along with its
+// predecessors back to the last step committing the run, if
+// RollbackOnFailure is set.
+func (e *Engine) Run(ctx context.Context) error {
+	if err := e.Validate(ctx); err != nil {
+		return err
+	}
+
+	committed := -1
+	for i, step := range e.steps {
+		log.WithField("phase", step.Name()).Debug("Starting phase")
+		e.setCurrent(step.Name())
+
+		if Commits(step) {
+			committed = i
+		}
+
+		if err := step.Execute(ctx); err != nil {
+			stepErr := &Error{Step: step.Name(), Err: err, Committed: committed >= 0}
+			if e.RollbackOnFailure {
+				stepErr.RollbackErrs = e.rollback(i, committed)
+				stepErr.RolledBack = committed < 0 && len(stepErr.RollbackErrs) == 0
+			}
+			return stepErr
+		}
+	}
+
+	return nil
+}
+
+// enginePoller tracks a run started with Start
+type enginePoller struct {
+	engine *Engine
+	done   chan struct{}
+	err    error
+}
+
+func (p *enginePoller) Done() <-chan struct{} { return p.done }
+func (p *enginePoller) Phase() string         { return p.engine.Current() }
+func (p *enginePoller) Result() error         { return p.err }
+
+// Start runs the engine in the background, as Run does, returning a Poller
+// tracking its progress and outcome
+func (e *Engine) Start(ctx context.Context) Poller {
+	p := &enginePoller{engine: e, done: make(chan struct{})}
+
+	go func() {
+		defer close(p.done)
+		p.err = e.Run(ctx)
+	}()
+
+	return p
+}
+
+// Rolls back the steps after 'committed' up to and including 'last', in
+// reverse order. Every step is attempted even if an earlier rollback
+// fails.
+func (e *Engine) rollback(last int, committed int) []error {
+	var errs []error
+
+	ctx, cancel := context.Background(), func() {}
+	if e.RollbackTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.RollbackTimeout)
+	}
+	defer cancel()
+
+	if committed >= 0 {
+		log.WithField("phase", e.steps[committed].Name()).Warn("Not rolling back this phase or any before it, the upgrade was committed to")
+	}
+
+	for i := last; i > committed; i-- {
+		step := e.steps[i]
+		log.WithField("phase", step.Name()).Warn("Rolling back phase")
+
+		if err := step.Rollback(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", step.Name(), err))
+		}
+	}
+
+	return errs
+}
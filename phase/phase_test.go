@@ -0,0 +1,207 @@
+package phase
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+// journal records the calls made to the steps of a run, in order
+type journal struct {
+	calls []string
+}
+
+// Returns a step which records its calls, failing Execute if asked to
+func (j *journal) step(name string, fail bool) *Func {
+	return &Func{
+		StepName: name,
+		ValidateFunc: func(context.Context) error {
+			j.calls = append(j.calls, "validate "+name)
+			return nil
+		},
+		ExecuteFunc: func(context.Context) error {
+			j.calls = append(j.calls, "execute "+name)
+			if fail {
+				return errFailed
+			}
+			return nil
+		},
+		RollbackFunc: func(context.Context) error {
+			j.calls = append(j.calls, "rollback "+name)
+			return nil
+		},
+	}
+}
+
+func (j *journal) expect(t *testing.T, calls ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(j.calls, calls) {
+		t.Errorf("expected calls %v, got %v", calls, j.calls)
+	}
+}
+
+func TestRunValidatesEveryStepBeforeExecuting(t *testing.T) {
+	j := &journal{}
+	engine := NewEngine(j.step("a", false), j.step("b", false))
+
+	if err := engine.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	j.expect(t, "validate a", "validate b", "execute a", "execute b")
+	if engine.Current() != "b" {
+		t.Errorf("expected the current phase to be b, got %s", engine.Current())
+	}
+}
+
+func TestRunExecutesNothingIfValidationFails(t *testing.T) {
+	j := &journal{}
+	invalid := j.step("b", false)
+	invalid.ValidateFunc = func(context.Context) error { return errFailed }
+
+	err := NewEngine(j.step("a", false), invalid).Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) || stepErr.Step != "b" || !errors.Is(stepErr.Err, errFailed) {
+		t.Fatalf("expected b to fail validation, got %v", err)
+	}
+	j.expect(t, "validate a")
+}
+
+func TestRollbackInReverseOrder(t *testing.T) {
+	j := &journal{}
+	engine := NewEngine(j.step("a", false), j.step("b", false), j.step("c", true), j.step("d", false))
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) || stepErr.Step != "c" {
+		t.Fatalf("expected c to fail, got %v", err)
+	}
+	if !stepErr.RolledBack || stepErr.Committed {
+		t.Errorf("expected a rolled back, uncommitted failure, got %+v", stepErr)
+	}
+	j.expect(t,
+		"validate a", "validate b", "validate c", "validate d",
+		"execute a", "execute b", "execute c",
+		"rollback c", "rollback b", "rollback a",
+	)
+}
+
+func TestNoRollbackUnlessAsked(t *testing.T) {
+	j := &journal{}
+	err := NewEngine(j.step("a", false), j.step("b", true)).Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) || stepErr.RolledBack {
+		t.Fatalf("expected a failure which isn't rolled back, got %v", err)
+	}
+	j.expect(t, "validate a", "validate b", "execute a", "execute b")
+}
+
+func TestRollbackStopsAtCommitter(t *testing.T) {
+	j := &journal{}
+	commit := j.step("commit", false)
+	commit.Commit = true
+
+	engine := NewEngine(j.step("a", false), commit, j.step("b", false), j.step("c", true))
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) || stepErr.Step != "c" {
+		t.Fatalf("expected c to fail, got %v", err)
+	}
+	if !stepErr.Committed || stepErr.RolledBack {
+		t.Errorf("expected a committed failure which isn't fully rolled back, got %+v", stepErr)
+	}
+	j.expect(t,
+		"validate a", "validate commit", "validate b", "validate c",
+		"execute a", "execute commit", "execute b", "execute c",
+		"rollback c", "rollback b",
+	)
+}
+
+func TestCommitterWhichFailsIsNotRolledBack(t *testing.T) {
+	j := &journal{}
+	commit := j.step("commit", true)
+	commit.Commit = true
+
+	engine := NewEngine(j.step("a", false), commit)
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) || !stepErr.Committed || stepErr.RolledBack {
+		t.Fatalf("expected a committed failure, got %v", err)
+	}
+	j.expect(t, "validate a", "validate commit", "execute a", "execute commit")
+}
+
+func TestRollbackErrorsAreCollected(t *testing.T) {
+	j := &journal{}
+	broken := j.step("b", false)
+	broken.RollbackFunc = func(context.Context) error {
+		j.calls = append(j.calls, "rollback b")
+		return errFailed
+	}
+
+	engine := NewEngine(j.step("a", false), broken, j.step("c", true))
+	engine.RollbackOnFailure = true
+
+	err := engine.Run(context.Background())
+
+	var stepErr *Error
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("expected a step error, got %v", err)
+	}
+	if stepErr.RolledBack || len(stepErr.RollbackErrs) != 1 {
+		t.Errorf("expected one rollback error and not to be rolled back, got %+v", stepErr)
+	}
+	// Rolling back carries on past the failure
+	j.expect(t,
+		"validate a", "validate b", "validate c",
+		"execute a", "execute b", "execute c",
+		"rollback c", "rollback b", "rollback a",
+	)
+}
+
+func TestRollbackRunsOnItsOwnContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var deadline time.Time
+	var rollbackErr error
+	engine := NewEngine(&Func{
+		StepName: "a",
+		ExecuteFunc: func(context.Context) error {
+			// The run's context expires as the step fails
+			cancel()
+			return errFailed
+		},
+		RollbackFunc: func(ctx context.Context) error {
+			deadline, _ = ctx.Deadline()
+			rollbackErr = ctx.Err()
+			return nil
+		},
+	})
+	engine.RollbackOnFailure = true
+	engine.RollbackTimeout = time.Minute
+
+	start := time.Now()
+	if err := engine.Run(ctx); err == nil {
+		t.Fatal("expected the run to fail")
+	}
+
+	if rollbackErr != nil {
+		t.Errorf("expected the rollback's context to outlive the run's, got %v", rollbackErr)
+	}
+	if deadline.IsZero() || deadline.Before(start) || deadline.After(start.Add(time.Minute+time.Second)) {
+		t.Errorf("expected the rollback to be limited to RollbackTimeout, got deadline %v", deadline)
+	}
+}
@@ -0,0 +1,200 @@
+// Package recorder captures the HTTP traffic of autorest clients to a
+// cassette file, and replays it later without touching the network. A
+// recorded run can then be repeated deterministically, e.g. to reproduce
+// a failure such as throttling part way through an upgrade.
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// Mode selects whether a Recorder records or replays traffic
+type Mode int
+
+const (
+	// Record sends requests to the network and appends each exchange to the cassette
+	Record Mode = iota
+	// Replay answers requests from the cassette, never touching the network
+	Replay
+)
+
+// Interaction is a single recorded request and its response
+type Interaction struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody string      `json:"requestBody,omitempty"`
+	StatusCode  int         `json:"statusCode"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        string      `json:"body,omitempty"`
+}
+
+// Recorder is an autorest.Sender which records or replays interactions.
+// Cassettes hold one JSON-encoded Interaction per line. Recorded
+// interactions are written as they happen, so a run which exits part way
+// through still leaves a usable cassette.
+type Recorder struct {
+	mode   Mode
+	sender autorest.Sender
+
+	mu           sync.Mutex
+	file         *os.File
+	interactions []Interaction
+	used         []bool
+}
+
+// New opens a cassette. Recording truncates any existing cassette at
+// 'path', while replaying loads every interaction from it.
+func New(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{mode: mode}
+
+	if mode == Record {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		r.file = file
+		r.sender = autorest.CreateSender()
+		return r, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var interaction Interaction
+		if err = json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("invalid interaction in cassette %s: %v", path, err)
+		}
+		r.interactions = append(r.interactions, interaction)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// Replaying reports whether the recorder answers requests from its cassette
+func (r *Recorder) Replaying() bool {
+	return r.mode == Replay
+}
+
+// Do records or replays a single request
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	if r.mode == Replay {
+		return r.replay(req)
+	}
+	return r.record(req)
+}
+
+// Sends the request and appends the exchange to the cassette. The
+// Authorization header is never part of an interaction, so cassettes don't
+// contain credentials.
+func (r *Recorder) record(req *http.Request) (*http.Response, error) {
+	interaction := Interaction{Method: req.Method, URL: req.URL.String()}
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		interaction.RequestBody = string(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := r.sender.Do(req)
+	if err != nil {
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	interaction.StatusCode = resp.StatusCode
+	interaction.Header = resp.Header
+	interaction.Body = string(body)
+
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err = r.file.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Answers the request with the first unused interaction of the same method
+// and URL, so repeated requests (e.g. polling an operation) are answered
+// in the order they were recorded. Retry-After headers are dropped, so a
+// replay doesn't wait out the delays of the original run.
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	url := req.URL.String()
+
+	for i, interaction := range r.interactions {
+		if r.used[i] || interaction.Method != req.Method || interaction.URL != url {
+			continue
+		}
+		r.used[i] = true
+
+		header := http.Header{}
+		for k, v := range interaction.Header {
+			header[k] = v
+		}
+		header.Del("Retry-After")
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.StatusCode, http.StatusText(interaction.StatusCode)),
+			StatusCode:    interaction.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(interaction.Body)),
+			ContentLength: int64(len(interaction.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no recorded interaction left for %s %s", req.Method, url)
+}
+
+// Close releases the cassette
+func (r *Recorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,112 @@
+package recorder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, r *Recorder, url string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		polls++
+		if polls == 1 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, `{"poll":%d}`, polls)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	rec, err := New(path, Record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		get(t, rec, server.URL+"/operation")
+	}
+	if err = rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cassette, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(cassette), "secret-token") {
+		t.Error("the cassette holds the Authorization header")
+	}
+
+	// Replayed after the server is gone, so nothing reaches the network
+	server.Close()
+
+	replay, err := New(path, Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := get(t, replay, server.URL+"/operation")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "" {
+		t.Errorf("expected a 429 without Retry-After first, got %d with '%s'", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	for _, want := range []string{`{"poll":2}`, `{"poll":3}`} {
+		if _, body := get(t, replay, server.URL+"/operation"); body != want {
+			t.Errorf("expected polls to be answered in order, got %s for %s", body, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/operation", nil)
+	if _, err = replay.Do(req); err == nil {
+		t.Error("expected an error once the recorded interactions run out")
+	}
+}
+
+func TestReplayFixture(t *testing.T) {
+	rec, err := New("testdata/throttled-protection.jsonl", Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Replaying() {
+		t.Fatal("expected the recorder to replay")
+	}
+
+	// The throttled update and its retry are answered in the order recorded
+	url := "https://management.azure.com/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/web/virtualmachines/4?api-version=2019-07-01"
+	for _, want := range []int{http.StatusTooManyRequests, http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader("{}"))
+		resp, err := rec.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("expected %d, got %d", want, resp.StatusCode)
+		}
+	}
+}
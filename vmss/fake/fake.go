@@ -0,0 +1,477 @@
+// Package fake provides an in-memory implementation of the vmss client
+// interfaces, for exercising upgrade logic without calling Azure.
+//
+// A ScaleSet behaves like a scale set with the default scale-in policy:
+// raising capacity creates instances running the current model, lowering
+// it deletes unprotected instances (highest instance ID first), and any
+// change to the model marks existing instances as out of date.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/krarey/azure-cluster-upgrade/vmss"
+)
+
+// Instance is the fake state of a single scale set instance
+type Instance struct {
+	ID                 string
+	LatestModelApplied bool
+	Protected          bool
+
+	// The VM size and image the instance was created with
+	VMSize         string
+	ImageReference *compute.ImageReference
+}
+
+// ScaleSet is an in-memory scale set. It implements vmss.ScaleSetsClient
+// directly, and vmss.VMsClient through VMs. It is safe for concurrent use.
+type ScaleSet struct {
+	// Model is returned from Get. Its Sku.Capacity tracks the instance count.
+	Model compute.VirtualMachineScaleSet
+
+	// RunCommandFunc, if set, produces the output of every Run Command
+	// invocation. Otherwise commands succeed with no output.
+	RunCommandFunc func(instanceID string, input compute.RunCommandInput) (compute.RunCommandResult, error)
+
+	// Errors to return from the named operation (e.g. "Update",
+	// "DeleteInstances", "List"), consumed one per call.
+	Errors map[string][]error
+
+	// AllocationFailures is the number of upcoming scale-outs which fail
+	// to allocate any instances.
+	AllocationFailures int
+
+	// ProvisioningDelay is how long scale-outs take to complete
+	ProvisioningDelay time.Duration
+
+	mu        sync.Mutex
+	instances map[string]*Instance
+	nextID    int
+}
+
+// NewScaleSet returns a fake scale set of the given name and VM size,
+// populated with 'capacity' instances running the current model.
+func NewScaleSet(name string, vmSize string, capacity int64) *ScaleSet {
+	f := &ScaleSet{
+		Model: compute.VirtualMachineScaleSet{
+			Name:     to.StringPtr(name),
+			Location: to.StringPtr("eastus"),
+			Sku:      &compute.Sku{Name: to.StringPtr(vmSize), Tier: to.StringPtr("Standard"), Capacity: to.Int64Ptr(0)},
+			Tags:     map[string]*string{},
+			VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+				VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+					StorageProfile: &compute.VirtualMachineScaleSetStorageProfile{},
+				},
+			},
+		},
+		instances: map[string]*Instance{},
+	}
+	f.resize(capacity)
+	return f
+}
+
+// Instances returns a copy of every instance, ordered by instance ID
+func (f *ScaleSet) Instances() []Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var instances []Instance
+	for _, id := range f.sortedIDs() {
+		instances = append(instances, *f.instances[id])
+	}
+	return instances
+}
+
+// MarkModelChanged flags every existing instance as out of date, as an
+// update to the scale set model would.
+func (f *ScaleSet) MarkModelChanged() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, instance := range f.instances {
+		instance.LatestModelApplied = false
+	}
+}
+
+// SetLatestModelApplied marks an instance as running, or not running, the
+// current model, as though it were reimaged or left behind by an upgrade.
+func (f *ScaleSet) SetLatestModelApplied(instanceID string, applied bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if instance, ok := f.instances[instanceID]; ok {
+		instance.LatestModelApplied = applied
+	}
+}
+
+// Returns the next queued error for an operation, if any
+func (f *ScaleSet) takeError(op string) error {
+	errs := f.Errors[op]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.Errors[op] = errs[1:]
+	return errs[0]
+}
+
+// Instance IDs in ascending numeric order
+func (f *ScaleSet) sortedIDs() []string {
+	ids := make([]string, 0, len(f.instances))
+	for id := range f.instances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	return ids
+}
+
+// Adds or removes instances until there are 'capacity' of them
+func (f *ScaleSet) resize(capacity int64) error {
+	for int64(len(f.instances)) < capacity {
+		id := strconv.Itoa(f.nextID)
+		f.instances[id] = &Instance{
+			ID:                 id,
+			LatestModelApplied: true,
+			VMSize:             to.String(f.Model.Sku.Name),
+			ImageReference:     f.Model.VirtualMachineProfile.StorageProfile.ImageReference,
+		}
+		f.nextID++
+	}
+
+	ids := f.sortedIDs()
+	for i := len(ids) - 1; i >= 0 && int64(len(f.instances)) > capacity; i-- {
+		if !f.instances[ids[i]].Protected {
+			delete(f.instances, ids[i])
+		}
+	}
+
+	if int64(len(f.instances)) > capacity {
+		return fmt.Errorf("cannot scale in to %d instances, %d are protected from scale-in", capacity, len(f.instances))
+	}
+
+	f.Model.Sku.Capacity = to.Int64Ptr(capacity)
+	return nil
+}
+
+// Get returns the scale set model
+func (f *ScaleSet) Get(ctx context.Context, resourceGroup string, scaleSet string) (compute.VirtualMachineScaleSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("Get"); err != nil {
+		return compute.VirtualMachineScaleSet{}, err
+	}
+
+	model := f.Model
+	capacity := *f.Model.Sku.Capacity
+	sku := *f.Model.Sku
+	sku.Capacity = &capacity
+	model.Sku = &sku
+
+	tags := map[string]*string{}
+	for k, v := range f.Model.Tags {
+		tags[k] = v
+	}
+	model.Tags = tags
+
+	return model, nil
+}
+
+// ListAll returns the scale set model as the only scale set in the
+// subscription, in a resource group named 'simulated'
+func (f *ScaleSet) ListAll(ctx context.Context) ([]compute.VirtualMachineScaleSet, error) {
+	model, err := f.Get(ctx, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	model.ID = to.StringPtr(fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/simulated/providers/Microsoft.Compute/virtualMachineScaleSets/%s", to.String(model.Name)))
+
+	return []compute.VirtualMachineScaleSet{model}, nil
+}
+
+// Update applies capacity, tag and model changes. A change to the VM
+// profile marks every existing instance as out of date.
+func (f *ScaleSet) Update(ctx context.Context, resourceGroup string, scaleSet string, parameters compute.VirtualMachineScaleSetUpdate) (vmss.Future, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("Update"); err != nil {
+		return nil, err
+	}
+
+	if parameters.Tags != nil {
+		f.Model.Tags = parameters.Tags
+	}
+
+	if parameters.VirtualMachineScaleSetUpdateProperties != nil && parameters.VirtualMachineProfile != nil {
+		profile := parameters.VirtualMachineProfile
+		if profile.StorageProfile != nil && profile.StorageProfile.ImageReference != nil {
+			f.Model.VirtualMachineProfile.StorageProfile.ImageReference = profile.StorageProfile.ImageReference
+		}
+		if profile.ScheduledEventsProfile != nil {
+			f.Model.VirtualMachineProfile.ScheduledEventsProfile = profile.ScheduledEventsProfile
+		}
+		for _, instance := range f.instances {
+			instance.LatestModelApplied = false
+		}
+	}
+
+	if parameters.Sku != nil && parameters.Sku.Name != nil && *parameters.Sku.Name != to.String(f.Model.Sku.Name) {
+		f.Model.Sku.Name = parameters.Sku.Name
+		for _, instance := range f.instances {
+			instance.LatestModelApplied = false
+		}
+	}
+
+	if parameters.Sku != nil && parameters.Sku.Capacity != nil {
+		capacity := *parameters.Sku.Capacity
+		if capacity <= int64(len(f.instances)) {
+			return future{err: f.resize(capacity)}, nil
+		}
+
+		if f.AllocationFailures > 0 {
+			f.AllocationFailures--
+			return future{
+				delay: f.ProvisioningDelay,
+				err:   fmt.Errorf("AllocationFailed: allocation of %d instances of size %s failed", capacity-int64(len(f.instances)), to.String(f.Model.Sku.Name)),
+			}, nil
+		}
+
+		return future{delay: f.ProvisioningDelay, err: f.resize(capacity)}, nil
+	}
+
+	return future{}, nil
+}
+
+// DeleteInstances removes instances, reducing capacity to match
+func (f *ScaleSet) DeleteInstances(ctx context.Context, resourceGroup string, scaleSet string, instanceIDs []string) (vmss.Future, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("DeleteInstances"); err != nil {
+		return nil, err
+	}
+
+	for _, id := range instanceIDs {
+		if _, ok := f.instances[id]; !ok {
+			return nil, fmt.Errorf("instance %s not found", id)
+		}
+		delete(f.instances, id)
+	}
+
+	f.Model.Sku.Capacity = to.Int64Ptr(int64(len(f.instances)))
+	return future{}, nil
+}
+
+// Renders a fake instance as the SDK would return it
+func (f *ScaleSet) vm(instance *Instance) compute.VirtualMachineScaleSetVM {
+	return compute.VirtualMachineScaleSetVM{
+		InstanceID: to.StringPtr(instance.ID),
+		Name:       to.StringPtr(fmt.Sprintf("%s_%s", to.String(f.Model.Name), instance.ID)),
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			LatestModelApplied: to.BoolPtr(instance.LatestModelApplied),
+			ProtectionPolicy: &compute.VirtualMachineScaleSetVMProtectionPolicy{
+				ProtectFromScaleIn: to.BoolPtr(instance.Protected),
+			},
+			InstanceView: &compute.VirtualMachineScaleSetVMInstanceView{
+				Statuses: &[]compute.InstanceViewStatus{
+					{Code: to.StringPtr("ProvisioningState/succeeded")},
+					{Code: to.StringPtr("PowerState/running")},
+				},
+			},
+		},
+	}
+}
+
+// List returns instances matching the filter. Only the empty filter and
+// 'properties/latestModelApplied eq true|false' are understood.
+func (f *ScaleSet) List(ctx context.Context, resourceGroup string, scaleSet string, filter string, expand string) ([]compute.VirtualMachineScaleSetVM, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var vms []compute.VirtualMachineScaleSetVM
+
+	if err := f.takeError("List"); err != nil {
+		return vms, err
+	}
+
+	match := func(*Instance) bool { return true }
+	switch strings.TrimSpace(filter) {
+	case "":
+	case "properties/latestModelApplied eq true":
+		match = func(i *Instance) bool { return i.LatestModelApplied }
+	case "properties/latestModelApplied eq false":
+		match = func(i *Instance) bool { return !i.LatestModelApplied }
+	default:
+		return vms, fmt.Errorf("unsupported filter '%s'", filter)
+	}
+
+	for _, id := range f.sortedIDs() {
+		if match(f.instances[id]) {
+			vms = append(vms, f.vm(f.instances[id]))
+		}
+	}
+
+	return vms, nil
+}
+
+// GetInstance returns a single instance, with the VM size and image it
+// was created with.
+func (f *ScaleSet) GetInstance(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("GetInstance"); err != nil {
+		return compute.VirtualMachineScaleSetVM{}, err
+	}
+
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return compute.VirtualMachineScaleSetVM{}, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	vm := f.vm(instance)
+	vm.Sku = &compute.Sku{Name: to.StringPtr(instance.VMSize), Tier: f.Model.Sku.Tier}
+	vm.StorageProfile = &compute.StorageProfile{ImageReference: instance.ImageReference}
+
+	return vm, nil
+}
+
+// UpdateInstance applies an instance's scale-in protection
+func (f *ScaleSet) UpdateInstance(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, vm compute.VirtualMachineScaleSetVM) (vmss.VMFuture, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("UpdateInstance"); err != nil {
+		return nil, err
+	}
+
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	if vm.VirtualMachineScaleSetVMProperties != nil && vm.ProtectionPolicy != nil && vm.ProtectionPolicy.ProtectFromScaleIn != nil {
+		instance.Protected = *vm.ProtectionPolicy.ProtectFromScaleIn
+	}
+
+	return vmFuture{vm: f.vm(instance)}, nil
+}
+
+// GetInstanceView returns a healthy, running instance view
+func (f *ScaleSet) GetInstanceView(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeError("GetInstanceView"); err != nil {
+		return compute.VirtualMachineScaleSetVMInstanceView{}, err
+	}
+
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return compute.VirtualMachineScaleSetVMInstanceView{}, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	return *f.vm(instance).InstanceView, nil
+}
+
+// RunCommand invokes RunCommandFunc, if set
+func (f *ScaleSet) RunCommand(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, input compute.RunCommandInput) (vmss.RunCommandFuture, error) {
+	f.mu.Lock()
+	err := f.takeError("RunCommand")
+	_, ok := f.instances[instanceID]
+	run := f.RunCommandFunc
+	f.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	if run == nil {
+		return runCommandFuture{}, nil
+	}
+
+	result, err := run(instanceID, input)
+	return runCommandFuture{result: result, err: err}, nil
+}
+
+// VMs adapts the scale set to vmss.VMsClient, whose Get and Update methods
+// would otherwise clash with the scale set's own.
+func (f *ScaleSet) VMs() vmss.VMsClient {
+	return vmsClient{f}
+}
+
+type vmsClient struct {
+	*ScaleSet
+}
+
+func (c vmsClient) Get(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	return c.GetInstance(ctx, resourceGroup, scaleSet, instanceID)
+}
+
+func (c vmsClient) Update(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, vm compute.VirtualMachineScaleSetVM) (vmss.VMFuture, error) {
+	return c.UpdateInstance(ctx, resourceGroup, scaleSet, instanceID, vm)
+}
+
+// Fake futures complete immediately, unless given a delay
+type future struct {
+	delay time.Duration
+	err   error
+}
+
+func (f future) Wait(ctx context.Context) error {
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.err
+}
+
+type vmFuture struct {
+	vm compute.VirtualMachineScaleSetVM
+}
+
+func (f vmFuture) Wait(ctx context.Context) error {
+	return nil
+}
+
+func (f vmFuture) Result() (compute.VirtualMachineScaleSetVM, error) {
+	return f.vm, nil
+}
+
+type runCommandFuture struct {
+	result compute.RunCommandResult
+	err    error
+}
+
+func (f runCommandFuture) Wait(ctx context.Context) error {
+	return f.err
+}
+
+func (f runCommandFuture) Result() (compute.RunCommandResult, error) {
+	return f.result, nil
+}
+
+var (
+	_ vmss.ScaleSetsClient = &ScaleSet{}
+	_ vmss.VMsClient       = vmsClient{}
+)
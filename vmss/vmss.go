@@ -0,0 +1,175 @@
+// Package vmss narrows the Azure SDK's scale set clients down to the
+// operations the upgrade relies on, behind interfaces which can be swapped
+// for the in-memory implementation in vmss/fake.
+package vmss
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Future is a long-running operation which has been accepted by Azure
+type Future interface {
+	// Wait blocks until the operation completes, returning its error if it failed
+	Wait(ctx context.Context) error
+}
+
+// VMFuture is a long-running update of a single scale set instance
+type VMFuture interface {
+	Future
+	// Result returns the updated instance. Only valid once Wait has returned.
+	Result() (compute.VirtualMachineScaleSetVM, error)
+}
+
+// RunCommandFuture is a long-running Run Command invocation
+type RunCommandFuture interface {
+	Future
+	// Result returns the command's output. Only valid once Wait has returned.
+	Result() (compute.RunCommandResult, error)
+}
+
+// ScaleSetsClient manages virtual machine scale sets
+type ScaleSetsClient interface {
+	Get(ctx context.Context, resourceGroup string, scaleSet string) (compute.VirtualMachineScaleSet, error)
+	Update(ctx context.Context, resourceGroup string, scaleSet string, parameters compute.VirtualMachineScaleSetUpdate) (Future, error)
+	DeleteInstances(ctx context.Context, resourceGroup string, scaleSet string, instanceIDs []string) (Future, error)
+	// ListAll returns every scale set in the client's subscription
+	ListAll(ctx context.Context) ([]compute.VirtualMachineScaleSet, error)
+}
+
+// VMsClient manages the instances within a virtual machine scale set
+type VMsClient interface {
+	// List returns every instance matching the OData filter, with the
+	// given properties (e.g. 'instanceView') expanded.
+	List(ctx context.Context, resourceGroup string, scaleSet string, filter string, expand string) ([]compute.VirtualMachineScaleSetVM, error)
+	// Get returns a single instance, including its extensions
+	Get(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVM, error)
+	Update(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, vm compute.VirtualMachineScaleSetVM) (VMFuture, error)
+	GetInstanceView(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error)
+	RunCommand(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, input compute.RunCommandInput) (RunCommandFuture, error)
+}
+
+// NewScaleSetsClient returns a ScaleSetsClient backed by a configured SDK client
+func NewScaleSetsClient(client compute.VirtualMachineScaleSetsClient) ScaleSetsClient {
+	return scaleSetsClient{client}
+}
+
+// NewVMsClient returns a VMsClient backed by a configured SDK client
+func NewVMsClient(client compute.VirtualMachineScaleSetVMsClient) VMsClient {
+	return vmsClient{client}
+}
+
+type scaleSetsClient struct {
+	client compute.VirtualMachineScaleSetsClient
+}
+
+func (c scaleSetsClient) Get(ctx context.Context, resourceGroup string, scaleSet string) (compute.VirtualMachineScaleSet, error) {
+	return c.client.Get(ctx, resourceGroup, scaleSet)
+}
+
+func (c scaleSetsClient) Update(ctx context.Context, resourceGroup string, scaleSet string, parameters compute.VirtualMachineScaleSetUpdate) (Future, error) {
+	future, err := c.client.Update(ctx, resourceGroup, scaleSet, parameters)
+	return &sdkFuture{future.Future, c.client.Client}, err
+}
+
+func (c scaleSetsClient) DeleteInstances(ctx context.Context, resourceGroup string, scaleSet string, instanceIDs []string) (Future, error) {
+	future, err := c.client.DeleteInstances(ctx, resourceGroup, scaleSet, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{InstanceIds: &instanceIDs})
+	return &sdkFuture{future.Future, c.client.Client}, err
+}
+
+func (c scaleSetsClient) ListAll(ctx context.Context) ([]compute.VirtualMachineScaleSet, error) {
+	var scaleSets []compute.VirtualMachineScaleSet
+
+	list, err := c.client.ListAllComplete(ctx)
+	if err != nil {
+		return scaleSets, err
+	}
+
+	for ; list.NotDone(); err = list.Next() {
+		if err != nil {
+			return scaleSets, err
+		}
+		scaleSets = append(scaleSets, list.Value())
+	}
+
+	return scaleSets, nil
+}
+
+type vmsClient struct {
+	client compute.VirtualMachineScaleSetVMsClient
+}
+
+func (c vmsClient) List(ctx context.Context, resourceGroup string, scaleSet string, filter string, expand string) ([]compute.VirtualMachineScaleSetVM, error) {
+	var vms []compute.VirtualMachineScaleSetVM
+
+	list, err := c.client.ListComplete(ctx, resourceGroup, scaleSet, filter, "", expand)
+	if err != nil {
+		return vms, err
+	}
+
+	for ; list.NotDone(); err = list.Next() {
+		if err != nil {
+			return vms, err
+		}
+		vms = append(vms, list.Value())
+	}
+
+	return vms, nil
+}
+
+func (c vmsClient) Get(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVM, error) {
+	return c.client.Get(ctx, resourceGroup, scaleSet, instanceID, "")
+}
+
+func (c vmsClient) Update(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, vm compute.VirtualMachineScaleSetVM) (VMFuture, error) {
+	future, err := c.client.Update(ctx, resourceGroup, scaleSet, instanceID, vm)
+	return &vmFuture{future, c.client}, err
+}
+
+func (c vmsClient) GetInstanceView(ctx context.Context, resourceGroup string, scaleSet string, instanceID string) (compute.VirtualMachineScaleSetVMInstanceView, error) {
+	return c.client.GetInstanceView(ctx, resourceGroup, scaleSet, instanceID)
+}
+
+func (c vmsClient) RunCommand(ctx context.Context, resourceGroup string, scaleSet string, instanceID string, input compute.RunCommandInput) (RunCommandFuture, error) {
+	future, err := c.client.RunCommand(ctx, resourceGroup, scaleSet, instanceID, input)
+	return &runCommandFuture{future, c.client}, err
+}
+
+// sdkFuture polls an SDK future with the client which started it
+type sdkFuture struct {
+	future azure.Future
+	client autorest.Client
+}
+
+func (f *sdkFuture) Wait(ctx context.Context) error {
+	return f.future.WaitForCompletionRef(ctx, f.client)
+}
+
+type vmFuture struct {
+	future compute.VirtualMachineScaleSetVMsUpdateFuture
+	client compute.VirtualMachineScaleSetVMsClient
+}
+
+func (f *vmFuture) Wait(ctx context.Context) error {
+	return f.future.WaitForCompletionRef(ctx, f.client.Client)
+}
+
+func (f *vmFuture) Result() (compute.VirtualMachineScaleSetVM, error) {
+	return f.future.Result(f.client)
+}
+
+type runCommandFuture struct {
+	future compute.VirtualMachineScaleSetVMsRunCommandFuture
+	client compute.VirtualMachineScaleSetVMsClient
+}
+
+func (f *runCommandFuture) Wait(ctx context.Context) error {
+	return f.future.WaitForCompletionRef(ctx, f.client.Client)
+}
+
+func (f *runCommandFuture) Result() (compute.RunCommandResult, error) {
+	return f.future.Result(f.client)
+}